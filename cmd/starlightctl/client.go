@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// client makes wallet RPCs to a starlightd.
+// It authenticates with an API token, if it has one,
+// or else with the session cookie saved by login or init.
+type client struct {
+	base        string // starlightd URL, without trailing slash
+	token       string
+	sessionFile string
+	http        *http.Client
+}
+
+// rpcError is an error response from starlightd.
+type rpcError struct {
+	Status    int
+	Message   string `json:"message"`
+	Retriable bool   `json:"retriable"`
+}
+
+func (e *rpcError) Error() string {
+	s := fmt.Sprintf("%s (HTTP %d)", e.Message, e.Status)
+	if e.Retriable {
+		s += ", retriable"
+	}
+	return s
+}
+
+// call POSTs the JSON encoding of body to path
+// and returns the response body.
+func (c *client) call(path string, body interface{}) (json.RawMessage, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", c.base+path, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return c.do(req)
+}
+
+// get GETs path with the given query
+// and returns the response body.
+func (c *client) get(path string, query url.Values) (json.RawMessage, error) {
+	u := c.base + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.do(req)
+}
+
+func (c *client) do(req *http.Request) (json.RawMessage, error) {
+	c.authorize(req)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		rerr := &rpcError{Status: resp.StatusCode}
+		if json.Unmarshal(b, rerr) != nil || rerr.Message == "" {
+			rerr.Message = strings.TrimSpace(string(b))
+		}
+		return nil, rerr
+	}
+	if cookies := resp.Cookies(); len(cookies) > 0 {
+		if err := c.saveSession(cookies); err != nil {
+			return nil, err
+		}
+	}
+	return json.RawMessage(b), nil
+}
+
+func (c *client) authorize(req *http.Request) {
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+		return
+	}
+	if b, err := ioutil.ReadFile(c.sessionFile); err == nil {
+		req.Header.Set("Cookie", strings.TrimSpace(string(b)))
+	}
+}
+
+// saveSession saves the session cookies set by starlightd
+// for use by later invocations.
+// A cookie with a negative MaxAge, as set by logout,
+// removes the saved session.
+func (c *client) saveSession(cookies []*http.Cookie) error {
+	var parts []string
+	for _, ck := range cookies {
+		if ck.MaxAge < 0 {
+			err := os.Remove(c.sessionFile)
+			if os.IsNotExist(err) {
+				err = nil
+			}
+			return err
+		}
+		parts = append(parts, ck.Name+"="+ck.Value)
+	}
+	err := os.MkdirAll(filepath.Dir(c.sessionFile), 0700)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(c.sessionFile, []byte(strings.Join(parts, "; ")+"\n"), 0600)
+}
+
+// stream calls f with each update in the update stream
+// selected by query, reconnecting after errors,
+// until f returns an error.
+func (c *client) stream(query url.Values, f func(id uint64, data json.RawMessage) error) error {
+	var lastID uint64
+	for {
+		err := c.streamOnce(query, lastID, func(id uint64, data json.RawMessage) error {
+			lastID = id
+			return f(id, data)
+		})
+		switch err := err.(type) {
+		case streamStop:
+			return err.err
+		case *rpcError:
+			if !err.Retriable || err.Status/100 == 4 {
+				return err
+			}
+		}
+		fmt.Fprintf(os.Stderr, "update stream: %v; reconnecting\n", err)
+		time.Sleep(time.Second)
+	}
+}
+
+// streamStop wraps an error returned by a stream callback.
+type streamStop struct{ err error }
+
+func (s streamStop) Error() string { return s.err.Error() }
+
+func (c *client) streamOnce(query url.Values, lastID uint64, f func(uint64, json.RawMessage) error) error {
+	req, err := http.NewRequest("GET", c.base+"/api/updates/stream?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	if lastID > 0 {
+		req.Header.Set("Last-Event-ID", strconv.FormatUint(lastID, 10))
+	}
+	c.authorize(req)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		rerr := &rpcError{Status: resp.StatusCode}
+		json.NewDecoder(resp.Body).Decode(rerr)
+		return rerr
+	}
+	return readEvents(resp.Body, func(id uint64, data json.RawMessage) error {
+		if err := f(id, data); err != nil {
+			return streamStop{err}
+		}
+		return nil
+	})
+}
+
+// readEvents reads Server-Sent Events from r,
+// calling f with the ID and data of each.
+// It ignores comments and other fields.
+func readEvents(r io.Reader, f func(id uint64, data json.RawMessage) error) error {
+	var (
+		id   uint64
+		data []byte
+	)
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<24)
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case line == "":
+			if data != nil {
+				if err := f(id, data); err != nil {
+					return err
+				}
+			}
+			data = nil
+		case strings.HasPrefix(line, "id: "):
+			n, err := strconv.ParseUint(strings.TrimPrefix(line, "id: "), 10, 64)
+			if err != nil {
+				return err
+			}
+			id = n
+		case strings.HasPrefix(line, "data: "):
+			data = append(data, strings.TrimPrefix(line, "data: ")...)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	return io.ErrUnexpectedEOF
+}
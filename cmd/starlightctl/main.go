@@ -0,0 +1,733 @@
+// Command starlightctl is a command-line client for a running starlightd.
+//
+// It makes the same wallet RPCs as the web UI.
+// Run starlightctl help for a list of commands.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/interstellar/starlight/env"
+	"github.com/interstellar/starlight/worizon/xlm"
+)
+
+// A command is a starlightctl subcommand.
+// Its run function parses args and returns the result
+// of the RPCs it makes, as JSON.
+type command struct {
+	args  string
+	help  string
+	run   func(c *client, args []string) (json.RawMessage, error)
+	human humanFunc
+}
+
+var commands map[string]*command
+
+func init() {
+	// Set in init, since the run functions refer to commands.
+	commands = map[string]*command{
+		"init": {
+			args: "[-horizon url] [-public] [-mnemonic] username",
+			help: "configure a new agent, or restore one from its recovery phrase, and log in",
+			run:  runInit,
+		},
+		"login": {
+			args: "username",
+			help: "log in, saving a session for later commands",
+			run:  runLogin,
+		},
+		"logout": {
+			help: "log out",
+			run:  simple("/api/logout", nil),
+		},
+		"status": {
+			help: "show whether the agent is configured and logged in",
+			run:  runStatus,
+		},
+		"config-edit": {
+			args: "[-horizon url] [-password]",
+			help: "change the Horizon URL or password",
+			run:  runConfigEdit,
+		},
+		"create-channel": {
+			args: "[-asset code -issuer account] guest-address amount",
+			help: "propose a channel to guest-address, funded with amount",
+			run:  runCreateChannel,
+		},
+		"pay": {
+			args: "[-id id] [-memo memo] [-invoice id] channel amount",
+			help: "pay amount on a channel",
+			run:  runPay,
+		},
+		"top-up": {
+			args: "channel amount",
+			help: "add amount to a channel from the wallet",
+			run:  channelCommand("TopUp", true),
+		},
+		"withdraw": {
+			args: "channel amount",
+			help: "withdraw amount from an open channel",
+			run:  channelCommand("Withdraw", true),
+		},
+		"close": {
+			args: "channel",
+			help: "close a channel cooperatively",
+			run:  channelCommand("CloseChannel", false),
+		},
+		"force-close": {
+			args: "channel",
+			help: "close a channel unilaterally",
+			run:  channelCommand("ForceClose", false),
+		},
+		"cleanup": {
+			args: "channel",
+			help: "abandon a channel that is being set up",
+			run:  channelCommand("CleanUp", false),
+		},
+		"wallet-pay": {
+			args: "[-asset code -issuer account] destination amount",
+			help: "pay amount from the wallet account on the ledger",
+			run:  runWalletPay,
+		},
+		"routed-pay": {
+			args: "destination amount",
+			help: "pay amount through a route of channels",
+			run:  runRoutedPay,
+		},
+		"close-account": {
+			args: "destination",
+			help: "merge the wallet account into destination, once every channel is closed",
+			run:  runCloseAccount,
+		},
+		"add-asset": {
+			args: "code issuer",
+			help: "add a trustline to the wallet account",
+			run:  assetCommand("/api/do-add-asset"),
+		},
+		"remove-asset": {
+			args: "code issuer",
+			help: "remove a trustline from the wallet account",
+			run:  assetCommand("/api/do-remove-asset"),
+		},
+		"find-account": {
+			args: "address",
+			help: "look up the account and Starlight URL of a federation address",
+			run:  runFindAccount,
+		},
+		"channels": {
+			help:  "list channels that have not yet closed",
+			run:   getter("/api/v1/channels"),
+			human: printChannels,
+		},
+		"channel": {
+			args: "id",
+			help: "show a channel",
+			run:  runChannel,
+		},
+		"wallet": {
+			help:  "show the wallet account",
+			run:   getter("/api/v1/wallet"),
+			human: printWallet,
+		},
+		"assets": {
+			help:  "list the wallet account's trustlines",
+			run:   getter("/api/v1/assets"),
+			human: printAssets,
+		},
+		"payments": {
+			args:  "[-from n] [-limit n]",
+			help:  "list completed payments",
+			run:   runPayments,
+			human: printPayments,
+		},
+		"create-invoice": {
+			args: "[-expiry duration] [-description text] amount",
+			help: "create an invoice for amount",
+			run:  runCreateInvoice,
+		},
+		"pay-invoice": {
+			args: "[-amount amount] invoice",
+			help: "pay an invoice on a lumen channel with its sender",
+			run:  runPayInvoice,
+		},
+		"invoices": {
+			help:  "list invoices",
+			run:   simple("/api/invoices", nil),
+			human: printInvoices,
+		},
+		"invoice": {
+			args: "id",
+			help: "show an invoice",
+			run:  runInvoice,
+		},
+		"create-token": {
+			args: "[-name name] read|pay|admin",
+			help: "create an API token with the given scope",
+			run:  runCreateToken,
+		},
+		"tokens": {
+			help:  "list API tokens",
+			run:   simple("/api/tokens", nil),
+			human: printTokens,
+		},
+		"revoke-token": {
+			args: "id",
+			help: "revoke an API token",
+			run:  runRevokeToken,
+		},
+		"backup": {
+			args: "file",
+			help: "save a backup of the agent, encrypted with its password, to file",
+			run:  runBackup,
+		},
+		"export-mnemonic": {
+			help: "show the recovery phrase for the agent's keys",
+			run:  runExportMnemonic,
+		},
+		"tail": {
+			args: "[-from n] [-type type]... [-channel id]...",
+			help: "print updates, waiting for new ones",
+		},
+	}
+}
+
+var (
+	addr    = flag.String("addr", env.String("STARLIGHT_ADDR", "http://localhost:7000"), "starlightd `URL` (env STARLIGHT_ADDR)")
+	token   = flag.String("token", env.String("STARLIGHT_TOKEN", ""), "API `token` (env STARLIGHT_TOKEN); if unset, use the session saved by login")
+	session = flag.String("session", env.String("STARLIGHT_SESSION", defaultSessionFile()), "session `file` (env STARLIGHT_SESSION)")
+	asJSON  = flag.Bool("json", false, "print results as JSON")
+)
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 || flag.Arg(0) == "help" {
+		usage()
+		os.Exit(2)
+	}
+	c := &client{
+		base:        strings.TrimRight(*addr, "/"),
+		token:       *token,
+		sessionFile: *session,
+		http:        &http.Client{Timeout: 30 * time.Second},
+	}
+	name, args := flag.Arg(0), flag.Args()[1:]
+	if name == "tail" {
+		c.http.Timeout = 0
+		if err := runTail(c, args); err != nil {
+			fatalf("tail: %s", err)
+		}
+		return
+	}
+	cmd := commands[name]
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "starlightctl: unknown command %q\n", name)
+		usage()
+		os.Exit(2)
+	}
+	raw, err := cmd.run(c, args)
+	if err != nil {
+		fatalf("%s: %s", name, err)
+	}
+	if err = printResult(os.Stdout, raw, *asJSON, cmd.human); err != nil {
+		fatalf("%s: printing result: %s", name, err)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: starlightctl [flags] command [args]\n\nFlags:\n")
+	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "\nCommands:\n")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cmd := commands[name]
+		fmt.Fprintf(os.Stderr, "  %s %s\n    \t%s\n", name, cmd.args, cmd.help)
+	}
+	fmt.Fprintf(os.Stderr, "\nAmounts are in lumens, or units of the channel's or payment's asset, e.g. 1.5.\n")
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "starlightctl: "+format+"\n", args...)
+	os.Exit(1)
+}
+
+func defaultSessionFile() string {
+	dir, err := os.UserHomeDir()
+	if err != nil {
+		dir = "."
+	}
+	return filepath.Join(dir, ".starlightctl", "session")
+}
+
+// parseArgs parses the flags in fs from args
+// and checks that n positional arguments remain.
+func parseArgs(fs *flag.FlagSet, args []string, n int) ([]string, error) {
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() != n {
+		return nil, fmt.Errorf("want %d arguments, got %d", n, fs.NArg())
+	}
+	return fs.Args(), nil
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: starlightctl %s %s\n", name, commands[name].args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+func parseAmount(s string) (xlm.Amount, error) {
+	amount, err := xlm.Parse(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	return amount, nil
+}
+
+// stdin is shared by all reads of secrets,
+// so that none loses input buffered by another.
+var stdin = bufio.NewReader(os.Stdin)
+
+// readPassword reads a password from env var STARLIGHT_PASSWORD,
+// or else from the terminal, without echo, after printing prompt,
+// or from the first line of standard input if it is not a terminal.
+func readPassword(prompt string) (string, error) {
+	return readSecret("STARLIGHT_PASSWORD", prompt)
+}
+
+// readSecret is like readPassword,
+// but reads from env var name instead of STARLIGHT_PASSWORD.
+func readSecret(name, prompt string) (string, error) {
+	if v := os.Getenv(name); v != "" {
+		return v, nil
+	}
+	fd := int(os.Stdin.Fd())
+	if terminal.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, prompt)
+		b, err := terminal.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		return string(b), err
+	}
+	line, err := stdin.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// simple returns a run function for a command with no arguments
+// that POSTs body to path.
+func simple(path string, body interface{}) func(*client, []string) (json.RawMessage, error) {
+	return func(c *client, args []string) (json.RawMessage, error) {
+		if len(args) != 0 {
+			return nil, fmt.Errorf("want no arguments, got %d", len(args))
+		}
+		if body == nil {
+			body = struct{}{}
+		}
+		return c.call(path, body)
+	}
+}
+
+// getter returns a run function for a command with no arguments
+// that GETs path.
+func getter(path string) func(*client, []string) (json.RawMessage, error) {
+	return func(c *client, args []string) (json.RawMessage, error) {
+		if len(args) != 0 {
+			return nil, fmt.Errorf("want no arguments, got %d", len(args))
+		}
+		return c.get(path, nil)
+	}
+}
+
+// channelCommand returns a run function for the channel command
+// with the given name, taking a channel ID and,
+// if withAmount is set, an amount.
+func channelCommand(name string, withAmount bool) func(*client, []string) (json.RawMessage, error) {
+	return func(c *client, args []string) (json.RawMessage, error) {
+		n := 1
+		if withAmount {
+			n = 2
+		}
+		if len(args) != n {
+			return nil, fmt.Errorf("want %d arguments, got %d", n, len(args))
+		}
+		cmd := map[string]interface{}{"Name": name}
+		if withAmount {
+			amount, err := parseAmount(args[1])
+			if err != nil {
+				return nil, err
+			}
+			cmd["Amount"] = amount
+		}
+		return c.call("/api/do-command", map[string]interface{}{
+			"ChannelID": args[0],
+			"Command":   cmd,
+		})
+	}
+}
+
+func assetCommand(path string) func(*client, []string) (json.RawMessage, error) {
+	return func(c *client, args []string) (json.RawMessage, error) {
+		if len(args) != 2 {
+			return nil, fmt.Errorf("want 2 arguments, got %d", len(args))
+		}
+		return c.call(path, map[string]string{
+			"AssetCode": args[0],
+			"Issuer":    args[1],
+		})
+	}
+}
+
+func runInit(c *client, args []string) (json.RawMessage, error) {
+	fs := newFlagSet("init")
+	horizon := fs.String("horizon", "https://horizon-testnet.stellar.org", "Horizon `URL`")
+	public := fs.Bool("public", false, "accept channels proposed by other agents")
+	restore := fs.Bool("mnemonic", false, "restore the agent's keys from its recovery phrase (env STARLIGHT_MNEMONIC)")
+	args, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return nil, err
+	}
+	var mnemonic string
+	if *restore {
+		mnemonic, err = readSecret("STARLIGHT_MNEMONIC", "recovery phrase: ")
+		if err != nil {
+			return nil, err
+		}
+	}
+	password, err := readPassword("new password: ")
+	if err != nil {
+		return nil, err
+	}
+	return c.call("/api/config-init", map[string]interface{}{
+		"Username":   args[0],
+		"Password":   password,
+		"HorizonURL": *horizon,
+		"Public":     *public,
+		"Mnemonic":   mnemonic,
+	})
+}
+
+func runLogin(c *client, args []string) (json.RawMessage, error) {
+	args, err := parseArgs(newFlagSet("login"), args, 1)
+	if err != nil {
+		return nil, err
+	}
+	password, err := readPassword("password: ")
+	if err != nil {
+		return nil, err
+	}
+	return c.call("/api/login", map[string]string{
+		"Username": args[0],
+		"Password": password,
+	})
+}
+
+func runStatus(c *client, args []string) (json.RawMessage, error) {
+	if len(args) != 0 {
+		return nil, fmt.Errorf("want no arguments, got %d", len(args))
+	}
+	return c.call("/api/status", struct{}{})
+}
+
+func runConfigEdit(c *client, args []string) (json.RawMessage, error) {
+	fs := newFlagSet("config-edit")
+	horizon := fs.String("horizon", "", "new Horizon `URL`")
+	changePassword := fs.Bool("password", false, "change the password, reading the old and new ones")
+	if _, err := parseArgs(fs, args, 0); err != nil {
+		return nil, err
+	}
+	edit := map[string]string{}
+	if *horizon != "" {
+		edit["HorizonURL"] = *horizon
+	}
+	if *changePassword {
+		old, err := readPassword("old password: ")
+		if err != nil {
+			return nil, err
+		}
+		new, err := readPassword("new password: ")
+		if err != nil {
+			return nil, err
+		}
+		edit["OldPassword"], edit["Password"] = old, new
+	}
+	return c.call("/api/config-edit", edit)
+}
+
+func runCreateChannel(c *client, args []string) (json.RawMessage, error) {
+	fs := newFlagSet("create-channel")
+	asset := fs.String("asset", "", "asset `code`, for a non-native channel")
+	issuer := fs.String("issuer", "", "asset issuer `account`, for a non-native channel")
+	args, err := parseArgs(fs, args, 2)
+	if err != nil {
+		return nil, err
+	}
+	amount, err := parseAmount(args[1])
+	if err != nil {
+		return nil, err
+	}
+	return c.call("/api/do-create-channel", map[string]interface{}{
+		"GuestAddr":  args[0],
+		"HostAmount": amount,
+		"AssetCode":  *asset,
+		"Issuer":     *issuer,
+	})
+}
+
+func runPay(c *client, args []string) (json.RawMessage, error) {
+	fs := newFlagSet("pay")
+	id := fs.String("id", "", "payment `id`, reported to the recipient")
+	memo := fs.String("memo", "", "payment `memo`, reported to the recipient")
+	invoice := fs.String("invoice", "", "`id` of the invoice this pays")
+	args, err := parseArgs(fs, args, 2)
+	if err != nil {
+		return nil, err
+	}
+	amount, err := parseAmount(args[1])
+	if err != nil {
+		return nil, err
+	}
+	return c.call("/api/do-command", map[string]interface{}{
+		"ChannelID": args[0],
+		"Command": map[string]interface{}{
+			"Name":      "ChannelPay",
+			"Amount":    amount,
+			"PaymentID": *id,
+			"Memo":      *memo,
+			"InvoiceID": *invoice,
+		},
+	})
+}
+
+func runWalletPay(c *client, args []string) (json.RawMessage, error) {
+	fs := newFlagSet("wallet-pay")
+	asset := fs.String("asset", "", "asset `code`, to pay an asset other than lumens")
+	issuer := fs.String("issuer", "", "asset issuer `account`")
+	args, err := parseArgs(fs, args, 2)
+	if err != nil {
+		return nil, err
+	}
+	amount, err := parseAmount(args[1])
+	if err != nil {
+		return nil, err
+	}
+	return c.call("/api/do-wallet-pay", map[string]interface{}{
+		"Dest":      args[0],
+		"Amount":    uint64(amount),
+		"AssetCode": *asset,
+		"Issuer":    *issuer,
+	})
+}
+
+func runRoutedPay(c *client, args []string) (json.RawMessage, error) {
+	args, err := parseArgs(newFlagSet("routed-pay"), args, 2)
+	if err != nil {
+		return nil, err
+	}
+	amount, err := parseAmount(args[1])
+	if err != nil {
+		return nil, err
+	}
+	return c.call("/api/do-routed-pay", map[string]interface{}{
+		"Dest":   args[0],
+		"Amount": amount,
+	})
+}
+
+func runCloseAccount(c *client, args []string) (json.RawMessage, error) {
+	args, err := parseArgs(newFlagSet("close-account"), args, 1)
+	if err != nil {
+		return nil, err
+	}
+	return c.call("/api/do-close-account", map[string]string{"Dest": args[0]})
+}
+
+func runFindAccount(c *client, args []string) (json.RawMessage, error) {
+	args, err := parseArgs(newFlagSet("find-account"), args, 1)
+	if err != nil {
+		return nil, err
+	}
+	return c.call("/api/find-account", map[string]string{"stellar_addr": args[0]})
+}
+
+func runChannel(c *client, args []string) (json.RawMessage, error) {
+	args, err := parseArgs(newFlagSet("channel"), args, 1)
+	if err != nil {
+		return nil, err
+	}
+	return c.get("/api/v1/channels/"+url.PathEscape(args[0]), nil)
+}
+
+func runPayments(c *client, args []string) (json.RawMessage, error) {
+	fs := newFlagSet("payments")
+	from := fs.Uint64("from", 1, "number of the first payment to list")
+	limit := fs.Int("limit", 50, "maximum number of payments to list")
+	if _, err := parseArgs(fs, args, 0); err != nil {
+		return nil, err
+	}
+	return c.get("/api/v1/payments", url.Values{
+		"from":  {strconv.FormatUint(*from, 10)},
+		"limit": {strconv.Itoa(*limit)},
+	})
+}
+
+func runCreateInvoice(c *client, args []string) (json.RawMessage, error) {
+	fs := newFlagSet("create-invoice")
+	expiry := fs.Duration("expiry", 24*time.Hour, "how long the invoice stays payable")
+	desc := fs.String("description", "", "invoice description")
+	args, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return nil, err
+	}
+	amount, err := parseAmount(args[0])
+	if err != nil {
+		return nil, err
+	}
+	return c.call("/api/do-create-invoice", map[string]interface{}{
+		"Amount":      amount,
+		"Expiry":      time.Now().Add(*expiry),
+		"Description": *desc,
+	})
+}
+
+func runPayInvoice(c *client, args []string) (json.RawMessage, error) {
+	fs := newFlagSet("pay-invoice")
+	amountFlag := fs.String("amount", "", "the `amount` the invoice must be for")
+	args, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return nil, err
+	}
+	var amount xlm.Amount
+	if *amountFlag != "" {
+		amount, err = parseAmount(*amountFlag)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c.call("/api/do-pay-invoice", map[string]interface{}{
+		"Invoice": args[0],
+		"Amount":  amount,
+	})
+}
+
+func runInvoice(c *client, args []string) (json.RawMessage, error) {
+	args, err := parseArgs(newFlagSet("invoice"), args, 1)
+	if err != nil {
+		return nil, err
+	}
+	return c.call("/api/invoice", map[string]string{"ID": args[0]})
+}
+
+func runCreateToken(c *client, args []string) (json.RawMessage, error) {
+	fs := newFlagSet("create-token")
+	name := fs.String("name", "", "token `name`, to tell tokens apart")
+	args, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return nil, err
+	}
+	return c.call("/api/do-create-token", map[string]string{
+		"Name":  *name,
+		"Scope": args[0],
+	})
+}
+
+func runRevokeToken(c *client, args []string) (json.RawMessage, error) {
+	args, err := parseArgs(newFlagSet("revoke-token"), args, 1)
+	if err != nil {
+		return nil, err
+	}
+	return c.call("/api/do-revoke-token", map[string]string{"ID": args[0]})
+}
+
+func runBackup(c *client, args []string) (json.RawMessage, error) {
+	args, err := parseArgs(newFlagSet("backup"), args, 1)
+	if err != nil {
+		return nil, err
+	}
+	password, err := readPassword("password: ")
+	if err != nil {
+		return nil, err
+	}
+	backup, err := c.call("/api/do-backup", map[string]string{"Password": password})
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(args[0], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.Write(backup)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(struct {
+		File string
+		Size int
+	}{args[0], len(backup)})
+}
+
+func runExportMnemonic(c *client, args []string) (json.RawMessage, error) {
+	if len(args) != 0 {
+		return nil, fmt.Errorf("want no arguments, got %d", len(args))
+	}
+	password, err := readPassword("password: ")
+	if err != nil {
+		return nil, err
+	}
+	return c.call("/api/do-export-mnemonic", map[string]string{"Password": password})
+}
+
+// stringsFlag is a flag that may be repeated.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string     { return strings.Join(*s, ",") }
+func (s *stringsFlag) Set(v string) error { *s = append(*s, v); return nil }
+
+func runTail(c *client, args []string) error {
+	fs := newFlagSet("tail")
+	from := fs.Uint64("from", 1, "number of the first update to print")
+	var types, channels stringsFlag
+	fs.Var(&types, "type", "print only updates of this `type` (repeatable)")
+	fs.Var(&channels, "channel", "print only updates of this channel `id` (repeatable)")
+	if _, err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+	query := url.Values{
+		"from":    {strconv.FormatUint(*from, 10)},
+		"type":    types,
+		"channel": channels,
+	}
+	return c.stream(query, func(id uint64, data json.RawMessage) error {
+		if *asJSON {
+			_, err := fmt.Printf("%s\n", data)
+			return err
+		}
+		return printUpdate(os.Stdout, data)
+	})
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/interstellar/starlight/worizon/xlm"
+)
+
+// humanFunc prints a command's JSON result for people to read.
+type humanFunc func(w io.Writer, raw json.RawMessage) error
+
+// printResult prints raw, the JSON result of a command, to w.
+// If asJSON is set, it prints raw as indented JSON.
+// Otherwise it prints raw with human, if that is set,
+// or as a generic outline.
+func printResult(w io.Writer, raw json.RawMessage, asJSON bool, human humanFunc) error {
+	raw = bytes.TrimSpace(raw)
+	if asJSON {
+		if len(raw) == 0 {
+			raw = json.RawMessage("{}")
+		}
+		var buf bytes.Buffer
+		if err := json.Indent(&buf, raw, "", "  "); err != nil {
+			return err
+		}
+		buf.WriteByte('\n')
+		_, err := buf.WriteTo(w)
+		return err
+	}
+	if len(raw) == 0 || string(raw) == "null" {
+		_, err := fmt.Fprintln(w, "ok")
+		return err
+	}
+	if human != nil {
+		return human(w, raw)
+	}
+	return printOutline(w, raw)
+}
+
+// printOutline prints the JSON value raw as an indented outline
+// of its fields, omitting empty ones.
+func printOutline(w io.Writer, raw json.RawMessage) error {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return err
+	}
+	writeOutline(w, v, "")
+	return nil
+}
+
+func writeOutline(w io.Writer, v interface{}, indent string) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k, x := range v {
+			if !isEmpty(x) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if isScalar(v[k]) {
+				fmt.Fprintf(w, "%s%s: %v\n", indent, k, v[k])
+				continue
+			}
+			fmt.Fprintf(w, "%s%s:\n", indent, k)
+			writeOutline(w, v[k], indent+"  ")
+		}
+	case []interface{}:
+		for _, x := range v {
+			if isScalar(x) {
+				fmt.Fprintf(w, "%s- %v\n", indent, x)
+				continue
+			}
+			fmt.Fprintf(w, "%s-\n", indent)
+			writeOutline(w, x, indent+"  ")
+		}
+	default:
+		fmt.Fprintf(w, "%s%v\n", indent, v)
+	}
+}
+
+func isScalar(v interface{}) bool {
+	switch v.(type) {
+	case map[string]interface{}, []interface{}:
+		return false
+	}
+	return true
+}
+
+func isEmpty(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return true
+	case string:
+		return v == "" || v == "0001-01-01T00:00:00Z"
+	case map[string]interface{}:
+		return len(v) == 0
+	case []interface{}:
+		return len(v) == 0
+	}
+	return false
+}
+
+// formatAmount formats n units of asset,
+// given in the form produced by xdr.Asset.String,
+// with lumens for the empty asset.
+func formatAmount(n int64, asset string) string {
+	if asset == "" {
+		return xlm.Amount(n).String()
+	}
+	code := asset
+	if parts := strings.Split(asset, "/"); len(parts) == 3 {
+		code = parts[1]
+	}
+	return xlm.Amount(n).HorizonString() + " " + code
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func printChannels(w io.Writer, raw json.RawMessage) error {
+	var channels []struct {
+		ID           string `json:"id"`
+		State        string `json:"state"`
+		Role         string `json:"role"`
+		Counterparty string `json:"counterparty"`
+		Asset        string `json:"asset"`
+		HostBalance  int64  `json:"host_balance"`
+		GuestBalance int64  `json:"guest_balance"`
+	}
+	if err := json.Unmarshal(raw, &channels); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSTATE\tROLE\tCOUNTERPARTY\tHOST BALANCE\tGUEST BALANCE")
+	for _, c := range channels {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", c.ID, c.State, c.Role, c.Counterparty,
+			formatAmount(c.HostBalance, c.Asset), formatAmount(c.GuestBalance, c.Asset))
+	}
+	return tw.Flush()
+}
+
+func printWallet(w io.Writer, raw json.RawMessage) error {
+	var wallet struct {
+		Address       string `json:"address"`
+		NativeBalance int64  `json:"native_balance"`
+		Reserve       int64  `json:"reserve"`
+	}
+	if err := json.Unmarshal(raw, &wallet); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "address: %s\nbalance: %s\nreserve: %s\n", wallet.Address,
+		formatAmount(wallet.NativeBalance, ""), formatAmount(wallet.Reserve, ""))
+	var v struct {
+		Assets json.RawMessage `json:"assets"`
+	}
+	json.Unmarshal(raw, &v)
+	fmt.Fprintln(w)
+	return printAssets(w, v.Assets)
+}
+
+func printAssets(w io.Writer, raw json.RawMessage) error {
+	var assets []struct {
+		Code       string `json:"code"`
+		Issuer     string `json:"issuer"`
+		Balance    int64  `json:"balance"`
+		Pending    bool   `json:"pending"`
+		Authorized bool   `json:"authorized"`
+	}
+	if err := json.Unmarshal(raw, &assets); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ASSET\tISSUER\tBALANCE\tPENDING\tAUTHORIZED")
+	for _, a := range assets {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%v\t%v\n", a.Code, a.Issuer,
+			xlm.Amount(a.Balance).HorizonString(), a.Pending, a.Authorized)
+	}
+	return tw.Flush()
+}
+
+func printPayments(w io.Writer, raw json.RawMessage) error {
+	var page struct {
+		Payments []struct {
+			Num          uint64    `json:"num"`
+			Kind         string    `json:"kind"`
+			Direction    string    `json:"direction"`
+			Counterparty string    `json:"counterparty"`
+			Amount       int64     `json:"amount"`
+			Asset        string    `json:"asset"`
+			ChannelID    string    `json:"channel_id"`
+			Memo         string    `json:"memo"`
+			TxHash       string    `json:"tx_hash"`
+			Time         time.Time `json:"time"`
+		} `json:"payments"`
+		Next uint64 `json:"next"`
+	}
+	if err := json.Unmarshal(raw, &page); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NUM\tTIME\tKIND\tDIRECTION\tAMOUNT\tCOUNTERPARTY\tCHANNEL/TX\tMEMO")
+	for _, p := range page.Payments {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", p.Num, formatTime(p.Time), p.Kind, p.Direction,
+			formatAmount(p.Amount, p.Asset), p.Counterparty, orDash(p.ChannelID+p.TxHash), orDash(p.Memo))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "next: %d\n", page.Next)
+	return err
+}
+
+func printInvoices(w io.Writer, raw json.RawMessage) error {
+	var invoices []struct {
+		ID          string
+		Amount      int64
+		Status      string
+		Expiry      time.Time
+		Description string
+	}
+	if err := json.Unmarshal(raw, &invoices); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tAMOUNT\tSTATUS\tEXPIRY\tDESCRIPTION")
+	for _, inv := range invoices {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", inv.ID, formatAmount(inv.Amount, ""),
+			inv.Status, formatTime(inv.Expiry), orDash(inv.Description))
+	}
+	return tw.Flush()
+}
+
+func printTokens(w io.Writer, raw json.RawMessage) error {
+	var tokens []struct {
+		ID      string
+		Name    string
+		Scope   string
+		Created time.Time
+	}
+	if err := json.Unmarshal(raw, &tokens); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSCOPE\tCREATED\tNAME")
+	for _, t := range tokens {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", t.ID, t.Scope, formatTime(t.Created), orDash(t.Name))
+	}
+	return tw.Flush()
+}
+
+// printUpdate prints a one-line summary of an update.
+func printUpdate(w io.Writer, raw json.RawMessage) error {
+	var u struct {
+		Type      string
+		UpdateNum uint64
+		Account   *struct {
+			ID      string
+			Balance int64
+		}
+		Channel *struct {
+			ID    string
+			State string
+		}
+		InputCommand     *struct{ Name string }
+		InputMessage     json.RawMessage
+		Invoice          *struct{ ID, Status string }
+		Warning          string
+		UpdateLedgerTime time.Time
+	}
+	if err := json.Unmarshal(raw, &u); err != nil {
+		return err
+	}
+	var detail string
+	switch {
+	case u.Channel != nil:
+		detail = fmt.Sprintf("channel %s %s", u.Channel.ID, u.Channel.State)
+		if u.InputCommand != nil {
+			detail += " (command " + u.InputCommand.Name + ")"
+		} else if len(u.InputMessage) > 0 && string(u.InputMessage) != "null" {
+			detail += " (message)"
+		}
+	case u.Invoice != nil:
+		detail = fmt.Sprintf("invoice %s %s", u.Invoice.ID, u.Invoice.Status)
+	case u.Warning != "":
+		detail = u.Warning
+	case u.Account != nil:
+		detail = fmt.Sprintf("account %s balance %s", u.Account.ID, formatAmount(u.Account.Balance, ""))
+	}
+	_, err := fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", u.UpdateNum, formatTime(u.UpdateLedgerTime), u.Type, detail)
+	return err
+}
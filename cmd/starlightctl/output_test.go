@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestReadEvents(t *testing.T) {
+	stream := ": keep-alive\n\nid: 3\ndata: {\"UpdateNum\":3}\n\nid: 5\ndata: {\"UpdateNum\":5}\n\n"
+	var got []uint64
+	err := readEvents(strings.NewReader(stream), func(id uint64, data json.RawMessage) error {
+		var u struct{ UpdateNum uint64 }
+		if err := json.Unmarshal(data, &u); err != nil {
+			return err
+		}
+		if u.UpdateNum != id {
+			t.Errorf("event %d has update %d", id, u.UpdateNum)
+		}
+		got = append(got, id)
+		return nil
+	})
+	if err == nil {
+		t.Error("got no error at end of stream")
+	}
+	if len(got) != 2 || got[0] != 3 || got[1] != 5 {
+		t.Errorf("got events %v, want [3 5]", got)
+	}
+}
+
+func TestPrintResult(t *testing.T) {
+	cases := []struct {
+		raw    string
+		asJSON bool
+		want   string
+	}{
+		{"", false, "ok\n"},
+		{"null", false, "ok\n"},
+		{`{"b":2,"a":"x","empty":"","nested":{"c":[1,2]}}`, false, "a: x\nb: 2\nnested:\n  c:\n    - 1\n    - 2\n"},
+		{`{"a":1}`, true, "{\n  \"a\": 1\n}\n"},
+	}
+	for _, tc := range cases {
+		var buf bytes.Buffer
+		err := printResult(&buf, json.RawMessage(tc.raw), tc.asJSON, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tc.want {
+			t.Errorf("printResult(%s, %v) = %q, want %q", tc.raw, tc.asJSON, buf.String(), tc.want)
+		}
+	}
+}
+
+func TestFormatAmount(t *testing.T) {
+	if got := formatAmount(15000000, ""); got != "1.5 XLM" {
+		t.Errorf("got %s, want 1.5 XLM", got)
+	}
+	asset := "credit_alphanum4/USD/GBOJVRYHEQRGBQDUT6B5C6HJYHVSY2LP65DRYJRXZWR2QZHTXFS3W4KL"
+	if got := formatAmount(15000000, asset); got != "1.5 USD" {
+		t.Errorf("got %s, want 1.5 USD", got)
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+
+	"github.com/interstellar/starlight/env"
+	"github.com/interstellar/starlight/starlight"
+	"github.com/interstellar/starlight/worizon/xlm"
+)
+
+const defaultHorizonURL = "https://horizon-testnet.stellar.org"
+
+// config is the configuration of starlightd.
+// It is read from a TOML file, if there is one,
+// then overridden by environment variables
+// and finally by command-line flags.
+type config struct {
+	Listen    string `toml:"listen"`
+	Data      string `toml:"data"`
+	Debug     bool   `toml:"debug"`
+	Name      string `toml:"name"`
+	WalletDir string `toml:"wallet_dir"`
+
+	// Database, if set, is the URL of a PostgreSQL database
+	// to keep the agent's data in, under Name,
+	// instead of a bolt file in Data.
+	// Many agents, with different names, can share a database.
+	Database string `toml:"database"`
+
+	// Unlock names where starlightd gets the password
+	// to decrypt the agent's seed when it starts;
+	// see parseUnlocker.
+	Unlock string `toml:"unlock"`
+
+	// ShutdownTimeout bounds how long starlightd waits,
+	// when it gets SIGTERM, for channel rounds to complete.
+	ShutdownTimeout duration `toml:"shutdown_timeout"`
+
+	// Agent configures a new agent when starlightd starts,
+	// instead of waiting for the user to do it in the wallet.
+	// It is ignored once the agent has been configured.
+	Agent agentConfig `toml:"agent"`
+
+	Retention retentionConfig `toml:"retention"`
+}
+
+// agentConfig corresponds to starlight.Config,
+// with durations and amounts in human-readable form.
+type agentConfig struct {
+	Username string `toml:"username"`
+	Password string `toml:"password"`
+
+	// Mnemonic, if set, is the recovery phrase
+	// of an agent to restore instead of creating a new one.
+	Mnemonic string `toml:"mnemonic"`
+
+	// Host is the host part of the wallet's Stellar address,
+	// which the wallet otherwise takes from the URL
+	// used to configure it.
+	// It defaults to the listen address.
+	Host string `toml:"host"`
+
+	HorizonURL       string    `toml:"horizon_url"`
+	MaxRoundDuration duration  `toml:"max_round_duration"`
+	FinalityDelay    duration  `toml:"finality_delay"`
+	ChannelFeerate   xlmAmount `toml:"channel_feerate"`
+	HostFeerate      xlmAmount `toml:"host_feerate"`
+	ForwardFeeBase   xlmAmount `toml:"forward_fee_base"`
+	ForwardFeeRate   int64     `toml:"forward_fee_rate"`
+	KeepAlive        *bool     `toml:"keep_alive"`
+	Public           bool      `toml:"public"`
+
+	MinMaxRoundDuration duration `toml:"min_max_round_duration"`
+	MaxMaxRoundDuration duration `toml:"max_max_round_duration"`
+	MinFinalityDelay    duration `toml:"min_finality_delay"`
+	MaxFinalityDelay    duration `toml:"max_finality_delay"`
+}
+
+// retentionConfig says how long starlightd keeps
+// the agent's history of updates.
+// See starlight.RetentionPolicy.
+type retentionConfig struct {
+	KeepUpdates  int      `toml:"keep_updates"`
+	MaxUpdateAge duration `toml:"max_update_age"`
+
+	// ArchiveDir, if set, is a directory
+	// where pruned updates are saved in gzipped JSON files.
+	ArchiveDir string `toml:"archive_dir"`
+
+	// PruneInterval is how often to prune.
+	// It defaults to an hour.
+	PruneInterval duration `toml:"prune_interval"`
+
+	// Compact, after each pruning that deletes updates,
+	// rewrites a bolt database file,
+	// or vacuums a PostgreSQL database's tables,
+	// to reclaim the space freed by pruning.
+	Compact bool `toml:"compact"`
+}
+
+// duration is a time.Duration written in TOML
+// as a string such as "1h30m".
+type duration struct{ time.Duration }
+
+func (d *duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+// xlmAmount is an amount written in TOML
+// as a decimal string such as "0.5".
+type xlmAmount struct{ xlm.Amount }
+
+func (a *xlmAmount) UnmarshalText(text []byte) error {
+	var err error
+	a.Amount, err = xlm.Parse(string(text))
+	return err
+}
+
+// loadConfig reads the config file at path, if path is not empty,
+// over the defaults in c,
+// then applies any overrides from the environment.
+func loadConfig(c *config, path string) error {
+	if path != "" {
+		md, err := toml.DecodeFile(path, c)
+		if err != nil {
+			return err
+		}
+		if keys := md.Undecoded(); len(keys) > 0 {
+			var names []string
+			for _, k := range keys {
+				names = append(names, k.String())
+			}
+			sort.Strings(names)
+			return fmt.Errorf("%s: unknown settings: %s", path, strings.Join(names, ", "))
+		}
+	}
+
+	c.Listen = env.String("STARLIGHTD_LISTEN", c.Listen)
+	c.Data = env.String("STARLIGHTD_DATA", c.Data)
+	c.Debug = env.Bool("STARLIGHTD_DEBUG", c.Debug)
+	c.Name = env.String("STARLIGHTD_NAME", c.Name)
+	c.WalletDir = env.String("STARLIGHTD_WALLET_DIR", c.WalletDir)
+	c.Database = env.String("STARLIGHTD_DATABASE", c.Database)
+	c.Unlock = env.String("STARLIGHTD_UNLOCK", c.Unlock)
+	c.ShutdownTimeout.Duration = env.Duration("STARLIGHTD_SHUTDOWN_TIMEOUT", c.ShutdownTimeout.Duration)
+
+	a := &c.Agent
+	a.Username = env.String("STARLIGHTD_USERNAME", a.Username)
+	a.Password = env.String("STARLIGHTD_PASSWORD", a.Password)
+	a.Mnemonic = env.String("STARLIGHTD_MNEMONIC", a.Mnemonic)
+	a.Host = env.String("STARLIGHTD_HOST", a.Host)
+	a.HorizonURL = env.String("STARLIGHTD_HORIZON_URL", a.HorizonURL)
+	a.MaxRoundDuration.Duration = env.Duration("STARLIGHTD_MAX_ROUND_DURATION", a.MaxRoundDuration.Duration)
+	a.FinalityDelay.Duration = env.Duration("STARLIGHTD_FINALITY_DELAY", a.FinalityDelay.Duration)
+	a.ForwardFeeRate = int64(env.Int("STARLIGHTD_FORWARD_FEE_RATE", int(a.ForwardFeeRate)))
+	a.Public = env.Bool("STARLIGHTD_PUBLIC", a.Public)
+	if os.Getenv("STARLIGHTD_KEEP_ALIVE") != "" {
+		keepAlive := env.Bool("STARLIGHTD_KEEP_ALIVE", false)
+		a.KeepAlive = &keepAlive
+	}
+	a.MinMaxRoundDuration.Duration = env.Duration("STARLIGHTD_MIN_MAX_ROUND_DURATION", a.MinMaxRoundDuration.Duration)
+	a.MaxMaxRoundDuration.Duration = env.Duration("STARLIGHTD_MAX_MAX_ROUND_DURATION", a.MaxMaxRoundDuration.Duration)
+	a.MinFinalityDelay.Duration = env.Duration("STARLIGHTD_MIN_FINALITY_DELAY", a.MinFinalityDelay.Duration)
+	a.MaxFinalityDelay.Duration = env.Duration("STARLIGHTD_MAX_FINALITY_DELAY", a.MaxFinalityDelay.Duration)
+
+	r := &c.Retention
+	r.KeepUpdates = env.Int("STARLIGHTD_KEEP_UPDATES", r.KeepUpdates)
+	r.MaxUpdateAge.Duration = env.Duration("STARLIGHTD_MAX_UPDATE_AGE", r.MaxUpdateAge.Duration)
+	r.ArchiveDir = env.String("STARLIGHTD_ARCHIVE_DIR", r.ArchiveDir)
+	r.PruneInterval.Duration = env.Duration("STARLIGHTD_PRUNE_INTERVAL", r.PruneInterval.Duration)
+	r.Compact = env.Bool("STARLIGHTD_COMPACT", r.Compact)
+
+	// The env package has no amounts, so parse them here.
+	amounts := []struct {
+		name string
+		v    *xlmAmount
+	}{
+		{"STARLIGHTD_CHANNEL_FEERATE", &a.ChannelFeerate},
+		{"STARLIGHTD_HOST_FEERATE", &a.HostFeerate},
+		{"STARLIGHTD_FORWARD_FEE_BASE", &a.ForwardFeeBase},
+	}
+	for _, x := range amounts {
+		if s := env.String(x.name, ""); s != "" {
+			if err := x.v.UnmarshalText([]byte(s)); err != nil {
+				return fmt.Errorf("%s: %s", x.name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// starlightConfig returns the starlight.Config for a,
+// or an error if a has durations that are not whole minutes.
+func (a *agentConfig) starlightConfig() (*starlight.Config, error) {
+	c := &starlight.Config{
+		Username:       a.Username,
+		Password:       a.Password,
+		Mnemonic:       a.Mnemonic,
+		HorizonURL:     a.HorizonURL,
+		ChannelFeerate: a.ChannelFeerate.Amount,
+		HostFeerate:    a.HostFeerate.Amount,
+		ForwardFeeBase: a.ForwardFeeBase.Amount,
+		ForwardFeeRate: a.ForwardFeeRate,
+		KeepAlive:      a.KeepAlive,
+		Public:         a.Public,
+	}
+	if c.HorizonURL == "" {
+		c.HorizonURL = defaultHorizonURL
+	}
+	mins := []struct {
+		name string
+		d    duration
+		v    *int64
+	}{
+		{"max_round_duration", a.MaxRoundDuration, &c.MaxRoundDurMins},
+		{"finality_delay", a.FinalityDelay, &c.FinalityDelayMins},
+		{"min_max_round_duration", a.MinMaxRoundDuration, &c.MinMaxRoundDurMins},
+		{"max_max_round_duration", a.MaxMaxRoundDuration, &c.MaxMaxRoundDurMins},
+		{"min_finality_delay", a.MinFinalityDelay, &c.MinFinalityDelayMins},
+		{"max_finality_delay", a.MaxFinalityDelay, &c.MaxFinalityDelayMins},
+	}
+	for _, m := range mins {
+		if m.d.Duration%time.Minute != 0 {
+			return nil, fmt.Errorf("%s %s is not a whole number of minutes", m.name, m.d.Duration)
+		}
+		*m.v = int64(m.d.Duration / time.Minute)
+	}
+	return c, nil
+}
+
+// parseUnlocker parses a seed-unlock source, one of
+//
+//	file:PATH         read the password from file PATH
+//	env:NAME          take the password from environment variable NAME
+//	command:PROG ARG  run PROG with space-separated arguments ARG
+//	                  and read the password from its output
+func parseUnlocker(s string) (starlight.SeedUnlocker, error) {
+	i := strings.Index(s, ":")
+	if i < 0 {
+		return nil, fmt.Errorf("unlock %q: want file:, env:, or command:", s)
+	}
+	kind, arg := s[:i], s[i+1:]
+	if arg == "" {
+		return nil, fmt.Errorf("unlock %q: empty %s", s, kind)
+	}
+	switch kind {
+	case "file":
+		return starlight.PassphraseFile(arg), nil
+	case "env":
+		return starlight.EnvPassphrase(arg), nil
+	case "command":
+		args := strings.Fields(arg)
+		if len(args) == 0 {
+			return nil, fmt.Errorf("unlock %q: empty command", s)
+		}
+		return starlight.CommandPassphrase(args[0], args[1:]...), nil
+	}
+	return nil, fmt.Errorf("unlock %q: unknown kind %q", s, kind)
+}
+
+// initAgent configures g from c, unless g is already configured
+// or c has no agent username.
+// It reports whether it configured g.
+func initAgent(g *starlight.Agent, c *config) (bool, error) {
+	if g.Configured() || c.Agent.Username == "" {
+		return false, nil
+	}
+	sc, err := c.Agent.starlightConfig()
+	if err != nil {
+		return false, err
+	}
+	host := c.Agent.Host
+	if host == "" {
+		host = c.Listen
+	}
+	err = g.ConfigInit(sc, host)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
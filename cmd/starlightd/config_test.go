@@ -0,0 +1,129 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/interstellar/starlight/worizon/xlm"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "starlightd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "starlightd.toml")
+	err = ioutil.WriteFile(path, []byte(`
+listen = "localhost:7001"
+data = "/var/lib/starlight"
+
+[agent]
+username = "alice"
+password = "file password"
+host = "alice.example.com"
+max_round_duration = "2h"
+channel_feerate = "0.001"
+keep_alive = false
+
+[retention]
+keep_updates = 1000
+max_update_age = "720h"
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("STARLIGHTD_PASSWORD", "env password")
+	os.Setenv("STARLIGHTD_HOST_FEERATE", "0.5")
+	defer os.Unsetenv("STARLIGHTD_PASSWORD")
+	defer os.Unsetenv("STARLIGHTD_HOST_FEERATE")
+
+	c := &config{Listen: "localhost:7000", Data: "./starlight-data", Name: "default"}
+	err = loadConfig(c, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Listen != "localhost:7001" || c.Data != "/var/lib/starlight" || c.Name != "default" {
+		t.Errorf("got listen %q data %q name %q", c.Listen, c.Data, c.Name)
+	}
+
+	sc, err := c.Agent.starlightConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sc.Username != "alice" {
+		t.Errorf("got username %q, want alice", sc.Username)
+	}
+	if sc.Password != "env password" {
+		t.Errorf("got password %q, want env password", sc.Password)
+	}
+	if sc.HorizonURL != defaultHorizonURL {
+		t.Errorf("got horizon URL %q, want %q", sc.HorizonURL, defaultHorizonURL)
+	}
+	if sc.MaxRoundDurMins != 120 {
+		t.Errorf("got max round duration %d mins, want 120", sc.MaxRoundDurMins)
+	}
+	if sc.ChannelFeerate != xlm.Millilumen {
+		t.Errorf("got channel feerate %s, want %s", sc.ChannelFeerate, xlm.Millilumen)
+	}
+	if sc.HostFeerate != xlm.Lumen/2 {
+		t.Errorf("got host feerate %s, want %s", sc.HostFeerate, xlm.Lumen/2)
+	}
+	if sc.KeepAlive == nil || *sc.KeepAlive {
+		t.Errorf("got keep alive %v, want false", sc.KeepAlive)
+	}
+	if r := c.Retention; r.KeepUpdates != 1000 || r.MaxUpdateAge.Duration != 30*24*time.Hour {
+		t.Errorf("got keep updates %d max update age %s", r.KeepUpdates, r.MaxUpdateAge)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "starlightd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cases := []struct {
+		name string
+		toml string
+	}{
+		{"unknown setting", "[agent]\nusername = \"alice\"\nfeerate = \"1\"\n"},
+		{"bad duration", "[agent]\nfinality_delay = \"soon\"\n"},
+		{"bad amount", "[agent]\nhost_feerate = \"lots\"\n"},
+	}
+	for _, tc := range cases {
+		path := filepath.Join(dir, "starlightd.toml")
+		err := ioutil.WriteFile(path, []byte(tc.toml), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = loadConfig(new(config), path)
+		if err == nil {
+			t.Errorf("%s: got no error", tc.name)
+		}
+	}
+
+	c := &config{Agent: agentConfig{FinalityDelay: duration{90 * time.Second}}}
+	_, err = c.Agent.starlightConfig()
+	if err == nil {
+		t.Error("fractional minutes: got no error")
+	}
+}
+
+func TestParseUnlocker(t *testing.T) {
+	for _, s := range []string{"file:/etc/starlight/passphrase", "env:STARLIGHT_PASSPHRASE", "command:kms-decrypt -in pw.enc"} {
+		if _, err := parseUnlocker(s); err != nil {
+			t.Errorf("parseUnlocker(%q): %s", s, err)
+		}
+	}
+	for _, s := range []string{"", "passphrase", "file:", "command:  ", "kms:key"} {
+		if _, err := parseUnlocker(s); err == nil {
+			t.Errorf("parseUnlocker(%q): got no error", s)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/interstellar/starlight/starlight"
+)
+
+// pruneUpdates prunes g's updates according to r
+// every r.PruneInterval, until ctx is done.
+func pruneUpdates(ctx context.Context, g *starlight.Agent, r *retentionConfig) {
+	interval := r.PruneInterval.Duration
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	for {
+		n, err := pruneOnce(g, r)
+		if err != nil {
+			log.Printf("pruning updates: %s", err)
+		} else if n > 0 {
+			log.Printf("pruned %d updates", n)
+			if r.Compact {
+				err = g.Compact()
+				if err != nil {
+					log.Printf("compacting database: %s", err)
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// pruneOnce prunes g's updates according to r,
+// archiving the pruned updates in a new file in r.ArchiveDir, if set.
+// It returns the number of updates pruned.
+func pruneOnce(g *starlight.Agent, r *retentionConfig) (int, error) {
+	p := &starlight.RetentionPolicy{
+		KeepUpdates: uint64(r.KeepUpdates),
+		MaxAge:      r.MaxUpdateAge.Duration,
+	}
+	if r.ArchiveDir == "" {
+		return g.PruneUpdates(p)
+	}
+
+	err := os.MkdirAll(r.ArchiveDir, 0700)
+	if err != nil {
+		return 0, err
+	}
+	name := filepath.Join(r.ArchiveDir, "updates-"+time.Now().UTC().Format("20060102T150405Z")+".jsonl.gz")
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return 0, err
+	}
+	zw := gzip.NewWriter(f)
+	p.Archive = zw
+	p.Flush = func() error {
+		err := zw.Close()
+		if err != nil {
+			return err
+		}
+		return f.Sync()
+	}
+	n, err := g.PruneUpdates(p)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if n == 0 {
+		// Nothing was deleted, so there's nothing to keep.
+		os.Remove(name)
+	}
+	return n, err
+}
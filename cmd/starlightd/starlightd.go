@@ -11,6 +11,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
 	"syscall"
@@ -20,29 +21,83 @@ import (
 	"github.com/kr/secureheader"
 	"golang.org/x/crypto/acme/autocert"
 
+	"github.com/interstellar/starlight/env"
 	i10rnet "github.com/interstellar/starlight/net"
 	"github.com/interstellar/starlight/starlight"
+	"github.com/interstellar/starlight/starlight/db/kv"
+	"github.com/interstellar/starlight/starlight/wallet"
 	"github.com/interstellar/starlight/starlight/walletrpc"
 )
 
 func main() {
 	var (
-		listen = flag.String("listen", "localhost:7000", "listen `address` (if no LISTEN_FDS)")
-		dir    = flag.String("data", "./starlight-data", "data directory")
-		debug  = flag.Bool("debug", false, "print verbose debugging output")
-		name   = flag.String("name", "", "name for the agent, used in log output")
+		configFile      = flag.String("config", env.String("STARLIGHTD_CONFIG", ""), "read configuration from TOML `file`")
+		listen          = flag.String("listen", "localhost:7000", "listen `address` (if no LISTEN_FDS)")
+		dir             = flag.String("data", "./starlight-data", "data directory")
+		debug           = flag.Bool("debug", false, "print verbose debugging output")
+		name            = flag.String("name", "", "name for the agent, used in log output and to find its data in -database")
+		assets          = flag.String("wallet-dir", "", "serve the wallet frontend from `dir` instead of the built-in copy")
+		shutdownTimeout = flag.Duration("shutdown-timeout", time.Minute, "on SIGTERM, wait up to `duration` for channel rounds in flight to finish")
+		unlock          = flag.String("unlock", "", "decrypt the agent's seed at startup with the password from `source` (file:PATH, env:NAME, or command:PROG)")
+		restore         = flag.String("restore", "", "restore the agent from backup `file` into empty storage, then start; requires -unlock")
+		database        = flag.String("database", "", "keep the agent's data in the PostgreSQL database at `url`, under -name, instead of the data directory")
 	)
 	flag.Parse()
 
-	err := os.MkdirAll(*dir, 0700)
+	cfg := &config{
+		Listen:    *listen,
+		Data:      *dir,
+		Debug:     *debug,
+		Name:      *name,
+		WalletDir: *assets,
+		Unlock:    *unlock,
+		Database:  *database,
+
+		ShutdownTimeout: duration{*shutdownTimeout},
+	}
+	err := loadConfig(cfg, *configFile)
+	if err != nil {
+		log.Fatalf("error loading config: %s", err)
+	}
+	// Flags given explicitly take precedence
+	// over the config file and environment.
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			cfg.Listen = *listen
+		case "data":
+			cfg.Data = *dir
+		case "debug":
+			cfg.Debug = *debug
+		case "name":
+			cfg.Name = *name
+		case "wallet-dir":
+			cfg.WalletDir = *assets
+		case "unlock":
+			cfg.Unlock = *unlock
+		case "shutdown-timeout":
+			cfg.ShutdownTimeout.Duration = *shutdownTimeout
+		case "database":
+			cfg.Database = *database
+		}
+	})
+
+	err = os.MkdirAll(cfg.Data, 0700)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	db, err := bolt.Open(filepath.Join(*dir, "db"), 0600, nil)
+	db, err := openDB(cfg)
 	if err != nil {
 		log.Fatalf("error opening database: %s", err)
 	}
+	if *restore != "" {
+		err = restoreBackup(db, *restore, cfg.Unlock)
+		if err != nil {
+			log.Fatalf("error restoring backup: %s", err)
+		}
+		log.Printf("restored backup %s", *restore)
+	}
 
 	ctx := context.Background()
 	ctx, cancel := context.WithCancel(ctx)
@@ -51,20 +106,51 @@ func main() {
 	if err != nil {
 		log.Fatalf("error starting agent: %s", err)
 	}
-	g.SetDebug(*debug, *name)
+	g.SetDebug(cfg.Debug, cfg.Name)
+
+	configured, err := initAgent(g, cfg)
+	if err != nil {
+		log.Fatalf("error configuring agent: %s", err)
+	}
+	if configured {
+		log.Printf("configured agent %s", cfg.Agent.Username)
+	}
+	// Unlock even a newly configured agent,
+	// so it keeps the unlock source
+	// for when an error puts it in watchtower mode.
+	if cfg.Unlock != "" && g.Configured() {
+		u, err := parseUnlocker(cfg.Unlock)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = g.Unlock(ctx, u)
+		if err != nil {
+			log.Fatalf("error unlocking agent: %s", err)
+		}
+		log.Print("unlocked agent")
+	}
 
-	handler := walletrpc.Handler(g)
-	if !i10rnet.IsLoopback(*listen) {
+	pruneCtx, stopPruning := context.WithCancel(ctx)
+	if cfg.Retention.KeepUpdates > 0 || cfg.Retention.MaxUpdateAge.Duration > 0 {
+		go pruneUpdates(pruneCtx, g, &cfg.Retention)
+	}
+
+	frontend := wallet.Assets()
+	if cfg.WalletDir != "" {
+		frontend = os.DirFS(cfg.WalletDir)
+	}
+	handler := walletrpc.Handler(g, frontend)
+	if !i10rnet.IsLoopback(cfg.Listen) {
 		handler = secureheader.Handler(handler)
 	}
 
-	serveLn, redirLn, err := systemdListenersOrListen(*listen)
+	serveLn, redirLn, err := systemdListenersOrListen(cfg.Listen)
 	if err != nil {
 		log.Fatalf("listen: %s", err)
 	}
 	serveLn = &keepAliveListener{serveLn}
 
-	cert, key, err := findCertKey(*dir)
+	cert, key, err := findCertKey(cfg.Data)
 	if err != nil && !os.IsNotExist(err) {
 		log.Fatal(err)
 	}
@@ -88,7 +174,7 @@ func main() {
 	// Timeout settings based on Filippo's late-2016 blog post
 	// https://blog.filippo.io/exposing-go-on-the-internet/.
 	srv := &http.Server{
-		Addr:        *listen,
+		Addr:        cfg.Listen,
 		ReadTimeout: 5 * time.Second,
 
 		// must be higher than the event handler timeout (10s)
@@ -97,15 +183,19 @@ func main() {
 		IdleTimeout: 120 * time.Second,
 		Handler:     handler,
 	}
-	if i10rnet.IsLoopback(*listen) {
-		srv.Serve(serveLn)
-	}
 
-	if cert != "" {
-		err = srv.ServeTLS(serveLn, cert, key)
-	} else {
+	errc := make(chan error, 1)
+	go func() {
+		if i10rnet.IsLoopback(cfg.Listen) {
+			errc <- srv.Serve(serveLn)
+			return
+		}
+		if cert != "" {
+			errc <- srv.ServeTLS(serveLn, cert, key)
+			return
+		}
 		tlsConfig := (&autocert.Manager{
-			Cache:      autocert.DirCache(filepath.Join(*dir, "autocert")),
+			Cache:      autocert.DirCache(filepath.Join(cfg.Data, "autocert")),
 			Prompt:     autocert.AcceptTOS,
 			HostPolicy: autoHostWhitelist(db),
 		}).TLSConfig()
@@ -128,19 +218,99 @@ func main() {
 		}
 
 		srv.TLSConfig = tlsConfig
-		err = srv.Serve(tls.NewListener(serveLn, tlsConfig))
+		errc <- srv.Serve(tls.NewListener(serveLn, tlsConfig))
+	}()
+
+	sigc := make(chan os.Signal, 2)
+	signal.Notify(sigc, syscall.SIGTERM, os.Interrupt)
+	select {
+	case err := <-errc:
+		log.Fatalf("ListenAndServe: %s", err)
+	case sig := <-sigc:
+		log.Printf("received %s, shutting down", sig)
 	}
+	go func() {
+		<-sigc
+		log.Fatal("received second signal, exiting immediately")
+	}()
+	stopPruning()
+	shutdown(g, srv, cfg.ShutdownTimeout.Duration)
+	db.Close()
+}
+
+// shutdown stops g and srv.
+// It first lets g finish in-flight rounds and pending tasks,
+// for up to timeout,
+// while srv continues serving, so peers can deliver the messages
+// that complete those rounds.
+// Then it shuts down srv and waits for g's goroutines to exit.
+func shutdown(g *starlight.Agent, srv *http.Server, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := g.Drain(ctx)
 	if err != nil {
-		log.Fatalf("ListenAndServe: %s", err)
+		log.Printf("shutting down with work in flight: %s", err)
+	}
+
+	// Give long-polling requests time to return.
+	ctx, cancel = context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	err = srv.Shutdown(ctx)
+	if err != nil {
+		log.Printf("shutting down HTTP server: %s", err)
+		srv.Close()
+	}
+	g.CloseWait()
+}
+
+// openDB opens the database c configures:
+// the PostgreSQL database c.Database if that's set,
+// or else the bolt file "db" in c.Data.
+func openDB(c *config) (*kv.DB, error) {
+	if c.Database != "" {
+		name := c.Name
+		if name == "" {
+			name = "starlight"
+		}
+		return kv.OpenPostgres(c.Database, name)
+	}
+	db, err := bolt.Open(filepath.Join(c.Data, "db"), 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	return kv.Bolt(db), nil
+}
+
+// restoreBackup restores the agent into db,
+// which must be empty,
+// from the backup in file backup,
+// decrypting it with the password from unlock.
+func restoreBackup(db *kv.DB, backup, unlock string) error {
+	if unlock == "" {
+		return errors.New("need the backup's password; set unlock")
+	}
+	u, err := parseUnlocker(unlock)
+	if err != nil {
+		return err
+	}
+	password, err := u.Password(context.Background())
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(backup)
+	if err != nil {
+		return err
 	}
+	defer f.Close()
+	return starlight.RestoreBackup(db, f, password)
 }
 
 // autoHostWhitelist provides a TOFU-like mechanism as an
 // autocert host policy. It whitelists the first-requested
 // name and rejects all subsequent names.
-func autoHostWhitelist(db *bolt.DB) autocert.HostPolicy {
+func autoHostWhitelist(db *kv.DB) autocert.HostPolicy {
 	return func(ctx context.Context, host string) error {
-		return db.Update(func(tx *bolt.Tx) error {
+		return db.Update(func(tx *kv.Tx) error {
 			bu, err := tx.CreateBucketIfNotExists([]byte("daemon"))
 			if err != nil {
 				return err
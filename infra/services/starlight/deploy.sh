@@ -4,6 +4,7 @@ set -ex
 host=ubuntu@starlight.i10rint.com
 tmpdir=$(mktemp -d)
 
+(cd $(go env GOPATH)/src/github.com/interstellar/starlight/starlight/wallet && npm install && npm run build)
 GOOS=linux GOARCH=amd64 go build -o $tmpdir/starlightd github.com/interstellar/starlight/cmd/starlightd
 ssh $host 'sudo systemctl stop starlight'
 scp $tmpdir/starlightd $host:~/starlightd
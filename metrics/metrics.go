@@ -0,0 +1,270 @@
+// Package metrics provides counters, gauges, and histograms
+// and serves them in the Prometheus text exposition format.
+//
+// It implements only what Starlight uses,
+// so as not to depend on the Prometheus client library.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Registry is a set of metrics.
+// It implements http.Handler,
+// serving its metrics to Prometheus scrapers.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+// desc describes a metric.
+type desc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d *desc) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, escapeHelp(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, d.typ)
+}
+
+// labelString renders the label pairs of d for values,
+// including the surrounding braces.
+// It panics if the number of values is wrong.
+func (d *desc) labelString(values []string, extra ...string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metric %s: got %d label values, want %d", d.name, len(values), len(d.labels)))
+	}
+	var pairs []string
+	for i, v := range values {
+		pairs = append(pairs, d.labels[i]+`="`+escapeLabel(v)+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escapeLabel(extra[i+1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+// WriteTo writes the current values of the metrics in r to w.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	cw := &countWriter{w: bufio.NewWriter(w)}
+	for _, m := range metrics {
+		m.write(cw)
+	}
+	if cw.err == nil {
+		cw.err = cw.w.(*bufio.Writer).Flush()
+	}
+	return cw.n, cw.err
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+// Counter is a cumulative count,
+// optionally partitioned by label values.
+type Counter struct {
+	desc
+	mu     sync.Mutex
+	values map[string]float64 // keyed by label string
+}
+
+// NewCounter registers and returns a new counter
+// with the given name, help text, and label names.
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{
+		desc:   desc{name: name, help: help, typ: "counter", labels: labels},
+		values: make(map[string]float64),
+	}
+	r.register(c)
+	return c
+}
+
+// Inc adds 1 to the count for the given label values.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v, which must not be negative,
+// to the count for the given label values.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic("metrics: counter decreased")
+	}
+	ls := c.labelString(labelValues)
+	c.mu.Lock()
+	c.values[ls] += v
+	c.mu.Unlock()
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.writeHeader(w)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.values) == 0 && len(c.labels) == 0 {
+		fmt.Fprintf(w, "%s 0\n", c.name)
+		return
+	}
+	writeSorted(w, c.name, c.values)
+}
+
+// Func is a metric whose values are computed
+// by a function each time the metric is read.
+type Func struct {
+	desc
+	f func(emit func(v float64, labelValues ...string))
+}
+
+// NewGaugeFunc registers a gauge whose values are reported by f.
+// Each time the gauge is read,
+// f calls emit with the current value for each set of label values.
+func (r *Registry) NewGaugeFunc(name, help string, labels []string, f func(emit func(v float64, labelValues ...string))) *Func {
+	g := &Func{desc: desc{name: name, help: help, typ: "gauge", labels: labels}, f: f}
+	r.register(g)
+	return g
+}
+
+// NewCounterFunc registers a counter whose values are reported by f,
+// as for NewGaugeFunc.
+// The values must never decrease.
+func (r *Registry) NewCounterFunc(name, help string, labels []string, f func(emit func(v float64, labelValues ...string))) *Func {
+	c := &Func{desc: desc{name: name, help: help, typ: "counter", labels: labels}, f: f}
+	r.register(c)
+	return c
+}
+
+func (g *Func) write(w io.Writer) {
+	g.writeHeader(w)
+	values := make(map[string]float64)
+	g.f(func(v float64, labelValues ...string) {
+		values[g.labelString(labelValues)] += v
+	})
+	writeSorted(w, g.name, values)
+}
+
+// Histogram counts observations in buckets.
+type Histogram struct {
+	desc
+	bounds []float64 // upper bounds, increasing
+
+	mu     sync.Mutex
+	counts []uint64 // per bucket, not cumulative; last is +Inf
+	sum    float64
+	count  uint64
+}
+
+// NewHistogram registers and returns a new histogram
+// with the given name, help text,
+// and bucket upper bounds, in increasing order.
+func (r *Registry) NewHistogram(name, help string, bounds []float64) *Histogram {
+	if !sort.Float64sAreSorted(bounds) {
+		panic("metrics: histogram bounds not sorted")
+	}
+	h := &Histogram{
+		desc:   desc{name: name, help: help, typ: "histogram"},
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)+1),
+	}
+	r.register(h)
+	return h
+}
+
+// Observe adds an observation of v to h.
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.mu.Lock()
+	h.counts[i]++
+	h.sum += v
+	h.count++
+	h.mu.Unlock()
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.writeHeader(w)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var cum uint64
+	for i, n := range h.counts {
+		cum += n
+		le := math.Inf(1)
+		if i < len(h.bounds) {
+			le = h.bounds[i]
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(nil, "le", formatFloat(le)), cum)
+	}
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
+
+func writeSorted(w io.Writer, name string, values map[string]float64) {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", name, k, formatFloat(values[k]))
+	}
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+
+type countWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	r := new(Registry)
+	c := r.NewCounter("requests_total", "Requests served.", "code")
+	c.Inc("200")
+	c.Inc("200")
+	c.Add(3, `a"b`)
+	r.NewCounter("errors_total", "Errors.")
+	r.NewGaugeFunc("queue_depth", "Items\nqueued.", []string{"queue"}, func(emit func(float64, ...string)) {
+		emit(2, "b")
+		emit(1, "a")
+		emit(1, "a")
+	})
+	h := r.NewHistogram("latency_seconds", "Latency.", []float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(5)
+
+	var buf bytes.Buffer
+	_, err := r.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP requests_total Requests served.
+# TYPE requests_total counter
+requests_total{code="200"} 2
+requests_total{code="a\"b"} 3
+# HELP errors_total Errors.
+# TYPE errors_total counter
+errors_total 0
+# HELP queue_depth Items\nqueued.
+# TYPE queue_depth gauge
+queue_depth{queue="a"} 2
+queue_depth{queue="b"} 2
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 1
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 5.55
+latency_seconds_count 3
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("got content type %q", ct)
+	}
+	if rec.Body.String() != want {
+		t.Errorf("served body differs from WriteTo output")
+	}
+}
+
+func TestLabelCount(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("no panic with wrong number of label values")
+		}
+	}()
+	new(Registry).NewCounter("c", "C.", "a", "b").Inc("x")
+}
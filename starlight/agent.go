@@ -3,6 +3,7 @@ package starlight
 
 import (
 	"context"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"html/template"
@@ -12,7 +13,6 @@ import (
 	"sync"
 	"time"
 
-	bolt "github.com/coreos/bbolt"
 	b "github.com/stellar/go/build"
 	"github.com/stellar/go/clients/horizon"
 	"github.com/stellar/go/network"
@@ -22,6 +22,7 @@ import (
 	"github.com/interstellar/starlight/errors"
 	"github.com/interstellar/starlight/net"
 	"github.com/interstellar/starlight/starlight/db"
+	"github.com/interstellar/starlight/starlight/db/kv"
 	"github.com/interstellar/starlight/starlight/fsm"
 	"github.com/interstellar/starlight/starlight/internal/message"
 	"github.com/interstellar/starlight/starlight/internal/update"
@@ -78,6 +79,14 @@ type Agent struct {
 	// messages (as well as all new inputs).
 	seed []byte // write-once; synchronized with db.Update
 
+	// Source of the password that Unlock last checked,
+	// with which mustDeauthenticate decrypts seed again.
+	unlocker SeedUnlocker // synchronized with db.Update
+
+	// Set by Drain, when the agent stops accepting new commands
+	// in preparation for shutting down.
+	draining bool // synchronized with db.Update
+
 	// Horizon client wrapper.
 	wclient *worizon.Client
 
@@ -87,9 +96,11 @@ type Agent struct {
 
 	tb *taskbasket.TB
 
+	metrics *agentMetrics
+
 	wg *sync.WaitGroup
 
-	db *bolt.DB // doubles as a mutex for the fields in this struct
+	db *kv.DB // doubles as a mutex for the fields in this struct
 
 	// Channel to indicate when testnet faucet funds returns successfully
 	wallet chan struct{}
@@ -103,6 +114,11 @@ type Agent struct {
 	// and are ready to be streamed from Horizon.
 	acctsReady map[string]chan struct{}
 
+	// Nonces of the recent requests for the agent's messages,
+	// with the times of the requests; see CheckMessagesRequest.
+	msgNonces   map[string]time.Time
+	msgNoncesMu sync.Mutex
+
 	// These fields are used for logging.
 	// They should be set once during initialization and not changed.
 	// As such they may be accessed without holding the db mutex.
@@ -122,11 +138,35 @@ type Config struct {
 	// It's never included in Updates.
 	OldPassword string `json:",omitempty"`
 
+	// Mnemonic is the recovery phrase, from ExportMnemonic,
+	// of the agent to restore in ConfigInit.
+	// It's never included in Updates.
+	Mnemonic string `json:",omitempty"`
+
 	MaxRoundDurMins   int64      `json:",omitempty"`
 	FinalityDelayMins int64      `json:",omitempty"`
 	ChannelFeerate    xlm.Amount `json:",omitempty"`
 	HostFeerate       xlm.Amount `json:",omitempty"`
 
+	// MinMaxRoundDurMins through MaxFinalityDelayMins bound the
+	// max round duration and finality delay the agent accepts
+	// in a channel proposed to it. It answers a proposal outside
+	// them with a counter-proposal, and accepts a counter-proposal
+	// to its own proposal within them.
+	// An unset bound is the agent's own MaxRoundDurMins
+	// or FinalityDelayMins.
+	MinMaxRoundDurMins   int64 `json:",omitempty"`
+	MaxMaxRoundDurMins   int64 `json:",omitempty"`
+	MinFinalityDelayMins int64 `json:",omitempty"`
+	MaxFinalityDelayMins int64 `json:",omitempty"`
+
+	// ForwardFeeBase and ForwardFeeRate set the fee the agent
+	// charges to forward routed payments between its channels:
+	// ForwardFeeBase plus ForwardFeeRate parts per million
+	// of the forwarded amount.
+	ForwardFeeBase xlm.Amount `json:",omitempty"`
+	ForwardFeeRate int64      `json:",omitempty"`
+
 	// KeepAlive, if set, indicates whether or not the agent will
 	// send 0-value keep-alive payments on its channels
 	KeepAlive *bool `json:",omitempty"`
@@ -145,13 +185,15 @@ const (
 )
 
 // StartAgent starts an agent
-// using the bucket "agent" in db for storage
+// using the bucket "agent" in store for storage
 // and returns it.
-func StartAgent(ctx context.Context, boltDB *bolt.DB) (*Agent, error) {
+// It first migrates store to the current schema version,
+// and fails with db.ErrNewerSchema if store is newer than that.
+func StartAgent(ctx context.Context, store *kv.DB) (*Agent, error) {
 	ctx, cancel := context.WithCancel(ctx)
 
 	g := &Agent{
-		db:         boltDB,
+		db:         store,
 		cancelers:  make(map[string]context.CancelFunc),
 		wg:         new(sync.WaitGroup),
 		rootCtx:    ctx,
@@ -162,8 +204,15 @@ func StartAgent(ctx context.Context, boltDB *bolt.DB) (*Agent, error) {
 	}
 
 	g.evcond.L = new(sync.Mutex)
+	g.metrics = g.newMetrics()
 
-	err := db.Update(boltDB, func(root *db.Root) error { return g.start(root) })
+	err := db.Update(store, func(root *db.Root) error {
+		err := db.Migrate(root)
+		if err != nil {
+			return err
+		}
+		return g.start(root)
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -233,6 +282,62 @@ func (g *Agent) CloseWait() {
 	g.wg.Wait()
 }
 
+// Drain prepares g to shut down.
+// It stops g from accepting new commands,
+// then waits until no channel has a payment round in flight
+// and g's taskbasket is empty,
+// or until ctx is done, in which case it returns ctx's error.
+// Peer messages and Horizon transactions continue to be processed,
+// so that rounds can complete.
+// Call CloseWait afterward to stop g.
+func (g *Agent) Drain(ctx context.Context) error {
+	err := db.Update(g.db, func(root *db.Root) error {
+		g.draining = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for {
+		busy, err := g.busy()
+		if err != nil {
+			return err
+		}
+		if busy == "" {
+			return nil
+		}
+		g.debugf("draining: waiting for %s", busy)
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "waiting for %s", busy)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// busy describes the work that g has in flight,
+// or returns the empty string if there is none.
+func (g *Agent) busy() (string, error) {
+	for _, c := range g.Channels() {
+		if inRound(c.State) {
+			return fmt.Sprintf("channel %s in state %s", c.ID, c.State), nil
+		}
+	}
+	var n int
+	err := db.View(g.db, func(root *db.Root) error {
+		if g.tb == nil {
+			return nil // not configured
+		}
+		var err error
+		n, err = g.tb.LenTx(root.Tx())
+		return err
+	})
+	if err != nil || n == 0 {
+		return "", err
+	}
+	return fmt.Sprintf("%d pending tasks", n), nil
+}
+
 // allez launches f as a goroutine, tracking it in the agent's WaitGroup.
 func (g *Agent) allez(f func(), desc string) {
 	g.wg.Add(1)
@@ -249,19 +354,48 @@ func (g *Agent) allez(f func(), desc string) {
 // and performs any other necessary setup steps,
 // such as obtaining free testnet lumens.
 // It is an error if g has already been configured.
+//
+// If c.Mnemonic is set, ConfigInit restores the agent's keys
+// from that recovery phrase instead of generating new ones.
+// It finds the wallet account on the ledger, if it exists,
+// and skips past the key indexes of channel accounts still in use.
 func (g *Agent) ConfigInit(c *Config, hostURL string) error {
 	err := g.wclient.ValidateTestnetURL(c.HorizonURL)
 	if err != nil {
 		return err
 	}
 
+	var seed []byte
+	var scan *keyScan
+	if c.Mnemonic != "" {
+		if g.Configured() {
+			return errAlreadyConfigured
+		}
+		seed, err = key.SeedFromMnemonic(c.Mnemonic)
+		if err != nil {
+			return errors.Sub(errInvalidMnemonic, err)
+		}
+		if len(seed) != 32 {
+			return errors.Wrap(errInvalidMnemonic, "want 24 words")
+		}
+		// WARNING: this software is not compatible with Stellar mainnet.
+		g.wclient.SetURL(c.HorizonURL)
+		scan, err = g.scanKeys(seed)
+		if err != nil {
+			return err
+		}
+	}
+
 	return db.Update(g.db, func(root *db.Root) error {
 		if g.isReadyConfigured(root) {
 			return errAlreadyConfigured
 		}
 
-		g.seed = make([]byte, 32)
-		randRead(g.seed)
+		if seed == nil {
+			seed = make([]byte, 32)
+			randRead(seed)
+		}
+		g.seed = seed
 		k := key.DeriveAccountPrimary(g.seed)
 		primaryAcct := fsm.AccountID(key.PublicKeyXDR(k))
 
@@ -286,6 +420,15 @@ func (g *Agent) ConfigInit(c *Config, hostURL string) error {
 		if c.HostFeerate < 0 {
 			return errors.Wrap(errInvalidInput, "negative host feerate")
 		}
+		if err := c.checkTermBounds(); err != nil {
+			return err
+		}
+		if c.ForwardFeeBase < 0 {
+			return errors.Wrap(errInvalidInput, "negative forwarding fee")
+		}
+		if c.ForwardFeeRate < 0 {
+			return errors.Wrap(errInvalidInput, "negative forwarding fee rate")
+		}
 		digest, err := bcrypt.GenerateFromPassword([]byte(c.Password), bcrypt.DefaultCost)
 		if err != nil {
 			return err
@@ -318,6 +461,12 @@ func (g *Agent) ConfigInit(c *Config, hostURL string) error {
 		root.Agent().Config().PutFinalityDelayMins(c.FinalityDelayMins)
 		root.Agent().Config().PutChannelFeerate(int64(c.ChannelFeerate))
 		root.Agent().Config().PutHostFeerate(int64(c.HostFeerate))
+		root.Agent().Config().PutMinMaxRoundDurMins(c.MinMaxRoundDurMins)
+		root.Agent().Config().PutMaxMaxRoundDurMins(c.MaxMaxRoundDurMins)
+		root.Agent().Config().PutMinFinalityDelayMins(c.MinFinalityDelayMins)
+		root.Agent().Config().PutMaxFinalityDelayMins(c.MaxFinalityDelayMins)
+		root.Agent().Config().PutForwardFeeBase(int64(c.ForwardFeeBase))
+		root.Agent().Config().PutForwardFeeRate(c.ForwardFeeRate)
 		root.Agent().Config().PutKeepAlive(*c.KeepAlive)
 		root.Agent().Config().PutPublic(c.Public)
 
@@ -342,13 +491,26 @@ func (g *Agent) ConfigInit(c *Config, hostURL string) error {
 				FinalityDelayMins: c.FinalityDelayMins,
 				ChannelFeerate:    c.ChannelFeerate,
 				HostFeerate:       c.HostFeerate,
+				ForwardFeeBase:    c.ForwardFeeBase,
+				ForwardFeeRate:    c.ForwardFeeRate,
 				KeepAlive:         *c.KeepAlive,
+
+				MinMaxRoundDurMins:   c.MinMaxRoundDurMins,
+				MaxMaxRoundDurMins:   c.MaxMaxRoundDurMins,
+				MinFinalityDelayMins: c.MinFinalityDelayMins,
+				MaxFinalityDelayMins: c.MaxFinalityDelayMins,
 			},
 			Account: &update.Account{
 				ID:      primaryAcct.Address(),
 				Balance: 0,
 			},
 		})
+		if scan != nil {
+			err := g.putRestoredKeys(root, scan)
+			if err != nil {
+				return err
+			}
+		}
 
 		return g.start(root)
 	})
@@ -390,6 +552,15 @@ func (g *Agent) ConfigEdit(c *Config) error {
 	if c.HostFeerate < 0 {
 		return errors.Wrap(errInvalidInput, "negative host feerate")
 	}
+	if err := c.checkTermBounds(); err != nil {
+		return err
+	}
+	if c.ForwardFeeBase < 0 {
+		return errors.Wrap(errInvalidInput, "negative forwarding fee")
+	}
+	if c.ForwardFeeRate < 0 {
+		return errors.Wrap(errInvalidInput, "negative forwarding fee rate")
+	}
 
 	return db.Update(g.db, func(root *db.Root) error {
 		if !g.isReadyConfigured(root) {
@@ -430,6 +601,24 @@ func (g *Agent) ConfigEdit(c *Config) error {
 		if c.HostFeerate != 0 {
 			root.Agent().Config().PutHostFeerate(int64(c.HostFeerate))
 		}
+		if c.MinMaxRoundDurMins != 0 {
+			root.Agent().Config().PutMinMaxRoundDurMins(c.MinMaxRoundDurMins)
+		}
+		if c.MaxMaxRoundDurMins != 0 {
+			root.Agent().Config().PutMaxMaxRoundDurMins(c.MaxMaxRoundDurMins)
+		}
+		if c.MinFinalityDelayMins != 0 {
+			root.Agent().Config().PutMinFinalityDelayMins(c.MinFinalityDelayMins)
+		}
+		if c.MaxFinalityDelayMins != 0 {
+			root.Agent().Config().PutMaxFinalityDelayMins(c.MaxFinalityDelayMins)
+		}
+		if c.ForwardFeeBase != 0 {
+			root.Agent().Config().PutForwardFeeBase(int64(c.ForwardFeeBase))
+		}
+		if c.ForwardFeeRate != 0 {
+			root.Agent().Config().PutForwardFeeRate(c.ForwardFeeRate)
+		}
 		g.putUpdate(root, &Update{
 			Type: update.ConfigType,
 			Config: &update.Config{
@@ -440,6 +629,13 @@ func (g *Agent) ConfigEdit(c *Config) error {
 				FinalityDelayMins: c.FinalityDelayMins,
 				ChannelFeerate:    c.ChannelFeerate,
 				HostFeerate:       c.HostFeerate,
+				ForwardFeeBase:    c.ForwardFeeBase,
+				ForwardFeeRate:    c.ForwardFeeRate,
+
+				MinMaxRoundDurMins:   c.MinMaxRoundDurMins,
+				MaxMaxRoundDurMins:   c.MaxMaxRoundDurMins,
+				MinFinalityDelayMins: c.MinFinalityDelayMins,
+				MaxFinalityDelayMins: c.MaxFinalityDelayMins,
 			},
 		})
 		return nil
@@ -455,7 +651,7 @@ func (g *Agent) AddAsset(assetCode, issuer string) error {
 		return errEmptyIssuer
 	}
 	return db.Update(g.db, func(root *db.Root) error {
-		if !root.Agent().Ready() {
+		if !root.Agent().Ready() || g.draining {
 			return errAgentClosing
 		}
 		w := root.Agent().Wallet()
@@ -526,7 +722,7 @@ func (g *Agent) RemoveAsset(assetCode, issuer string) error {
 		return errEmptyIssuer
 	}
 	return db.Update(g.db, func(root *db.Root) error {
-		if !root.Agent().Ready() {
+		if !root.Agent().Ready() || g.draining {
 			return errAgentClosing
 		}
 		w := root.Agent().Wallet()
@@ -602,6 +798,16 @@ func (g *Agent) Configured() bool {
 	return ok
 }
 
+// Wallet returns the state of g's wallet account.
+func (g *Agent) Wallet() *fsm.WalletAcct {
+	var w *fsm.WalletAcct
+	db.View(g.db, func(root *db.Root) error {
+		w = root.Agent().Wallet()
+		return nil
+	})
+	return w
+}
+
 func (g *Agent) isReadyConfigured(root *db.Root) bool {
 	return root.Agent().Config().HorizonURL() != ""
 }
@@ -709,6 +915,15 @@ func (g *Agent) watchWalletAcct(acctID string, cursor horizon.Cursor) {
 
 				case xdr.OperationTypePayment:
 					paymentOp := op.Body.PaymentOp
+					opSrc := InputTx.Env.Tx.SourceAccount
+					if op.SourceAccount != nil {
+						opSrc = *op.SourceAccount
+					}
+					if opSrc.Address() == acctID {
+						// The balance was debited when the payment was made.
+						putWalletPayment(root, acctID, InputTx, htx.Hash, &op)
+						continue
+					}
 					if paymentOp.Destination.Address() != acctID {
 						continue
 					}
@@ -755,6 +970,7 @@ func (g *Agent) watchWalletAcct(acctID string, cursor horizon.Cursor) {
 						}
 						w.Balances[assetStr] = currBalance
 					}
+					putWalletPayment(root, acctID, InputTx, htx.Hash, &op)
 					w.Cursor = htx.PT
 					root.Agent().PutWallet(w)
 					g.putUpdate(root, &Update{
@@ -1018,17 +1234,33 @@ func (g *Agent) Authenticate(name, password string) bool {
 	return ok
 }
 
+// mustDeauthenticate discards g's decrypted seed,
+// putting g in watchtower mode.
+// If g was unlocked with a SeedUnlocker,
+// it then unlocks g again with it,
+// so g can resume without waiting for the user to log in.
 func (g *Agent) mustDeauthenticate() {
+	var u SeedUnlocker
 	err := db.Update(g.db, func(root *db.Root) error {
 		if g.seed != nil {
 			g.logf("entering watchtower mode")
 			g.seed = nil
 		}
+		u = g.unlocker
 		return nil
 	})
 	if err != nil {
 		panic(err)
 	}
+	if u == nil {
+		return
+	}
+	err = g.Unlock(g.rootCtx, u)
+	if err != nil {
+		g.logf("unlocking after entering watchtower mode: %s", err)
+		return
+	}
+	g.logf("unlocked, leaving watchtower mode")
 }
 
 const (
@@ -1038,34 +1270,45 @@ const (
 	defaultHostFeerate       = 100 * xlm.Stroop
 )
 
-// checkChannelUnique checks if there exists a channel between two parties with
-// account IDS a and b. If so, it returns the channel ID and an error.
-func (g *Agent) checkChannelUnique(a, b string) ([]byte, error) {
-	var chanID []byte
-	err := db.View(g.db, func(root *db.Root) error {
-		chans := root.Agent().Channels()
-		return chans.Bucket().ForEach(func(curChanID, _ []byte) error {
-			c := chans.Get(curChanID)
-			p, q := c.HostAcct.Address(), c.GuestAcct.Address()
-			if (a == p && b == q) || (a == q && b == p) {
-				chanID = curChanID
-				return errors.Wrapf(errExists, "between host %s and guest %s", p, q)
-			}
-			return nil
-		})
-	})
-	return chanID, err
-}
-
 // DoCreateChannel creates a channel between the agent host and the guest
-// specified at guestFedAddr, funding the channel with hostAmount
-func (g *Agent) DoCreateChannel(guestFedAddr string, hostAmount xlm.Amount) (*fsm.Channel, error) {
+// specified at guestFedAddr, funding the channel with hostAmount.
+// If assetCode and issuer are set, the channel is denominated in that
+// non-native asset and hostAmount is taken from the wallet's balance of it;
+// otherwise the channel is denominated in lumens.
+func (g *Agent) DoCreateChannel(guestFedAddr string, hostAmount xlm.Amount, assetCode, issuer string) (*fsm.Channel, error) {
 	if guestFedAddr == "" {
 		return nil, errEmptyAddress
 	}
 	if hostAmount == 0 {
 		return nil, errEmptyAmount
 	}
+	if assetCode == "" && issuer != "" {
+		return nil, errEmptyAsset
+	}
+	if assetCode != "" && issuer == "" {
+		return nil, errEmptyIssuer
+	}
+	var asset xdr.Asset
+	if assetCode != "" {
+		var issuerAccountID xdr.AccountId
+		err := issuerAccountID.SetAddress(issuer)
+		if err != nil {
+			return nil, errors.Sub(errInvalidAddress, err)
+		}
+		err = asset.SetCredit(assetCode, issuerAccountID)
+		if err != nil {
+			return nil, errors.Sub(errInvalidAsset, err)
+		}
+		// The funding tx creates the escrow account's trustline,
+		// which an issuer requiring authorization would never have authorized.
+		issuerAcct, err := g.wclient.LoadAccount(issuer)
+		if err != nil {
+			return nil, errors.Wrap(err, "getting issuer auth requirement")
+		}
+		if issuerAcct.Flags.AuthRequired {
+			return nil, errors.Wrap(errAssetAuthRequired, issuer)
+		}
+	}
 	// TODO(debnil): Distinguish account string and federation server address better, i.e. using type aliases for string.
 	var hostAcctStr string
 	db.View(g.db, func(root *db.Root) error {
@@ -1080,14 +1323,10 @@ func (g *Agent) DoCreateChannel(guestFedAddr string, hostAmount xlm.Amount) (*fs
 	if guestAcctStr == hostAcctStr {
 		return nil, errAcctsSame
 	}
-	_, err = g.checkChannelUnique(hostAcctStr, guestAcctStr)
-	if err != nil {
-		return nil, err
-	}
 
 	var ch *fsm.Channel
 	err = db.Update(g.db, func(root *db.Root) error {
-		if !root.Agent().Ready() {
+		if !root.Agent().Ready() || g.draining {
 			return errAgentClosing
 		}
 		if !g.isReadyFunded(root) {
@@ -1156,6 +1395,7 @@ func (g *Agent) DoCreateChannel(guestFedAddr string, hostAmount xlm.Amount) (*fs
 			HostRatchetAcct:     hostRatchetAcct,
 			GuestRatchetAcct:    guestRatchetAcct,
 			RoundNumber:         1,
+			Asset:               asset,
 		}
 		err = ch.HostAcct.SetAddress(hostAcctStr)
 		if err != nil {
@@ -1165,6 +1405,21 @@ func (g *Agent) DoCreateChannel(guestFedAddr string, hostAmount xlm.Amount) (*fs
 		if newBalance < 0 {
 			return errors.Wrap(errInsufficientBalance, w.NativeBalance.String())
 		}
+		if !ch.IsNative() {
+			assetStr := asset.String()
+			currBalance, ok := w.Balances[assetStr]
+			if !ok {
+				return errors.Wrap(errInvalidAsset, fmt.Sprintf("no trustline exists for asset %s, issuer %s", assetCode, issuer))
+			}
+			if !currBalance.Authorized {
+				return errors.Wrap(errInvalidAsset, fmt.Sprintf("unauthorized trustline for %s", assetStr))
+			}
+			if currBalance.Amount < uint64(hostAmount) {
+				return errors.Wrap(errInsufficientBalance, "asset amount for channel funding")
+			}
+			currBalance.Amount -= uint64(hostAmount)
+			w.Balances[assetStr] = currBalance
+		}
 		w.NativeBalance = newBalance
 		g.putChannel(root, channelID, ch)
 		root.Agent().PutWallet(w)
@@ -1174,6 +1429,8 @@ func (g *Agent) DoCreateChannel(guestFedAddr string, hostAmount xlm.Amount) (*fs
 				Name:      fsm.CreateChannel,
 				Amount:    ch.HostAmount,
 				Recipient: guestFedAddr,
+				AssetCode: assetCode,
+				Issuer:    issuer,
 			}
 			update.InputCommand = c
 			return updater.Cmd(c)
@@ -1197,7 +1454,7 @@ func (g *Agent) DoWalletPay(dest string, amount uint64, assetCode, issuer string
 		return errEmptyIssuer
 	}
 	return db.Update(g.db, func(root *db.Root) error {
-		if !root.Agent().Ready() {
+		if !root.Agent().Ready() || g.draining {
 			return errAgentClosing
 		}
 		var (
@@ -1245,7 +1502,7 @@ func (g *Agent) DoWalletPay(dest string, amount uint64, assetCode, issuer string
 				b.CreditAmount{
 					Code:   assetCode,
 					Issuer: issuer,
-					Amount: string(amount),
+					Amount: xlm.Amount(amount).HorizonString(),
 				},
 			)
 		} else {
@@ -1301,7 +1558,7 @@ func (g *Agent) DoWalletPay(dest string, amount uint64, assetCode, issuer string
 	})
 }
 
-func (g *Agent) addTxTask(tx *bolt.Tx, chanID string, e xdr.TransactionEnvelope) error {
+func (g *Agent) addTxTask(tx *kv.Tx, chanID string, e xdr.TransactionEnvelope) error {
 	t := &TbTx{
 		g:      g,
 		ChanID: chanID,
@@ -1352,6 +1609,29 @@ func (g *Agent) Messages(chanID string, a, b uint64) []*fsm.Message {
 	return msgs
 }
 
+// AckMessages discards the messages the agent has sent
+// on channel chanID that are numbered below n.
+// The counterparty acknowledges them
+// by requesting messages starting with n.
+func (g *Agent) AckMessages(chanID string, n uint64) error {
+	var acked bool
+	err := db.View(g.db, func(root *db.Root) error {
+		m := root.Agent().Messages().GetByString(chanID)
+		acked = len(m.Messages) > 0 && m.Messages[0].MsgNum < n
+		return nil
+	})
+	if err != nil || !acked {
+		return err
+	}
+	return db.Update(g.db, func(root *db.Root) error {
+		m := root.Agent().Messages().GetByString(chanID)
+		if m.Ack(n) {
+			root.Agent().Messages().PutByString(chanID, m)
+		}
+		return nil
+	})
+}
+
 // WaitMsg blocks until a message with number i is available for the
 // channel chanID
 func (g *Agent) WaitMsg(ctx context.Context, chanID string, i uint64) {
@@ -1366,8 +1646,8 @@ func (g *Agent) WaitMsg(ctx context.Context, chanID string, i uint64) {
 	}
 }
 
-func lastMsgNum(boltDB *bolt.DB, chanID string) (n uint64) {
-	err := db.View(boltDB, func(root *db.Root) error {
+func lastMsgNum(store *kv.DB, chanID string) (n uint64) {
+	err := db.View(store, func(root *db.Root) error {
 		if m := root.Agent().Messages().GetByString(chanID); m != nil {
 			n = m.LastSeqNum
 		}
@@ -1388,7 +1668,7 @@ func lastMsgNum(boltDB *bolt.DB, chanID string) (n uint64) {
 // state on merge success.
 func (g *Agent) DoCloseAccount(dest string) error {
 	return db.Update(g.db, func(root *db.Root) error {
-		if !root.Agent().Ready() {
+		if !root.Agent().Ready() || g.draining {
 			return errAgentClosing
 		}
 		var chanIDs []string
@@ -1439,8 +1719,15 @@ func (g *Agent) DoCommand(channelID string, c *fsm.Command) error {
 	if c.Name == "" {
 		return errNoCommandSpecified
 	}
+	if c.Name == fsm.ChannelPay && c.Amount > 0 && c.PaymentID == "" {
+		// Payments are identified in the channel's updates,
+		// whether made at once or batched into a later round.
+		var id [8]byte
+		randRead(id[:])
+		c.PaymentID = hex.EncodeToString(id[:])
+	}
 	return g.updateChannel(channelID, func(root *db.Root, updater *fsm.Updater, update *Update) error {
-		if !root.Agent().Ready() {
+		if !root.Agent().Ready() || g.draining {
 			return errAgentClosing
 		}
 		update.InputCommand = c
@@ -1448,7 +1735,7 @@ func (g *Agent) DoCommand(channelID string, c *fsm.Command) error {
 	})
 }
 
-func (g *Agent) scheduleTimer(tx *bolt.Tx, t time.Time, chanID string) {
+func (g *Agent) scheduleTimer(tx *kv.Tx, t time.Time, chanID string) {
 	tx.OnCommit(func() {
 		// TODO(bobg): this should be cancelable.
 		g.wclient.AfterFunc(t, func() {
@@ -1475,6 +1762,8 @@ func (g *Agent) PeerHandler() http.Handler {
 	g.once.Do(func() {
 		mux := new(http.ServeMux)
 		mux.HandleFunc("/starlight/message", g.handleMsg)
+		mux.HandleFunc("/starlight/routes", g.handleRoutes)
+		mux.HandleFunc("/starlight/route-hash", g.handleRouteHash)
 		mux.HandleFunc("/federation", g.handleFed)
 		mux.HandleFunc("/.well-known/stellar.toml", g.handleTOML)
 		g.handler = mux
@@ -1500,12 +1789,18 @@ func (g *Agent) handleMsg(w http.ResponseWriter, req *http.Request) {
 	)
 	if m.ChannelProposeMsg != nil {
 		propose := m.ChannelProposeMsg
-		chanID, err := g.checkChannelUnique(propose.HostAcct.Address(), propose.GuestAcct.Address())
+		err = g.resolveChannelCreateConflict(m.ChannelID, propose)
 		if err != nil {
-			err = g.resolveChannelCreateConflict(chanID, propose)
-			if err != nil {
-				WriteError(req, w, err)
-			}
+			WriteError(req, w, err)
+			return
+		}
+		counter, err := g.channelCounterProposal(m.ChannelID, propose)
+		if err != nil {
+			WriteError(req, w, err)
+			return
+		}
+		if counter != nil {
+			writeCounterProposal(req, w, counter)
 			return
 		}
 		err = escrowAcct.SetAddress(string(m.ChannelID))
@@ -1531,14 +1826,6 @@ func (g *Agent) handleMsg(w http.ResponseWriter, req *http.Request) {
 	}
 	err = g.updateChannel(m.ChannelID, func(root *db.Root, updater *fsm.Updater, update *Update) error {
 		if m.ChannelProposeMsg != nil {
-			maxRoundDur := time.Minute * time.Duration(root.Agent().Config().MaxRoundDurMins())
-			finalityDelay := time.Minute * time.Duration(root.Agent().Config().FinalityDelayMins())
-			if m.ChannelProposeMsg.MaxRoundDuration != maxRoundDur {
-				return errors.Wrapf(errBadRequest, "channel proposed with max round dur %s, want %s", m.ChannelProposeMsg.MaxRoundDuration, maxRoundDur)
-			}
-			if m.ChannelProposeMsg.FinalityDelay != finalityDelay {
-				return errors.Wrapf(errBadRequest, "channel proposed with finality delay %s, want %s", m.ChannelProposeMsg.FinalityDelay, finalityDelay)
-			}
 			if hostAccount != "" {
 				updater.C.CounterpartyAddress = hostAccount
 			} else {
@@ -1562,42 +1849,23 @@ func (g *Agent) handleMsg(w http.ResponseWriter, req *http.Request) {
 	return
 }
 
-func (g *Agent) resolveChannelCreateConflict(chanID []byte, propose *fsm.ChannelProposeMsg) error {
-	return db.Update(g.db, func(root *db.Root) error {
-		if !root.Agent().Ready() {
+// resolveChannelCreateConflict checks a proposal of channel chanID
+// against the agent's existing channels.
+// An agent can have any number of channels with the same counterparty,
+// in different assets or with different terms,
+// so only a channel with the proposed ID, that of its escrow account,
+// conflicts with the proposal. That is a repeat of a proposal
+// the agent has already accepted, and is rejected.
+func (g *Agent) resolveChannelCreateConflict(chanID string, propose *fsm.ChannelProposeMsg) error {
+	return db.View(g.db, func(root *db.Root) error {
+		if !root.Agent().Ready() || g.draining {
 			return errAgentClosing
 		}
-
-		var (
-			proposedHostAddr  = propose.HostAcct.Address()
-			proposedGuestAddr = propose.GuestAcct.Address()
-		)
-
-		chans := root.Agent().Channels()
-		c := chans.Get(chanID)
-		switch c.State {
-		case fsm.SettingUp:
-			return errors.Wrapf(errChannelExistsRetriable, "setting up: host %s, guest %s", proposedHostAddr, proposedGuestAddr)
-
-		case fsm.ChannelProposed:
-			if propose.HostAmount < c.HostAmount || (propose.HostAmount == c.HostAmount && proposedHostAddr < c.HostAcct.Address()) {
-				g.logf("channel proposal from %s takes precedence", proposedHostAddr)
-				return errors.Wrapf(errExists, "channel proposed: host %s, guest %s", proposedHostAddr, proposedGuestAddr)
-			}
-			g.logf("my channel proposal takes precedence over the one from %s", proposedHostAddr)
-			go g.DoCommand(string(chanID), &fsm.Command{
-				Name: "CleanUp",
-			})
-			return errors.Wrapf(errChannelExistsRetriable, "channel proposed: host %s, guest %s", proposedHostAddr, proposedGuestAddr)
-
-		case fsm.AwaitingCleanup:
-			// Channel in cleanup process: counterparty should retry until cleanup is complete
-			return errors.Wrapf(errChannelExistsRetriable, "awaiting cleanup: host %s, guest %s", proposedHostAddr, proposedGuestAddr)
-
-		default:
-			// Channel is already open or in some payment state: reject the proposed channel
-			return errors.Wrapf(errExists, "host %s, guest %s", proposedHostAddr, proposedGuestAddr)
+		c := g.getChannel(root, chanID)
+		if c.State == fsm.Start {
+			return nil
 		}
+		return errors.Wrapf(errExists, "%s in state %s: host %s, guest %s", chanID, c.State, propose.HostAcct.Address(), propose.GuestAcct.Address())
 	})
 }
 
@@ -2,6 +2,7 @@ package starlight
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"testing"
 	"time"
@@ -322,6 +323,8 @@ func TestAgentCreateChannel(t *testing.T) {
 		name       string
 		guestAddr  string
 		hostAmount xlm.Amount
+		assetCode  string
+		issuer     string
 		host       string
 		want       error
 		agentFunc  func(g *Agent)
@@ -382,6 +385,33 @@ func TestAgentCreateChannel(t *testing.T) {
 			},
 			want: errInsufficientBalance,
 		},
+		{
+			name:       "second channel with guest",
+			guestAddr:  successGuestAddr,
+			hostAmount: 1 * xlm.Lumen,
+			host:       successHostAddr,
+			agentFunc: func(g *Agent) {
+				g.DoCreateChannel(successGuestAddr, 1*xlm.Lumen, "", "")
+			},
+			want: nil,
+		},
+		{
+			name:       "issuer without asset code",
+			guestAddr:  successGuestAddr,
+			hostAmount: 1 * xlm.Lumen,
+			issuer:     "GDVIAIZXN2UQ6ZIW5VDQR7XZPAXBTXEETMAV3R676SE2KWO5LSHOEPST",
+			host:       successHostAddr,
+			want:       errEmptyAsset,
+		},
+		{
+			name:       "asset without trustline",
+			guestAddr:  successGuestAddr,
+			hostAmount: 1 * xlm.Lumen,
+			assetCode:  "USD",
+			issuer:     "GDVIAIZXN2UQ6ZIW5VDQR7XZPAXBTXEETMAV3R676SE2KWO5LSHOEPST",
+			host:       successHostAddr,
+			want:       errInvalidAsset,
+		},
 	}
 
 	for _, c := range cases {
@@ -413,7 +443,7 @@ func TestAgentCreateChannel(t *testing.T) {
 			if c.agentFunc != nil {
 				c.agentFunc(g)
 			}
-			_, got := g.DoCreateChannel(c.guestAddr, c.hostAmount)
+			_, got := g.DoCreateChannel(c.guestAddr, c.hostAmount, c.assetCode, c.issuer)
 			if errors.Root(got) != c.want {
 				t.Errorf("g.DoCreateChannel(%s, %s) = %s, want %s", c.guestAddr, c.hostAmount, got, c.want)
 			}
@@ -448,7 +478,7 @@ func TestShutdown(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	_, err = g.DoCreateChannel("alice*starlight.com", xlm.Lumen)
+	_, err = g.DoCreateChannel("alice*starlight.com", xlm.Lumen, "", "")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -471,3 +501,93 @@ func TestShutdown(t *testing.T) {
 		t.Error("timed out")
 	}
 }
+
+func TestDrain(t *testing.T) {
+	g, closer := startTestAgent(t)
+	defer closer()
+
+	err := g.ConfigInit(&Config{
+		Username:   "alice",
+		Password:   "password",
+		HorizonURL: testHorizonURL,
+	}, "starlight.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &fsm.Channel{ID: "chan", Role: fsm.Host, State: fsm.PaymentProposed}
+	putState := func(state fsm.State) {
+		err := db.Update(g.db, func(root *db.Root) error {
+			c.State = state
+			g.putChannel(root, c.ID, c)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	putState(fsm.PaymentProposed)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	err = g.Drain(ctx)
+	if errors.Root(err) != context.DeadlineExceeded {
+		t.Errorf("got error %v draining with round in flight, want %v", err, context.DeadlineExceeded)
+	}
+
+	err = g.AddAsset("USD", "GAIH3ULLFQ4DGSECF2AR555KZ4KNDGEKN4AFI4SU2M7B43MGK3QJZNSR")
+	if errors.Root(err) != errAgentClosing {
+		t.Errorf("got error %v from command while draining, want %v", err, errAgentClosing)
+	}
+
+	done := make(chan error)
+	go func() { done <- g.Drain(context.Background()) }()
+	putState(fsm.Open)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Error("timed out draining after round completed")
+	}
+}
+
+func TestResolveChannelCreateConflict(t *testing.T) {
+	g, closer := startTestAgent(t)
+	defer closer()
+	config := Config{
+		Username:   "alice",
+		Password:   "password",
+		HorizonURL: testHorizonURL,
+	}
+	err := g.ConfigInit(&config, "starlight.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(g.db, func(root *db.Root) error {
+		h := root.Agent().Wallet()
+		h.Seqnum = 1
+		h.NativeBalance = 50 * xlm.Lumen
+		root.Agent().PutWallet(h)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch, err := g.DoCreateChannel("bob*starlight.com", xlm.Lumen, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	propose := &fsm.ChannelProposeMsg{HostAcct: ch.HostAcct, GuestAcct: ch.GuestAcct}
+
+	// Only a proposal of an existing channel conflicts,
+	// not another channel between the same accounts.
+	err = g.resolveChannelCreateConflict(ch.ID, propose)
+	if errors.Root(err) != errExists {
+		t.Errorf("got error %v, want %v", err, errExists)
+	}
+	err = g.resolveChannelCreateConflict("another channel", propose)
+	if err != nil {
+		t.Errorf("got error %v, want nil", err)
+	}
+}
@@ -0,0 +1,133 @@
+package starlight
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"sort"
+	"strings"
+
+	"github.com/interstellar/starlight/errors"
+	"github.com/interstellar/starlight/starlight/db"
+	"github.com/interstellar/starlight/starlight/internal/apitoken"
+)
+
+// maxAPITokenNameLen is the maximum length of an API token name, in bytes.
+const maxAPITokenNameLen = 128
+
+// APIToken is an agent's record of an API token.
+type APIToken = apitoken.Token
+
+// Scope is the scope of an API token.
+type Scope = apitoken.Scope
+
+// API token scopes.
+const (
+	ScopeRead  = apitoken.Read
+	ScopePay   = apitoken.Pay
+	ScopeAdmin = apitoken.Admin
+)
+
+// CreateAPIToken creates a long-lived API token with the given
+// name and scope.
+// It returns the token's record and the token itself,
+// which the caller presents to authenticate.
+// The token cannot be recovered later: the agent stores only its hash.
+func (g *Agent) CreateAPIToken(name string, scope Scope) (*APIToken, string, error) {
+	if !scope.Valid() {
+		return nil, "", errors.Wrap(errInvalidScope, string(scope))
+	}
+	if len(name) > maxAPITokenNameLen {
+		return nil, "", errors.Wrapf(errInvalidInput, "name longer than %d bytes", maxAPITokenNameLen)
+	}
+	id := make([]byte, 8)
+	randRead(id)
+	secret := make([]byte, 32)
+	randRead(secret)
+	hash := sha256.Sum256(secret)
+	tok := &APIToken{
+		ID:      hex.EncodeToString(id),
+		Name:    name,
+		Scope:   scope,
+		Created: g.wclient.Now(),
+		Hash:    hash[:],
+	}
+	err := db.Update(g.db, func(root *db.Root) error {
+		if !g.isReadyConfigured(root) {
+			return errNotConfigured
+		}
+		root.Agent().APITokens().PutByString(tok.ID, tok)
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	g.logf("created API token %s (%s) with scope %s", tok.ID, name, scope)
+	tok.Hash = nil
+	return tok, tok.ID + "." + hex.EncodeToString(secret), nil
+}
+
+// APITokens returns the agent's unrevoked API tokens, oldest first.
+// The returned records do not include the tokens' hashes.
+func (g *Agent) APITokens() []*APIToken {
+	tokens := make([]*APIToken, 0) // we want json "[]" not "null"
+	db.View(g.db, func(root *db.Root) error {
+		bucket := root.Agent().APITokens().Bucket()
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(id, _ []byte) error {
+			tok := root.Agent().APITokens().Get(id)
+			tok.Hash = nil
+			tokens = append(tokens, tok)
+			return nil
+		})
+	})
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].Created.Before(tokens[j].Created)
+	})
+	return tokens
+}
+
+// RevokeAPIToken revokes the API token with the given ID.
+func (g *Agent) RevokeAPIToken(id string) error {
+	return db.Update(g.db, func(root *db.Root) error {
+		bucket := root.Agent().APITokens().Bucket()
+		if bucket == nil || bucket.Get([]byte(id)) == nil {
+			return errors.Wrap(errNoAPIToken, id)
+		}
+		g.logf("revoked API token %s", id)
+		return bucket.Delete([]byte(id))
+	})
+}
+
+// AuthenticateAPIToken checks the API token s.
+// It returns the token's scope and whether the token is valid.
+//
+// Unlike Authenticate, it does not enable private-key operations.
+func (g *Agent) AuthenticateAPIToken(s string) (Scope, bool) {
+	parts := strings.Split(s, ".")
+	if len(parts) != 2 {
+		return "", false
+	}
+	secret, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return "", false
+	}
+	var tok *APIToken
+	db.View(g.db, func(root *db.Root) error {
+		bucket := root.Agent().APITokens().Bucket()
+		if bucket != nil && bucket.Get([]byte(parts[0])) != nil {
+			tok = root.Agent().APITokens().GetByString(parts[0])
+		}
+		return nil
+	})
+	if tok == nil {
+		return "", false
+	}
+	hash := sha256.Sum256(secret)
+	if subtle.ConstantTimeCompare(hash[:], tok.Hash) != 1 {
+		return "", false
+	}
+	return tok.Scope, true
+}
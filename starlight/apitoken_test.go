@@ -0,0 +1,61 @@
+package starlight
+
+import (
+	"testing"
+
+	"github.com/interstellar/starlight/errors"
+)
+
+func TestAPITokens(t *testing.T) {
+	g, closer := startTestAgent(t)
+	defer closer()
+	err := g.ConfigInit(&Config{
+		Username:   "alice",
+		Password:   "password",
+		HorizonURL: testHorizonURL,
+	}, "starlight.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = g.CreateAPIToken("bad", "superuser")
+	if errors.Root(err) != errInvalidScope {
+		t.Errorf("got error %v, want %v", err, errInvalidScope)
+	}
+	tok, secret, err := g.CreateAPIToken("payments service", ScopePay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.Hash != nil {
+		t.Error("created token record includes hash")
+	}
+
+	scope, ok := g.AuthenticateAPIToken(secret)
+	if !ok || scope != ScopePay {
+		t.Errorf("AuthenticateAPIToken = %s, %v, want %s, true", scope, ok, ScopePay)
+	}
+	if !scope.Permits(ScopeRead) || scope.Permits(ScopeAdmin) {
+		t.Errorf("scope %s permits read %v, admin %v; want true, false", scope, scope.Permits(ScopeRead), scope.Permits(ScopeAdmin))
+	}
+	for _, bad := range []string{"", tok.ID, tok.ID + ".00", secret + "0", "nonexistent." + secret[len(tok.ID)+1:]} {
+		if _, ok := g.AuthenticateAPIToken(bad); ok {
+			t.Errorf("AuthenticateAPIToken(%q) succeeded", bad)
+		}
+	}
+
+	tokens := g.APITokens()
+	if len(tokens) != 1 || tokens[0].ID != tok.ID || tokens[0].Hash != nil {
+		t.Fatalf("got tokens %+v, want %s without hash", tokens, tok.ID)
+	}
+
+	err = g.RevokeAPIToken(tok.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := g.AuthenticateAPIToken(secret); ok {
+		t.Error("revoked token authenticated")
+	}
+	if err = g.RevokeAPIToken(tok.ID); errors.Root(err) != errNoAPIToken {
+		t.Errorf("got error %v revoking twice, want %v", err, errNoAPIToken)
+	}
+}
@@ -0,0 +1,221 @@
+package starlight
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/stellar/go/xdr"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/interstellar/starlight/errors"
+	"github.com/interstellar/starlight/starlight/db"
+	"github.com/interstellar/starlight/starlight/db/kv"
+	"github.com/interstellar/starlight/starlight/fsm"
+	"github.com/interstellar/starlight/worizon"
+)
+
+// backupMagic begins every backup,
+// followed by the snapshot sealed with sealBox.
+const backupMagic = "starlight backup 1\n"
+
+// Backup writes to w a snapshot of g's entire database,
+// encrypted with password, which must be the agent's password.
+// The snapshot includes the channels,
+// with their latest ratchet and settlement transactions,
+// the wallet, and the encrypted seed.
+// It is taken in a single read transaction,
+// so it is consistent even while channels are active.
+// See RestoreBackup.
+func (g *Agent) Backup(w io.Writer, password []byte) error {
+	var snapshot []byte
+	err := db.View(g.db, func(root *db.Root) error {
+		if !g.isReadyConfigured(root) {
+			return errNotConfigured
+		}
+		digest := root.Agent().Config().PwHash()
+		if bcrypt.CompareHashAndPassword(digest, password) != nil {
+			return errors.Wrap(ErrAuthFailed, "backup password")
+		}
+		var err error
+		snapshot, err = boltSnapshot(root.Tx())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, backupMagic)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(sealBox(snapshot, password))
+	return err
+}
+
+// boltSnapshot returns the contents of a bolt database file
+// holding a copy of everything in tx.
+// Backups are bolt files whatever the agent's storage,
+// so they can be restored into any storage.
+func boltSnapshot(tx *kv.Tx) ([]byte, error) {
+	f, err := ioutil.TempFile("", "starlight-backup")
+	if err != nil {
+		return nil, err
+	}
+	name := f.Name()
+	f.Close()
+	defer os.Remove(name)
+
+	boltDB, err := bolt.Open(name, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = kv.Bolt(boltDB).Update(func(dst *kv.Tx) error {
+		return kv.Copy(dst, tx)
+	})
+	if closeErr := boltDB.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(name)
+}
+
+// RestoreBackup decrypts the backup read from r with password
+// and copies the database it contains into dst,
+// which must be empty.
+// Start an agent on the restored database to resume its channels.
+//
+// First it checks each channel in the backup against the ledger,
+// using the Horizon server in the backup's configuration.
+// If a channel's escrow account shows a transaction
+// from a later round than the backup knows about,
+// the backup is too old to resume that channel safely,
+// and RestoreBackup returns an error naming the stale channels.
+// Transactions from the backup's own round or earlier,
+// including those that closed a channel,
+// are replayed when the agent starts.
+func RestoreBackup(dst *kv.DB, r io.Reader, password []byte) error {
+	return restoreBackup(dst, r, password, nil)
+}
+
+// restoreBackup is RestoreBackup, looking up escrow accounts
+// with wclient if it's not nil.
+func restoreBackup(dst *kv.DB, r io.Reader, password []byte, wclient *worizon.Client) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(b, []byte(backupMagic)) {
+		return errors.Wrap(errBadBackup, "missing header")
+	}
+	box := b[len(backupMagic):]
+	if len(box) < 48 {
+		return errors.Wrap(errBadBackup, "truncated")
+	}
+	snapshot := openBox(box, password)
+	if snapshot == nil {
+		return errBadBackup
+	}
+
+	f, err := ioutil.TempFile("", "starlight-restore")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	defer os.Remove(name)
+	_, err = f.Write(snapshot)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	boltDB, err := bolt.Open(name, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return errors.Wrap(errBadBackup, err.Error())
+	}
+	src := kv.Bolt(boltDB)
+	defer src.Close()
+
+	err = checkRestore(src, wclient)
+	if err != nil {
+		return err
+	}
+	return dst.Update(func(dtx *kv.Tx) error {
+		if k, _ := dtx.Cursor().First(); k != nil {
+			return errors.New("database to restore into is not empty")
+		}
+		return src.View(func(stx *kv.Tx) error {
+			return kv.Copy(dtx, stx)
+		})
+	})
+}
+
+// checkRestore checks the channels in the restored database
+// against the ledger.
+func checkRestore(restored *kv.DB, wclient *worizon.Client) error {
+	var chans []*fsm.Channel
+	err := db.View(restored, func(root *db.Root) error {
+		if root.Agent().Config().Username() == "" {
+			return errors.Wrap(errBadBackup, "agent not configured")
+		}
+		if wclient == nil {
+			wclient = new(worizon.Client)
+			wclient.SetURL(root.Agent().Config().HorizonURL())
+		}
+		bu := root.Agent().Channels().Bucket()
+		if bu == nil {
+			return nil
+		}
+		return bu.ForEach(func(k, _ []byte) error {
+			chans = append(chans, root.Agent().Channels().Get(k))
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	var stale []string
+	for _, c := range chans {
+		if c.BaseSequenceNumber == 0 {
+			continue // escrow account not yet created
+		}
+		seqnum, err := wclient.SequenceForAccount(c.EscrowAcct.Address())
+		if worizon.IsNotFound(err) {
+			continue // channel closed since the backup
+		} else if err != nil {
+			return errors.Wrapf(err, "checking escrow account of channel %s", c.ID)
+		}
+		if seqnum > maxEscrowSeqNum(c) {
+			stale = append(stale, c.ID)
+		}
+	}
+	if len(stale) > 0 {
+		return errors.Wrap(errStaleBackup, fmt.Sprintf("channels %s", strings.Join(stale, ", ")))
+	}
+	return nil
+}
+
+// maxEscrowSeqNum returns the highest sequence number
+// the escrow account of c can have on the ledger,
+// given the transactions c knows of.
+// The ratchet transaction of each round bumps the escrow account
+// to the round's base sequence number, plus one,
+// and the settlement and HTLC transactions
+// of the round use up to three more.
+// In a round in progress,
+// the counterparty may also hold the next round's transactions.
+func maxEscrowSeqNum(c *fsm.Channel) xdr.SequenceNumber {
+	round := c.RoundNumber
+	if inRound(c.State) {
+		round++
+	}
+	return c.BaseSequenceNumber + xdr.SequenceNumber(round*4+4)
+}
@@ -0,0 +1,125 @@
+package starlight
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	bolt "github.com/coreos/bbolt"
+	"github.com/stellar/go/xdr"
+
+	"github.com/interstellar/starlight/errors"
+	"github.com/interstellar/starlight/starlight/db"
+	"github.com/interstellar/starlight/starlight/db/kv"
+	"github.com/interstellar/starlight/starlight/fsm"
+	"github.com/interstellar/starlight/worizon"
+	"github.com/interstellar/starlight/worizon/worizontest"
+)
+
+// seqHorizon reports seqnum as the sequence number of every account.
+type seqHorizon struct {
+	worizontest.FakeHorizonClient
+	seqnum xdr.SequenceNumber
+}
+
+func (h *seqHorizon) SequenceForAccount(string) (xdr.SequenceNumber, error) {
+	return h.seqnum, nil
+}
+
+func TestBackupRestore(t *testing.T) {
+	g, closer := startTestAgent(t)
+	defer closer()
+	err := g.ConfigInit(&Config{
+		Username:   "alice",
+		Password:   "password",
+		HorizonURL: testHorizonURL,
+	}, "starlight.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const base = 100 << 32
+	c := &fsm.Channel{ID: "chan", State: fsm.Open, BaseSequenceNumber: base, RoundNumber: 3}
+	db.Update(g.db, func(root *db.Root) error {
+		g.putChannel(root, c.ID, c)
+		return nil
+	})
+
+	var backup bytes.Buffer
+	err = g.Backup(&backup, []byte("wrong"))
+	if errors.Root(err) != ErrAuthFailed {
+		t.Fatalf("got error %v backing up with wrong password, want %v", err, ErrAuthFailed)
+	}
+	err = g.Backup(&backup, []byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cases := []struct {
+		name     string
+		password string
+		seqnum   xdr.SequenceNumber
+		wantErr  error
+	}{
+		{"wrong password", "wrong", base, errBadBackup},
+		{"ledger ahead", "password", base + 3*4 + 5, errStaleBackup},
+		{"ok", "password", base + 3*4 + 1, nil},
+		{"exists", "password", base, nil},
+	}
+	boltDB, err := bolt.Open(filepath.Join(dir, "db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := kv.Bolt(boltDB)
+	defer restored.Close()
+	for _, tc := range cases {
+		wclient := worizon.NewClient(horizonHTTP{}, &seqHorizon{seqnum: tc.seqnum})
+		err := restoreBackup(restored, bytes.NewReader(backup.Bytes()), []byte(tc.password), wclient)
+		if tc.name == "exists" {
+			if err == nil {
+				t.Errorf("%s: restored over existing database", tc.name)
+			}
+			continue
+		}
+		if errors.Root(err) != tc.wantErr {
+			t.Errorf("%s: got error %v, want %v", tc.name, err, tc.wantErr)
+		}
+	}
+
+	db.View(restored, func(root *db.Root) error {
+		if got := root.Agent().Config().Username(); got != "alice" {
+			t.Errorf("restored username %q, want alice", got)
+		}
+		if got := root.Agent().Channels().Get([]byte("chan")); got.RoundNumber != 3 {
+			t.Errorf("restored channel round %d, want 3", got.RoundNumber)
+		}
+		return nil
+	})
+}
+
+func TestRestoreBadBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	boltDB, err := bolt.Open(filepath.Join(dir, "db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := kv.Bolt(boltDB)
+	defer dst.Close()
+	for _, b := range []string{"", "not a backup", backupMagic + "short"} {
+		err := RestoreBackup(dst, bytes.NewReader([]byte(b)), []byte("password"))
+		if errors.Root(err) != errBadBackup {
+			t.Errorf("restoring %q: got error %v, want %v", b, err, errBadBackup)
+		}
+	}
+}
@@ -1,7 +1,10 @@
 package starlight
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -10,6 +13,7 @@ import (
 	"time"
 
 	"github.com/stellar/go/clients/horizon"
+	"github.com/stellar/go/keypair"
 	"github.com/stellar/go/xdr"
 
 	"github.com/interstellar/starlight/errors"
@@ -17,6 +21,7 @@ import (
 	"github.com/interstellar/starlight/starlight/db"
 	"github.com/interstellar/starlight/starlight/fsm"
 	"github.com/interstellar/starlight/starlight/internal/update"
+	"github.com/interstellar/starlight/starlight/key"
 	"github.com/interstellar/starlight/worizon"
 	"github.com/interstellar/starlight/worizon/xlm"
 )
@@ -93,18 +98,21 @@ func (g *Agent) pollGuestMessages(ctx context.Context, chanID string) error {
 			return nil
 		}
 
-		body := fmt.Sprintf(`
-		{
-			"channel_id":"%s",
-			"From":%d
-		}`, chanID, from)
+		body, sig, err := g.signMessagesRequest(chanID, from)
+		if err != nil {
+			// In watchtower mode, this fails until the agent is unlocked.
+			g.debugf("signing messages request: %s", err)
+			g.sleep(time.Second)
+			continue
+		}
 		url := strings.TrimRight(remoteURL, "/") + "/api/messages"
-		req, err := http.NewRequest("POST", url, strings.NewReader(body))
+		req, err := http.NewRequest("POST", url, bytes.NewReader(body))
 		if err != nil {
 			g.debugf("unexpected error building request: %s", err)
 			continue
 		}
 		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(MessagesSigHeader, sig)
 		req = req.WithContext(ctx)
 		resp, err := g.httpclient.Do(req)
 		if err != nil {
@@ -135,6 +143,140 @@ func (g *Agent) pollGuestMessages(ctx context.Context, chanID string) error {
 	}
 }
 
+// MessagesSigHeader is the header carrying the host's signature
+// on the body of a request for a guest's messages.
+const MessagesSigHeader = "Starlight-Signature"
+
+// maxMessagesRequestAge is how far the time in a request
+// for a guest's messages may be from the guest's own time.
+const maxMessagesRequestAge = 2 * time.Minute
+
+// messagesRequest is the body of a request for a guest's messages.
+// Nonce is random, so that the guest can reject
+// a replay of a request it has answered.
+type messagesRequest struct {
+	ChannelID string `json:"channel_id"`
+	From      uint64
+	Time      time.Time
+	Nonce     string
+}
+
+// signMessagesRequest returns the body of a request for
+// the guest's messages on channel chanID, starting with from,
+// and the base64-encoded signature on it by the agent's primary key,
+// the key of the channel's HostAcct.
+func (g *Agent) signMessagesRequest(chanID string, from uint64) (body []byte, sig string, err error) {
+	var nonce [16]byte
+	randRead(nonce[:])
+	body, err = json.Marshal(&messagesRequest{
+		ChannelID: chanID,
+		From:      from,
+		Time:      g.wclient.Now(),
+		Nonce:     hex.EncodeToString(nonce[:]),
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	sig, err = g.signPrimary(body)
+	if err != nil {
+		return nil, "", err
+	}
+	return body, sig, nil
+}
+
+// signPrimary returns the base64-encoded signature on body
+// by the agent's primary key.
+func (g *Agent) signPrimary(body []byte) (string, error) {
+	var seed []byte
+	db.View(g.db, func(root *db.Root) error {
+		seed = g.seed
+		return nil
+	})
+	if seed == nil {
+		return "", errors.New("agent not authenticated")
+	}
+	b, err := key.DeriveAccountPrimary(seed).Sign(body)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// CheckMessagesRequest checks a request for the agent's messages,
+// with the given body and signature header,
+// as sent by the host of a channel on which the agent is guest.
+// The request must be signed by the channel's HostAcct,
+// made recently, and not seen before.
+// The agent remembers the nonces of recent requests only in memory,
+// so a request can be replayed to it
+// within maxMessagesRequestAge of a restart.
+// It returns the channel ID and the number of the first message
+// requested.
+func (g *Agent) CheckMessagesRequest(body []byte, sig string) (chanID string, from uint64, err error) {
+	var r messagesRequest
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return "", 0, errors.Sub(ErrUnmarshaling, err)
+	}
+	sigBytes, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		return "", 0, errors.Sub(ErrUnauthorized, err)
+	}
+	var hostAcct string
+	db.View(g.db, func(root *db.Root) error {
+		bucket := root.Agent().Channels().Bucket()
+		if bucket == nil || bucket.Get([]byte(r.ChannelID)) == nil {
+			return nil
+		}
+		if c := g.getChannel(root, r.ChannelID); c.Role == fsm.Guest {
+			hostAcct = c.HostAcct.Address()
+		}
+		return nil
+	})
+	if hostAcct == "" {
+		return "", 0, errors.Wrapf(ErrUnauthorized, "no channel %s with agent as guest", r.ChannelID)
+	}
+	kp, err := keypair.Parse(hostAcct)
+	if err != nil {
+		return "", 0, err
+	}
+	if kp.Verify(body, sigBytes) != nil {
+		return "", 0, errors.Wrap(ErrUnauthorized, "bad signature")
+	}
+	now := g.wclient.Now()
+	if d := now.Sub(r.Time); d > maxMessagesRequestAge || d < -maxMessagesRequestAge {
+		return "", 0, errors.Wrapf(ErrUnauthorized, "request time %s too far from now", r.Time)
+	}
+	if r.Nonce == "" {
+		return "", 0, errors.Wrap(ErrUnauthorized, "no nonce")
+	}
+	if !g.useMessagesNonce(r.Nonce, r.Time, now) {
+		return "", 0, errors.Wrap(ErrUnauthorized, "replayed request")
+	}
+	return r.ChannelID, r.From, nil
+}
+
+// useMessagesNonce records the nonce of a messages request made at t,
+// and reports whether it was new.
+// It forgets nonces of requests too old to pass CheckMessagesRequest.
+func (g *Agent) useMessagesNonce(nonce string, t, now time.Time) bool {
+	g.msgNoncesMu.Lock()
+	defer g.msgNoncesMu.Unlock()
+	for n, nt := range g.msgNonces {
+		if now.Sub(nt) > maxMessagesRequestAge {
+			delete(g.msgNonces, n)
+		}
+	}
+	if _, ok := g.msgNonces[nonce]; ok {
+		return false
+	}
+	if g.msgNonces == nil {
+		g.msgNonces = make(map[string]time.Time)
+	}
+	g.msgNonces[nonce] = t
+	return true
+}
+
 func (g *Agent) preupdateLookups(chanID string, tx *worizon.Tx) error {
 	var c *fsm.Channel
 	err := db.View(g.db, func(root *db.Root) error {
@@ -204,7 +346,21 @@ func (g *Agent) preupdateLookups(chanID string, tx *worizon.Tx) error {
 			if err != nil {
 				return err
 			}
-			if nativeBalance < c.HostAmount+3*xlm.Lumen/2+8*c.ChannelFeerate {
+			if !c.IsNative() {
+				var typ, code, issuer string
+				c.Asset.MustExtract(&typ, &code, &issuer)
+				assetBalance, err := xlm.Parse(escrowAcct.GetCreditBalance(code, issuer))
+				if err != nil {
+					return err
+				}
+				if assetBalance < c.HostAmount {
+					return g.closeAfterFunding(root, chanID)
+				}
+				// The escrow trustline adds to the minimum balance.
+				if nativeBalance < 2*xlm.Lumen+8*c.ChannelFeerate {
+					return g.closeAfterFunding(root, chanID)
+				}
+			} else if nativeBalance < c.HostAmount+3*xlm.Lumen/2+8*c.ChannelFeerate {
 				return g.closeAfterFunding(root, chanID)
 			}
 			g.putChannel(root, chanID, c)
@@ -275,6 +431,39 @@ func (g *Agent) putChannel(root *db.Root, chanID string, channel *fsm.Channel) {
 	root.Agent().Channels().Put([]byte(chanID), channel)
 }
 
+// Channels returns the agent's channels, ordered by ID.
+// Closed channels are not included.
+func (g *Agent) Channels() []*fsm.Channel {
+	channels := make([]*fsm.Channel, 0) // we want json "[]" not "null"
+	db.View(g.db, func(root *db.Root) error {
+		bucket := root.Agent().Channels().Bucket()
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(id, _ []byte) error {
+			channels = append(channels, root.Agent().Channels().Get(id))
+			return nil
+		})
+	})
+	return channels
+}
+
+// Channel returns the channel with the given ID.
+func (g *Agent) Channel(chanID string) (*fsm.Channel, error) {
+	var c *fsm.Channel
+	db.View(g.db, func(root *db.Root) error {
+		bucket := root.Agent().Channels().Bucket()
+		if bucket != nil && bucket.Get([]byte(chanID)) != nil {
+			c = g.getChannel(root, chanID)
+		}
+		return nil
+	})
+	if c == nil {
+		return nil, errors.Wrap(errNoChannel, chanID)
+	}
+	return c, nil
+}
+
 // Function startChannel schedules any timer,
 // and sets watchers for the channel.
 // Must be called from within an update transaction.
@@ -319,6 +508,11 @@ func (g *Agent) doUpdateChannel(root *db.Root, chanID string, f func(*db.Root, *
 	if c.TopUpAmount != 0 {
 		c.TopUpAmount = 0
 	}
+	c.SettledPayments = nil
+	c.ReceivedPayments = nil
+
+	prevHTLC, prevPendingHTLC := c.HTLC, c.PendingHTLC
+	prevState := c.State
 
 	o := new(outputter)
 	updater := &fsm.Updater{
@@ -338,6 +532,7 @@ func (g *Agent) doUpdateChannel(root *db.Root, chanID string, f func(*db.Root, *
 	if c.State == fsm.Start {
 		return nil // channel (still) does not exist; do not store it
 	}
+	g.metrics.observeTransition(root, chanID, prevState, c.State)
 
 	g.putChannel(root, chanID, c)
 
@@ -348,7 +543,7 @@ func (g *Agent) doUpdateChannel(root *db.Root, chanID string, f func(*db.Root, *
 	if c.State == fsm.Closed {
 		// other states
 		switch c.PrevState {
-		case fsm.AwaitingCleanup, fsm.AwaitingClose, fsm.AwaitingSettlement:
+		case fsm.AwaitingCleanup, fsm.AwaitingClose, fsm.AwaitingSettlement, fsm.AwaitingHTLC:
 		default:
 			g.putUpdate(root, &Update{
 				Type:    update.WarningType,
@@ -356,6 +551,12 @@ func (g *Agent) doUpdateChannel(root *db.Root, chanID string, f func(*db.Root, *
 				Channel: c,
 			})
 		}
+		if c.Role == fsm.Host && !c.IsNative() {
+			err = g.releaseEscrow(root, c)
+			if err != nil {
+				return err
+			}
+		}
 		// tear down channel
 		err = chans.Bucket().Delete([]byte(chanID))
 		if err != nil {
@@ -365,7 +566,7 @@ func (g *Agent) doUpdateChannel(root *db.Root, chanID string, f func(*db.Root, *
 			canceler()
 			delete(g.cancelers, string(chanID))
 		}
-		return nil
+		return g.updateRoutedPayment(root, c, prevHTLC, prevPendingHTLC)
 	}
 
 	// After saving the current state, start the channel, creating cancelers and starting the
@@ -402,7 +603,25 @@ func (g *Agent) doUpdateChannel(root *db.Root, chanID string, f func(*db.Root, *
 	if t != nil {
 		g.scheduleTimer(tx, *t, c.ID)
 	}
-	return nil
+	putChannelPayments(root, c)
+	g.updateInvoices(root, c)
+	return g.updateRoutedPayment(root, c, prevHTLC, prevPendingHTLC)
+}
+
+// releaseEscrow queues a task to merge the escrow account of c,
+// a closed non-native channel hosted by g, into the host's account,
+// paying it the escrow's entire balance of the asset.
+// The settlement and cooperative close txs leave the escrow account
+// to the host alone rather than merging it.
+// The task outlives c's record and retries until the release succeeds;
+// see TbEscrowRelease.
+// Must be called from within an update transaction.
+func (g *Agent) releaseEscrow(root *db.Root, c *fsm.Channel) error {
+	r := &TbEscrowRelease{
+		g:       g,
+		Channel: *c,
+	}
+	return g.tb.AddTx(root.Tx(), r)
 }
 
 // watchChannel sets a watcher for the escrow account,
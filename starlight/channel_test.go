@@ -0,0 +1,109 @@
+package starlight
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/interstellar/starlight/errors"
+	"github.com/interstellar/starlight/starlight/db"
+	"github.com/interstellar/starlight/starlight/fsm"
+	"github.com/interstellar/starlight/starlight/key"
+)
+
+func TestCheckMessagesRequest(t *testing.T) {
+	guest, closeGuest := startTestAgent(t)
+	defer closeGuest()
+	host, closeHost := startTestAgent(t)
+	defer closeHost()
+	other, closeOther := startTestAgent(t)
+	defer closeOther()
+
+	host.seed = make([]byte, 32)
+	other.seed = make([]byte, 32)
+	other.seed[0] = 1
+
+	c := &fsm.Channel{ID: "chan", Role: fsm.Guest, State: fsm.Open}
+	err := c.HostAcct.SetAddress(key.DeriveAccountPrimary(host.seed).Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Update(guest.db, func(root *db.Root) error {
+		guest.putChannel(root, c.ID, c)
+		return nil
+	})
+
+	body, sig, err := host.signMessagesRequest("chan", 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chanID, from, err := guest.CheckMessagesRequest(body, sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chanID != "chan" || from != 7 {
+		t.Errorf("got channel %s from %d, want chan from 7", chanID, from)
+	}
+	_, _, err = guest.CheckMessagesRequest(body, sig)
+	if errors.Root(err) != ErrUnauthorized {
+		t.Errorf("got error %v for replayed request, want %v", err, ErrUnauthorized)
+	}
+
+	cases := []struct {
+		name string
+		f    func() ([]byte, string, error)
+	}{{
+		name: "wrong key",
+		f:    func() ([]byte, string, error) { return other.signMessagesRequest("chan", 7) },
+	}, {
+		name: "unknown channel",
+		f:    func() ([]byte, string, error) { return host.signMessagesRequest("nonexistent", 7) },
+	}, {
+		name: "tampered body",
+		f: func() ([]byte, string, error) {
+			body, sig, err := host.signMessagesRequest("chan", 7)
+			return bytes.Replace(body, []byte(`"From":7`), []byte(`"From":1`), 1), sig, err
+		},
+	}, {
+		name: "no signature",
+		f: func() ([]byte, string, error) {
+			body, _, err := host.signMessagesRequest("chan", 7)
+			return body, "", err
+		},
+	}}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			body, sig, err := tc.f()
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _, err = guest.CheckMessagesRequest(body, sig)
+			if errors.Root(err) != ErrUnauthorized {
+				t.Errorf("got error %v, want %v", err, ErrUnauthorized)
+			}
+		})
+	}
+
+	now := guest.wclient.Now()
+	for name, r := range map[string]*messagesRequest{
+		"stale":    {ChannelID: "chan", From: 7, Time: now.Add(-time.Hour), Nonce: "1"},
+		"no nonce": {ChannelID: "chan", From: 7, Time: now},
+	} {
+		t.Run(name, func(t *testing.T) {
+			body, err := json.Marshal(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sig, err := key.DeriveAccountPrimary(host.seed).Sign(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _, err = guest.CheckMessagesRequest(body, base64.StdEncoding.EncodeToString(sig))
+			if errors.Root(err) != ErrUnauthorized {
+				t.Errorf("got error %v, want %v", err, ErrUnauthorized)
+			}
+		})
+	}
+}
@@ -7,9 +7,13 @@ import bytes "bytes"
 import encoding "encoding"
 import binary "encoding/binary"
 import json "encoding/json"
-import bolt "github.com/coreos/bbolt"
+import bolt "github.com/interstellar/starlight/starlight/db/kv"
 import fsm "github.com/interstellar/starlight/starlight/fsm"
+import apitoken "github.com/interstellar/starlight/starlight/internal/apitoken"
+import invoice "github.com/interstellar/starlight/starlight/internal/invoice"
 import message "github.com/interstellar/starlight/starlight/internal/message"
+import payment "github.com/interstellar/starlight/starlight/internal/payment"
+import route "github.com/interstellar/starlight/starlight/internal/route"
 import update "github.com/interstellar/starlight/starlight/internal/update"
 
 const _ = binary.MaxVarintLen16
@@ -62,6 +66,27 @@ func (o *Root) Tx() *bolt.Tx {
 	return o.db
 }
 
+// Meta is a bucket with a static set of elements.
+//
+// Meta is the db layout for facts about the database itself.
+//
+// Accessor methods read and write records
+// and open child buckets.
+type Meta struct {
+	db *bolt.Bucket
+}
+
+// Bucket returns o's underlying *bolt.Bucket object.
+// This can be useful to access low-level database functions
+// or other features not exposed by this generated code.
+//
+// Note, if o's transaction is read-only and the underlying
+// bucket has not previously been created in a writable
+// transaction, Bucket returns nil.
+func (o *Meta) Bucket() *bolt.Bucket {
+	return o.db
+}
+
 // Agent is a bucket with a static set of elements.
 //
 // Agent is the db layout for a Starlight agent.
@@ -116,6 +141,21 @@ func (o *Root) Agent() *Agent {
 	return &Agent{bucket(o.db, keyAgent)}
 }
 
+// Meta gets the child bucket with key "Meta" from o.
+//
+// Meta is kept apart from Agent
+// so that it survives deleting the agent.
+//
+// Meta creates a new bucket if none exists
+// and o's transaction is writable.
+// Regardless, it always returns a non-nil *Meta;
+// if the bucket doesn't exist
+// and o's transaction is read-only, the returned value
+// represents an empty bucket.
+func (o *Root) Meta() *Meta {
+	return &Meta{bucket(o.db, keyMeta)}
+}
+
 // Config gets the child bucket with key "Config" from o.
 //
 // Config creates a new bucket if none exists
@@ -167,6 +207,91 @@ func (o *Agent) Messages() *MapOfMessageMessage {
 	return &MapOfMessageMessage{bucket(o.db, keyMessages)}
 }
 
+// RoutedPayments gets the child bucket with key "RoutedPayments" from o.
+//
+// RoutedPayments holds the routed payments the agent has sent,
+// forwarded, or expects to receive, keyed by hex-encoded hash.
+//
+// RoutedPayments creates a new bucket if none exists
+// and o's transaction is writable.
+// Regardless, it always returns a non-nil *MapOfRoutePayment;
+// if the bucket doesn't exist
+// and o's transaction is read-only, the returned value
+// represents an empty bucket.
+func (o *Agent) RoutedPayments() *MapOfRoutePayment {
+	return &MapOfRoutePayment{bucket(o.db, keyRoutedPayments)}
+}
+
+// Invoices gets the child bucket with key "Invoices" from o.
+//
+// Invoices holds the invoices the agent has created, keyed by ID.
+//
+// Invoices creates a new bucket if none exists
+// and o's transaction is writable.
+// Regardless, it always returns a non-nil *MapOfInvoiceInvoice;
+// if the bucket doesn't exist
+// and o's transaction is read-only, the returned value
+// represents an empty bucket.
+func (o *Agent) Invoices() *MapOfInvoiceInvoice {
+	return &MapOfInvoiceInvoice{bucket(o.db, keyInvoices)}
+}
+
+// Payments gets the child bucket with key "Payments" from o.
+//
+// Payments holds the completed payments the agent has
+// sent or received, on channels or with its wallet account.
+//
+// Payments creates a new bucket if none exists
+// and o's transaction is writable.
+// Regardless, it always returns a non-nil *SeqOfPaymentPayment;
+// if the bucket doesn't exist
+// and o's transaction is read-only, the returned value
+// represents an empty bucket.
+func (o *Agent) Payments() *SeqOfPaymentPayment {
+	return &SeqOfPaymentPayment{bucket(o.db, keyPayments)}
+}
+
+// APITokens gets the child bucket with key "APITokens" from o.
+//
+// APITokens holds the agent's unrevoked API tokens, keyed by ID.
+//
+// APITokens creates a new bucket if none exists
+// and o's transaction is writable.
+// Regardless, it always returns a non-nil *MapOfApitokenToken;
+// if the bucket doesn't exist
+// and o's transaction is read-only, the returned value
+// represents an empty bucket.
+func (o *Agent) APITokens() *MapOfApitokenToken {
+	return &MapOfApitokenToken{bucket(o.db, keyAPITokens)}
+}
+
+// SchemaVersion reads the record stored under key "SchemaVersion".
+//
+// SchemaVersion is the number of migrations
+// applied to the database; see Migrate.
+// Databases from before versioning have none.
+//
+// If no record has been stored, SchemaVersion returns
+// the zero value.
+func (o *Meta) SchemaVersion() uint64 {
+	rec := get(o.db, keySchemaVersion)
+	if rec == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(rec)
+}
+
+// PutSchemaVersion stores v as a record under the key "SchemaVersion".
+//
+// SchemaVersion is the number of migrations
+// applied to the database; see Migrate.
+// Databases from before versioning have none.
+func (o *Meta) PutSchemaVersion(v uint64) {
+	rec := make([]byte, 8)
+	binary.BigEndian.PutUint64(rec, v)
+	put(o.db, keySchemaVersion, rec)
+}
+
 // Ready reads the record stored under key "Ready".
 //
 // Ready indicates whether or not the Agent is ready to accept
@@ -416,6 +541,134 @@ func (o *Config) PutHostFeerate(v int64) {
 	put(o.db, keyHostFeerate, rec)
 }
 
+// MinMaxRoundDurMins reads the record stored under key "MinMaxRoundDurMins".
+//
+// MinMaxRoundDurMins through MaxFinalityDelayMins bound the
+// timing parameters the agent accepts for a channel,
+// as guest or in a guest's counter-proposal.
+// Zero means the agent's own value.
+//
+// If no record has been stored, MinMaxRoundDurMins returns
+// the zero value.
+func (o *Config) MinMaxRoundDurMins() int64 {
+	rec := get(o.db, keyMinMaxRoundDurMins)
+	if rec == nil {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(rec))
+}
+
+// PutMinMaxRoundDurMins stores v as a record under the key "MinMaxRoundDurMins".
+//
+// MinMaxRoundDurMins through MaxFinalityDelayMins bound the
+// timing parameters the agent accepts for a channel,
+// as guest or in a guest's counter-proposal.
+// Zero means the agent's own value.
+func (o *Config) PutMinMaxRoundDurMins(v int64) {
+	rec := make([]byte, 8)
+	binary.BigEndian.PutUint64(rec, uint64(v))
+	put(o.db, keyMinMaxRoundDurMins, rec)
+}
+
+// MaxMaxRoundDurMins reads the record stored under key "MaxMaxRoundDurMins".
+// If no record has been stored, MaxMaxRoundDurMins returns
+// the zero value.
+func (o *Config) MaxMaxRoundDurMins() int64 {
+	rec := get(o.db, keyMaxMaxRoundDurMins)
+	if rec == nil {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(rec))
+}
+
+// PutMaxMaxRoundDurMins stores v as a record under the key "MaxMaxRoundDurMins".
+func (o *Config) PutMaxMaxRoundDurMins(v int64) {
+	rec := make([]byte, 8)
+	binary.BigEndian.PutUint64(rec, uint64(v))
+	put(o.db, keyMaxMaxRoundDurMins, rec)
+}
+
+// MinFinalityDelayMins reads the record stored under key "MinFinalityDelayMins".
+// If no record has been stored, MinFinalityDelayMins returns
+// the zero value.
+func (o *Config) MinFinalityDelayMins() int64 {
+	rec := get(o.db, keyMinFinalityDelayMins)
+	if rec == nil {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(rec))
+}
+
+// PutMinFinalityDelayMins stores v as a record under the key "MinFinalityDelayMins".
+func (o *Config) PutMinFinalityDelayMins(v int64) {
+	rec := make([]byte, 8)
+	binary.BigEndian.PutUint64(rec, uint64(v))
+	put(o.db, keyMinFinalityDelayMins, rec)
+}
+
+// MaxFinalityDelayMins reads the record stored under key "MaxFinalityDelayMins".
+// If no record has been stored, MaxFinalityDelayMins returns
+// the zero value.
+func (o *Config) MaxFinalityDelayMins() int64 {
+	rec := get(o.db, keyMaxFinalityDelayMins)
+	if rec == nil {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(rec))
+}
+
+// PutMaxFinalityDelayMins stores v as a record under the key "MaxFinalityDelayMins".
+func (o *Config) PutMaxFinalityDelayMins(v int64) {
+	rec := make([]byte, 8)
+	binary.BigEndian.PutUint64(rec, uint64(v))
+	put(o.db, keyMaxFinalityDelayMins, rec)
+}
+
+// ForwardFeeBase reads the record stored under key "ForwardFeeBase".
+//
+// ForwardFeeBase and ForwardFeeRate are the fee the agent
+// charges to forward a routed payment: a fixed amount in stroops
+// plus a rate in parts per million of the forwarded amount.
+//
+// If no record has been stored, ForwardFeeBase returns
+// the zero value.
+func (o *Config) ForwardFeeBase() int64 {
+	rec := get(o.db, keyForwardFeeBase)
+	if rec == nil {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(rec))
+}
+
+// PutForwardFeeBase stores v as a record under the key "ForwardFeeBase".
+//
+// ForwardFeeBase and ForwardFeeRate are the fee the agent
+// charges to forward a routed payment: a fixed amount in stroops
+// plus a rate in parts per million of the forwarded amount.
+func (o *Config) PutForwardFeeBase(v int64) {
+	rec := make([]byte, 8)
+	binary.BigEndian.PutUint64(rec, uint64(v))
+	put(o.db, keyForwardFeeBase, rec)
+}
+
+// ForwardFeeRate reads the record stored under key "ForwardFeeRate".
+// If no record has been stored, ForwardFeeRate returns
+// the zero value.
+func (o *Config) ForwardFeeRate() int64 {
+	rec := get(o.db, keyForwardFeeRate)
+	if rec == nil {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(rec))
+}
+
+// PutForwardFeeRate stores v as a record under the key "ForwardFeeRate".
+func (o *Config) PutForwardFeeRate(v int64) {
+	rec := make([]byte, 8)
+	binary.BigEndian.PutUint64(rec, uint64(v))
+	put(o.db, keyForwardFeeRate, rec)
+}
+
 // KeepAlive reads the record stored under key "KeepAlive".
 // If no record has been stored, KeepAlive returns
 // the zero value.
@@ -450,6 +703,60 @@ func (o *Config) PutPublic(v bool) {
 	put(o.db, keyPublic, rec)
 }
 
+// MapOfApitokenToken is a bucket with arbitrary keys,
+// holding records of type *apitoken.Token.
+type MapOfApitokenToken struct {
+	db *bolt.Bucket
+}
+
+// Bucket returns o's underlying *bolt.Bucket object.
+// This can be useful to access low-level database functions
+// or other features not exposed by this generated code.
+//
+// Note, if o's transaction is read-only and the underlying
+// bucket has not previously been created in a writable
+// transaction, Bucket returns nil.
+func (o *MapOfApitokenToken) Bucket() *bolt.Bucket {
+	return o.db
+}
+
+// Get reads the record stored in o under the given key.
+//
+// If no record has been stored, it returns
+// a pointer to
+// the zero value.
+func (o *MapOfApitokenToken) Get(key []byte) *apitoken.Token {
+	rec := get(o.db, key)
+	v := new(apitoken.Token)
+	if rec == nil {
+		return v
+	}
+	err := json.Unmarshal(rec, json.Unmarshaler(v))
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+// GetByString is equivalent to o.Get([]byte(key)).
+func (o *MapOfApitokenToken) GetByString(key string) *apitoken.Token {
+	return o.Get([]byte(key))
+}
+
+// Put stores v in o as a record under the given key.
+func (o *MapOfApitokenToken) Put(key []byte, v *apitoken.Token) {
+	rec, err := json.Marshal(json.Marshaler(v))
+	if err != nil {
+		panic(err)
+	}
+	put(o.db, key, rec)
+}
+
+// PutByString is equivalent to o.Put([]byte(key), v).
+func (o *MapOfApitokenToken) PutByString(key string, v *apitoken.Token) {
+	o.Put([]byte(key), v)
+}
+
 // MapOfFsmChannel is a bucket with arbitrary keys,
 // holding records of type *fsm.Channel.
 type MapOfFsmChannel struct {
@@ -504,6 +811,60 @@ func (o *MapOfFsmChannel) PutByString(key string, v *fsm.Channel) {
 	o.Put([]byte(key), v)
 }
 
+// MapOfInvoiceInvoice is a bucket with arbitrary keys,
+// holding records of type *invoice.Invoice.
+type MapOfInvoiceInvoice struct {
+	db *bolt.Bucket
+}
+
+// Bucket returns o's underlying *bolt.Bucket object.
+// This can be useful to access low-level database functions
+// or other features not exposed by this generated code.
+//
+// Note, if o's transaction is read-only and the underlying
+// bucket has not previously been created in a writable
+// transaction, Bucket returns nil.
+func (o *MapOfInvoiceInvoice) Bucket() *bolt.Bucket {
+	return o.db
+}
+
+// Get reads the record stored in o under the given key.
+//
+// If no record has been stored, it returns
+// a pointer to
+// the zero value.
+func (o *MapOfInvoiceInvoice) Get(key []byte) *invoice.Invoice {
+	rec := get(o.db, key)
+	v := new(invoice.Invoice)
+	if rec == nil {
+		return v
+	}
+	err := json.Unmarshal(rec, json.Unmarshaler(v))
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+// GetByString is equivalent to o.Get([]byte(key)).
+func (o *MapOfInvoiceInvoice) GetByString(key string) *invoice.Invoice {
+	return o.Get([]byte(key))
+}
+
+// Put stores v in o as a record under the given key.
+func (o *MapOfInvoiceInvoice) Put(key []byte, v *invoice.Invoice) {
+	rec, err := json.Marshal(json.Marshaler(v))
+	if err != nil {
+		panic(err)
+	}
+	put(o.db, key, rec)
+}
+
+// PutByString is equivalent to o.Put([]byte(key), v).
+func (o *MapOfInvoiceInvoice) PutByString(key string, v *invoice.Invoice) {
+	o.Put([]byte(key), v)
+}
+
 // MapOfMessageMessage is a bucket with arbitrary keys,
 // holding records of type *message.Message.
 type MapOfMessageMessage struct {
@@ -558,6 +919,122 @@ func (o *MapOfMessageMessage) PutByString(key string, v *message.Message) {
 	o.Put([]byte(key), v)
 }
 
+// MapOfRoutePayment is a bucket with arbitrary keys,
+// holding records of type *route.Payment.
+type MapOfRoutePayment struct {
+	db *bolt.Bucket
+}
+
+// Bucket returns o's underlying *bolt.Bucket object.
+// This can be useful to access low-level database functions
+// or other features not exposed by this generated code.
+//
+// Note, if o's transaction is read-only and the underlying
+// bucket has not previously been created in a writable
+// transaction, Bucket returns nil.
+func (o *MapOfRoutePayment) Bucket() *bolt.Bucket {
+	return o.db
+}
+
+// Get reads the record stored in o under the given key.
+//
+// If no record has been stored, it returns
+// a pointer to
+// the zero value.
+func (o *MapOfRoutePayment) Get(key []byte) *route.Payment {
+	rec := get(o.db, key)
+	v := new(route.Payment)
+	if rec == nil {
+		return v
+	}
+	err := json.Unmarshal(rec, json.Unmarshaler(v))
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+// GetByString is equivalent to o.Get([]byte(key)).
+func (o *MapOfRoutePayment) GetByString(key string) *route.Payment {
+	return o.Get([]byte(key))
+}
+
+// Put stores v in o as a record under the given key.
+func (o *MapOfRoutePayment) Put(key []byte, v *route.Payment) {
+	rec, err := json.Marshal(json.Marshaler(v))
+	if err != nil {
+		panic(err)
+	}
+	put(o.db, key, rec)
+}
+
+// PutByString is equivalent to o.Put([]byte(key), v).
+func (o *MapOfRoutePayment) PutByString(key string, v *route.Payment) {
+	o.Put([]byte(key), v)
+}
+
+// SeqOfPaymentPayment is a bucket with sequential numeric keys,
+// holding records of type *payment.Payment.
+type SeqOfPaymentPayment struct {
+	db *bolt.Bucket
+}
+
+// Bucket returns o's underlying *bolt.Bucket object.
+// This can be useful to access low-level database functions
+// or other features not exposed by this generated code.
+//
+// Note, if o's transaction is read-only and the underlying
+// bucket has not previously been created in a writable
+// transaction, Bucket returns nil.
+func (o *SeqOfPaymentPayment) Bucket() *bolt.Bucket {
+	return o.db
+}
+
+// Get reads the record stored in o under sequence number n.
+//
+// If no record has been stored, it returns
+// a pointer to
+// the zero value.
+func (o *SeqOfPaymentPayment) Get(n uint64) *payment.Payment {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, n)
+	rec := get(o.db, key)
+	v := new(payment.Payment)
+	if rec == nil {
+		return v
+	}
+	err := json.Unmarshal(rec, json.Unmarshaler(v))
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+// Add stores v in o under a new sequence number.
+// It writes the new sequence number to *np
+// before marshaling v. It is okay for
+// np to point to a field inside v, to store
+// the sequence number in the new record.
+func (o *SeqOfPaymentPayment) Add(v *payment.Payment, np *uint64) {
+	n, err := o.db.NextSequence()
+	if err != nil {
+		panic(err)
+	}
+	*np = n
+	o.Put(n, v)
+}
+
+// Put stores v in o as a record under sequence number n.
+func (o *SeqOfPaymentPayment) Put(n uint64, v *payment.Payment) {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, n)
+	rec, err := json.Marshal(json.Marshaler(v))
+	if err != nil {
+		panic(err)
+	}
+	put(o.db, key, rec)
+}
+
 // SeqOfUpdateUpdate is a bucket with sequential numeric keys,
 // holding records of type *update.Update.
 type SeqOfUpdateUpdate struct {
@@ -621,26 +1098,38 @@ func (o *SeqOfUpdateUpdate) Put(n uint64, v *update.Update) {
 }
 
 var (
-	keyAgent             = []byte("Agent")
-	keyChannelFeerate    = []byte("ChannelFeerate")
-	keyChannels          = []byte("Channels")
-	keyConfig            = []byte("Config")
-	keyEncryptedSeed     = []byte("EncryptedSeed")
-	keyFinalityDelayMins = []byte("FinalityDelayMins")
-	keyHorizonURL        = []byte("HorizonURL")
-	keyHostFeerate       = []byte("HostFeerate")
-	keyKeepAlive         = []byte("KeepAlive")
-	keyMaxRoundDurMins   = []byte("MaxRoundDurMins")
-	keyMessages          = []byte("Messages")
-	keyNextKeypathIndex  = []byte("NextKeypathIndex")
-	keyPrimaryAcct       = []byte("PrimaryAcct")
-	keyPublic            = []byte("Public")
-	keyPwHash            = []byte("PwHash")
-	keyPwType            = []byte("PwType")
-	keyReady             = []byte("Ready")
-	keyUpdates           = []byte("Updates")
-	keyUsername          = []byte("Username")
-	keyWallet            = []byte("Wallet")
+	keyAPITokens            = []byte("APITokens")
+	keyAgent                = []byte("Agent")
+	keyChannelFeerate       = []byte("ChannelFeerate")
+	keyChannels             = []byte("Channels")
+	keyConfig               = []byte("Config")
+	keyEncryptedSeed        = []byte("EncryptedSeed")
+	keyFinalityDelayMins    = []byte("FinalityDelayMins")
+	keyForwardFeeBase       = []byte("ForwardFeeBase")
+	keyForwardFeeRate       = []byte("ForwardFeeRate")
+	keyHorizonURL           = []byte("HorizonURL")
+	keyHostFeerate          = []byte("HostFeerate")
+	keyInvoices             = []byte("Invoices")
+	keyKeepAlive            = []byte("KeepAlive")
+	keyMaxFinalityDelayMins = []byte("MaxFinalityDelayMins")
+	keyMaxMaxRoundDurMins   = []byte("MaxMaxRoundDurMins")
+	keyMaxRoundDurMins      = []byte("MaxRoundDurMins")
+	keyMessages             = []byte("Messages")
+	keyMeta                 = []byte("Meta")
+	keyMinFinalityDelayMins = []byte("MinFinalityDelayMins")
+	keyMinMaxRoundDurMins   = []byte("MinMaxRoundDurMins")
+	keyNextKeypathIndex     = []byte("NextKeypathIndex")
+	keyPayments             = []byte("Payments")
+	keyPrimaryAcct          = []byte("PrimaryAcct")
+	keyPublic               = []byte("Public")
+	keyPwHash               = []byte("PwHash")
+	keyPwType               = []byte("PwType")
+	keyReady                = []byte("Ready")
+	keyRoutedPayments       = []byte("RoutedPayments")
+	keySchemaVersion        = []byte("SchemaVersion")
+	keyUpdates              = []byte("Updates")
+	keyUsername             = []byte("Username")
+	keyWallet               = []byte("Wallet")
 )
 
 type db interface {
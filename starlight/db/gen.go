@@ -1,3 +1,9 @@
 //go:generate genbolt -o db.go schema/schema.go
+//go:generate sed -i.orig -e s,github.com/coreos/bbolt,github.com/interstellar/starlight/starlight/db/kv, db.go
+//go:generate rm db.go.orig
+
+// The generated code is written against bolt's API.
+// It gets package kv in place of bolt,
+// so the database can be kept in any kv.Backend.
 
 package db
@@ -0,0 +1,211 @@
+package kv
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+
+	bolt "github.com/coreos/bbolt"
+)
+
+// Bolt returns a DB that keeps its data in db.
+// Closing it closes db.
+func Bolt(db *bolt.DB) *DB {
+	return New(&boltBackend{path: db.Path(), f: &boltFile{db: db}})
+}
+
+type boltBackend struct {
+	path string
+
+	mu sync.RWMutex // protects f, which Compact replaces
+	f  *boltFile
+}
+
+// boltFile is an open bolt file
+// and its transactions in progress.
+// Bolt unmaps the file when it's closed,
+// even under read-only transactions,
+// so Compact waits for them to end first.
+type boltFile struct {
+	db  *bolt.DB
+	txs sync.WaitGroup
+}
+
+func (b *boltBackend) current() *boltFile {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.f
+}
+
+func (b *boltBackend) Begin(writable bool) (Txn, error) {
+	for {
+		b.mu.RLock()
+		f := b.f
+		f.txs.Add(1)
+		b.mu.RUnlock()
+
+		tx, err := f.db.Begin(writable)
+		if b.current() == f {
+			if err != nil {
+				f.txs.Done()
+				return nil, err
+			}
+			return &boltTxn{tx: tx, f: f}, nil
+		}
+		// Compact replaced f while we waited;
+		// begin again in the new file.
+		if err == nil {
+			tx.Rollback()
+		}
+		f.txs.Done()
+	}
+}
+
+func (b *boltBackend) Close() error {
+	return b.current().db.Close()
+}
+
+// Compact rewrites the bolt file into a new one,
+// leaving out its free pages, and replaces the original.
+// Bolt reuses the pages freed by deleting records,
+// so deleting alone keeps the file from growing,
+// but only rewriting it makes the file smaller.
+//
+// It copies the data in a writable transaction,
+// so no change is lost.
+// Transactions that begin after it's done use the new file,
+// which bolt opens with its default options.
+// It returns once those already begun have ended
+// and it has closed the original.
+func (b *boltBackend) Compact() error {
+	old := b.current()
+	src, err := old.db.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer src.Rollback()
+
+	tmp := b.path + ".compact"
+	os.Remove(tmp)
+	dst, err := bolt.Open(tmp, 0600, nil)
+	if err != nil {
+		return err
+	}
+	err = Bolt(dst).Update(func(dtx *Tx) error {
+		return Copy(dtx, &Tx{txn: &boltTxn{tx: src}})
+	})
+	if err == nil {
+		err = os.Rename(tmp, b.path)
+	}
+	if err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	b.mu.Lock()
+	b.f = &boltFile{db: dst}
+	b.mu.Unlock()
+	src.Rollback()
+	old.txs.Wait()
+	err = old.db.Close()
+	if syncErr := syncDir(filepath.Dir(b.path)); err == nil {
+		err = syncErr
+	}
+	return err
+}
+
+// syncDir commits the entries of directory dir,
+// such as a renamed file, to stable storage.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// boltTxn is a transaction in f.
+// Compact copies from a boltTxn with no f.
+type boltTxn struct {
+	tx *bolt.Tx
+	f  *boltFile
+}
+
+func (t *boltTxn) Root() Node { return boltRoot{t.tx} }
+
+func (t *boltTxn) Commit() error {
+	defer t.end()
+	return t.tx.Commit()
+}
+
+func (t *boltTxn) Rollback() error {
+	defer t.end()
+	return t.tx.Rollback()
+}
+
+func (t *boltTxn) end() {
+	if t.f != nil {
+		t.f.txs.Done()
+		t.f = nil
+	}
+}
+
+// boltRoot is the root bucket of a bolt transaction,
+// which bolt exposes as methods of the transaction.
+type boltRoot struct {
+	tx *bolt.Tx
+}
+
+func (r boltRoot) Bucket(name []byte) Node {
+	if b := r.tx.Bucket(name); b != nil {
+		return boltBucket{b}
+	}
+	return nil
+}
+
+func (r boltRoot) CreateBucketIfNotExists(name []byte) (Node, error) {
+	b, err := r.tx.CreateBucketIfNotExists(name)
+	if err != nil {
+		return nil, err
+	}
+	return boltBucket{b}, nil
+}
+
+func (r boltRoot) DeleteBucket(name []byte) error { return r.tx.DeleteBucket(name) }
+func (r boltRoot) Cursor() Cursor                 { return r.tx.Cursor() }
+func (r boltRoot) Get([]byte) []byte              { return nil }
+func (r boltRoot) Put([]byte, []byte) error       { return ErrIncompatibleValue }
+func (r boltRoot) Delete([]byte) error            { return ErrIncompatibleValue }
+func (r boltRoot) NextSequence() (uint64, error)  { return 0, ErrIncompatibleValue }
+func (r boltRoot) Sequence() uint64               { return 0 }
+func (r boltRoot) SetSequence(uint64) error       { return ErrIncompatibleValue }
+
+type boltBucket struct {
+	b *bolt.Bucket
+}
+
+func (b boltBucket) Bucket(name []byte) Node {
+	if sub := b.b.Bucket(name); sub != nil {
+		return boltBucket{sub}
+	}
+	return nil
+}
+
+func (b boltBucket) CreateBucketIfNotExists(name []byte) (Node, error) {
+	sub, err := b.b.CreateBucketIfNotExists(name)
+	if err != nil {
+		return nil, err
+	}
+	return boltBucket{sub}, nil
+}
+
+func (b boltBucket) DeleteBucket(name []byte) error { return b.b.DeleteBucket(name) }
+func (b boltBucket) Cursor() Cursor                 { return b.b.Cursor() }
+func (b boltBucket) Get(key []byte) []byte          { return b.b.Get(key) }
+func (b boltBucket) Put(key, value []byte) error    { return b.b.Put(key, value) }
+func (b boltBucket) Delete(key []byte) error        { return b.b.Delete(key) }
+func (b boltBucket) NextSequence() (uint64, error)  { return b.b.NextSequence() }
+func (b boltBucket) Sequence() uint64               { return b.b.Sequence() }
+func (b boltBucket) SetSequence(v uint64) error     { return b.b.SetSequence(v) }
@@ -0,0 +1,385 @@
+// Package kv stores buckets of sorted keys and values,
+// which can hold other buckets, in transactions.
+// Its API is that of bolt (github.com/coreos/bbolt),
+// but the data can live in any Backend:
+// a bolt file (see Bolt) or PostgreSQL (see OpenPostgres).
+//
+// Package db's generated accessors use this package
+// in place of bolt; see db/gen.go.
+package kv
+
+import (
+	bolt "github.com/coreos/bbolt"
+
+	"github.com/interstellar/starlight/errors"
+)
+
+// MaxKeySize is the size, in bytes, of the longest key.
+const MaxKeySize = bolt.MaxKeySize
+
+// Errors returned by every Backend.
+// They are bolt's, so callers can treat them alike.
+var (
+	ErrBucketNotFound     = bolt.ErrBucketNotFound
+	ErrBucketNameRequired = bolt.ErrBucketNameRequired
+	ErrKeyRequired        = bolt.ErrKeyRequired
+	ErrKeyTooLarge        = bolt.ErrKeyTooLarge
+	ErrTxNotWritable      = bolt.ErrTxNotWritable
+	ErrIncompatibleValue  = bolt.ErrIncompatibleValue
+)
+
+// A Backend stores the data of a DB.
+type Backend interface {
+	// Begin starts a transaction.
+	// Like bolt, a Backend allows many read-only transactions
+	// and one writable transaction at a time;
+	// Begin(true) waits until the previous writable transaction ends.
+	// Read-only transactions see the data as of when they began.
+	Begin(writable bool) (Txn, error)
+
+	Close() error
+}
+
+// A Txn is a transaction in a Backend.
+type Txn interface {
+	// Root returns the root bucket.
+	// It holds only other buckets.
+	Root() Node
+
+	// Commit commits a writable transaction.
+	// It ends the transaction even if it fails.
+	Commit() error
+
+	// Rollback ends the transaction,
+	// discarding any changes.
+	Rollback() error
+}
+
+// A Node is a bucket in a Txn.
+// Its methods behave like those of *bolt.Bucket,
+// except that Bucket returns a nil Node
+// if there is no such bucket.
+// DB checks that the transaction is writable
+// and that keys and names are valid
+// before calling a Node's methods.
+type Node interface {
+	Bucket(name []byte) Node
+	CreateBucketIfNotExists(name []byte) (Node, error)
+	DeleteBucket(name []byte) error
+	Cursor() Cursor
+
+	Get(key []byte) []byte
+	Put(key, value []byte) error
+	Delete(key []byte) error
+
+	NextSequence() (uint64, error)
+	Sequence() uint64
+	SetSequence(v uint64) error
+}
+
+// A Cursor moves over the keys in a bucket in sorted order.
+// Like a *bolt.Cursor, it returns the names of the bucket's
+// child buckets as keys, with nil values.
+// Each method returns a nil key if there is no such item.
+type Cursor interface {
+	First() (key, value []byte)
+	Last() (key, value []byte)
+	Next() (key, value []byte)
+	Prev() (key, value []byte)
+	Seek(seek []byte) (key, value []byte)
+
+	// Delete deletes the record at the cursor.
+	// It returns ErrIncompatibleValue if that's a bucket.
+	Delete() error
+}
+
+// A Compacter is a Backend that can reclaim
+// the space freed by deleted records.
+type Compacter interface {
+	Compact() error
+}
+
+// DB is a database kept in a Backend.
+type DB struct {
+	b Backend
+}
+
+// New returns a DB that keeps its data in b.
+func New(b Backend) *DB {
+	return &DB{b: b}
+}
+
+// Close closes db's Backend.
+func (db *DB) Close() error {
+	return db.b.Close()
+}
+
+// Compact reclaims the space freed by deleted records
+// in db's Backend, if it's a Compacter;
+// otherwise it does nothing.
+// Read-only transactions carry on while it runs,
+// but the Backend may hold up writable ones.
+func (db *DB) Compact() error {
+	if c, ok := db.b.(Compacter); ok {
+		return c.Compact()
+	}
+	return nil
+}
+
+// View calls fn in a read-only transaction.
+// It returns the error returned by fn.
+func (db *DB) View(fn func(*Tx) error) error {
+	txn, err := db.b.Begin(false)
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
+	return fn(&Tx{txn: txn})
+}
+
+// Update calls fn in a writable transaction,
+// then commits it if fn returns nil,
+// or rolls it back if fn returns an error or panics.
+// It returns the error returned by fn,
+// or any error committing.
+func (db *DB) Update(fn func(*Tx) error) error {
+	txn, err := db.b.Begin(true)
+	if err != nil {
+		return err
+	}
+	tx := &Tx{txn: txn, writable: true}
+	done := false
+	defer func() {
+		if !done {
+			txn.Rollback()
+		}
+	}()
+	err = fn(tx)
+	if err != nil {
+		return err
+	}
+	done = true
+	err = txn.Commit()
+	if err != nil {
+		return err
+	}
+	for _, f := range tx.onCommit {
+		f()
+	}
+	return nil
+}
+
+// Tx is a transaction in a DB.
+type Tx struct {
+	txn      Txn
+	writable bool
+	onCommit []func()
+}
+
+// Writable reports whether tx can write.
+func (tx *Tx) Writable() bool {
+	return tx.writable
+}
+
+// OnCommit arranges for fn to be called
+// after tx commits successfully.
+func (tx *Tx) OnCommit(fn func()) {
+	tx.onCommit = append(tx.onCommit, fn)
+}
+
+func (tx *Tx) root() *Bucket {
+	return &Bucket{tx: tx, n: tx.txn.Root()}
+}
+
+// Bucket returns the top-level bucket with the given name,
+// or nil if there is none.
+func (tx *Tx) Bucket(name []byte) *Bucket {
+	return tx.root().Bucket(name)
+}
+
+// CreateBucketIfNotExists returns the top-level bucket
+// with the given name, creating it if necessary.
+func (tx *Tx) CreateBucketIfNotExists(name []byte) (*Bucket, error) {
+	return tx.root().CreateBucketIfNotExists(name)
+}
+
+// DeleteBucket deletes the top-level bucket with the given name,
+// and everything in it.
+func (tx *Tx) DeleteBucket(name []byte) error {
+	return tx.root().DeleteBucket(name)
+}
+
+// Cursor returns a cursor over the names of the top-level buckets.
+func (tx *Tx) Cursor() Cursor {
+	return tx.root().Cursor()
+}
+
+// ForEach calls fn for each top-level bucket,
+// stopping at the first error.
+func (tx *Tx) ForEach(fn func(name []byte, b *Bucket) error) error {
+	return tx.root().ForEach(func(name, _ []byte) error {
+		return fn(name, tx.Bucket(name))
+	})
+}
+
+// Bucket is a bucket in a transaction.
+type Bucket struct {
+	tx *Tx
+	n  Node
+}
+
+// Tx returns b's transaction.
+func (b *Bucket) Tx() *Tx {
+	return b.tx
+}
+
+// Writable reports whether b's transaction can write.
+func (b *Bucket) Writable() bool {
+	return b.tx.writable
+}
+
+// Bucket returns the child bucket with the given name,
+// or nil if there is none.
+func (b *Bucket) Bucket(name []byte) *Bucket {
+	n := b.n.Bucket(name)
+	if n == nil {
+		return nil
+	}
+	return &Bucket{tx: b.tx, n: n}
+}
+
+// CreateBucketIfNotExists returns the child bucket
+// with the given name, creating it if necessary.
+func (b *Bucket) CreateBucketIfNotExists(name []byte) (*Bucket, error) {
+	if !b.tx.writable {
+		return nil, ErrTxNotWritable
+	}
+	if len(name) == 0 {
+		return nil, ErrBucketNameRequired
+	}
+	if len(name) > MaxKeySize {
+		return nil, ErrKeyTooLarge
+	}
+	n, err := b.n.CreateBucketIfNotExists(name)
+	if err != nil {
+		return nil, err
+	}
+	return &Bucket{tx: b.tx, n: n}, nil
+}
+
+// DeleteBucket deletes the child bucket with the given name,
+// and everything in it.
+func (b *Bucket) DeleteBucket(name []byte) error {
+	if !b.tx.writable {
+		return ErrTxNotWritable
+	}
+	return b.n.DeleteBucket(name)
+}
+
+// Cursor returns a cursor over b's keys.
+func (b *Bucket) Cursor() Cursor {
+	return b.n.Cursor()
+}
+
+// ForEach calls fn for each key in b, in order,
+// with a nil value for each child bucket.
+// It stops at the first error.
+// Fn must not change b.
+func (b *Bucket) ForEach(fn func(k, v []byte) error) error {
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		err := fn(k, v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get returns the value stored under key,
+// or nil if there is none, or if key names a child bucket.
+func (b *Bucket) Get(key []byte) []byte {
+	return b.n.Get(key)
+}
+
+// Put stores value under key.
+func (b *Bucket) Put(key, value []byte) error {
+	if !b.tx.writable {
+		return ErrTxNotWritable
+	}
+	if len(key) == 0 {
+		return ErrKeyRequired
+	}
+	if len(key) > MaxKeySize {
+		return ErrKeyTooLarge
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	return b.n.Put(key, value)
+}
+
+// Delete deletes the value stored under key, if any.
+func (b *Bucket) Delete(key []byte) error {
+	if !b.tx.writable {
+		return ErrTxNotWritable
+	}
+	return b.n.Delete(key)
+}
+
+// NextSequence increments b's sequence number
+// and returns the new value.
+func (b *Bucket) NextSequence() (uint64, error) {
+	if !b.tx.writable {
+		return 0, ErrTxNotWritable
+	}
+	return b.n.NextSequence()
+}
+
+// Sequence returns b's sequence number.
+func (b *Bucket) Sequence() uint64 {
+	return b.n.Sequence()
+}
+
+// SetSequence sets b's sequence number.
+func (b *Bucket) SetSequence(v uint64) error {
+	if !b.tx.writable {
+		return ErrTxNotWritable
+	}
+	return b.n.SetSequence(v)
+}
+
+// Copy copies every top-level bucket in src,
+// with everything in it, including sequence numbers,
+// into dst, which must not already have buckets
+// of the same names.
+// The transactions may be in DBs with different Backends.
+func Copy(dst, src *Tx) error {
+	return src.ForEach(func(name []byte, b *Bucket) error {
+		if dst.Bucket(name) != nil {
+			return errors.Wrapf(ErrIncompatibleValue, "bucket %q exists", name)
+		}
+		nb, err := dst.CreateBucketIfNotExists(name)
+		if err != nil {
+			return err
+		}
+		return copyBucket(nb, b)
+	})
+}
+
+func copyBucket(dst, src *Bucket) error {
+	err := dst.SetSequence(src.Sequence())
+	if err != nil {
+		return err
+	}
+	return src.ForEach(func(k, v []byte) error {
+		if v != nil {
+			return dst.Put(k, v)
+		}
+		sub, err := dst.CreateBucketIfNotExists(k)
+		if err != nil {
+			return err
+		}
+		return copyBucket(sub, src.Bucket(k))
+	})
+}
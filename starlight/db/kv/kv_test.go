@@ -0,0 +1,391 @@
+package kv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	bolt "github.com/coreos/bbolt"
+
+	"github.com/interstellar/starlight/errors"
+)
+
+// testBolt returns a DB in a new bolt file,
+// and a function to close and remove it.
+func testBolt(t *testing.T) (*DB, func()) {
+	f, err := ioutil.TempFile("", "kv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	boltDB, err := bolt.Open(f.Name(), 0600, nil)
+	if err != nil {
+		os.Remove(f.Name())
+		t.Fatal(err)
+	}
+	db := Bolt(boltDB)
+	return db, func() {
+		db.Close()
+		os.Remove(f.Name())
+	}
+}
+
+func TestBolt(t *testing.T) {
+	db, closer := testBolt(t)
+	defer closer()
+	testBackend(t, db)
+}
+
+func TestBoltCompact(t *testing.T) {
+	db, closer := testBolt(t)
+	defer closer()
+	path := db.b.(*boltBackend).path
+
+	value := bytes.Repeat([]byte("x"), 1000)
+	key := func(n uint64) []byte {
+		k := make([]byte, 8)
+		binary.BigEndian.PutUint64(k, n)
+		return k
+	}
+	err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("Updates"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 1000; i++ {
+			n, _ := b.NextSequence()
+			err = b.Put(key(n), value)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Delete all but the last record, as pruning might.
+	err = db.Update(func(tx *Tx) error {
+		b := tx.Bucket([]byte("Updates"))
+		for n := uint64(1); n < 1000; n++ {
+			err := b.Delete(key(n))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A read-only transaction begun before compacting
+	// still works after.
+	rtx := make(chan *Tx)
+	done := make(chan error)
+	go func() {
+		done <- db.View(func(tx *Tx) error {
+			rtx <- tx
+			<-rtx
+			if tx.Bucket([]byte("Updates")).Get(key(1000)) == nil {
+				return errors.New("last record missing in old transaction")
+			}
+			return nil
+		})
+	}()
+	<-rtx
+	compacted := make(chan error)
+	go func() {
+		compacted <- db.Compact()
+	}()
+	rtx <- nil
+	if err = <-done; err != nil {
+		t.Error(err)
+	}
+	if err = <-compacted; err != nil {
+		t.Fatal(err)
+	}
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Size() >= before.Size() {
+		t.Errorf("compacted size %d, want less than %d", after.Size(), before.Size())
+	}
+
+	err = db.Update(func(tx *Tx) error {
+		b := tx.Bucket([]byte("Updates"))
+		if seq := b.Sequence(); seq != 1000 {
+			t.Errorf("got sequence %d, want 1000", seq)
+		}
+		if !bytes.Equal(b.Get(key(1000)), value) {
+			t.Error("last record missing after compaction")
+		}
+		return b.Put(key(1001), value)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Writes after compacting land in the file at path.
+	db.Close()
+	boltDB, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db = Bolt(boltDB)
+	err = db.View(func(tx *Tx) error {
+		if tx.Bucket([]byte("Updates")).Get(key(1001)) == nil {
+			t.Error("record written after compaction missing")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testBackend checks that db behaves like bolt.
+// It must be empty.
+func testBackend(t *testing.T, db *DB) {
+	var committed bool
+	err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("a"))
+		if err != nil {
+			return err
+		}
+		for _, k := range []string{"k2", "k1"} {
+			err = b.Put([]byte(k), []byte("v"+k[1:]))
+			if err != nil {
+				return err
+			}
+		}
+		err = b.Put([]byte("k3"), []byte{})
+		if err != nil {
+			return err
+		}
+		sub, err := b.CreateBucketIfNotExists([]byte("sub"))
+		if err != nil {
+			return err
+		}
+		err = sub.Put([]byte("x"), []byte("y"))
+		if err != nil {
+			return err
+		}
+		for i := uint64(1); i <= 2; i++ {
+			n, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			if n != i {
+				t.Errorf("NextSequence = %d, want %d", n, i)
+			}
+		}
+		tx.OnCommit(func() { committed = true })
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !committed {
+		t.Error("OnCommit function not called")
+	}
+
+	db.View(func(tx *Tx) error {
+		b := tx.Bucket([]byte("a"))
+		if b == nil {
+			t.Fatal("bucket a not found")
+		}
+		if got := b.Get([]byte("k1")); string(got) != "v1" {
+			t.Errorf("Get(k1) = %q, want v1", got)
+		}
+		if got := b.Get([]byte("k3")); got == nil || len(got) != 0 {
+			t.Errorf("Get(k3) = %#v, want empty", got)
+		}
+		for _, k := range []string{"missing", "sub"} {
+			if got := b.Get([]byte(k)); got != nil {
+				t.Errorf("Get(%s) = %q, want nil", k, got)
+			}
+		}
+		if got := b.Sequence(); got != 2 {
+			t.Errorf("Sequence = %d, want 2", got)
+		}
+		if got := string(b.Bucket([]byte("sub")).Get([]byte("x"))); got != "y" {
+			t.Errorf("sub Get(x) = %q, want y", got)
+		}
+		if tx.Bucket([]byte("missing")) != nil {
+			t.Error("found missing bucket")
+		}
+		if err := b.Put([]byte("k4"), nil); err != ErrTxNotWritable {
+			t.Errorf("Put in View: got error %v, want %v", err, ErrTxNotWritable)
+		}
+
+		var keys []string
+		var values [][]byte
+		b.ForEach(func(k, v []byte) error {
+			keys = append(keys, string(k))
+			values = append(values, v)
+			return nil
+		})
+		if want := []string{"k1", "k2", "k3", "sub"}; !reflect.DeepEqual(keys, want) {
+			t.Errorf("ForEach keys %v, want %v", keys, want)
+		}
+		if values[3] != nil {
+			t.Errorf("ForEach value of bucket = %q, want nil", values[3])
+		}
+
+		c := b.Cursor()
+		moves := []struct {
+			name string
+			move func() ([]byte, []byte)
+			want string
+		}{
+			{"Seek(k2)", func() ([]byte, []byte) { return c.Seek([]byte("k2")) }, "k2"},
+			{"Next", c.Next, "k3"},
+			{"Last", c.Last, "sub"},
+			{"Prev", c.Prev, "k3"},
+			{"Seek(k0)", func() ([]byte, []byte) { return c.Seek([]byte("k0")) }, "k1"},
+			{"Prev", c.Prev, ""},
+			{"Seek(z)", func() ([]byte, []byte) { return c.Seek([]byte("z")) }, ""},
+			{"First", c.First, "k1"},
+		}
+		for _, m := range moves {
+			if k, _ := m.move(); string(k) != m.want {
+				t.Errorf("%s = %q, want %q", m.name, k, m.want)
+			}
+		}
+
+		var names []string
+		tx.ForEach(func(name []byte, b *Bucket) error {
+			names = append(names, string(name))
+			return nil
+		})
+		if !reflect.DeepEqual(names, []string{"a"}) {
+			t.Errorf("top-level buckets %v, want [a]", names)
+		}
+		return nil
+	})
+
+	// A failed Update rolls back, and doesn't call OnCommit.
+	committed = false
+	fail := errors.New("fail")
+	err = db.Update(func(tx *Tx) error {
+		tx.OnCommit(func() { committed = true })
+		tx.Bucket([]byte("a")).Put([]byte("k1"), []byte("changed"))
+		return fail
+	})
+	if err != fail {
+		t.Errorf("got error %v, want %v", err, fail)
+	}
+	func() {
+		defer func() { recover() }()
+		db.Update(func(tx *Tx) error {
+			tx.Bucket([]byte("a")).Put([]byte("k2"), []byte("changed"))
+			panic("fail")
+		})
+	}()
+	if committed {
+		t.Error("OnCommit function called after failure")
+	}
+	db.View(func(tx *Tx) error {
+		b := tx.Bucket([]byte("a"))
+		if got := b.Get([]byte("k1")); string(got) != "v1" {
+			t.Errorf("after rollback, Get(k1) = %q, want v1", got)
+		}
+		if got := b.Get([]byte("k2")); string(got) != "v2" {
+			t.Errorf("after panic, Get(k2) = %q, want v2", got)
+		}
+		return nil
+	})
+
+	// Deleting with a cursor while scanning a large bucket.
+	const n = 250
+	err = db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("big"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			err := b.Put([]byte(fmt.Sprintf("%04d", i)), []byte{byte(i)})
+			if err != nil {
+				return err
+			}
+		}
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if v[0]%2 == 0 {
+				err := c.Delete()
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.View(func(tx *Tx) error {
+		var count int
+		tx.Bucket([]byte("big")).ForEach(func(k, v []byte) error {
+			if v[0]%2 == 0 {
+				t.Errorf("key %s not deleted", k)
+			}
+			count++
+			return nil
+		})
+		if count != n/2 {
+			t.Errorf("%d keys left, want %d", count, n/2)
+		}
+		return nil
+	})
+
+	// Copy, then delete.
+	dst, closer := testBolt(t)
+	defer closer()
+	err = dst.Update(func(dtx *Tx) error {
+		return db.View(func(stx *Tx) error {
+			return Copy(dtx, stx)
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *Tx) error {
+		err := tx.DeleteBucket([]byte("a"))
+		if err != nil {
+			return err
+		}
+		if tx.Bucket([]byte("a")) != nil {
+			t.Error("found deleted bucket")
+		}
+		if err := tx.DeleteBucket([]byte("a")); err != ErrBucketNotFound {
+			t.Errorf("deleting missing bucket: got error %v, want %v", err, ErrBucketNotFound)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst.View(func(tx *Tx) error {
+		b := tx.Bucket([]byte("a"))
+		if b == nil {
+			t.Fatal("bucket a not copied")
+		}
+		if got := b.Sequence(); got != 2 {
+			t.Errorf("copied Sequence = %d, want 2", got)
+		}
+		if got := b.Bucket([]byte("sub")).Get([]byte("x")); !bytes.Equal(got, []byte("y")) {
+			t.Errorf("copied sub Get(x) = %q, want y", got)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,491 @@
+package kv
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+
+	_ "github.com/lib/pq" // PostgreSQL driver
+
+	"github.com/interstellar/starlight/errors"
+)
+
+// pgSchema creates the tables holding every DB
+// in a PostgreSQL database.
+// Each bucket is a row in starlight_buckets,
+// and each record is a row in starlight_records.
+// A DB's root bucket has no parent,
+// and the DB's name as its name.
+//
+// Records of a DB can be queried directly;
+// most are JSON, readable with convert_from(value, 'UTF8').
+const pgSchema = `
+CREATE TABLE IF NOT EXISTS starlight_buckets (
+	id       bigserial PRIMARY KEY,
+	parent   bigint REFERENCES starlight_buckets ON DELETE CASCADE,
+	name     bytea NOT NULL,
+	sequence bigint NOT NULL DEFAULT 0,
+	UNIQUE (parent, name)
+);
+CREATE UNIQUE INDEX IF NOT EXISTS starlight_roots
+	ON starlight_buckets (name) WHERE parent IS NULL;
+CREATE TABLE IF NOT EXISTS starlight_records (
+	bucket bigint NOT NULL REFERENCES starlight_buckets ON DELETE CASCADE,
+	key    bytea NOT NULL,
+	value  bytea NOT NULL,
+	PRIMARY KEY (bucket, key)
+);
+`
+
+// pgItems selects the items of a bucket for a cursor:
+// its records, and its child buckets, with NULL values.
+// It takes the comparison of keys with the bound
+// and the sort order as format arguments.
+const pgItems = `
+SELECT key, value, false FROM starlight_records WHERE bucket = $1 AND key %[1]s $2
+UNION ALL
+SELECT name, NULL, true FROM starlight_buckets WHERE parent = $1 AND name %[1]s $2
+ORDER BY 1 %[2]s LIMIT $3
+`
+
+// pgReadAhead is how many items a cursor reads at once
+// when moving forward.
+const pgReadAhead = 100
+
+// OpenPostgres returns a DB that keeps its data
+// in the PostgreSQL database at url, under name.
+// It creates the tables it needs if they don't exist.
+// Many DBs, with different names, can share a database.
+//
+// As bolt locks its file, OpenPostgres takes an advisory lock
+// on the DB, held until it's closed,
+// so only one process at a time can open a DB with a given name.
+//
+// Unlike bolt, the DB doesn't stop a record and a child bucket
+// of the same bucket from having the same key.
+func OpenPostgres(url, name string) (*DB, error) {
+	sqlDB, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, err
+	}
+	b, err := openPostgres(sqlDB, name)
+	if err != nil {
+		sqlDB.Close()
+		return nil, err
+	}
+	return New(b), nil
+}
+
+func openPostgres(sqlDB *sql.DB, name string) (*pgBackend, error) {
+	ctx := context.Background()
+	_, err := sqlDB.ExecContext(ctx, pgSchema)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating tables")
+	}
+	const q = `
+		INSERT INTO starlight_buckets (name) VALUES ($1)
+		ON CONFLICT (name) WHERE parent IS NULL DO NOTHING
+	`
+	_, err = sqlDB.ExecContext(ctx, q, []byte(name))
+	if err != nil {
+		return nil, errors.Wrap(err, "creating root bucket")
+	}
+	b := &pgBackend{db: sqlDB}
+	const rootq = `SELECT id FROM starlight_buckets WHERE parent IS NULL AND name = $1`
+	err = sqlDB.QueryRowContext(ctx, rootq, []byte(name)).Scan(&b.root)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading root bucket")
+	}
+
+	b.lock, err = sqlDB.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var ok bool
+	err = b.lock.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, b.root).Scan(&ok)
+	if err == nil && !ok {
+		err = fmt.Errorf("database %s is open in another process", name)
+	}
+	if err != nil {
+		b.lock.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+type pgBackend struct {
+	db   *sql.DB
+	lock *sql.Conn // holds the advisory lock on root
+	root int64
+
+	mu sync.Mutex // held by the writable transaction
+}
+
+func (b *pgBackend) Begin(writable bool) (Txn, error) {
+	if writable {
+		b.mu.Lock()
+	}
+	tx, err := b.db.BeginTx(context.Background(), &sql.TxOptions{
+		Isolation: sql.LevelRepeatableRead,
+		ReadOnly:  !writable,
+	})
+	if err != nil {
+		if writable {
+			b.mu.Unlock()
+		}
+		return nil, err
+	}
+	t := &pgTxn{
+		b:        b,
+		tx:       tx,
+		writable: writable,
+		buckets:  make(map[pgBucketKey]int64),
+	}
+	return t, nil
+}
+
+func (b *pgBackend) Close() error {
+	_, err := b.lock.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, b.root)
+	b.lock.Close()
+	if closeErr := b.db.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Compact vacuums the tables holding every DB,
+// so that PostgreSQL reuses the space of deleted records
+// and returns any at the tables' ends to the operating system.
+// Shrinking the tables further takes VACUUM FULL,
+// which locks out every DB sharing them,
+// so it's left to the database's administrator.
+func (b *pgBackend) Compact() error {
+	for _, table := range []string{"starlight_records", "starlight_buckets"} {
+		_, err := b.db.ExecContext(context.Background(), "VACUUM "+table)
+		if err != nil {
+			return errors.Wrapf(err, "vacuuming %s", table)
+		}
+	}
+	return nil
+}
+
+type pgTxn struct {
+	b        *pgBackend
+	tx       *sql.Tx
+	writable bool
+	done     bool
+
+	// buckets caches the IDs of the buckets
+	// the transaction has looked up.
+	buckets map[pgBucketKey]int64
+
+	// gen counts writes in the transaction,
+	// so that cursors know when items they've read ahead
+	// may be out of date.
+	gen uint64
+}
+
+type pgBucketKey struct {
+	parent int64
+	name   string
+}
+
+func (t *pgTxn) Root() Node {
+	return &pgNode{t: t, id: t.b.root}
+}
+
+func (t *pgTxn) Commit() error {
+	defer t.end()
+	return t.tx.Commit()
+}
+
+func (t *pgTxn) Rollback() error {
+	defer t.end()
+	return t.tx.Rollback()
+}
+
+func (t *pgTxn) end() {
+	if !t.done && t.writable {
+		t.b.mu.Unlock()
+	}
+	t.done = true
+}
+
+// changed records a write in t.
+func (t *pgTxn) changed() {
+	t.gen++
+}
+
+// pgNode is a bucket in a pgTxn.
+// Like the accessors generated for package db,
+// its methods that can't return an error
+// panic if PostgreSQL fails.
+type pgNode struct {
+	t  *pgTxn
+	id int64
+}
+
+func (n *pgNode) Bucket(name []byte) Node {
+	k := pgBucketKey{n.id, string(name)}
+	id, ok := n.t.buckets[k]
+	if !ok {
+		const q = `SELECT id FROM starlight_buckets WHERE parent = $1 AND name = $2`
+		err := n.t.tx.QueryRow(q, n.id, name).Scan(&id)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			panic(errors.Wrap(err, "reading bucket"))
+		}
+		n.t.buckets[k] = id
+	}
+	return &pgNode{t: n.t, id: id}
+}
+
+func (n *pgNode) CreateBucketIfNotExists(name []byte) (Node, error) {
+	if b := n.Bucket(name); b != nil {
+		return b, nil
+	}
+	var id int64
+	const q = `INSERT INTO starlight_buckets (parent, name) VALUES ($1, $2) RETURNING id`
+	err := n.t.tx.QueryRow(q, n.id, name).Scan(&id)
+	if err != nil {
+		return nil, err
+	}
+	n.t.changed()
+	n.t.buckets[pgBucketKey{n.id, string(name)}] = id
+	return &pgNode{t: n.t, id: id}, nil
+}
+
+func (n *pgNode) DeleteBucket(name []byte) error {
+	const q = `DELETE FROM starlight_buckets WHERE parent = $1 AND name = $2`
+	res, err := n.t.tx.Exec(q, n.id, name)
+	if err != nil {
+		return err
+	}
+	if k, err := res.RowsAffected(); err == nil && k == 0 {
+		return ErrBucketNotFound
+	}
+	n.t.changed()
+	// The cascade deleted the bucket's descendants too;
+	// forget all cached IDs rather than find theirs.
+	n.t.buckets = make(map[pgBucketKey]int64)
+	return nil
+}
+
+func (n *pgNode) Cursor() Cursor {
+	return &pgCursor{n: n}
+}
+
+func (n *pgNode) Get(key []byte) []byte {
+	var v []byte
+	const q = `SELECT value FROM starlight_records WHERE bucket = $1 AND key = $2`
+	err := n.t.tx.QueryRow(q, n.id, key).Scan(&v)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		panic(errors.Wrap(err, "reading record"))
+	}
+	if v == nil {
+		v = []byte{}
+	}
+	return v
+}
+
+func (n *pgNode) Put(key, value []byte) error {
+	const q = `
+		INSERT INTO starlight_records (bucket, key, value) VALUES ($1, $2, $3)
+		ON CONFLICT (bucket, key) DO UPDATE SET value = excluded.value
+	`
+	_, err := n.t.tx.Exec(q, n.id, key, value)
+	if err != nil {
+		return err
+	}
+	n.t.changed()
+	return nil
+}
+
+func (n *pgNode) Delete(key []byte) error {
+	const q = `DELETE FROM starlight_records WHERE bucket = $1 AND key = $2`
+	_, err := n.t.tx.Exec(q, n.id, key)
+	if err != nil {
+		return err
+	}
+	n.t.changed()
+	return nil
+}
+
+func (n *pgNode) NextSequence() (uint64, error) {
+	var v int64
+	const q = `UPDATE starlight_buckets SET sequence = sequence + 1 WHERE id = $1 RETURNING sequence`
+	err := n.t.tx.QueryRow(q, n.id).Scan(&v)
+	if err != nil {
+		return 0, err
+	}
+	n.t.changed()
+	return uint64(v), nil
+}
+
+func (n *pgNode) Sequence() uint64 {
+	var v int64
+	const q = `SELECT sequence FROM starlight_buckets WHERE id = $1`
+	err := n.t.tx.QueryRow(q, n.id).Scan(&v)
+	if err != nil {
+		panic(errors.Wrap(err, "reading sequence"))
+	}
+	return uint64(v)
+}
+
+func (n *pgNode) SetSequence(v uint64) error {
+	const q = `UPDATE starlight_buckets SET sequence = $2 WHERE id = $1`
+	_, err := n.t.tx.Exec(q, n.id, int64(v))
+	if err != nil {
+		return err
+	}
+	n.t.changed()
+	return nil
+}
+
+// items returns up to limit items of n, in the given order,
+// whose keys compare with bound by op.
+func (n *pgNode) items(op, order string, bound []byte, limit int) []pgItem {
+	rows, err := n.t.tx.Query(fmt.Sprintf(pgItems, op, order), n.id, bound, limit)
+	if err != nil {
+		panic(errors.Wrap(err, "reading bucket"))
+	}
+	defer rows.Close()
+	var items []pgItem
+	for rows.Next() {
+		var (
+			it       pgItem
+			isBucket bool
+		)
+		err := rows.Scan(&it.key, &it.value, &isBucket)
+		if err != nil {
+			panic(errors.Wrap(err, "reading bucket"))
+		}
+		if isBucket {
+			it.value = nil
+		} else if it.value == nil {
+			it.value = []byte{}
+		}
+		items = append(items, it)
+	}
+	if err := rows.Err(); err != nil {
+		panic(errors.Wrap(err, "reading bucket"))
+	}
+	return items
+}
+
+type pgItem struct {
+	key, value []byte
+}
+
+// pgCursor is a cursor over a pgNode.
+// Moving forward, it reads items ahead,
+// so a scan of a bucket takes one query per pgReadAhead items.
+type pgCursor struct {
+	n   *pgNode
+	key []byte // key of the current item, nil if none
+
+	ahead []pgItem // items after key
+	end   bool     // ahead runs to the end of the bucket
+	gen   uint64   // the transaction's gen when ahead was read
+}
+
+func (c *pgCursor) First() ([]byte, []byte) {
+	return c.readAhead(">=", []byte{})
+}
+
+func (c *pgCursor) Seek(seek []byte) ([]byte, []byte) {
+	if seek == nil {
+		seek = []byte{}
+	}
+	return c.readAhead(">=", seek)
+}
+
+func (c *pgCursor) Next() ([]byte, []byte) {
+	if c.key == nil {
+		return nil, nil
+	}
+	if c.gen == c.n.t.gen {
+		if len(c.ahead) > 0 {
+			it := c.ahead[0]
+			c.ahead = c.ahead[1:]
+			c.key = it.key
+			return it.key, it.value
+		}
+		if c.end {
+			c.key = nil
+			return nil, nil
+		}
+	}
+	return c.readAhead(">", c.key)
+}
+
+func (c *pgCursor) Last() ([]byte, []byte) {
+	return c.move(">=", "DESC", []byte{})
+}
+
+func (c *pgCursor) Prev() ([]byte, []byte) {
+	if c.key == nil {
+		return nil, nil
+	}
+	return c.move("<", "DESC", c.key)
+}
+
+func (c *pgCursor) Delete() error {
+	if !c.n.t.writable {
+		return ErrTxNotWritable
+	}
+	if c.key == nil {
+		return nil
+	}
+	const q = `DELETE FROM starlight_records WHERE bucket = $1 AND key = $2`
+	res, err := c.n.t.tx.Exec(q, c.n.id, c.key)
+	if err != nil {
+		return err
+	}
+	if k, err := res.RowsAffected(); err == nil && k == 0 {
+		return ErrIncompatibleValue
+	}
+	// Deleting the current item leaves the items ahead valid.
+	fresh := c.gen == c.n.t.gen
+	c.n.t.changed()
+	if fresh {
+		c.gen = c.n.t.gen
+	}
+	return nil
+}
+
+// readAhead moves c to the first item whose key compares
+// with bound by op, and reads the items after it.
+func (c *pgCursor) readAhead(op string, bound []byte) ([]byte, []byte) {
+	items := c.n.items(op, "ASC", bound, pgReadAhead)
+	c.gen = c.n.t.gen
+	c.end = len(items) < pgReadAhead
+	c.ahead = nil
+	if len(items) == 0 {
+		c.key = nil
+		return nil, nil
+	}
+	c.key = items[0].key
+	c.ahead = items[1:]
+	return items[0].key, items[0].value
+}
+
+// move moves c to the first item, in the given order,
+// whose key compares with bound by op.
+func (c *pgCursor) move(op, order string, bound []byte) ([]byte, []byte) {
+	items := c.n.items(op, order, bound, 1)
+	c.ahead = nil
+	c.end = false
+	if len(items) == 0 {
+		c.key = nil
+		return nil, nil
+	}
+	c.key = items[0].key
+	return items[0].key, items[0].value
+}
@@ -0,0 +1,35 @@
+package kv
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestPostgres runs against the PostgreSQL database
+// at the URL in env var STARLIGHT_TEST_POSTGRES, if it's set.
+func TestPostgres(t *testing.T) {
+	url := os.Getenv("STARLIGHT_TEST_POSTGRES")
+	if url == "" {
+		t.Skip("STARLIGHT_TEST_POSTGRES not set")
+	}
+	name := fmt.Sprintf("test-%d", time.Now().UnixNano())
+	db, err := OpenPostgres(url, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := db.b.(*pgBackend)
+	defer func() {
+		b.db.Exec(`DELETE FROM starlight_buckets WHERE id = $1`, b.root)
+		db.Close()
+	}()
+
+	if _, err := OpenPostgres(url, name); err == nil {
+		t.Error("opened the same DB twice")
+	}
+	testBackend(t, db)
+	if err := db.Compact(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,60 @@
+package db
+
+import "github.com/interstellar/starlight/errors"
+
+// ErrNewerSchema means the database was written
+// by a newer version of this program.
+var ErrNewerSchema = errors.New("database schema is newer than this program supports")
+
+// migrations holds the functions that bring a database
+// from each schema version to the next,
+// in order: migrations[i] takes version i to version i+1.
+// Append to it whenever a change to schema/schema.go,
+// or to the JSON encoding of a type stored in the database,
+// needs existing records rewritten;
+// never change or remove an entry once released.
+//
+// A migration must work on an empty database too,
+// since a new database starts at version 0.
+var migrations = []func(*Root) error{
+	// Version 1 is the layout when versioning began.
+	func(*Root) error { return nil },
+}
+
+// SchemaVersion is the schema version of databases
+// written by this program.
+func SchemaVersion() uint64 {
+	return uint64(len(migrations))
+}
+
+// Migrate runs, in order, each migration newer than
+// the schema version recorded in root,
+// then records the current version.
+// It returns ErrNewerSchema if root's version
+// is newer than SchemaVersion.
+// Must be called from within an update transaction,
+// so that an error rolls back any migrations already run.
+func Migrate(root *Root) error {
+	return migrate(root, migrations)
+}
+
+func migrate(root *Root, migrations []func(*Root) error) error {
+	v := root.Meta().SchemaVersion()
+	if v > uint64(len(migrations)) {
+		return errors.Wrapf(ErrNewerSchema, "database version %d, want at most %d", v, len(migrations))
+	}
+	for ; v < uint64(len(migrations)); v++ {
+		err := migrations[v](root)
+		if err != nil {
+			return errors.Wrapf(err, "migrating database to version %d", v+1)
+		}
+		root.Meta().PutSchemaVersion(v + 1)
+	}
+	return nil
+}
+
+// DeleteAgent wipes an agent from the database by deleting its bucket.
+// The database's schema version remains.
+func (r *Root) DeleteAgent() {
+	r.db.DeleteBucket(keyAgent)
+}
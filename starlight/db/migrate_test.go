@@ -0,0 +1,107 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	bolt "github.com/coreos/bbolt"
+
+	"github.com/interstellar/starlight/errors"
+	"github.com/interstellar/starlight/starlight/db/kv"
+)
+
+func TestMigrate(t *testing.T) {
+	f, err := ioutil.TempFile("", "migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	boltDB, err := bolt.Open(f.Name(), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := kv.Bolt(boltDB)
+	defer db.Close()
+
+	var ran []int
+	step := func(i int) func(*Root) error {
+		return func(root *Root) error {
+			ran = append(ran, i)
+			root.Agent().PutNextKeypathIndex(uint32(i))
+			return nil
+		}
+	}
+	fail := func(*Root) error { return errors.New("fail") }
+
+	cases := []struct {
+		name       string
+		migrations []func(*Root) error
+		wantRan    []int
+		wantErr    bool
+		wantVers   uint64
+	}{
+		{"new", []func(*Root) error{step(1), step(2)}, []int{1, 2}, false, 2},
+		{"current", []func(*Root) error{step(1), step(2)}, nil, false, 2},
+		{"older", []func(*Root) error{step(1), step(2), step(3)}, []int{3}, false, 3},
+		{"failed", []func(*Root) error{step(1), step(2), step(3), step(4), fail}, []int{4}, true, 3},
+		{"newer", []func(*Root) error{step(1)}, nil, true, 3},
+	}
+	for _, tc := range cases {
+		ran = nil
+		err := Update(db, func(root *Root) error {
+			return migrate(root, tc.migrations)
+		})
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: got error %v, want error %v", tc.name, err, tc.wantErr)
+		}
+		if tc.name == "newer" && errors.Root(err) != ErrNewerSchema {
+			t.Errorf("%s: got error %v, want %v", tc.name, err, ErrNewerSchema)
+		}
+		if !reflect.DeepEqual(ran, tc.wantRan) {
+			t.Errorf("%s: ran migrations %v, want %v", tc.name, ran, tc.wantRan)
+		}
+		View(db, func(root *Root) error {
+			if got := root.Meta().SchemaVersion(); got != tc.wantVers {
+				t.Errorf("%s: version %d, want %d", tc.name, got, tc.wantVers)
+			}
+			if got := root.Agent().NextKeypathIndex(); got != uint32(tc.wantVers) {
+				t.Errorf("%s: migrated data %d, want %d", tc.name, got, tc.wantVers)
+			}
+			return nil
+		})
+	}
+}
+
+func TestDeleteAgentKeepsVersion(t *testing.T) {
+	f, err := ioutil.TempFile("", "migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	boltDB, err := bolt.Open(f.Name(), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := kv.Bolt(boltDB)
+	defer db.Close()
+
+	Update(db, func(root *Root) error {
+		Migrate(root)
+		root.Agent().PutNextKeypathIndex(5)
+		root.DeleteAgent()
+		return nil
+	})
+	View(db, func(root *Root) error {
+		if got := root.Meta().SchemaVersion(); got != SchemaVersion() {
+			t.Errorf("version %d after DeleteAgent, want %d", got, SchemaVersion())
+		}
+		if got := root.Agent().NextKeypathIndex(); got != 0 {
+			t.Errorf("next keypath index %d after DeleteAgent, want 0", got)
+		}
+		return nil
+	})
+}
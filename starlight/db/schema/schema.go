@@ -5,14 +5,22 @@ import (
 	"encoding/json"
 
 	"github.com/interstellar/starlight/starlight/fsm"
+	"github.com/interstellar/starlight/starlight/internal/apitoken"
+	"github.com/interstellar/starlight/starlight/internal/invoice"
 	"github.com/interstellar/starlight/starlight/internal/message"
+	"github.com/interstellar/starlight/starlight/internal/payment"
+	"github.com/interstellar/starlight/starlight/internal/route"
 	"github.com/interstellar/starlight/starlight/internal/update"
 )
 
 var (
+	_ json.Marshaler = (*apitoken.Token)(nil)
 	_ json.Marshaler = (*fsm.Channel)(nil)
 	_ json.Marshaler = (*fsm.WalletAcct)(nil)
+	_ json.Marshaler = (*invoice.Invoice)(nil)
 	_ json.Marshaler = (*message.Message)(nil)
+	_ json.Marshaler = (*payment.Payment)(nil)
+	_ json.Marshaler = (*route.Payment)(nil)
 	_ json.Marshaler = (*update.Update)(nil)
 
 	_ encoding.BinaryMarshaler = (*fsm.AccountID)(nil)
@@ -21,6 +29,18 @@ var (
 // Root is the type of the root bucket, as required by genbolt.
 type Root struct {
 	Agent *Agent
+
+	// Meta is kept apart from Agent
+	// so that it survives deleting the agent.
+	Meta *Meta
+}
+
+// Meta is the db layout for facts about the database itself.
+type Meta struct {
+	// SchemaVersion is the number of migrations
+	// applied to the database; see Migrate.
+	// Databases from before versioning have none.
+	SchemaVersion uint64
 }
 
 // Agent is the db layout for a Starlight agent.
@@ -39,6 +59,20 @@ type Agent struct {
 
 	Messages map[string]*message.Message
 
+	// RoutedPayments holds the routed payments the agent has sent,
+	// forwarded, or expects to receive, keyed by hex-encoded hash.
+	RoutedPayments map[string]*route.Payment
+
+	// Invoices holds the invoices the agent has created, keyed by ID.
+	Invoices map[string]*invoice.Invoice
+
+	// Payments holds the completed payments the agent has
+	// sent or received, on channels or with its wallet account.
+	Payments []*payment.Payment
+
+	// APITokens holds the agent's unrevoked API tokens, keyed by ID.
+	APITokens map[string]*apitoken.Token
+
 	EncryptedSeed    []byte
 	NextKeypathIndex uint32
 	PrimaryAcct      *fsm.AccountID
@@ -60,6 +94,21 @@ type Config struct {
 	ChannelFeerate    int64
 	HostFeerate       int64
 
+	// MinMaxRoundDurMins through MaxFinalityDelayMins bound the
+	// timing parameters the agent accepts for a channel,
+	// as guest or in a guest's counter-proposal.
+	// Zero means the agent's own value.
+	MinMaxRoundDurMins   int64
+	MaxMaxRoundDurMins   int64
+	MinFinalityDelayMins int64
+	MaxFinalityDelayMins int64
+
+	// ForwardFeeBase and ForwardFeeRate are the fee the agent
+	// charges to forward a routed payment: a fixed amount in stroops
+	// plus a rate in parts per million of the forwarded amount.
+	ForwardFeeBase int64
+	ForwardFeeRate int64
+
 	KeepAlive bool
 	Public    bool
 }
@@ -7,37 +7,48 @@ import (
 
 // Defines errors returned by the agent.
 var (
-	errAcctsSame         = errors.New("same host and guest acct address")
-	errAgentClosing      = errors.New("agent in closing state: cannot process new commands")
-	errAlreadyConfigured = errors.New("already configured")
-	errBadAddress        = errors.New("bad address")
-	errBadHTTPStatus     = errors.New("bad http status")
-	errBadHTTPRequest    = errors.New("bad http request")
-	errBadRequest        = errors.New("bad request")
-	errDecoding          = errors.New("error decoding")
-	errEmptyAddress      = errors.New("destination address not set")
-	errEmptyAmount       = errors.New("amount not set")
-	errEmptyConfigEdit   = errors.New("config edit fields not set")
-	errEmptyAsset        = errors.New("asset field not set")
-	errEmptyIssuer       = errors.New("issuer field not set")
-	errExists            = errors.New("channel exists")
-	// Channel exists, but will be cleaned up and so the error is retriable
-	errChannelExistsRetriable = errors.New("channel exists in a setup state")
-	errFetchingAccounts       = errors.New("error fetching accounts")
-	errInsufficientBalance    = errors.New("insufficient balance")
-	errInvalidAddress         = errors.New("invalid address")
-	errInvalidAsset           = errors.New("invalid asset")
-	errInvalidChannelID       = errors.New("invalid channel ID")
-	errInvalidEdit            = errors.New("can only update password and horizon URL")
-	errInvalidInput           = errors.New("invalid input")
-	errInvalidPassword        = errors.New("invalid password")
-	errInvalidUsername        = errors.New("invalid username")
-	errNoChannelSpecified     = errors.New("channel not specified")
-	errNoCommandSpecified     = errors.New("command not specified")
-	errNotConfigured          = errors.New("not configured")
-	errNotFunded              = errors.New("primary acct not funded")
-	errPasswordsDontMatch     = errors.New("old password doesn't match")
-	errRemoteGuestMessage     = errors.New("received RPC message from guest")
+	errAcctsSame           = errors.New("same host and guest acct address")
+	errAgentClosing        = errors.New("agent in closing state: cannot process new commands")
+	errAlreadyConfigured   = errors.New("already configured")
+	errAssetAuthRequired   = errors.New("asset issuer requires authorization")
+	errBadAddress          = errors.New("bad address")
+	errBadBackup           = errors.New("not a backup, or wrong password")
+	errBadHTTPStatus       = errors.New("bad http status")
+	errBadHTTPRequest      = errors.New("bad http request")
+	errBadRequest          = errors.New("bad request")
+	errChannelTerms        = errors.New("channel terms not accepted")
+	errDecoding            = errors.New("error decoding")
+	errEmptyAddress        = errors.New("destination address not set")
+	errEmptyAmount         = errors.New("amount not set")
+	errEmptyConfigEdit     = errors.New("config edit fields not set")
+	errEmptyAsset          = errors.New("asset field not set")
+	errEmptyIssuer         = errors.New("issuer field not set")
+	errExists              = errors.New("channel exists")
+	errFetchingAccounts    = errors.New("error fetching accounts")
+	errInsufficientBalance = errors.New("insufficient balance")
+	errInvalidAddress      = errors.New("invalid address")
+	errInvalidAsset        = errors.New("invalid asset")
+	errInvalidChannelID    = errors.New("invalid channel ID")
+	errInvalidEdit         = errors.New("can only update password and horizon URL")
+	errInvalidInvoice      = errors.New("invalid invoice")
+	errInvoiceExpired      = errors.New("invoice expired")
+	errInvalidInput        = errors.New("invalid input")
+	errInvalidMnemonic     = errors.New("invalid recovery phrase")
+	errInvalidPassword     = errors.New("invalid password")
+	errInvalidScope        = errors.New("invalid token scope")
+	errInvalidUsername     = errors.New("invalid username")
+	errNoChannelSpecified  = errors.New("channel not specified")
+	errNoAPIToken          = errors.New("API token not found")
+	errNoChannel           = errors.New("channel not found")
+	errNoCommandSpecified  = errors.New("command not specified")
+	errNoInvoice           = errors.New("invoice not found")
+	errNoInvoiceChannel    = errors.New("no native channel with the invoice's account")
+	errNoRoute             = errors.New("no route to destination")
+	errNotConfigured       = errors.New("not configured")
+	errNotFunded           = errors.New("primary acct not funded")
+	errPasswordsDontMatch  = errors.New("old password doesn't match")
+	errRemoteGuestMessage  = errors.New("received RPC message from guest")
+	errStaleBackup         = errors.New("backup is older than the ledger")
 )
 
 // WriteError formats an error with the correct message and status from
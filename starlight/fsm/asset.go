@@ -0,0 +1,174 @@
+package fsm
+
+import (
+	b "github.com/stellar/go/build"
+	"github.com/stellar/go/xdr"
+
+	"github.com/interstellar/starlight/worizon/xlm"
+)
+
+// trustlineReserve is the amount each trustline adds
+// to an account's minimum balance.
+const trustlineReserve = 500 * xlm.Millilumen
+
+// IsNative reports whether the channel is denominated in lumens.
+// Channels whose Asset is the zero xdr.Asset are native channels.
+func (ch *Channel) IsNative() bool {
+	return ch.Asset.Type == xdr.AssetTypeAssetTypeNative
+}
+
+// assetCodeIssuer returns the code and issuer address of the channel's asset.
+// Both are empty for a native channel.
+func (ch *Channel) assetCodeIssuer() (code, issuer string) {
+	var typ string
+	ch.Asset.MustExtract(&typ, &code, &issuer)
+	return code, issuer
+}
+
+// assetAmount produces a payment mutator for amt units
+// of the channel's asset.
+func (ch *Channel) assetAmount(amt xlm.Amount) interface{} {
+	if ch.IsNative() {
+		return b.NativeAmount{Amount: amt.HorizonString()}
+	}
+	code, issuer := ch.assetCodeIssuer()
+	return b.CreditAmount{Code: code, Issuer: issuer, Amount: amt.HorizonString()}
+}
+
+// escrowReserveAmount is the extra minimum balance the escrow account
+// carries for its trustline, if the channel has a non-native asset.
+func (ch *Channel) escrowReserveAmount() xlm.Amount {
+	if ch.IsNative() {
+		return 0
+	}
+	return trustlineReserve
+}
+
+// escrowNativeFundingAmount is the amount of lumens the funding tx pays
+// into the escrow account. For native channels this includes HostAmount.
+func (ch *Channel) escrowNativeFundingAmount() xlm.Amount {
+	amt := 500*xlm.Millilumen + 8*ch.ChannelFeerate + ch.escrowReserveAmount()
+	if ch.IsNative() {
+		amt += ch.HostAmount
+	}
+	return amt
+}
+
+// releaseAssetMutators returns the escrow-sourced operations that
+// take the place of merging the escrow account in a non-native channel:
+// paying the host its remaining balance, and removing the guest's signer
+// so that the escrow account is left to the host alone.
+// An account with a trustline cannot be merged,
+// and a trustline holding any of the asset cannot be removed.
+// Since anyone can send the escrow account more of the asset,
+// the host merges it only afterward, with a tx paying out
+// whatever it then holds. See BuildEscrowReleaseTx.
+func (ch *Channel) releaseAssetMutators() []b.TransactionMutator {
+	if ch.IsNative() {
+		return nil
+	}
+	var m []b.TransactionMutator
+	if ch.HostAmount > 0 {
+		m = append(m, b.Payment(
+			b.SourceAccount{AddressOrSeed: ch.EscrowAcct.Address()},
+			b.Destination{AddressOrSeed: ch.HostAcct.Address()},
+			ch.assetAmount(ch.HostAmount),
+		))
+	}
+	m = append(m, b.SetOptions(
+		b.SourceAccount{AddressOrSeed: ch.EscrowAcct.Address()},
+		b.SetThresholds(1, 1, 1),
+		b.RemoveSigner(ch.GuestAcct.Address()),
+	))
+	return m
+}
+
+// releaseAssetOps is the xdr counterpart of releaseAssetMutators,
+// used for recognizing transactions on the ledger.
+func (ch *Channel) releaseAssetOps() []xdr.Operation {
+	if ch.IsNative() {
+		return nil
+	}
+	var ops []xdr.Operation
+	if ch.HostAmount > 0 {
+		ops = append(ops, assetPaymentOp(ch.EscrowAcct, ch.HostAcct, ch.Asset, ch.HostAmount))
+	}
+	one := xdr.Uint32(1)
+	ops = append(ops, xdr.Operation{
+		SourceAccount: ch.EscrowAcct.XDR(),
+		Body: xdr.OperationBody{
+			Type: xdr.OperationTypeSetOptions,
+			SetOptionsOp: &xdr.SetOptionsOp{
+				LowThreshold:  &one,
+				MedThreshold:  &one,
+				HighThreshold: &one,
+				Signer: &xdr.Signer{
+					Key: xdr.SignerKey{
+						Type:    xdr.SignerKeyTypeSignerKeyTypeEd25519,
+						Ed25519: ch.GuestAcct.Ed25519,
+					},
+					Weight: 0,
+				},
+			},
+		},
+	})
+	return ops
+}
+
+// BuildEscrowReleaseTx builds the tx with which the host merges
+// the escrow account of a closed non-native channel into its own account,
+// once the channel's settlement or cooperative close tx has left
+// the escrow account to it alone.
+// It pays the host bal, the escrow account's entire balance of the asset,
+// and removes the trustline first.
+// The escrow account's sequence number is seqnum.
+func BuildEscrowReleaseTx(ch *Channel, seqnum xdr.SequenceNumber, bal xlm.Amount) (*b.TransactionBuilder, error) {
+	code, issuer := ch.assetCodeIssuer()
+	var m []b.TransactionMutator
+	if bal > 0 {
+		m = append(m, b.Payment(
+			b.Destination{AddressOrSeed: ch.HostAcct.Address()},
+			ch.assetAmount(bal),
+		))
+	}
+	m = append(m,
+		b.RemoveTrust(code, issuer),
+		b.AccountMerge(b.Destination{AddressOrSeed: ch.HostAcct.Address()}),
+	)
+	return ch.buildEscrowTx(seqnum+1, m...)
+}
+
+// assetBalance returns the wallet's balance of the channel's asset.
+// For native channels it is the wallet's native balance.
+func (h *WalletAcct) assetBalance(asset xdr.Asset) xlm.Amount {
+	if asset.Type == xdr.AssetTypeAssetTypeNative {
+		return h.NativeBalance
+	}
+	return xlm.Amount(h.Balances[asset.String()].Amount)
+}
+
+// addAssetBalance adds amt (which may be negative) to the wallet's
+// balance of asset.
+func (h *WalletAcct) addAssetBalance(asset xdr.Asset, amt xlm.Amount) {
+	if asset.Type == xdr.AssetTypeAssetTypeNative {
+		h.NativeBalance += amt
+		return
+	}
+	if h.Balances == nil {
+		h.Balances = make(map[string]Balance)
+	}
+	bal := h.Balances[asset.String()]
+	bal.Asset = asset
+	bal.Amount = uint64(xlm.Amount(bal.Amount) + amt)
+	h.Balances[asset.String()] = bal
+}
+
+// unreserveAssetAmount returns the HostAmount of a non-native channel
+// to the wallet's asset balance, after funding fails or is abandoned.
+// In a native channel, HostAmount is part of fundingBalanceAmount.
+func (u *Updater) unreserveAssetAmount() {
+	if u.C.IsNative() {
+		return
+	}
+	u.H.addAssetBalance(u.C.Asset, u.C.HostAmount)
+}
@@ -48,22 +48,9 @@ func buildSettleOnlyWithHostTx(ch *Channel, paymentTime time.Time) (*b.Transacti
 	if minTime > math.MaxInt64 {
 		return nil, checked.ErrOverflow
 	}
-	return ch.buildEscrowTx(
-		ch.roundSeqNum()+2,
-		b.Timebounds{MinTime: minTime},
-		b.AccountMerge(
-			b.SourceAccount{AddressOrSeed: ch.EscrowAcct.Address()},
-			b.Destination{AddressOrSeed: ch.HostAcct.Address()},
-		),
-		b.AccountMerge(
-			b.SourceAccount{AddressOrSeed: ch.GuestRatchetAcct.Address()},
-			b.Destination{AddressOrSeed: ch.HostAcct.Address()},
-		),
-		b.AccountMerge(
-			b.SourceAccount{AddressOrSeed: ch.HostRatchetAcct.Address()},
-			b.Destination{AddressOrSeed: ch.HostAcct.Address()},
-		),
-	)
+	m := []b.TransactionMutator{b.Timebounds{MinTime: minTime}}
+	m = append(m, ch.settleWithHostMutators()...)
+	return ch.buildEscrowTx(ch.roundSeqNum()+2, m...)
 }
 
 func buildRatchetTx(ch *Channel, ledgerTime time.Time, acct AccountID, seqnum xdr.SequenceNumber) (*b.TransactionBuilder, error) {
@@ -94,7 +81,7 @@ func buildFundingTx(ch *Channel, h *WalletAcct) (*b.TransactionBuilder, error) {
 		b.Payment(
 			b.SourceAccount{AddressOrSeed: ch.HostAcct.Address()},
 			b.Destination{AddressOrSeed: ch.EscrowAcct.Address()},
-			b.NativeAmount{Amount: (ch.HostAmount + 500*xlm.Millilumen + 8*ch.ChannelFeerate).HorizonString()},
+			b.NativeAmount{Amount: ch.escrowNativeFundingAmount().HorizonString()},
 		),
 		b.SetOptions(
 			b.SourceAccount{AddressOrSeed: ch.EscrowAcct.Address()},
@@ -131,6 +118,20 @@ func buildFundingTx(ch *Channel, h *WalletAcct) (*b.TransactionBuilder, error) {
 			b.AddSigner(ch.EscrowAcct.Address(), 1),
 		),
 	)
+	if err != nil || ch.IsNative() {
+		return tb, err
+	}
+	code, issuer := ch.assetCodeIssuer()
+	err = tb.Mutate(
+		b.Trust(code, issuer,
+			b.SourceAccount{AddressOrSeed: ch.EscrowAcct.Address()},
+		),
+		b.Payment(
+			b.SourceAccount{AddressOrSeed: ch.HostAcct.Address()},
+			b.Destination{AddressOrSeed: ch.EscrowAcct.Address()},
+			ch.assetAmount(ch.HostAmount),
+		),
+	)
 	return tb, err
 }
 
@@ -145,7 +146,7 @@ func buildSettleWithGuestTx(ch *Channel, paymentTime time.Time) (*b.TransactionB
 		b.Payment(
 			b.SourceAccount{AddressOrSeed: ch.EscrowAcct.Address()},
 			b.Destination{AddressOrSeed: ch.GuestAcct.Address()},
-			b.NativeAmount{Amount: ch.GuestAmount.HorizonString()},
+			ch.assetAmount(ch.guestSettleAmount()),
 		),
 	)
 }
@@ -155,26 +156,13 @@ func buildSettleWithHostTx(ch *Channel, paymentTime time.Time) (*b.TransactionBu
 	if minTime > math.MaxInt64 {
 		return nil, checked.ErrOverflow
 	}
-	return ch.buildEscrowTx(
-		ch.roundSeqNum()+3,
-		b.Timebounds{MinTime: minTime},
-		b.AccountMerge(
-			b.SourceAccount{AddressOrSeed: ch.EscrowAcct.Address()},
-			b.Destination{AddressOrSeed: ch.HostAcct.Address()},
-		),
-		b.AccountMerge(
-			b.SourceAccount{AddressOrSeed: ch.GuestRatchetAcct.Address()},
-			b.Destination{AddressOrSeed: ch.HostAcct.Address()},
-		),
-		b.AccountMerge(
-			b.SourceAccount{AddressOrSeed: ch.HostRatchetAcct.Address()},
-			b.Destination{AddressOrSeed: ch.HostAcct.Address()},
-		),
-	)
+	m := []b.TransactionMutator{b.Timebounds{MinTime: minTime}}
+	m = append(m, ch.settleWithHostMutators()...)
+	return ch.buildEscrowTx(ch.roundSeqNum()+3, m...)
 }
 
 func buildCooperativeCloseTx(ch *Channel) (*b.TransactionBuilder, error) {
-	tb, err := ch.buildEscrowTx(ch.BaseSequenceNumber + 1)
+	tb, err := ch.buildEscrowTx(ch.escrowSeqNum() + 1)
 	if err != nil {
 		return nil, err
 	}
@@ -183,18 +171,37 @@ func buildCooperativeCloseTx(ch *Channel) (*b.TransactionBuilder, error) {
 			b.Payment(
 				b.SourceAccount{AddressOrSeed: ch.EscrowAcct.Address()},
 				b.Destination{AddressOrSeed: ch.GuestAcct.Address()},
-				b.NativeAmount{Amount: ch.GuestAmount.HorizonString()},
+				ch.assetAmount(ch.GuestAmount),
 			),
 		)
 		if err != nil {
 			return nil, err
 		}
 	}
-	err = tb.Mutate(
-		b.AccountMerge(
+	err = tb.Mutate(ch.releaseAssetMutators()...)
+	if err != nil {
+		return nil, err
+	}
+	err = tb.Mutate(ch.escrowMergeMutators()...)
+	if err != nil {
+		return nil, err
+	}
+	err = tb.Mutate(b.Defaults{})
+	return tb, err
+}
+
+// escrowMergeMutators returns the operations merging the channel accounts
+// into the host's account. The escrow account of a non-native channel
+// is not merged; see releaseAssetMutators.
+func (ch *Channel) escrowMergeMutators() []b.TransactionMutator {
+	var m []b.TransactionMutator
+	if ch.IsNative() {
+		m = append(m, b.AccountMerge(
 			b.SourceAccount{AddressOrSeed: ch.EscrowAcct.Address()},
 			b.Destination{AddressOrSeed: ch.HostAcct.Address()},
-		),
+		))
+	}
+	return append(m,
 		b.AccountMerge(
 			b.SourceAccount{AddressOrSeed: ch.GuestRatchetAcct.Address()},
 			b.Destination{AddressOrSeed: ch.HostAcct.Address()},
@@ -204,11 +211,6 @@ func buildCooperativeCloseTx(ch *Channel) (*b.TransactionBuilder, error) {
 			b.Destination{AddressOrSeed: ch.HostAcct.Address()},
 		),
 	)
-	if err != nil {
-		return nil, err
-	}
-	err = tb.Mutate(b.Defaults{})
-	return tb, err
 }
 
 func buildCleanupTx(ch *Channel, h *WalletAcct) (*b.TransactionBuilder, error) {
@@ -241,7 +243,7 @@ func buildTopUpTx(ch *Channel, h *WalletAcct) (*b.TransactionBuilder, error) {
 		b.Payment(
 			b.SourceAccount{AddressOrSeed: ch.HostAcct.Address()},
 			b.Destination{AddressOrSeed: ch.EscrowAcct.Address()},
-			b.NativeAmount{Amount: ch.TopUpAmount.HorizonString()},
+			ch.assetAmount(ch.TopUpAmount),
 		),
 	)
 }
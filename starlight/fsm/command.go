@@ -3,6 +3,8 @@ package fsm
 import (
 	"time"
 
+	"github.com/stellar/go/xdr"
+
 	"github.com/interstellar/starlight/errors"
 	"github.com/interstellar/starlight/worizon/xlm"
 )
@@ -21,16 +23,60 @@ const (
 	Pay           CommandName = "Pay"
 	AddAsset      CommandName = "AddAsset"
 	RemoveAsset   CommandName = "RemoveAsset"
+	Withdraw      CommandName = "Withdraw"
+
+	ConditionalPay CommandName = "ConditionalPay"
+	FulfillHTLC    CommandName = "FulfillHTLC"
+	CancelHTLC     CommandName = "CancelHTLC"
 )
 
 // Command contains a command name and its required arguments.
 type Command struct {
-	Name      CommandName
-	Amount    xlm.Amount // for TopUp, ChannelPay, or Pay
-	Time      time.Time
-	Recipient string // for Pay
-	AssetCode string // for AddAsset, RemoveAsset
-	Issuer    string // for AddAsset, RemoveAsset
+	Name       CommandName
+	Amount     xlm.Amount // for TopUp, ChannelPay, Pay, ConditionalPay, or Withdraw
+	Time       time.Time
+	Recipient  string    // for Pay
+	AssetCode  string    // for AddAsset, RemoveAsset
+	Issuer     string    // for AddAsset, RemoveAsset
+	HTLCHash   xdr.Hash  // for ConditionalPay
+	HTLCExpiry time.Time // for ConditionalPay
+	Route      []Hop     // for ConditionalPay
+	Preimage   []byte    // for FulfillHTLC
+	PaymentID  string    // for ChannelPay
+	Memo       string    // for ChannelPay
+	InvoiceID  string    // for ChannelPay
+}
+
+// PaymentIntent is a single payment made with ChannelPay.
+// Payments made while a round is in progress are queued,
+// and settled together in the next round.
+// The recipient learns each payment's ID, memo, and invoice ID
+// from the PaymentProposeMsg of the round settling it.
+type PaymentIntent struct {
+	ID        string
+	Amount    xlm.Amount
+	Memo      string `json:",omitempty"`
+	InvoiceID string `json:",omitempty"`
+}
+
+// Limits on the descriptive fields of a PaymentIntent,
+// which travel in a PaymentProposeMsg.
+const (
+	maxPaymentIDLen = 64
+	maxMemoLen      = 512
+	maxInvoiceIDLen = 128
+)
+
+func (p PaymentIntent) validate() error {
+	switch {
+	case len(p.ID) > maxPaymentIDLen:
+		return errors.Wrapf(ErrInvalidPaymentInfo, "payment ID longer than %d bytes", maxPaymentIDLen)
+	case len(p.Memo) > maxMemoLen:
+		return errors.Wrapf(ErrInvalidPaymentInfo, "memo longer than %d bytes", maxMemoLen)
+	case len(p.InvoiceID) > maxInvoiceIDLen:
+		return errors.Wrapf(ErrInvalidPaymentInfo, "invoice ID longer than %d bytes", maxInvoiceIDLen)
+	}
+	return nil
 }
 
 var commandFuncs = map[CommandName]func(*Command, *Updater) error{
@@ -40,6 +86,11 @@ var commandFuncs = map[CommandName]func(*Command, *Updater) error{
 	TopUp:         topUpFn,
 	ChannelPay:    channelPayFn,
 	ForceClose:    forceCloseFn,
+	Withdraw:      withdrawFn,
+
+	ConditionalPay: conditionalPayFn,
+	FulfillHTLC:    fulfillHTLCFn,
+	CancelHTLC:     cancelHTLCFn,
 }
 
 func createChannelFn(_ *Command, u *Updater) error {
@@ -56,6 +107,7 @@ func cleanUpFn(_ *Command, u *Updater) error {
 	// Get back funds associated with funding tx.
 	// Setup balances are added back in processing MergeOps.
 	u.H.NativeBalance += u.C.totalFundingTxAmount()
+	u.unreserveAssetAmount()
 	u.H.Seqnum++
 	return u.transitionTo(AwaitingCleanup)
 }
@@ -64,55 +116,282 @@ func closeChannelFn(_ *Command, u *Updater) error {
 	if u.C.State != Open {
 		return errors.Wrapf(ErrUnexpectedState, "got %s, want %s", u.C.State, Open)
 	}
+	if u.C.HTLC != nil {
+		return errHTLCPending
+	}
+	if u.C.Withdrawal != nil {
+		return errWithdrawalPending
+	}
+	// A top-up waiting for a round is abandoned.
+	u.refundGuestTopUp()
 	return u.transitionTo(AwaitingClose)
 }
 
+// topUpFn pays c.Amount from the wallet into the channel.
+// The host's top-up is credited to it once on the ledger;
+// the guest's is made in a payment round (see guestTopUpFn).
 func topUpFn(c *Command, u *Updater) error {
+	if u.C.Role == Guest {
+		return guestTopUpFn(c, u)
+	}
 	if u.C.State != Open {
 		return errors.Wrapf(ErrUnexpectedState, "got %s, want %s", u.C.State, Open)
 	}
-	if u.C.Role != Host {
-		return errors.Wrap(errUnexpectedRole, "only host can top up")
-	}
 	if u.C.TopUpAmount != 0 {
 		return errTopUpInProgress
 	}
-	if c.Amount > u.H.NativeBalance {
-		return errors.Wrapf(ErrInsufficientFunds, "balance %d", u.C.HostAmount)
+	if bal := u.H.assetBalance(u.C.Asset); c.Amount > bal {
+		return errors.Wrapf(ErrInsufficientFunds, "balance %d", bal)
 	}
 	u.C.TopUpAmount = c.Amount
 
-	u.H.NativeBalance -= c.Amount
+	u.H.addAssetBalance(u.C.Asset, -c.Amount)
 	u.H.NativeBalance -= u.C.HostFeerate
 
 	u.H.Seqnum++
 	return u.transitionTo(Open)
 }
 
-func channelPayFn(c *Command, u *Updater) error {
+// withdrawFn pays c.Amount of u.C's own balance out of the channel
+// to its wallet account. The withdrawal tx's fee is reserved
+// from the wallet now; the withdrawal is made
+// in the next payment round u.C proposes,
+// and its sequence number reserved once that round completes.
+func withdrawFn(c *Command, u *Updater) error {
 	if u.C.State != Open {
 		return errors.Wrapf(ErrUnexpectedState, "got %s, want %s", u.C.State, Open)
 	}
-	u.C.PendingAmountSent = c.Amount
-	if u.C.PaymentTime.After(c.Time) {
-		u.C.PendingPaymentTime = u.C.PaymentTime
-	} else {
-		u.C.PendingPaymentTime = c.Time
+	if u.C.Withdrawal != nil {
+		return errWithdrawalPending
 	}
-	switch u.C.Role {
-	case Guest:
-		if u.C.GuestAmount < c.Amount {
-			return errors.Wrapf(ErrInsufficientFunds, "balance %d", u.C.GuestAmount)
+	if c.Amount <= 0 {
+		return errors.Wrapf(ErrInvalidWithdrawal, "amount %s", c.Amount)
+	}
+	if bal := u.C.spendableAmount(u.C.Role); bal < c.Amount {
+		return errors.Wrapf(ErrInsufficientFunds, "balance %d", bal)
+	}
+	if u.H.NativeBalance < u.C.ChannelFeerate {
+		return errors.Wrapf(ErrInsufficientFunds, "wallet balance %d", u.H.NativeBalance)
+	}
+	u.H.NativeBalance -= u.C.ChannelFeerate
+	u.C.Withdrawal = &Withdrawal{
+		Role:   u.C.Role,
+		Amount: c.Amount,
+	}
+	return u.proposePayment(0, c.Time, "", nil)
+}
+
+func channelPayFn(c *Command, u *Updater) error {
+	if err := c.paymentIntent().validate(); err != nil {
+		return err
+	}
+	switch u.C.State {
+	case Open:
+	case PaymentProposed, PaymentAccepted, AwaitingPaymentMerge:
+		if c.Amount > 0 {
+			return u.queuePayment(c)
 		}
-	case Host:
-		if u.C.HostAmount < c.Amount {
-			return errors.Wrapf(ErrInsufficientFunds, "balance %d", u.C.HostAmount)
+		fallthrough
+	default:
+		return errors.Wrapf(ErrUnexpectedState, "got %s, want %s", u.C.State, Open)
+	}
+	if bal := u.C.spendableAmount(u.C.Role); bal < c.Amount {
+		return errors.Wrapf(ErrInsufficientFunds, "balance %d", bal)
+	}
+	if c.Amount == 0 && len(u.C.QueuedPayments) == 0 {
+		return u.proposePayment(0, c.Time, "", nil)
+	}
+	if c.Amount > 0 {
+		u.C.QueuedPayments = append(u.C.QueuedPayments, c.paymentIntent())
+	}
+	return u.proposeQueuedPayments(c.Time)
+}
+
+func (c *Command) paymentIntent() PaymentIntent {
+	return PaymentIntent{
+		ID:        c.PaymentID,
+		Amount:    c.Amount,
+		Memo:      c.Memo,
+		InvoiceID: c.InvoiceID,
+	}
+}
+
+// queuePayment queues a payment made while a round is in progress,
+// if the balance left after that round and the payments
+// already queued covers it.
+func (u *Updater) queuePayment(c *Command) error {
+	ch2 := u.C.roundResult()
+	bal := ch2.spendableAmount(u.C.Role) - totalAmount(u.C.QueuedPayments)
+	if bal < c.Amount {
+		return errors.Wrapf(ErrInsufficientFunds, "balance %d after pending payments", bal)
+	}
+	u.C.QueuedPayments = append(u.C.QueuedPayments, c.paymentIntent())
+	return nil
+}
+
+// proposeQueuedPayments starts a payment round settling
+// the queued payments, with their total as the payment amount.
+// Payments the balance does not cover stay queued.
+// It does nothing if the balance covers none of them.
+func (u *Updater) proposeQueuedPayments(now time.Time) error {
+	var (
+		bal             = u.C.spendableAmount(u.C.Role)
+		amount          xlm.Amount
+		batch, deferred []PaymentIntent
+	)
+	for _, p := range u.C.QueuedPayments {
+		if amount+p.Amount > bal {
+			deferred = append(deferred, p)
+			continue
+		}
+		amount += p.Amount
+		batch = append(batch, p)
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+	if len(deferred) > 0 {
+		u.debugf("%d queued payments deferred: insufficient balance", len(deferred))
+	}
+	u.C.PendingPayments = batch
+	u.C.QueuedPayments = deferred
+	return u.proposePayment(amount, now, "", nil)
+}
+
+// completePayments records the payments, sent and received,
+// settled by the round that just completed.
+func (u *Updater) completePayments() {
+	u.C.SettledPayments = u.C.PendingPayments
+	u.C.PendingPayments = nil
+	u.C.ReceivedPayments = u.C.PendingPaymentsReceived
+	u.C.PendingPaymentsReceived = nil
+}
+
+func totalAmount(payments []PaymentIntent) xlm.Amount {
+	var total xlm.Amount
+	for _, p := range payments {
+		total += p.Amount
+	}
+	return total
+}
+
+func conditionalPayFn(c *Command, u *Updater) error {
+	if u.C.State != Open {
+		return errors.Wrapf(ErrUnexpectedState, "got %s, want %s", u.C.State, Open)
+	}
+	if u.C.HTLC != nil {
+		return errHTLCInProgress
+	}
+	h := &HTLC{
+		Sender: u.C.Role,
+		Amount: c.Amount,
+		Hash:   c.HTLCHash,
+		Expiry: c.HTLCExpiry,
+		Route:  c.Route,
+	}
+	if err := u.C.checkHTLC(h, u.C.nextPaymentTime(c.Time)); err != nil {
+		return err
+	}
+	ch2 := *u.C
+	ch2.HTLC = h
+	if !ch2.hasSettleFunds() {
+		return errors.Wrapf(ErrInsufficientFunds, "balance %d", u.C.spendableAmount(u.C.Role))
+	}
+	return u.proposePayment(0, c.Time, HTLCAdd, h)
+}
+
+func fulfillHTLCFn(c *Command, u *Updater) error {
+	h := u.C.HTLC
+	if h == nil || h.recipient() != u.C.Role {
+		return errors.Wrap(ErrInvalidHTLC, "no HTLC to fulfill")
+	}
+	if !h.matches(c.Preimage) {
+		return ErrInvalidPreimage
+	}
+	h.Preimage = c.Preimage
+	switch u.C.State {
+	case AwaitingHTLC:
+		return publishHTLCClaimTx(u.Seed, u.C, u.O)
+	case AwaitingRatchet, AwaitingSettlementMintime, AwaitingSettlement:
+		// claimed once the settlement txs are on the ledger
+		return nil
+	}
+	return sendHTLCFulfillMsg(u.Seed, u.C, u.O)
+}
+
+// cancelHTLCFn refunds an HTLC received by u.C's role to its sender
+// before it expires, e.g. when a routed payment cannot be forwarded.
+func cancelHTLCFn(c *Command, u *Updater) error {
+	if u.C.State != Open {
+		return errors.Wrapf(ErrUnexpectedState, "got %s, want %s", u.C.State, Open)
+	}
+	h := u.C.HTLC
+	if h == nil || h.recipient() != u.C.Role {
+		return errors.Wrap(ErrInvalidHTLC, "no HTLC to cancel")
+	}
+	if h.Preimage != nil {
+		return errors.Wrap(ErrInvalidHTLC, "HTLC already fulfilled")
+	}
+	return u.proposePayment(0, c.Time, HTLCRefund, nil)
+}
+
+// proposePayment starts a payment round sending amount,
+// with an optional change to the channel's HTLC.
+// The round also makes the channel's own withdrawal,
+// if it has one waiting for a round and the balance still covers it,
+// or else the guest's top-up, if the round makes no other change.
+func (u *Updater) proposePayment(amount xlm.Amount, now time.Time, op HTLCOp, h *HTLC) error {
+	u.C.PendingAmountSent = amount
+	u.C.PendingPaymentTime = u.C.nextPaymentTime(now)
+	u.C.PendingHTLCOp = op
+	u.C.PendingHTLC = h
+	u.C.PendingWithdrawal = nil
+	if w := u.C.Withdrawal; w != nil && w.Round == 0 {
+		ch2 := u.C.roundResult()
+		ch2.PendingWithdrawal = w
+		ch2.applyWithdrawal()
+		if ch2.hasSettleFunds() {
+			u.C.PendingWithdrawal = w
+		} else {
+			u.debugf("withdrawal of %s deferred: insufficient balance", w.Amount)
 		}
 	}
 	u.C.RoundNumber++
+	if t := u.C.GuestTopUp; t != nil && t.Round == 0 && amount == 0 && op == "" &&
+		u.C.HTLC == nil && u.C.PendingWithdrawal == nil && u.C.RoundNumber > 2 {
+		t.Round = u.C.RoundNumber
+		t.Time = u.C.PendingPaymentTime
+	}
 	return u.transitionTo(PaymentProposed)
 }
 
+// roundResult returns a copy of ch as it will be
+// once the payment round ch is proposing completes.
+func (ch *Channel) roundResult() Channel {
+	ch2 := *ch
+	switch ch.Role {
+	case Guest:
+		ch2.GuestAmount -= ch.PendingAmountSent
+		ch2.HostAmount += ch.PendingAmountSent
+	case Host:
+		ch2.HostAmount -= ch.PendingAmountSent
+		ch2.GuestAmount += ch.PendingAmountSent
+	}
+	ch2.HTLC = ch.nextHTLC()
+	ch2.applyWithdrawal()
+	ch2.applyGuestTopUp()
+	return ch2
+}
+
+// nextPaymentTime is the payment time of a round proposed at now.
+// Payment times never decrease.
+func (ch *Channel) nextPaymentTime(now time.Time) time.Time {
+	if ch.PaymentTime.After(now) {
+		return ch.PaymentTime
+	}
+	return now
+}
+
 func forceCloseFn(_ *Command, u *Updater) error {
 	if isSetupState(u.C.State) || isForceCloseState(u.C.State) {
 		return errors.Wrapf(ErrUnexpectedState, "got %s, want non-starting, non-force close state", u.C.State)
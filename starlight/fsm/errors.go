@@ -7,12 +7,20 @@ var (
 	// Command errors
 	ErrInsufficientFunds = errors.New("insufficient funds")
 	errTopUpInProgress   = errors.New("top-up currently being submitted")
-	errUnexpectedRole    = errors.New("unexpected role")
+	errHTLCInProgress    = errors.New("conditional payment already pending")
+	errHTLCPending       = errors.New("cannot close cooperatively with a conditional payment pending")
+	errWithdrawalPending = errors.New("withdrawal pending")
 
 	// Message errors
 	ErrChannelExists            = errors.New("received channel propose message for channel that already exists")
 	ErrInvalidVersion           = errors.New("invalid version number")
 	ErrUnusedSettleWithGuestSig = errors.New("unused settle with guest sig")
+	ErrUntrustedAsset           = errors.New("no authorized trustline for proposed asset")
+	ErrInvalidHTLC              = errors.New("invalid conditional payment")
+	ErrInvalidPreimage          = errors.New("preimage does not match hash")
+	ErrInvalidWithdrawal        = errors.New("invalid withdrawal")
+	ErrInvalidPaymentInfo       = errors.New("invalid payment memo or ID")
+	ErrInvalidTopUp             = errors.New("invalid top-up")
 
 	// Tx errors
 	errRatchetTxFailed = errors.New("ratchet tx failed")
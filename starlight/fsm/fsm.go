@@ -59,6 +59,7 @@ type Channel struct {
 	FundingTime            time.Time
 	FundingTimedOut        bool
 	FundingTxSeqnum        xdr.SequenceNumber
+	Asset                  xdr.Asset // the zero value denotes lumens
 	HostAmount             xlm.Amount
 	GuestAmount            xlm.Amount
 	TopUpAmount            xlm.Amount
@@ -98,6 +99,43 @@ type Channel struct {
 	// is included in the Channel state so a Transaction Envelope
 	// containing the transaction signed by each party can be submitted.
 	CounterpartyCoopCloseSig xdr.DecoratedSignature
+
+	// HTLC is the conditional payment pending in the channel, if any.
+	// PendingHTLCOp and PendingHTLC describe the change to it made
+	// in the current payment round, and PendingHTLCRefundSig is the
+	// counterparty's signature on the refund tx for that round.
+	HTLC                 *HTLC                   `json:",omitempty"`
+	PendingHTLCOp        HTLCOp                  `json:",omitempty"`
+	PendingHTLC          *HTLC                   `json:",omitempty"`
+	PendingHTLCRefundSig *xdr.DecoratedSignature `json:",omitempty"`
+
+	// GuestTopUp is the guest's top-up, from the TopUp command
+	// until its round completes. GuestTopUpCount is the number
+	// of guest top-up txs, each using a sequence number
+	// of the escrow account.
+	GuestTopUp      *GuestTopUp `json:",omitempty"`
+	GuestTopUpCount uint64      `json:",omitempty"`
+
+	// Withdrawal is the channel's own withdrawal, from the Withdraw
+	// command until its tx appears on the ledger. PendingWithdrawal
+	// is the withdrawal made in the current payment round, by either party.
+	Withdrawal        *Withdrawal `json:",omitempty"`
+	PendingWithdrawal *Withdrawal `json:",omitempty"`
+
+	// QueuedPayments are the channel's own ChannelPay payments
+	// waiting for the next round, and PendingPayments those
+	// settled by the current round. SettledPayments are those
+	// settled by the round completed in the latest update.
+	QueuedPayments  []PaymentIntent `json:",omitempty"`
+	PendingPayments []PaymentIntent `json:",omitempty"`
+	SettledPayments []PaymentIntent `json:",omitempty"`
+
+	// PendingPaymentsReceived are the counterparty's payments,
+	// as described in its PaymentProposeMsg, settled by the
+	// current round. ReceivedPayments are those settled by the
+	// round completed in the latest update.
+	PendingPaymentsReceived []PaymentIntent `json:",omitempty"`
+	ReceivedPayments        []PaymentIntent `json:",omitempty"`
 }
 
 // MarshalJSON implements json.Marshaler. Required for genbolt.
@@ -274,13 +312,24 @@ func (ch *Channel) totalFundingTxAmount() xlm.Amount {
 
 func (ch *Channel) fundingBalanceAmount() xlm.Amount {
 	// Guest ratchet has 2 additional signers, escrow and host ratchet 1 each.
-	// Each additional signer adds .5 Lumen to the minimum reserve balance.
-	return ch.HostAmount + 2*xlm.Lumen
+	// Each additional signer adds .5 Lumen to the minimum reserve balance,
+	// as does the escrow trustline in a non-native channel.
+	// The HostAmount of a non-native channel is reserved from the
+	// wallet's asset balance instead.
+	result := 2*xlm.Lumen + ch.escrowReserveAmount()
+	if ch.IsNative() {
+		result += ch.HostAmount
+	}
+	return result
 }
 
 func (ch *Channel) fundingFeeAmount() xlm.Amount {
-	// Funding tx has 7 ops, from Host account.
-	return 7 * ch.HostFeerate
+	// Funding tx has 7 ops, from Host account,
+	// plus a trustline and an asset payment in a non-native channel.
+	if ch.IsNative() {
+		return 7 * ch.HostFeerate
+	}
+	return 9 * ch.HostFeerate
 }
 
 func (ch *Channel) fundedAcctsTxFeeAmount() xlm.Amount {
@@ -298,7 +347,7 @@ func isSetupState(state State) bool {
 
 func isForceCloseState(state State) bool {
 	switch state {
-	case AwaitingRatchet, AwaitingSettlementMintime, AwaitingSettlement:
+	case AwaitingRatchet, AwaitingSettlementMintime, AwaitingSettlement, AwaitingHTLC:
 		return true
 	}
 	return false
@@ -307,11 +356,14 @@ func isForceCloseState(state State) bool {
 func (u *Updater) setForceCloseState() error {
 	// if we're already in a force close state, do nothing
 	switch u.C.State {
-	case AwaitingRatchet, AwaitingSettlement, AwaitingSettlementMintime, Closed:
+	case AwaitingRatchet, AwaitingSettlement, AwaitingSettlementMintime, AwaitingHTLC, Closed:
 		return nil
 	}
 	u.debugf("entering force close")
-	if u.C.Role == Guest && u.C.GuestAmount == 0 {
+	if t := u.C.GuestTopUp; t != nil && t.Tx == nil {
+		u.refundGuestTopUp()
+	}
+	if u.C.Role == Guest && u.C.GuestAmount == 0 && u.C.HTLC == nil && u.C.GuestTopUp == nil {
 		// doesn't care about settlement
 		// and may not even have a ratchet tx
 		return u.transitionTo(Closed)
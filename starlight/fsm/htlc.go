@@ -0,0 +1,581 @@
+package fsm
+
+import (
+	"crypto/sha256"
+	"math"
+	"time"
+
+	b "github.com/stellar/go/build"
+	"github.com/stellar/go/keypair"
+	"github.com/stellar/go/strkey"
+	"github.com/stellar/go/xdr"
+
+	"github.com/interstellar/starlight/errors"
+	"github.com/interstellar/starlight/math/checked"
+	"github.com/interstellar/starlight/worizon"
+	"github.com/interstellar/starlight/worizon/xlm"
+)
+
+// HTLCOp is the type of a change to a channel's HTLC
+// made in a payment round.
+type HTLCOp string
+
+// HTLC changes. A payment round may lock a new conditional payment,
+// fulfill the pending one by paying its amount to the recipient,
+// or refund it to the sender once it has expired.
+const (
+	HTLCAdd     HTLCOp = "Add"
+	HTLCFulfill HTLCOp = "Fulfill"
+	HTLCRefund  HTLCOp = "Refund"
+)
+
+// htlcSignerReserve is the amount the hash-x signer adds to the
+// escrow account's minimum balance when a channel is force closed
+// with an HTLC pending. It comes out of the host's settlement
+// and is returned to the host when the HTLC is resolved.
+const htlcSignerReserve = 500 * xlm.Millilumen
+
+// HTLC is a hash-time-locked conditional payment in a channel.
+// Its Amount is still counted in the sender's balance,
+// but cannot be spent while the HTLC is pending.
+type HTLC struct {
+	Sender Role
+	Amount xlm.Amount
+	Hash   xdr.Hash // SHA-256 hash of the preimage
+	Expiry time.Time
+
+	// Preimage is known to the recipient from the start,
+	// and to the sender once the recipient reveals it.
+	Preimage []byte `json:",omitempty"`
+
+	// RefundTx is the sender's refund tx for the latest completed round,
+	// signed by the recipient.
+	RefundTx *xdr.TransactionEnvelope `json:",omitempty"`
+
+	// RefundPublished is set once the sender has published RefundTx.
+	RefundPublished bool `json:",omitempty"`
+
+	// SettleSeqNum is the sequence number of the settlement tx
+	// that left the HTLC in the escrow account in a force close.
+	SettleSeqNum xdr.SequenceNumber `json:",omitempty"`
+
+	// Route holds the remaining hops of a routed payment,
+	// for the recipient to forward. It is empty if the recipient
+	// is the payment's destination.
+	Route []Hop `json:",omitempty"`
+}
+
+// HTLCTerms are the terms of a new HTLC proposed by its sender.
+type HTLCTerms struct {
+	Amount xlm.Amount
+	Hash   xdr.Hash
+	Expiry time.Time
+	Route  []Hop `json:",omitempty"`
+}
+
+// Hop is one step of a routed payment. The recipient of an HTLC
+// whose route starts with Hop forwards it as a new HTLC of Amount,
+// with the same hash, expiring at Expiry, on channel ChannelID.
+// The difference between the two amounts is the recipient's fee.
+type Hop struct {
+	ChannelID string
+	Amount    xlm.Amount
+	Expiry    time.Time
+}
+
+func (h *HTLC) recipient() Role {
+	if h.Sender == Host {
+		return Guest
+	}
+	return Host
+}
+
+// matches reports whether preimage is the preimage of h.Hash.
+func (h *HTLC) matches(preimage []byte) bool {
+	return xdr.Hash(sha256.Sum256(preimage)) == h.Hash
+}
+
+// htlcMinDuration is the minimum time between a round's payment time
+// and the expiry of an HTLC added in that round. It leaves the
+// recipient a round to reveal the preimage, and still enough time
+// to claim the HTLC on the ledger after a force close.
+func (ch *Channel) htlcMinDuration() time.Duration {
+	return 2*ch.FinalityDelay + 3*ch.MaxRoundDuration
+}
+
+// htlcClaimDeadline is the time by which a recipient that knows the
+// preimage, but has not been paid, must force close the channel
+// to be sure of claiming the HTLC before it expires.
+func (ch *Channel) htlcClaimDeadline() time.Time {
+	return ch.HTLC.Expiry.Add(-2*ch.FinalityDelay - 2*ch.MaxRoundDuration)
+}
+
+// checkHTLC validates a new HTLC added in a round with the given payment time.
+func (ch *Channel) checkHTLC(h *HTLC, paymentTime time.Time) error {
+	if !ch.IsNative() {
+		return errors.Wrap(ErrInvalidHTLC, "non-native channel")
+	}
+	if h.Amount <= 0 {
+		return errors.Wrapf(ErrInvalidHTLC, "amount %s", h.Amount)
+	}
+	if h.Expiry.Before(paymentTime.Add(ch.htlcMinDuration())) {
+		return errors.Wrapf(ErrInvalidHTLC, "expiry %s is less than %s after %s", h.Expiry, ch.htlcMinDuration(), paymentTime)
+	}
+	return nil
+}
+
+// lockedAmount is the part of role's balance locked in the pending HTLC.
+func (ch *Channel) lockedAmount(role Role) xlm.Amount {
+	if ch.HTLC == nil || ch.HTLC.Sender != role {
+		return 0
+	}
+	return ch.HTLC.Amount
+}
+
+// guestSettleAmount is the amount the settlement txs pay the guest.
+// It excludes any amount the guest has locked in an HTLC.
+func (ch *Channel) guestSettleAmount() xlm.Amount {
+	return ch.GuestAmount - ch.lockedAmount(Guest)
+}
+
+// hostSettleAmount is the amount the settlement txs pay the host
+// before merging the escrow account, when an HTLC is pending.
+func (ch *Channel) hostSettleAmount() xlm.Amount {
+	amt := ch.HostAmount - ch.lockedAmount(Host)
+	if ch.HTLC != nil {
+		amt -= htlcSignerReserve
+	}
+	return amt
+}
+
+// spendableAmount is the amount role can pay in a channel payment.
+func (ch *Channel) spendableAmount(role Role) xlm.Amount {
+	if role == Guest {
+		return ch.guestSettleAmount()
+	}
+	return ch.hostSettleAmount()
+}
+
+// SpendableAmount is the amount the channel's own side
+// can pay in a channel payment or lock in a new HTLC.
+func (ch *Channel) SpendableAmount() xlm.Amount {
+	return ch.spendableAmount(ch.Role)
+}
+
+// hasSettleFunds reports whether both balances cover
+// their part of the channel's pending HTLC.
+func (ch *Channel) hasSettleFunds() bool {
+	return ch.guestSettleAmount() >= 0 && ch.hostSettleAmount() >= 0
+}
+
+// nextHTLC returns the HTLC that will be pending
+// once the current payment round completes.
+func (ch *Channel) nextHTLC() *HTLC {
+	switch ch.PendingHTLCOp {
+	case HTLCAdd:
+		return ch.PendingHTLC
+	case HTLCFulfill, HTLCRefund:
+		return nil
+	}
+	return ch.HTLC
+}
+
+// htlcSeqNum is the sequence number of the claim and refund txs
+// for the current round, following its settlement txs.
+func (ch *Channel) htlcSeqNum() xdr.SequenceNumber {
+	if ch.guestSettleAmount() == 0 {
+		return ch.roundSeqNum() + 3
+	}
+	return ch.roundSeqNum() + 4
+}
+
+// settleWithHostMutators returns the operations of the settlement tx
+// that pays the host. Normally it releases any asset and merges the
+// channel accounts into the host's account. With an HTLC pending,
+// the escrow account instead stays open holding the HTLC amount,
+// re-keyed so it can be spent only by the recipient with the preimage,
+// or by the sender with the recipient's presigned refund tx.
+func (ch *Channel) settleWithHostMutators() []b.TransactionMutator {
+	if ch.HTLC == nil {
+		return append(ch.releaseAssetMutators(), ch.escrowMergeMutators()...)
+	}
+	var m []b.TransactionMutator
+	if amt := ch.hostSettleAmount(); amt > 0 {
+		m = append(m, b.Payment(
+			b.SourceAccount{AddressOrSeed: ch.EscrowAcct.Address()},
+			b.Destination{AddressOrSeed: ch.HostAcct.Address()},
+			ch.assetAmount(amt),
+		))
+	}
+	m = append(m,
+		b.AccountMerge(
+			b.SourceAccount{AddressOrSeed: ch.GuestRatchetAcct.Address()},
+			b.Destination{AddressOrSeed: ch.HostAcct.Address()},
+		),
+		b.AccountMerge(
+			b.SourceAccount{AddressOrSeed: ch.HostRatchetAcct.Address()},
+			b.Destination{AddressOrSeed: ch.HostAcct.Address()},
+		),
+	)
+	// The recipient's key has weight 2 and the sender's weight 1,
+	// so the recipient needs either the preimage or the sender.
+	hostWeight, guestWeight := uint32(2), uint32(1)
+	if ch.HTLC.Sender == Host {
+		hostWeight, guestWeight = 1, 2
+	}
+	hashX, _ := strkey.Encode(strkey.VersionByteHashX, ch.HTLC.Hash[:]) // cannot fail with a 32-byte hash
+	m = append(m,
+		b.SetOptions(
+			b.SourceAccount{AddressOrSeed: ch.EscrowAcct.Address()},
+			b.MasterWeight(hostWeight),
+			b.SetThresholds(3, 3, 3),
+			b.AddSigner(ch.GuestAcct.Address(), guestWeight),
+		),
+		b.SetOptions(
+			b.SourceAccount{AddressOrSeed: ch.EscrowAcct.Address()},
+			b.AddSigner(hashX, 1),
+		),
+	)
+	return m
+}
+
+// htlcPayoutMutators returns the operations resolving an HTLC left
+// in the escrow account: paying its amount to role,
+// then merging the escrow account into the host's account.
+func (ch *Channel) htlcPayoutMutators(role Role) []b.TransactionMutator {
+	dest := ch.HostAcct
+	if role == Guest {
+		dest = ch.GuestAcct
+	}
+	return []b.TransactionMutator{
+		b.Payment(
+			b.SourceAccount{AddressOrSeed: ch.EscrowAcct.Address()},
+			b.Destination{AddressOrSeed: dest.Address()},
+			ch.assetAmount(ch.HTLC.Amount),
+		),
+		b.AccountMerge(
+			b.SourceAccount{AddressOrSeed: ch.EscrowAcct.Address()},
+			b.Destination{AddressOrSeed: ch.HostAcct.Address()},
+		),
+	}
+}
+
+// buildHTLCClaimTx builds the tx with which the recipient claims
+// an HTLC left in the escrow account, before it expires.
+func buildHTLCClaimTx(ch *Channel) (*b.TransactionBuilder, error) {
+	maxTime := uint64(ch.HTLC.Expiry.Unix())
+	if maxTime > math.MaxInt64 {
+		return nil, checked.ErrOverflow
+	}
+	m := []b.TransactionMutator{b.Timebounds{MaxTime: maxTime}}
+	m = append(m, ch.htlcPayoutMutators(ch.HTLC.recipient())...)
+	return ch.buildEscrowTx(ch.HTLC.SettleSeqNum+1, m...)
+}
+
+// buildHTLCRefundTx builds the tx returning an expired HTLC
+// to its sender, following the current round's settlement txs.
+func buildHTLCRefundTx(ch *Channel) (*b.TransactionBuilder, error) {
+	minTime := uint64(ch.HTLC.Expiry.Unix())
+	if minTime > math.MaxInt64 {
+		return nil, checked.ErrOverflow
+	}
+	m := []b.TransactionMutator{b.Timebounds{MinTime: minTime}}
+	m = append(m, ch.htlcPayoutMutators(ch.HTLC.Sender)...)
+	return ch.buildEscrowTx(ch.htlcSeqNum(), m...)
+}
+
+// htlcChange validates the HTLC change in a payment proposed
+// by the counterparty, returning the change and the HTLC
+// that will be pending once the round completes.
+func (u *Updater) htlcChange(p *PaymentProposeMsg) (HTLCOp, *HTLC, error) {
+	var (
+		op HTLCOp
+		n  int
+	)
+	if p.HTLC != nil {
+		op = HTLCAdd
+		n++
+	}
+	if p.HTLCPreimage != nil {
+		op = HTLCFulfill
+		n++
+	}
+	if p.HTLCRefund {
+		op = HTLCRefund
+		n++
+	}
+	if n > 1 {
+		return "", nil, errors.Wrap(ErrInvalidHTLC, "multiple HTLC changes")
+	}
+
+	sender := Host
+	if u.C.Role == Host {
+		sender = Guest
+	}
+	h := u.C.HTLC
+	switch op {
+	case "":
+		return "", h, nil
+
+	case HTLCAdd:
+		if h != nil {
+			return "", nil, errHTLCInProgress
+		}
+		if p.PaymentAmount != 0 {
+			return "", nil, errors.Wrapf(ErrInvalidHTLC, "payment amount %s with new HTLC", p.PaymentAmount)
+		}
+		next := &HTLC{
+			Sender: sender,
+			Amount: p.HTLC.Amount,
+			Hash:   p.HTLC.Hash,
+			Expiry: p.HTLC.Expiry,
+			Route:  p.HTLC.Route,
+		}
+		if err := u.C.checkHTLC(next, p.PaymentTime); err != nil {
+			return "", nil, err
+		}
+		return op, next, nil
+	}
+
+	if op == HTLCRefund && h != nil && h.Sender == u.C.Role {
+		// The recipient can cancel the HTLC at any time.
+		if p.PaymentAmount != 0 {
+			return "", nil, errors.Wrapf(ErrInvalidHTLC, "payment amount %s with cancel", p.PaymentAmount)
+		}
+		return op, nil, nil
+	}
+	if h == nil || h.Sender != sender {
+		return "", nil, errors.Wrapf(ErrInvalidHTLC, "no HTLC from %s", sender)
+	}
+	switch op {
+	case HTLCFulfill:
+		if !h.matches(p.HTLCPreimage) {
+			return "", nil, ErrInvalidPreimage
+		}
+		if p.PaymentAmount != h.Amount {
+			return "", nil, errors.Wrapf(ErrInvalidHTLC, "payment amount %s fulfilling HTLC of %s", p.PaymentAmount, h.Amount)
+		}
+	case HTLCRefund:
+		if p.PaymentAmount != 0 {
+			return "", nil, errors.Wrapf(ErrInvalidHTLC, "payment amount %s with refund", p.PaymentAmount)
+		}
+		if u.LedgerTime.Before(h.Expiry) {
+			return "", nil, errors.Wrapf(ErrInvalidHTLC, "refund before expiry %s", h.Expiry)
+		}
+	}
+	return op, nil, nil
+}
+
+// completeHTLCRound applies the HTLC change of the payment round
+// that just completed. If the channel's sender of the resulting HTLC,
+// it also stores the refund tx for the round, signed with the
+// recipient's refundSig and its own key.
+func (u *Updater) completeHTLCRound(refundSig *xdr.DecoratedSignature) error {
+	u.C.HTLC = u.C.nextHTLC()
+	u.C.PendingHTLCOp = ""
+	u.C.PendingHTLC = nil
+	u.C.PendingHTLCRefundSig = nil
+	if u.C.HTLC == nil || u.C.HTLC.Sender != u.C.Role {
+		return nil
+	}
+	if refundSig == nil {
+		return errors.Wrap(ErrInvalidHTLC, "missing refund tx signature")
+	}
+	refundTx, err := buildHTLCRefundTx(u.C)
+	if err != nil {
+		return err
+	}
+	sig, err := detachedSig(refundTx.TX, u.Seed, u.C.Passphrase, u.C.KeyIndex)
+	if err != nil {
+		return err
+	}
+	u.C.HTLC.RefundTx = &xdr.TransactionEnvelope{
+		Tx:         *refundTx.TX,
+		Signatures: []xdr.DecoratedSignature{*refundSig, sig},
+	}
+	return nil
+}
+
+// verifyHTLCRefundSig checks the counterparty's signature
+// on the refund tx of ch's HTLC.
+func verifyHTLCRefundSig(ch *Channel, verifyKey keypair.KP, sig *xdr.DecoratedSignature) error {
+	if sig == nil {
+		return errors.Wrap(ErrInvalidHTLC, "missing refund tx signature")
+	}
+	refundTx, err := buildHTLCRefundTx(ch)
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(verifySig(refundTx, verifyKey, *sig), "HTLC refund tx")
+}
+
+// htlcRefundSig signs the refund tx of ch's HTLC, if ch's role is its recipient.
+func htlcRefundSig(seed []byte, ch *Channel) (*xdr.DecoratedSignature, error) {
+	if ch.HTLC == nil || ch.HTLC.recipient() != ch.Role {
+		return nil, nil
+	}
+	refundTx, err := buildHTLCRefundTx(ch)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := detachedSig(refundTx.TX, seed, ch.Passphrase, ch.KeyIndex)
+	if err != nil {
+		return nil, err
+	}
+	return &sig, nil
+}
+
+// htlcTimerTime returns the time at which the channel's HTLC
+// next needs attention, or nil if it needs none.
+func (ch *Channel) htlcTimerTime() *time.Time {
+	h := ch.HTLC
+	if h == nil {
+		return nil
+	}
+	var t time.Time
+	switch {
+	case h.Sender == ch.Role && ch.State == Open && h.Preimage != nil:
+		// HTLCFulfillTimeout, immediately
+		t = ch.PaymentTime
+	case h.Sender == ch.Role && ch.State == Open:
+		// HTLCExpiryTimeout
+		t = h.Expiry
+	case h.recipient() == ch.Role && h.Preimage != nil:
+		// HTLCClaimTimeout
+		t = ch.htlcClaimDeadline()
+	default:
+		return nil
+	}
+	return &t
+}
+
+// htlcTimeout handles the HTLC timers of an open channel.
+// The sender pays a fulfilled HTLC or refunds an expired one,
+// and a recipient that has not been paid in time force closes the channel.
+func (u *Updater) htlcTimeout() error {
+	h := u.C.HTLC
+	if h == nil {
+		return nil
+	}
+	switch {
+	case h.Sender == u.C.Role && u.C.State == Open && h.Preimage != nil:
+		u.debugf("HTLCFulfillTimeout...")
+		return u.proposePayment(h.Amount, u.LedgerTime, HTLCFulfill, nil)
+
+	case h.Sender == u.C.Role && u.C.State == Open && !u.LedgerTime.Before(h.Expiry):
+		u.debugf("HTLCExpiryTimeout...")
+		return u.proposePayment(0, u.LedgerTime, HTLCRefund, nil)
+
+	case h.recipient() == u.C.Role && h.Preimage != nil && !u.LedgerTime.Before(u.C.htlcClaimDeadline()):
+		u.debugf("HTLCClaimTimeout...")
+		return u.setForceCloseState()
+	}
+	return nil
+}
+
+func (u *Updater) handleHTLCFulfillMsg(m *Message) error {
+	h := u.C.HTLC
+	if h == nil || h.Sender != u.C.Role {
+		u.debugf("dropped message: no HTLC sent by %s", u.C.Role)
+		return nil
+	}
+	if !h.matches(m.HTLCFulfillMsg.Preimage) {
+		u.debugf("dropped message: %s", ErrInvalidPreimage)
+		return nil
+	}
+	h.Preimage = m.HTLCFulfillMsg.Preimage
+	if u.C.State != Open {
+		// The HTLC timer pays it once the channel is open again.
+		return nil
+	}
+	return u.proposePayment(h.Amount, u.LedgerTime, HTLCFulfill, nil)
+}
+
+// handleHTLCTx recognizes the claim and refund txs
+// of an HTLC left in the escrow account after a force close.
+func handleHTLCTx(u *Updater, tx *worizon.Tx, success bool) (bool, error) {
+	h := u.C.HTLC
+	if h == nil || u.C.State != AwaitingHTLC {
+		return false, nil
+	}
+	for _, role := range []Role{h.recipient(), h.Sender} {
+		want, err := u.C.buildEscrowTx(0, u.C.htlcPayoutMutators(role)...)
+		if err != nil {
+			return false, err
+		}
+		if !txMatches(tx, u.C.EscrowAcct, want.TX.Operations...) {
+			continue
+		}
+		if !success {
+			// Our own claim or refund tx failed.
+			// A refund can be retried once the HTLC expires.
+			u.logf("HTLC %s tx failed", role)
+			return true, nil
+		}
+		if role == h.recipient() && h.Preimage == nil {
+			for _, sig := range tx.Env.Signatures {
+				if h.matches(sig.Signature) {
+					h.Preimage = sig.Signature
+				}
+			}
+		}
+		return true, u.transitionTo(Closed)
+	}
+	return false, nil
+}
+
+func publishHTLCClaimTx(seed []byte, ch *Channel, o Outputter) error {
+	tx, err := buildHTLCClaimTx(ch)
+	if err != nil {
+		return err
+	}
+	sig, err := detachedSig(tx.TX, seed, ch.Passphrase, ch.KeyIndex)
+	if err != nil {
+		return err
+	}
+	var hint xdr.SignatureHint
+	copy(hint[:], ch.HTLC.Hash[28:])
+	env := xdr.TransactionEnvelope{
+		Tx: *tx.TX,
+		Signatures: []xdr.DecoratedSignature{
+			sig,
+			{Hint: hint, Signature: ch.HTLC.Preimage},
+		},
+	}
+	o.OutputTx(env)
+	return nil
+}
+
+// publishHTLCRefundTx publishes the sender's refund tx
+// for an expired HTLC left in the escrow account.
+func (u *Updater) publishHTLCRefundTx() error {
+	h := u.C.HTLC
+	h.RefundPublished = true
+	if h.RefundTx == nil || h.RefundTx.Tx.SeqNum != h.SettleSeqNum+1 {
+		u.logf("UNRECOVERABLE FAILURE: no refund tx for HTLC settled at sequence number %d, abandoning HTLC!", h.SettleSeqNum)
+		return u.transitionTo(Closed)
+	}
+	u.O.OutputTx(*h.RefundTx)
+	return nil
+}
+
+func createHTLCFulfillMsg(seed []byte, ch *Channel) (*Message, error) {
+	m := &Message{
+		ChannelID: ch.ID,
+		HTLCFulfillMsg: &HTLCFulfillMsg{
+			Preimage: ch.HTLC.Preimage,
+		},
+		Version: version,
+		MsgNum:  ch.LastMsgIndex + 1,
+	}
+	return m.signMsg(seed)
+}
+
+func sendHTLCFulfillMsg(seed []byte, ch *Channel, o Outputter) error {
+	m, err := createHTLCFulfillMsg(seed, ch)
+	if err != nil {
+		return err
+	}
+	o.OutputMsg(m)
+	return nil
+}
@@ -0,0 +1,348 @@
+package fsm
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+	"time"
+
+	"github.com/stellar/go/xdr"
+
+	"github.com/interstellar/starlight/errors"
+	"github.com/interstellar/starlight/worizon"
+	"github.com/interstellar/starlight/worizon/xlm"
+)
+
+var (
+	testPreimage = []byte("starlight htlc test preimage")
+	testHash     = xdr.Hash(sha256.Sum256(testPreimage))
+)
+
+// recorder is an Outputter that keeps its output.
+type recorder struct {
+	msgs []*Message
+	txs  []xdr.TransactionEnvelope
+}
+
+func (r *recorder) OutputMsg(m *Message)                { r.msgs = append(r.msgs, m) }
+func (r *recorder) OutputTx(tx xdr.TransactionEnvelope) { r.txs = append(r.txs, tx) }
+
+// htlcTestPair is an open channel seen by both its host and its guest.
+type htlcTestPair struct {
+	host, guest       *Updater
+	hostOut, guestOut *recorder
+}
+
+func newHTLCTestPair(t *testing.T, now time.Time) *htlcTestPair {
+	p := &htlcTestPair{hostOut: new(recorder), guestOut: new(recorder)}
+	for _, role := range []Role{Host, Guest} {
+		ch, err := createTestChannel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ch.Role = role
+		ch.State = Open
+		ch.PendingAmountSent = 0
+		ch.PaymentTime = now
+		u := &Updater{C: ch, H: createTestHost(), LedgerTime: now}
+		switch role {
+		case Host:
+			u.O, u.Seed = p.hostOut, []byte(hostSeed)
+			p.host = u
+		case Guest:
+			ch.KeyIndex = 0
+			u.O, u.Seed = p.guestOut, []byte(guestSeed)
+			p.guest = u
+		}
+	}
+	return p
+}
+
+func (p *htlcTestPair) setTime(now time.Time) {
+	p.host.LedgerTime = now
+	p.guest.LedgerTime = now
+}
+
+// deliver passes messages between the host and guest until neither has any left.
+func (p *htlcTestPair) deliver(t *testing.T) {
+	for {
+		var (
+			out *recorder
+			to  *Updater
+		)
+		switch {
+		case len(p.hostOut.msgs) > 0:
+			out, to = p.hostOut, p.guest
+		case len(p.guestOut.msgs) > 0:
+			out, to = p.guestOut, p.host
+		default:
+			return
+		}
+		m := out.msgs[0]
+		out.msgs = out.msgs[1:]
+		if err := to.Msg(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func (p *htlcTestPair) addHTLC(t *testing.T, sender *Updater, amount xlm.Amount, expiry time.Time) {
+	err := sender.Cmd(&Command{
+		Name:       ConditionalPay,
+		Amount:     amount,
+		HTLCHash:   testHash,
+		HTLCExpiry: expiry,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.deliver(t)
+	for _, u := range []*Updater{p.host, p.guest} {
+		if u.C.State != Open {
+			t.Fatalf("%s got state %s, want %s", u.C.Role, u.C.State, Open)
+		}
+		if u.C.HTLC == nil {
+			t.Fatalf("%s has no HTLC", u.C.Role)
+		}
+	}
+}
+
+func (p *htlcTestPair) checkBalances(t *testing.T, hostAmount, guestAmount xlm.Amount) {
+	t.Helper()
+	for _, u := range []*Updater{p.host, p.guest} {
+		if u.C.HostAmount != hostAmount || u.C.GuestAmount != guestAmount {
+			t.Errorf("%s got balances %s/%s, want %s/%s", u.C.Role, u.C.HostAmount, u.C.GuestAmount, hostAmount, guestAmount)
+		}
+	}
+}
+
+func TestHTLCFulfill(t *testing.T) {
+	now := time.Date(2018, 9, 24, 11, 03, 00, 0, time.UTC)
+	p := newHTLCTestPair(t, now)
+	p.addHTLC(t, p.host, xlm.Lumen, now.Add(time.Hour))
+	p.checkBalances(t, 2*xlm.Lumen, 2*xlm.Lumen)
+	if p.host.C.HTLC.RefundTx == nil {
+		t.Fatal("sender has no refund tx")
+	}
+
+	// The locked amount cannot be spent.
+	err := p.host.Cmd(&Command{Name: ChannelPay, Amount: xlm.Lumen})
+	if errors.Root(err) != ErrInsufficientFunds {
+		t.Errorf("got error %v, want %v", err, ErrInsufficientFunds)
+	}
+	err = p.host.Cmd(&Command{Name: CloseChannel})
+	if errors.Root(err) != errHTLCPending {
+		t.Errorf("got error %v, want %v", err, errHTLCPending)
+	}
+
+	err = p.guest.Cmd(&Command{Name: FulfillHTLC, Preimage: []byte("wrong")})
+	if errors.Root(err) != ErrInvalidPreimage {
+		t.Errorf("got error %v, want %v", err, ErrInvalidPreimage)
+	}
+	err = p.guest.Cmd(&Command{Name: FulfillHTLC, Preimage: testPreimage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.deliver(t)
+	for _, u := range []*Updater{p.host, p.guest} {
+		if u.C.State != Open {
+			t.Errorf("%s got state %s, want %s", u.C.Role, u.C.State, Open)
+		}
+		if u.C.HTLC != nil {
+			t.Errorf("%s still has HTLC", u.C.Role)
+		}
+	}
+	p.checkBalances(t, xlm.Lumen, 3*xlm.Lumen)
+}
+
+func TestHTLCRefund(t *testing.T) {
+	now := time.Date(2018, 9, 24, 11, 03, 00, 0, time.UTC)
+	expiry := now.Add(time.Hour)
+	p := newHTLCTestPair(t, now)
+	p.addHTLC(t, p.guest, xlm.Lumen, expiry)
+
+	if tt := p.guest.C.htlcTimerTime(); tt == nil || !tt.Equal(expiry) {
+		t.Errorf("got sender HTLC timer %v, want %v", tt, expiry)
+	}
+	if tt := p.host.C.htlcTimerTime(); tt != nil {
+		t.Errorf("got recipient HTLC timer %v, want none", tt)
+	}
+
+	// A payment in the meantime keeps the channel alive
+	// and gives the sender a new refund tx.
+	p.setTime(expiry.Add(-30 * time.Second))
+	err := p.host.Cmd(&Command{Name: ChannelPay, Amount: 500 * xlm.Millilumen})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.deliver(t)
+	if got := p.guest.C.HTLC.RefundTx.Tx.SeqNum; got != p.guest.C.htlcSeqNum() {
+		t.Errorf("got refund tx seqnum %d, want %d", got, p.guest.C.htlcSeqNum())
+	}
+
+	p.setTime(expiry)
+	if err = p.guest.Time(); err != nil {
+		t.Fatal(err)
+	}
+	if p.guest.C.State != PaymentProposed {
+		t.Fatalf("got state %s, want %s", p.guest.C.State, PaymentProposed)
+	}
+	p.deliver(t)
+	for _, u := range []*Updater{p.host, p.guest} {
+		if u.C.HTLC != nil {
+			t.Errorf("%s still has HTLC", u.C.Role)
+		}
+	}
+	p.checkBalances(t, 1500*xlm.Millilumen, 2500*xlm.Millilumen)
+}
+
+func TestHTLCForceClose(t *testing.T) {
+	now := time.Date(2018, 9, 24, 11, 03, 00, 0, time.UTC)
+	p := newHTLCTestPair(t, now)
+	p.addHTLC(t, p.host, xlm.Lumen, now.Add(time.Hour))
+
+	// The recipient learns the preimage during the force close.
+	p.host.C.State = AwaitingSettlement
+	p.guest.C.State = AwaitingSettlement
+	err := p.guest.Cmd(&Command{Name: FulfillHTLC, Preimage: testPreimage})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	settleTx, err := buildSettleWithHostTx(p.guest.C, p.guest.C.PaymentTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ptx := &worizon.Tx{
+		Env:    &xdr.TransactionEnvelope{Tx: *settleTx.TX},
+		Result: new(xdr.TransactionResult),
+	}
+	for _, u := range []*Updater{p.host, p.guest} {
+		if err = u.Tx(ptx); err != nil {
+			t.Fatal(err)
+		}
+		if u.C.State != AwaitingHTLC {
+			t.Fatalf("%s got state %s, want %s", u.C.Role, u.C.State, AwaitingHTLC)
+		}
+	}
+	if got, want := p.host.C.HTLC.RefundTx.Tx.SeqNum, settleTx.TX.SeqNum+1; got != want {
+		t.Errorf("got refund tx seqnum %d, want %d", got, want)
+	}
+
+	if len(p.guestOut.txs) != 1 {
+		t.Fatalf("got %d claim txs, want 1", len(p.guestOut.txs))
+	}
+	claim := p.guestOut.txs[0]
+	if len(claim.Signatures) != 2 || !bytes.Equal(claim.Signatures[1].Signature, testPreimage) {
+		t.Fatalf("claim tx not signed with preimage: %+v", claim.Signatures)
+	}
+	if err = p.host.Tx(&worizon.Tx{Env: &claim, Result: new(xdr.TransactionResult)}); err != nil {
+		t.Fatal(err)
+	}
+	if p.host.C.State != Closed {
+		t.Errorf("got state %s, want %s", p.host.C.State, Closed)
+	}
+	if !bytes.Equal(p.host.C.HTLC.Preimage, testPreimage) {
+		t.Errorf("got preimage %q, want %q", p.host.C.HTLC.Preimage, testPreimage)
+	}
+}
+
+func TestConditionalPayErrors(t *testing.T) {
+	now := time.Date(2018, 9, 24, 11, 03, 00, 0, time.UTC)
+	cases := []struct {
+		name    string
+		amount  xlm.Amount
+		expiry  time.Time
+		chFunc  func(*Channel)
+		wantErr error
+	}{
+		{
+			name:    "expiry too soon",
+			amount:  xlm.Lumen,
+			expiry:  now.Add(time.Minute),
+			wantErr: ErrInvalidHTLC,
+		},
+		{
+			name:    "zero amount",
+			expiry:  now.Add(time.Hour),
+			wantErr: ErrInvalidHTLC,
+		},
+		{
+			name:    "no host reserve",
+			amount:  1600 * xlm.Millilumen,
+			expiry:  now.Add(time.Hour),
+			wantErr: ErrInsufficientFunds,
+		},
+		{
+			name:    "non-native asset",
+			amount:  xlm.Lumen,
+			expiry:  now.Add(time.Hour),
+			chFunc:  func(ch *Channel) { ch.Asset.SetCredit("USD", xdr.AccountId(ch.HostAcct)) },
+			wantErr: ErrInvalidHTLC,
+		},
+		{
+			name:    "not open",
+			amount:  xlm.Lumen,
+			expiry:  now.Add(time.Hour),
+			chFunc:  func(ch *Channel) { ch.State = PaymentProposed },
+			wantErr: ErrUnexpectedState,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p := newHTLCTestPair(t, now)
+			if c.chFunc != nil {
+				c.chFunc(p.host.C)
+			}
+			err := p.host.Cmd(&Command{
+				Name:       ConditionalPay,
+				Amount:     c.amount,
+				HTLCHash:   testHash,
+				HTLCExpiry: c.expiry,
+			})
+			if errors.Root(err) != c.wantErr {
+				t.Errorf("got error %v, want %v", err, c.wantErr)
+			}
+		})
+	}
+}
+
+func TestHTLCCancel(t *testing.T) {
+	now := time.Date(2018, 9, 24, 11, 03, 00, 0, time.UTC)
+	expiry := now.Add(time.Hour)
+	route := []Hop{{ChannelID: "next", Amount: 900 * xlm.Millilumen, Expiry: expiry.Add(-30 * time.Minute)}}
+	p := newHTLCTestPair(t, now)
+	err := p.host.Cmd(&Command{
+		Name:       ConditionalPay,
+		Amount:     xlm.Lumen,
+		HTLCHash:   testHash,
+		HTLCExpiry: expiry,
+		Route:      route,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.deliver(t)
+	if h := p.guest.C.HTLC; h == nil || len(h.Route) != 1 || h.Route[0] != route[0] {
+		t.Fatalf("got recipient HTLC %+v, want route %+v", h, route)
+	}
+
+	err = p.host.Cmd(&Command{Name: CancelHTLC})
+	if errors.Root(err) != ErrInvalidHTLC {
+		t.Errorf("got error %v, want %v", err, ErrInvalidHTLC)
+	}
+	err = p.guest.Cmd(&Command{Name: CancelHTLC})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.deliver(t)
+	for _, u := range []*Updater{p.host, p.guest} {
+		if u.C.State != Open {
+			t.Errorf("%s got state %s, want %s", u.C.Role, u.C.State, Open)
+		}
+		if u.C.HTLC != nil {
+			t.Errorf("%s still has HTLC", u.C.Role)
+		}
+	}
+	p.checkBalances(t, 2*xlm.Lumen, 2*xlm.Lumen)
+}
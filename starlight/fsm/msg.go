@@ -28,6 +28,9 @@ type Message struct {
 	PaymentAcceptMsg   *PaymentAcceptMsg   `json:",omitempty"`
 	PaymentCompleteMsg *PaymentCompleteMsg `json:",omitempty"`
 	CloseMsg           *CloseMsg           `json:",omitempty"`
+	HTLCFulfillMsg     *HTLCFulfillMsg     `json:",omitempty"`
+	ChannelCounterMsg  *ChannelCounterMsg  `json:",omitempty"`
+	WithdrawalMsg      *WithdrawalMsg      `json:",omitempty"`
 
 	// Signature is a signature over the JSON representation of the message
 	// (minus the Signature field itself), made with the sender's key.
@@ -58,6 +61,31 @@ type ChannelProposeMsg struct {
 	HostAmount         xlm.Amount
 	Feerate            xlm.Amount
 	FundingTime        time.Time
+	Asset              xdr.Asset // the zero value denotes lumens
+}
+
+// ChannelCounterMsg is a guest's counter-proposal to a ChannelProposeMsg
+// whose timing parameters it does not accept.
+// It is returned in the guest's response to the proposal,
+// rather than sent with the channel's other messages,
+// since the guest does not create the channel.
+type ChannelCounterMsg struct {
+	MaxRoundDuration time.Duration
+	FinalityDelay    time.Duration
+}
+
+// NewChannelCounterMsg returns a signed counter-proposal
+// to the proposal of channel chanID.
+func NewChannelCounterMsg(seed []byte, chanID string, maxRoundDuration, finalityDelay time.Duration) (*Message, error) {
+	m := &Message{
+		ChannelID: chanID,
+		ChannelCounterMsg: &ChannelCounterMsg{
+			MaxRoundDuration: maxRoundDuration,
+			FinalityDelay:    finalityDelay,
+		},
+		Version: version,
+	}
+	return m.signMsg(seed)
 }
 
 // ChannelAcceptMsg contains Signatures for Guest accepting a proposal.
@@ -73,6 +101,30 @@ type PaymentProposeMsg struct {
 	PaymentAmount            xlm.Amount
 	SenderSettleWithGuestSig xdr.DecoratedSignature
 	SenderSettleWithHostSig  xdr.DecoratedSignature
+
+	// At most one of HTLC, HTLCPreimage, and HTLCRefund is set,
+	// adding, fulfilling, or refunding an HTLC in this round.
+	// HTLCRefundSig is the sender's signature on the refund tx
+	// of an HTLC it receives, pending after this round.
+	HTLC          *HTLCTerms              `json:",omitempty"`
+	HTLCPreimage  []byte                  `json:",omitempty"`
+	HTLCRefund    bool                    `json:",omitempty"`
+	HTLCRefundSig *xdr.DecoratedSignature `json:",omitempty"`
+
+	// Withdrawal is set if the sender also withdraws
+	// part of its balance in this round.
+	Withdrawal *WithdrawalTerms `json:",omitempty"`
+
+	// TopUp is set if the guest tops up the channel in this round.
+	// It is the round's only change.
+	TopUp *TopUpTerms `json:",omitempty"`
+
+	// Payments describes the ChannelPay payments, if any,
+	// making up PaymentAmount, so the recipient can record
+	// their IDs, memos, and invoice IDs.
+	// In a merge payment, the payments were described
+	// in the sender's original proposal.
+	Payments []PaymentIntent `json:",omitempty"`
 }
 
 // PaymentAcceptMsg is the protocol message accepting a proposed channel payment.
@@ -81,12 +133,27 @@ type PaymentAcceptMsg struct {
 	RecipientRatchetSig         xdr.DecoratedSignature
 	RecipientSettleWithGuestSig *xdr.DecoratedSignature
 	RecipientSettleWithHostSig  xdr.DecoratedSignature
+	HTLCRefundSig               *xdr.DecoratedSignature `json:",omitempty"`
+
+	// TopUpSig is the host's signature on the guest's top-up tx,
+	// if the round makes a top-up.
+	TopUpSig *xdr.DecoratedSignature `json:",omitempty"`
 }
 
 // PaymentCompleteMsg is the protocol message acknowledging a PaymentAcceptMsg.
 type PaymentCompleteMsg struct {
 	RoundNumber      uint64
 	SenderRatchetSig xdr.DecoratedSignature
+
+	// WithdrawalSeqNum is the sequence number of the sender's
+	// withdrawal tx, if the round makes a withdrawal.
+	WithdrawalSeqNum xdr.SequenceNumber `json:",omitempty"`
+}
+
+// HTLCFulfillMsg is the protocol message revealing the preimage
+// of an HTLC to its sender, asking to be paid.
+type HTLCFulfillMsg struct {
+	Preimage []byte
 }
 
 // CloseMsg is the protocol message proposing a cooperative closure of the channel.
@@ -98,6 +165,20 @@ func (u *Updater) handlePaymentCompleteMsg(m *Message) error {
 	if u.C.State != PaymentAccepted {
 		return errors.Wrap(ErrUnexpectedState, u.C.State)
 	}
+	complete := m.PaymentCompleteMsg
+	if u.C.guestTopUpPending() {
+		// The round completes once the top-up tx is on the ledger.
+		return u.holdGuestTopUpComplete(complete)
+	}
+	if err := u.completePayment(complete); err != nil {
+		return err
+	}
+	return u.transitionTo(Open)
+}
+
+// completePayment completes the round u.C accepted,
+// checking the sender's signature on its ratchet tx.
+func (u *Updater) completePayment(complete *PaymentCompleteMsg) error {
 	var (
 		senderRatchetAccount AccountID
 		senderRatchetSeqNum  xdr.SequenceNumber
@@ -125,11 +206,11 @@ func (u *Updater) handlePaymentCompleteMsg(m *Message) error {
 			return err
 		}
 	}
+	u.C.applyWithdrawal()
 	ratchetTx, err := buildRatchetTx(u.C, u.C.PendingPaymentTime, senderRatchetAccount, senderRatchetSeqNum)
 	if err != nil {
 		return err
 	}
-	complete := m.PaymentCompleteMsg
 	if err = verifySig(ratchetTx, senderKey, complete.SenderRatchetSig); err != nil {
 		return errors.Wrap(err, "ratchet tx")
 	}
@@ -139,15 +220,39 @@ func (u *Updater) handlePaymentCompleteMsg(m *Message) error {
 	if err != nil {
 		return err
 	}
+	// Now that the round's ratchet tx is countersigned,
+	// the sender's withdrawal, if any, can be signed.
+	err = u.sendWithdrawalMsg(complete.WithdrawalSeqNum)
+	if err != nil {
+		return err
+	}
+	err = u.completeHTLCRound(u.C.PendingHTLCRefundSig)
+	if err != nil {
+		return err
+	}
 	u.C.PaymentTime = u.C.PendingPaymentTime
 	u.C.PendingAmountReceived = 0
 	u.C.PendingAmountSent = 0
-	return u.transitionTo(Open)
+	u.completePayments()
+	return nil
 }
 
 func (u *Updater) handlePaymentAcceptMsg(m *Message) error {
 	accept := m.PaymentAcceptMsg
+	if u.C.guestTopUpPending() {
+		// The round completes once the top-up tx is on the ledger.
+		return u.publishGuestTopUpTx(accept)
+	}
+	if err := u.acceptPayment(accept); err != nil {
+		return err
+	}
+	return u.transitionTo(Open)
+}
 
+// acceptPayment completes the round u.C proposed,
+// checking the recipient's signatures on its ratchet
+// and settlement txs.
+func (u *Updater) acceptPayment(accept *PaymentAcceptMsg) error {
 	var (
 		err              error
 		recipientAccount AccountID
@@ -172,6 +277,17 @@ func (u *Updater) handlePaymentAcceptMsg(m *Message) error {
 	if err != nil {
 		return err
 	}
+	u.C.applyWithdrawal()
+	// The round's settlement txs reflect its HTLC change.
+	err = u.completeHTLCRound(accept.HTLCRefundSig)
+	if err != nil {
+		return err
+	}
+	if u.C.HTLC != nil && u.C.HTLC.Sender == u.C.Role {
+		if err = verifyHTLCRefundSig(u.C, recipientKey, accept.HTLCRefundSig); err != nil {
+			return err
+		}
+	}
 	ratchetTx, err := buildRatchetTx(u.C, u.C.PendingPaymentTime, recipientAccount, recipientSeqNum)
 	if err != nil {
 		return err
@@ -182,7 +298,7 @@ func (u *Updater) handlePaymentAcceptMsg(m *Message) error {
 
 	var hostTx *b.TransactionBuilder
 
-	if u.C.GuestAmount == 0 {
+	if u.C.guestSettleAmount() == 0 {
 		hostTx, err = buildSettleOnlyWithHostTx(u.C, u.C.PendingPaymentTime)
 	} else {
 		hostTx, err = buildSettleWithHostTx(u.C, u.C.PendingPaymentTime)
@@ -197,7 +313,7 @@ func (u *Updater) handlePaymentAcceptMsg(m *Message) error {
 
 	var guestTx *b.TransactionBuilder
 	var recipientSettleWithGuestSig *xdr.DecoratedSignature
-	if u.C.GuestAmount == 0 {
+	if u.C.guestSettleAmount() == 0 {
 		if accept.RecipientSettleWithGuestSig != nil {
 			return ErrUnusedSettleWithGuestSig
 		}
@@ -222,10 +338,12 @@ func (u *Updater) handlePaymentAcceptMsg(m *Message) error {
 	if err != nil {
 		return err
 	}
+	u.reserveWithdrawal()
 	u.C.PaymentTime = u.C.PendingPaymentTime
 	u.C.PendingAmountReceived = 0
 	u.C.PendingAmountSent = 0
-	return u.transitionTo(Open)
+	u.completePayments()
+	return nil
 }
 
 func (u *Updater) handleChannelProposeMsg(m *Message) error {
@@ -240,6 +358,15 @@ func (u *Updater) handleChannelProposeMsg(m *Message) error {
 		return nil
 	}
 
+	if propose.Asset.Type != xdr.AssetTypeAssetTypeNative {
+		// The guest needs an authorized trustline
+		// to receive its balance at settlement.
+		bal, ok := u.H.Balances[propose.Asset.String()]
+		if !ok || !bal.Authorized {
+			return errors.Wrap(ErrUntrustedAsset, propose.Asset.String())
+		}
+	}
+
 	var EscrowAcct AccountID
 	err := EscrowAcct.SetAddress(string(m.ChannelID))
 	if err != nil {
@@ -266,11 +393,33 @@ func (u *Updater) handleChannelProposeMsg(m *Message) error {
 		Passphrase:             u.Passphrase,
 		CounterpartyAddress:    u.C.CounterpartyAddress,
 		ChannelFeerate:         propose.Feerate,
+		Asset:                  propose.Asset,
 	}
 
 	return u.transitionTo(AwaitingFunding)
 }
 
+// handleChannelCounterMsg proposes the channel again
+// with the guest's counter-proposed timing parameters.
+// The agent checks them against its own bounds first.
+func (u *Updater) handleChannelCounterMsg(m *Message) error {
+	counter := m.ChannelCounterMsg
+	if u.C.State != ChannelProposed {
+		return errors.Wrap(ErrUnexpectedState, u.C.State)
+	}
+	if u.C.Role != Host {
+		u.debugf("dropped message: guest cannot receive counter-proposal")
+		return nil
+	}
+	if counter.MaxRoundDuration <= 0 || counter.FinalityDelay <= 0 {
+		u.debugf("dropped message: counter-proposed max round duration %s, finality delay %s", counter.MaxRoundDuration, counter.FinalityDelay)
+		return nil
+	}
+	u.C.MaxRoundDuration = counter.MaxRoundDuration
+	u.C.FinalityDelay = counter.FinalityDelay
+	return u.transitionTo(ChannelProposed)
+}
+
 func (u *Updater) handleChannelAcceptMsg(m *Message) error {
 	accept := m.ChannelAcceptMsg
 	if u.C.State != ChannelProposed {
@@ -349,12 +498,53 @@ func (u *Updater) handlePaymentProposeMsg(m *Message) error {
 			return err
 		}
 	}
+	htlcOp, nextHTLC, err := u.htlcChange(payment)
+	if err != nil {
+		u.debugf("dropped message: %s", err)
+		return nil
+	}
+	if htlcOp != "" && u.C.State == AwaitingPaymentMerge {
+		u.debugf("dropped message: merge payment with HTLC change %s", htlcOp)
+		return nil
+	}
+	withdrawal, err := u.withdrawalTerms(payment)
+	if err != nil {
+		u.debugf("dropped message: %s", err)
+		return nil
+	}
+	if withdrawal != nil && u.C.State == AwaitingPaymentMerge {
+		u.debugf("dropped message: merge payment with withdrawal")
+		return nil
+	}
+	topUp, err := u.guestTopUpTerms(payment)
+	if err != nil {
+		u.debugf("dropped message: %s", err)
+		return nil
+	}
+	if topUp != nil && u.C.State == AwaitingPaymentMerge {
+		u.debugf("dropped message: merge payment with top-up")
+		return nil
+	}
+	if u.C.State != AwaitingPaymentMerge {
+		if err = validatePayments(payment); err != nil {
+			u.debugf("dropped message: %s", err)
+			return nil
+		}
+	}
+
 	// Verify signatures
 	ch2 := *u.C
+	ch2.HTLC = nextHTLC
+	ch2.PendingWithdrawal = withdrawal
 
 	if u.C.State == Open || u.C.State == AwaitingPaymentMerge {
 		ch2.RoundNumber++
 	}
+	if topUp != nil {
+		topUp.Round = ch2.RoundNumber
+		ch2.GuestTopUp = topUp
+		ch2.applyGuestTopUp()
+	}
 
 	switch ch2.Role {
 	case Guest:
@@ -364,9 +554,14 @@ func (u *Updater) handlePaymentProposeMsg(m *Message) error {
 		ch2.HostAmount += payment.PaymentAmount
 		ch2.GuestAmount -= payment.PaymentAmount
 	}
+	ch2.applyWithdrawal()
+	if !ch2.hasSettleFunds() {
+		u.debugf("dropped message: payment amount %s leaves balances short of pending HTLC or withdrawal", payment.PaymentAmount)
+		return nil
+	}
 
 	var settleWithHostTx, settleWithGuestTx *b.TransactionBuilder
-	if ch2.GuestAmount == 0 {
+	if ch2.guestSettleAmount() == 0 {
 		if payment.SenderSettleWithGuestSig.Signature != nil {
 			u.debugf("dropped message: %s", ErrUnusedSettleWithGuestSig)
 			return ErrUnusedSettleWithGuestSig
@@ -394,8 +589,42 @@ func (u *Updater) handlePaymentProposeMsg(m *Message) error {
 	if err = verifySig(settleWithHostTx, verifyKey, payment.SenderSettleWithHostSig); err != nil {
 		return errors.Wrap(err, "settle with host tx")
 	}
+	if ch2.HTLC != nil && ch2.HTLC.Sender == u.C.Role {
+		if err = verifyHTLCRefundSig(&ch2, verifyKey, payment.HTLCRefundSig); err != nil {
+			return err
+		}
+	}
 
-	switch u.C.State {
+	state := u.C.State
+	if state == PaymentProposed && (htlcOp != "" || u.C.PendingHTLCOp != "" || withdrawal != nil || u.C.PendingWithdrawal != nil || topUp != nil || u.C.guestTopUpPending()) {
+		// Payments that change the HTLC or make a withdrawal
+		// or top-up are not merged.
+		// The host's proposal wins. An abandoned withdrawal
+		// or top-up waits for the guest's next proposal.
+		if u.C.RoundNumber != payment.RoundNumber {
+			u.debugf("dropped message: payment round %d for channel round %d", payment.RoundNumber, u.C.RoundNumber)
+			return nil
+		}
+		if u.C.Role == Host {
+			u.debugf("dropped message: conflicts with proposed HTLC change")
+			return nil
+		}
+		u.debugf("abandoning proposed payment for conflicting host payment")
+		u.C.QueuedPayments = append(u.C.PendingPayments, u.C.QueuedPayments...)
+		u.C.PendingPayments = nil
+		u.C.PendingAmountSent = 0
+		u.C.PendingHTLCOp = ""
+		u.C.PendingHTLC = nil
+		u.C.PendingWithdrawal = nil
+		if u.C.guestTopUpPending() {
+			u.C.GuestTopUp.Round = 0
+			u.C.GuestTopUp.Time = time.Time{}
+		}
+		u.C.RoundNumber--
+		state = Open
+	}
+
+	switch state {
 	case Open, AwaitingPaymentMerge:
 		if u.C.RoundNumber >= payment.RoundNumber {
 			u.debugf("dropped message: payment round %d for channel round %d", payment.RoundNumber, u.C.RoundNumber)
@@ -420,7 +649,17 @@ func (u *Updater) handlePaymentProposeMsg(m *Message) error {
 			}
 		} else {
 			u.C.PendingAmountReceived = payment.PaymentAmount
+			u.C.PendingPaymentsReceived = payment.Payments
+			u.C.PendingHTLCOp = htlcOp
+			if htlcOp == HTLCAdd {
+				u.C.PendingHTLC = nextHTLC
+			}
+			u.C.PendingWithdrawal = withdrawal
+			if topUp != nil {
+				u.C.GuestTopUp = topUp
+			}
 		}
+		u.C.PendingHTLCRefundSig = payment.HTLCRefundSig
 		u.C.setCounterpartySettlementTxes(settleWithGuestTx, settleWithHostTx,
 			payment.SenderSettleWithGuestSig, payment.SenderSettleWithHostSig, u.Seed)
 		u.C.PendingPaymentTime = payment.PaymentTime
@@ -432,6 +671,7 @@ func (u *Updater) handlePaymentProposeMsg(m *Message) error {
 			u.debugf("dropped message: payment round %d for channel round %d", payment.RoundNumber, u.C.RoundNumber)
 			return nil
 		}
+		u.C.PendingPaymentsReceived = payment.Payments
 		if u.C.PendingAmountSent > payment.PaymentAmount || (u.C.PendingAmountSent == payment.PaymentAmount && u.C.Role == Host) {
 			// Create merged payment
 			u.C.RoundNumber++
@@ -445,12 +685,44 @@ func (u *Updater) handlePaymentProposeMsg(m *Message) error {
 	return nil
 }
 
+// validatePayments checks the payments described in p
+// against the limits on their fields and p's amount.
+func validatePayments(p *PaymentProposeMsg) error {
+	var total xlm.Amount
+	for _, pi := range p.Payments {
+		if err := pi.validate(); err != nil {
+			return err
+		}
+		if pi.Amount <= 0 || pi.Amount > p.PaymentAmount-total {
+			return errors.Wrapf(ErrInvalidPaymentInfo, "payment %s amount %s exceeds payment amount %s", pi.ID, pi.Amount, p.PaymentAmount)
+		}
+		total += pi.Amount
+	}
+	return nil
+}
+
 func (u *Updater) handleCloseMsg(m *Message) error {
 	switch u.C.State {
 	case Open, PaymentProposed, AwaitingClose: // Accepted states.
 	default:
 		return errors.Wrap(ErrUnexpectedState, u.C.State)
 	}
+	if u.C.HTLC != nil {
+		u.debugf("dropped message: %s", errHTLCPending)
+		return nil
+	}
+	if u.C.Withdrawal != nil {
+		u.debugf("dropped message: %s", errWithdrawalPending)
+		return nil
+	}
+	if t := u.C.GuestTopUp; t != nil {
+		if t.Round != 0 {
+			u.debugf("dropped message: %s", errTopUpInProgress)
+			return nil
+		}
+		// A top-up waiting for a round is abandoned.
+		u.refundGuestTopUp()
+	}
 
 	var verifyKey keypair.KP
 	var err error
@@ -1,6 +1,7 @@
 package fsm
 
 import (
+	"reflect"
 	"testing"
 	"time"
 
@@ -133,6 +134,48 @@ func TestHandleChannelAcceptMessage(t *testing.T) {
 	}
 }
 
+func TestHandleChannelCounterMsg(t *testing.T) {
+	ch, err := createTestChannel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch.Role = Host
+	out := new(recorder)
+	u := &Updater{
+		C:          ch,
+		O:          out,
+		H:          createTestHost(),
+		LedgerTime: ch.FundingTime,
+		Seed:       []byte(hostSeed),
+	}
+	u.transitionTo(ChannelProposed)
+	out.msgs = nil
+
+	m, err := NewChannelCounterMsg([]byte(hostSeed), ch.ID, 2*time.Hour, 3*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = u.Msg(m); err == nil {
+		t.Error("accepted counter-proposal not signed by guest")
+	}
+	m, err = NewChannelCounterMsg([]byte(guestSeed), ch.ID, 2*time.Hour, 3*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = u.Msg(m); err != nil {
+		t.Fatal(err)
+	}
+	if ch.MaxRoundDuration != 2*time.Hour || ch.FinalityDelay != 3*time.Hour {
+		t.Errorf("got max round duration %s, finality delay %s, want 2h, 3h", ch.MaxRoundDuration, ch.FinalityDelay)
+	}
+	if len(out.msgs) != 1 || out.msgs[0].ChannelProposeMsg == nil {
+		t.Fatalf("got messages %+v, want a channel proposal", out.msgs)
+	}
+	if got := out.msgs[0].ChannelProposeMsg.MaxRoundDuration; got != 2*time.Hour {
+		t.Errorf("got proposed max round duration %s, want 2h", got)
+	}
+}
+
 func TestHandlePaymentProposeMessage(t *testing.T) {
 	cases := []struct {
 		name         string
@@ -344,7 +387,10 @@ func TestHandlePaymentProposeMessage(t *testing.T) {
 			}
 
 			if c.senderUFunc != nil {
+				// The payment amount may change here,
+				// so the payment is no longer described.
 				c.senderUFunc(u)
+				u.C.PendingPayments = nil
 			}
 			m, err := createPaymentProposeMsg(senderSeed, sender)
 			if err != nil {
@@ -1043,3 +1089,161 @@ func TestMessageVersion(t *testing.T) {
 		t.Fatalf("got %s, want %s", err, ErrInvalidVersion)
 	}
 }
+
+func TestHandleChannelProposeMsgAsset(t *testing.T) {
+	ch, err := createTestAssetChannel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch.Role = Guest
+	ch.KeyIndex = 0
+	h := createTestHost()
+	m, err := createChannelProposeMsg([]byte(guestSeed), ch, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.ChannelProposeMsg.Asset.Equals(ch.Asset) {
+		t.Fatalf("got proposed asset %s, want %s", m.ChannelProposeMsg.Asset, ch.Asset)
+	}
+	u := &Updater{
+		C:          ch,
+		O:          ono{},
+		Seed:       []byte(seed),
+		H:          h,
+		Passphrase: ch.Passphrase,
+	}
+	err = u.transitionTo(Start)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = u.handleChannelProposeMsg(m)
+	if errors.Root(err) != ErrUntrustedAsset {
+		t.Fatalf("got error %v, want %s", err, ErrUntrustedAsset)
+	}
+
+	h.Balances = map[string]Balance{
+		ch.Asset.String(): {Asset: ch.Asset, Authorized: false},
+	}
+	err = u.handleChannelProposeMsg(m)
+	if errors.Root(err) != ErrUntrustedAsset {
+		t.Fatalf("got error %v, want %s", err, ErrUntrustedAsset)
+	}
+
+	h.Balances[ch.Asset.String()] = Balance{Asset: ch.Asset, Authorized: true}
+	err = u.handleChannelProposeMsg(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ch.Asset.Equals(m.ChannelProposeMsg.Asset) {
+		t.Fatalf("got Asset %s, want %s", ch.Asset, m.ChannelProposeMsg.Asset)
+	}
+	if ch.State != AwaitingFunding {
+		t.Fatalf("got state %s, want %s", ch.State, AwaitingFunding)
+	}
+}
+
+func TestBatchPayments(t *testing.T) {
+	now := time.Date(2018, 9, 24, 11, 03, 00, 0, time.UTC)
+	p := newHTLCTestPair(t, now)
+	pay := func(id string, amount xlm.Amount) error {
+		return p.host.Cmd(&Command{Name: ChannelPay, Amount: amount, PaymentID: id, Memo: "memo " + id})
+	}
+	if err := pay("a", 100*xlm.Millilumen); err != nil {
+		t.Fatal(err)
+	}
+	round := p.host.C.RoundNumber
+
+	// Payments made while the round is in progress are queued.
+	if err := pay("b", 200*xlm.Millilumen); err != nil {
+		t.Fatal(err)
+	}
+	if err := pay("c", 300*xlm.Millilumen); err != nil {
+		t.Fatal(err)
+	}
+	err := pay("d", 2*xlm.Lumen)
+	if errors.Root(err) != ErrInsufficientFunds {
+		t.Errorf("got error %v, want %v", err, ErrInsufficientFunds)
+	}
+	if got := len(p.host.C.QueuedPayments); got != 2 {
+		t.Fatalf("got %d queued payments, want 2", got)
+	}
+
+	// The round's completion starts a round settling the queue.
+	if err := p.guest.Msg(p.hostOut.msgs[0]); err != nil {
+		t.Fatal(err)
+	}
+	p.hostOut.msgs = p.hostOut.msgs[1:]
+	if err := p.host.Msg(p.guestOut.msgs[0]); err != nil {
+		t.Fatal(err)
+	}
+	p.guestOut.msgs = p.guestOut.msgs[1:]
+	if got := p.host.C.SettledPayments; len(got) != 1 || got[0].ID != "a" {
+		t.Errorf("got settled payments %+v, want a", got)
+	}
+	if p.host.C.State != PaymentProposed {
+		t.Fatalf("got host state %s, want %s", p.host.C.State, PaymentProposed)
+	}
+	if p.host.C.RoundNumber != round+1 {
+		t.Errorf("got round %d, want %d", p.host.C.RoundNumber, round+1)
+	}
+	if p.host.C.PendingAmountSent != 500*xlm.Millilumen {
+		t.Errorf("got pending amount %s, want %s", p.host.C.PendingAmountSent, 500*xlm.Millilumen)
+	}
+	p.host.C.SettledPayments = nil
+
+	p.deliver(t)
+	p.checkBalances(t, 1400*xlm.Millilumen, 2600*xlm.Millilumen)
+	got := p.host.C.SettledPayments
+	if len(got) != 2 || got[0].ID != "b" || got[1].ID != "c" || got[1].Memo != "memo c" {
+		t.Errorf("got settled payments %+v, want b and c", got)
+	}
+	if len(p.host.C.QueuedPayments) != 0 || len(p.host.C.PendingPayments) != 0 {
+		t.Error("payments left after settling the queue")
+	}
+}
+
+func TestPaymentMemos(t *testing.T) {
+	now := time.Date(2018, 9, 24, 11, 03, 00, 0, time.UTC)
+	p := newHTLCTestPair(t, now)
+	err := p.host.Cmd(&Command{
+		Name:      ChannelPay,
+		Amount:    xlm.Lumen,
+		Memo:      string(make([]byte, maxMemoLen+1)),
+		PaymentID: "a",
+	})
+	if errors.Root(err) != ErrInvalidPaymentInfo {
+		t.Errorf("got error %v, want %v", err, ErrInvalidPaymentInfo)
+	}
+	err = p.host.Cmd(&Command{
+		Name:      ChannelPay,
+		Amount:    xlm.Lumen,
+		PaymentID: "a",
+		Memo:      "order 17",
+		InvoiceID: "inv-17",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := p.hostOut.msgs[0]
+	want := []PaymentIntent{{ID: "a", Amount: xlm.Lumen, Memo: "order 17", InvoiceID: "inv-17"}}
+	if got := m.PaymentProposeMsg.Payments; !reflect.DeepEqual(got, want) {
+		t.Errorf("got payments %+v in message, want %+v", got, want)
+	}
+	p.deliver(t)
+	if got := p.guest.C.ReceivedPayments; !reflect.DeepEqual(got, want) {
+		t.Errorf("got received payments %+v, want %+v", got, want)
+	}
+	if p.guest.C.PendingPaymentsReceived != nil {
+		t.Error("guest has pending received payments after round")
+	}
+
+	// Payments totaling more than the payment amount are rejected.
+	bad := &PaymentProposeMsg{
+		PaymentAmount: xlm.Lumen,
+		Payments:      []PaymentIntent{{ID: "b", Amount: 2 * xlm.Lumen}},
+	}
+	if err := validatePayments(bad); errors.Root(err) != ErrInvalidPaymentInfo {
+		t.Errorf("got error %v, want %v", err, ErrInvalidPaymentInfo)
+	}
+}
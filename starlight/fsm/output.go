@@ -97,14 +97,18 @@ func createPaymentCompleteMsg(seed []byte, ch *Channel) (*Message, error) {
 	if err != nil {
 		return nil, err
 	}
+	complete := &PaymentCompleteMsg{
+		RoundNumber:      ch.RoundNumber,
+		SenderRatchetSig: senderRatchetSig,
+	}
+	if w := ch.Withdrawal; w != nil && w.Round == ch.RoundNumber && w.Tx == nil {
+		complete.WithdrawalSeqNum = w.SeqNum
+	}
 	m := &Message{
-		ChannelID: ch.ID,
-		PaymentCompleteMsg: &PaymentCompleteMsg{
-			RoundNumber:      ch.RoundNumber,
-			SenderRatchetSig: senderRatchetSig,
-		},
-		Version: version,
-		MsgNum:  ch.LastMsgIndex + 1,
+		ChannelID:          ch.ID,
+		PaymentCompleteMsg: complete,
+		Version:            version,
+		MsgNum:             ch.LastMsgIndex + 1,
 	}
 	return m.signMsg(seed)
 }
@@ -166,6 +170,7 @@ func createChannelProposeMsg(seed []byte, ch *Channel, h *WalletAcct) (*Message,
 			FundingTime:        ch.FundingTime,
 			BaseSequenceNumber: xdr.SequenceNumber(ch.BaseSequenceNumber),
 			Feerate:            ch.ChannelFeerate,
+			Asset:              ch.Asset,
 		},
 		Version: version,
 		MsgNum:  ch.LastMsgIndex + 1,
@@ -184,18 +189,10 @@ func sendChannelProposeMsg(seed []byte, ch *Channel, o Outputter, h *WalletAcct)
 
 func createPaymentProposeMsg(seed []byte, ch *Channel) (*Message, error) {
 	// We copy the Channel to construct signatures with updated PaymentAmount values.
-	ch2 := *ch
-	switch ch.Role {
-	case Guest:
-		ch2.GuestAmount -= ch.PendingAmountSent
-		ch2.HostAmount += ch.PendingAmountSent
-	case Host:
-		ch2.HostAmount -= ch.PendingAmountSent
-		ch2.GuestAmount += ch.PendingAmountSent
-	}
+	ch2 := ch.roundResult()
 
 	var settleWithHostSig, settleWithGuestSig xdr.DecoratedSignature
-	if ch2.GuestAmount == 0 {
+	if ch2.guestSettleAmount() == 0 {
 		settleOnlyWithHostTx, err := buildSettleOnlyWithHostTx(&ch2, ch2.PendingPaymentTime)
 		if err != nil {
 			return nil, err
@@ -222,17 +219,47 @@ func createPaymentProposeMsg(seed []byte, ch *Channel) (*Message, error) {
 			return nil, err
 		}
 	}
+	refundSig, err := htlcRefundSig(seed, &ch2)
+	if err != nil {
+		return nil, err
+	}
+	payment := &PaymentProposeMsg{
+		RoundNumber:              uint64(ch2.RoundNumber),
+		PaymentTime:              ch2.PendingPaymentTime,
+		PaymentAmount:            ch2.PendingAmountSent,
+		SenderSettleWithGuestSig: settleWithGuestSig,
+		SenderSettleWithHostSig:  settleWithHostSig,
+		HTLCRefundSig:            refundSig,
+		Payments:                 ch.PendingPayments,
+	}
+	switch ch.PendingHTLCOp {
+	case HTLCAdd:
+		payment.HTLC = &HTLCTerms{
+			Amount: ch.PendingHTLC.Amount,
+			Hash:   ch.PendingHTLC.Hash,
+			Expiry: ch.PendingHTLC.Expiry,
+			Route:  ch.PendingHTLC.Route,
+		}
+	case HTLCFulfill:
+		payment.HTLCPreimage = ch.HTLC.Preimage
+	case HTLCRefund:
+		payment.HTLCRefund = true
+	}
+	if w := ch.PendingWithdrawal; w != nil {
+		payment.Withdrawal = &WithdrawalTerms{
+			Amount: w.Amount,
+		}
+	}
+	if ch.guestTopUpPending() {
+		payment.TopUp = &TopUpTerms{
+			Amount: ch.GuestTopUp.Amount,
+		}
+	}
 	m := &Message{
-		ChannelID: ch2.ID,
-		PaymentProposeMsg: &PaymentProposeMsg{
-			RoundNumber:              uint64(ch2.RoundNumber),
-			PaymentTime:              ch2.PendingPaymentTime,
-			PaymentAmount:            ch2.PendingAmountSent,
-			SenderSettleWithGuestSig: settleWithGuestSig,
-			SenderSettleWithHostSig:  settleWithHostSig,
-		},
-		Version: version,
-		MsgNum:  ch.LastMsgIndex + 1,
+		ChannelID:         ch2.ID,
+		PaymentProposeMsg: payment,
+		Version:           version,
+		MsgNum:            ch.LastMsgIndex + 1,
 	}
 	return m.signMsg(seed)
 }
@@ -247,6 +274,17 @@ func sendPaymentProposeMsg(seed []byte, ch *Channel, o Outputter) error {
 }
 
 func createPaymentAcceptMsg(seed []byte, ch *Channel) (*Message, error) {
+	topUpSig, err := guestTopUpSig(seed, ch)
+	if err != nil {
+		return nil, err
+	}
+	if ch.guestTopUpPending() {
+		// The guest's ratchet tx for the round
+		// follows the bump in the top-up tx.
+		landed := *ch
+		landed.landGuestTopUp()
+		ch = &landed
+	}
 	var ratchetAccount AccountID
 	var ratchetSeqNum xdr.SequenceNumber
 	switch ch.Role {
@@ -266,17 +304,23 @@ func createPaymentAcceptMsg(seed []byte, ch *Channel) (*Message, error) {
 		return nil, err
 	}
 
-	guestAmount := ch.GuestAmount
+	// We copy the Channel to sign the refund tx
+	// for the HTLC pending after this round.
+	ch2 := *ch
+	delta := ch.PendingAmountReceived - ch.PendingAmountSent
 	switch ch.Role {
 	case Guest:
-		guestAmount += ch.PendingAmountReceived
-
+		ch2.GuestAmount += delta
+		ch2.HostAmount -= delta
 	case Host:
-		guestAmount -= ch.PendingAmountReceived
+		ch2.HostAmount += delta
+		ch2.GuestAmount -= delta
 	}
+	ch2.HTLC = ch.nextHTLC()
+	ch2.applyWithdrawal()
 
 	var settleWithGuestSig *xdr.DecoratedSignature
-	if guestAmount != 0 {
+	if ch.CounterpartyLatestSettleWithGuestTx != nil {
 		settleWithGuestSig = new(xdr.DecoratedSignature)
 		*settleWithGuestSig, err = detachedSig(&ch.CounterpartyLatestSettleWithGuestTx.Tx, seed, ch.Passphrase, ch.KeyIndex)
 		if err != nil {
@@ -288,6 +332,10 @@ func createPaymentAcceptMsg(seed []byte, ch *Channel) (*Message, error) {
 	if err != nil {
 		return nil, err
 	}
+	refundSig, err := htlcRefundSig(seed, &ch2)
+	if err != nil {
+		return nil, err
+	}
 	m := &Message{
 		ChannelID: ch.ID,
 		PaymentAcceptMsg: &PaymentAcceptMsg{
@@ -295,6 +343,8 @@ func createPaymentAcceptMsg(seed []byte, ch *Channel) (*Message, error) {
 			RecipientRatchetSig:         ratchetTxSig,
 			RecipientSettleWithGuestSig: settleWithGuestSig,
 			RecipientSettleWithHostSig:  settleWithHostSig,
+			HTLCRefundSig:               refundSig,
+			TopUpSig:                    topUpSig,
 		},
 		Version: version,
 		MsgNum:  ch.LastMsgIndex + 1,
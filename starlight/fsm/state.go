@@ -17,6 +17,7 @@ const (
 	AwaitingCleanup           State = "AwaitingCleanup"
 	AwaitingClose             State = "AwaitingClose"
 	AwaitingFunding           State = "AwaitingFunding"
+	AwaitingHTLC              State = "AwaitingHTLC"
 	AwaitingPaymentMerge      State = "AwaitingPaymentMerge"
 	AwaitingRatchet           State = "AwaitingRatchet"
 	AwaitingSettlement        State = "AwaitingSettlement"
@@ -59,6 +60,12 @@ func (u *Updater) transitionTo(newState State) error {
 			return publishFundingTx(u.Seed, u.C, u.O, u.H)
 		}
 
+	case AwaitingHTLC:
+		if u.C.HTLC.recipient() == u.C.Role && u.C.HTLC.Preimage != nil {
+			return publishHTLCClaimTx(u.Seed, u.C, u.O)
+		}
+		// sender's timer gets set
+
 	case AwaitingPaymentMerge:
 		return nil // nothing to do
 
@@ -87,8 +94,23 @@ func (u *Updater) transitionTo(newState State) error {
 				return publishTopUpTx(u.Seed, u.C, u.O, u.H)
 			}
 
+		case AwaitingFunding:
+			return u.proposeGuestTopUp(u.LedgerTime)
+
 		case PaymentProposed:
-			return sendPaymentCompleteMsg(u.Seed, u.C, u.O)
+			if err := sendPaymentCompleteMsg(u.Seed, u.C, u.O); err != nil {
+				return err
+			}
+			if err := u.proposeQueuedPayments(u.LedgerTime); err != nil {
+				return err
+			}
+			return u.proposeGuestTopUp(u.LedgerTime)
+
+		case PaymentAccepted:
+			if err := u.proposeQueuedPayments(u.LedgerTime); err != nil {
+				return err
+			}
+			return u.proposeGuestTopUp(u.LedgerTime)
 		}
 
 	case PaymentAccepted:
@@ -27,6 +27,9 @@ func (ch *Channel) TimerTime() (*time.Time, error) {
 	case Open, PaymentProposed, PaymentAccepted, AwaitingClose:
 		// RoundTimeout
 		t = ch.PaymentTime.Add(ch.MaxRoundDuration)
+		if ht := ch.htlcTimerTime(); ht != nil && ht.Before(t) {
+			t = *ht
+		}
 
 	case AwaitingSettlementMintime:
 		// SettlementMintimeTimeout
@@ -36,6 +39,14 @@ func (ch *Channel) TimerTime() (*time.Time, error) {
 			return nil, err
 		}
 
+	case AwaitingHTLC:
+		if ch.HTLC.Sender != ch.Role || ch.HTLC.RefundPublished {
+			return nil, nil
+		}
+
+		// HTLCRefundTimeout
+		t = ch.HTLC.Expiry
+
 	default:
 		return nil, nil
 	}
@@ -0,0 +1,326 @@
+package fsm
+
+import (
+	"math"
+	"time"
+
+	b "github.com/stellar/go/build"
+	"github.com/stellar/go/keypair"
+	"github.com/stellar/go/xdr"
+
+	"github.com/interstellar/starlight/errors"
+	"github.com/interstellar/starlight/math/checked"
+	"github.com/interstellar/starlight/starlight/key"
+	"github.com/interstellar/starlight/worizon"
+	"github.com/interstellar/starlight/worizon/xlm"
+)
+
+// GuestTopUp is a payment from the guest's wallet account
+// into the escrow account, adding to the guest's balance.
+// It is made in a payment round proposed by the guest,
+// whose settlement txs pay the guest Amount more.
+// The top-up tx, sourced from the escrow account,
+// also bumps the sequence number of the host ratchet account,
+// and the guest's ratchet tx for the round is valid only after that.
+// So the guest publishes the top-up tx only once it holds the host's
+// signatures on that round's txs, and neither party
+// completes the round until the top-up tx is on the ledger.
+type GuestTopUp struct {
+	Amount xlm.Amount
+
+	// Round and Time are the number and payment time
+	// of the round making the top-up, once proposed.
+	Round uint64    `json:",omitempty"`
+	Time  time.Time `json:",omitempty"`
+
+	// Accept is the host's PaymentAcceptMsg for the round,
+	// and Tx the top-up tx, signed by both parties,
+	// held by the guest until the tx is on the ledger.
+	Accept *PaymentAcceptMsg        `json:",omitempty"`
+	Tx     *xdr.TransactionEnvelope `json:",omitempty"`
+
+	// Complete is the guest's PaymentCompleteMsg for the round,
+	// held by the host if it arrives before the top-up tx.
+	Complete *PaymentCompleteMsg `json:",omitempty"`
+}
+
+// TopUpTerms are the terms of a top-up proposed by the guest.
+type TopUpTerms struct {
+	Amount xlm.Amount
+}
+
+// guestTopUpFn reserves a top-up of c.Amount, and the fee
+// for the top-up tx, from the guest's wallet.
+// The top-up is made in the next payment round the guest proposes.
+// The guest can top up a channel it has just accepted,
+// funding it once it is open.
+func guestTopUpFn(c *Command, u *Updater) error {
+	switch u.C.State {
+	case AwaitingFunding, Open, PaymentProposed, PaymentAccepted, AwaitingPaymentMerge:
+	default:
+		return errors.Wrapf(ErrUnexpectedState, "got %s, want %s", u.C.State, Open)
+	}
+	if u.C.GuestTopUp != nil {
+		return errTopUpInProgress
+	}
+	if c.Amount <= 0 {
+		return errors.Wrapf(ErrInvalidTopUp, "amount %s", c.Amount)
+	}
+	fee := u.C.guestTopUpFee()
+	if bal := u.H.assetBalance(u.C.Asset); c.Amount > bal || (u.C.IsNative() && c.Amount+fee > bal) {
+		return errors.Wrapf(ErrInsufficientFunds, "balance %d", bal)
+	}
+	if u.H.NativeBalance < fee {
+		return errors.Wrapf(ErrInsufficientFunds, "wallet balance %d", u.H.NativeBalance)
+	}
+	u.H.addAssetBalance(u.C.Asset, -c.Amount)
+	u.H.NativeBalance -= fee
+	u.C.GuestTopUp = &GuestTopUp{Amount: c.Amount}
+	return u.proposeGuestTopUp(c.Time)
+}
+
+// proposeGuestTopUp starts a payment round to make the guest's
+// waiting top-up, if the channel is open.
+// No top-up is made while an HTLC is pending,
+// or in round 2, while the host's ratchet tx is still
+// sourced from the host ratchet account; a zero payment
+// is proposed first to complete that round.
+func (u *Updater) proposeGuestTopUp(now time.Time) error {
+	t := u.C.GuestTopUp
+	if t == nil || t.Round != 0 || u.C.State != Open || u.C.HTLC != nil {
+		return nil
+	}
+	return u.proposePayment(0, now, "", nil)
+}
+
+// guestTopUpFee is the fee for the top-up tx, which the escrow
+// account pays and the guest pays back into it.
+func (ch *Channel) guestTopUpFee() xlm.Amount {
+	return 3 * ch.ChannelFeerate
+}
+
+// guestTopUpPending tells whether the current round makes a guest top-up.
+func (ch *Channel) guestTopUpPending() bool {
+	t := ch.GuestTopUp
+	return t != nil && t.Round != 0 && t.Round == ch.RoundNumber
+}
+
+// applyGuestTopUp adds the current round's guest top-up, if any,
+// to the guest's balance.
+func (ch *Channel) applyGuestTopUp() {
+	if ch.guestTopUpPending() {
+		ch.GuestAmount += ch.GuestTopUp.Amount
+	}
+}
+
+// landGuestTopUp records that the current round's top-up tx
+// is on the ledger.
+func (ch *Channel) landGuestTopUp() {
+	ch.GuestAmount += ch.GuestTopUp.Amount
+	ch.HostRatchetAcctSeqNum += 2
+	ch.GuestTopUpCount++
+	ch.GuestTopUp = nil
+}
+
+// escrowSeqNum is the sequence number of the escrow account
+// while the channel is open. Each guest top-up tx uses one.
+func (ch *Channel) escrowSeqNum() xdr.SequenceNumber {
+	return ch.BaseSequenceNumber + xdr.SequenceNumber(ch.GuestTopUpCount)
+}
+
+// buildGuestTopUpTx builds the tx paying t.Amount, and the tx's fee,
+// from the guest's wallet account into the escrow account.
+// It bumps the host ratchet account past the guest's ratchet txs
+// for earlier rounds, so that the round making the top-up
+// takes effect only with it. Being sourced from the escrow account,
+// it is invalid once a ratchet tx is on the ledger.
+func buildGuestTopUpTx(ch *Channel, t *GuestTopUp) (*b.TransactionBuilder, error) {
+	maxTime := uint64(t.Time.Add(ch.MaxRoundDuration).Unix())
+	if maxTime > math.MaxInt64 {
+		return nil, checked.ErrOverflow
+	}
+	return ch.buildTx(
+		ch.EscrowAcct,
+		ch.escrowSeqNum()+1,
+		ch.ChannelFeerate,
+		b.Timebounds{MaxTime: maxTime},
+		b.Payment(
+			b.SourceAccount{AddressOrSeed: ch.GuestAcct.Address()},
+			b.Destination{AddressOrSeed: ch.EscrowAcct.Address()},
+			ch.assetAmount(t.Amount),
+		),
+		b.Payment(
+			b.SourceAccount{AddressOrSeed: ch.GuestAcct.Address()},
+			b.Destination{AddressOrSeed: ch.EscrowAcct.Address()},
+			b.NativeAmount{Amount: ch.guestTopUpFee().HorizonString()},
+		),
+		b.BumpSequence(
+			b.SourceAccount{AddressOrSeed: ch.HostRatchetAcct.Address()},
+			b.BumpTo(ch.HostRatchetAcctSeqNum+2),
+		),
+	)
+}
+
+// guestTopUpSig is the host's signature on the top-up tx
+// of the round it is accepting, if the round makes one.
+// It signs for the escrow account and the host ratchet account.
+func guestTopUpSig(seed []byte, ch *Channel) (*xdr.DecoratedSignature, error) {
+	if !ch.guestTopUpPending() {
+		return nil, nil
+	}
+	tx, err := buildGuestTopUpTx(ch, ch.GuestTopUp)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := detachedSig(tx.TX, seed, ch.Passphrase, ch.KeyIndex)
+	if err != nil {
+		return nil, err
+	}
+	return &sig, nil
+}
+
+// publishGuestTopUpTx checks the host's acceptance
+// of the round making the guest's top-up,
+// against the channel as it will be once the top-up tx
+// is on the ledger, then signs and publishes the tx.
+// The acceptance is held until the tx is on the ledger.
+func (u *Updater) publishGuestTopUpTx(accept *PaymentAcceptMsg) error {
+	t := u.C.GuestTopUp
+	if t.Tx != nil {
+		u.debugf("dropped message: top-up tx already published")
+		return nil
+	}
+	if accept.TopUpSig == nil {
+		return errors.Wrap(ErrInvalidTopUp, "missing top-up tx signature")
+	}
+	landed := *u.C
+	landed.landGuestTopUp()
+	u2 := *u
+	u2.C = &landed
+	if err := u2.acceptPayment(accept); err != nil {
+		return err
+	}
+	tx, err := buildGuestTopUpTx(u.C, t)
+	if err != nil {
+		return err
+	}
+	escrowKey, err := keypair.Parse(u.C.EscrowAcct.Address())
+	if err != nil {
+		return err
+	}
+	if err = verifySig(tx, escrowKey, *accept.TopUpSig); err != nil {
+		return errors.Wrap(err, "top-up tx")
+	}
+	mySig, err := detachedSig(tx.TX, u.Seed, u.C.Passphrase, key.PrimaryAccountIndex)
+	if err != nil {
+		return err
+	}
+	t.Accept = accept
+	t.Tx = &xdr.TransactionEnvelope{
+		Tx:         *tx.TX,
+		Signatures: []xdr.DecoratedSignature{*accept.TopUpSig, mySig},
+	}
+	u.O.OutputTx(*t.Tx)
+	return nil
+}
+
+// holdGuestTopUpComplete checks the guest's completion
+// of the round making its top-up, against the channel
+// as it will be once the top-up tx is on the ledger,
+// and holds it until then.
+func (u *Updater) holdGuestTopUpComplete(complete *PaymentCompleteMsg) error {
+	landed := *u.C
+	landed.landGuestTopUp()
+	u2 := *u
+	u2.C = &landed
+	if err := u2.completePayment(complete); err != nil {
+		return err
+	}
+	u.C.GuestTopUp.Complete = complete
+	return nil
+}
+
+// guestTopUpTerms validates the top-up in a payment
+// proposed by the guest. A top-up is the only change
+// in its round, and is not made in round 2.
+func (u *Updater) guestTopUpTerms(p *PaymentProposeMsg) (*GuestTopUp, error) {
+	if p.TopUp == nil {
+		return nil, nil
+	}
+	switch {
+	case u.C.Role != Host:
+		return nil, errors.Wrap(ErrInvalidTopUp, "proposed by host")
+	case p.TopUp.Amount <= 0:
+		return nil, errors.Wrapf(ErrInvalidTopUp, "amount %s", p.TopUp.Amount)
+	case p.PaymentAmount != 0 || p.HTLC != nil || p.HTLCPreimage != nil || p.HTLCRefund || p.Withdrawal != nil:
+		return nil, errors.Wrap(ErrInvalidTopUp, "round makes other changes")
+	case u.C.HTLC != nil:
+		return nil, errors.Wrap(ErrInvalidTopUp, "HTLC pending")
+	case u.C.RoundNumber < 2:
+		return nil, errors.Wrapf(ErrInvalidTopUp, "in round %d", u.C.RoundNumber+1)
+	}
+	if _, ok := checked.AddInt64(int64(u.C.GuestAmount), int64(p.TopUp.Amount)); !ok {
+		return nil, checked.ErrOverflow
+	}
+	return &GuestTopUp{
+		Amount: p.TopUp.Amount,
+		Time:   p.PaymentTime,
+	}, nil
+}
+
+// refundGuestTopUp returns the guest's top-up,
+// abandoned or failed, and its fee to the wallet.
+func (u *Updater) refundGuestTopUp() {
+	t := u.C.GuestTopUp
+	if t == nil || u.C.Role != Guest {
+		return
+	}
+	u.H.addAssetBalance(u.C.Asset, t.Amount)
+	u.H.NativeBalance += u.C.guestTopUpFee()
+	u.C.GuestTopUp = nil
+}
+
+// handleGuestTopUpTx recognizes the top-up tx of the current round.
+// Once it is on the ledger, the round completes.
+// A guest whose own ratchet tx failed while the top-up tx was
+// in flight publishes the ratchet tx for the round instead.
+// Only the guest, which submits the tx, sees it fail.
+func handleGuestTopUpTx(u *Updater, ptx *worizon.Tx, success bool) (bool, error) {
+	t := u.C.GuestTopUp
+	if t == nil || t.Round == 0 {
+		return false, nil
+	}
+	tx, err := buildGuestTopUpTx(u.C, t)
+	if err != nil {
+		return false, err
+	}
+	if !txMatches(ptx, u.C.EscrowAcct, tx.TX.Operations...) {
+		return false, nil
+	}
+	if !success {
+		u.logf("top-up of %s failed, returning it to the wallet", t.Amount)
+		if ptx.Result.Result.Code == xdr.TransactionResultCodeTxFailed {
+			// The tx used the escrow account's sequence number.
+			u.C.GuestTopUpCount++
+		}
+		u.refundGuestTopUp()
+		if u.C.State == AwaitingRatchet {
+			return true, u.transitionTo(AwaitingRatchet)
+		}
+		return true, nil
+	}
+	accept, complete := t.Accept, t.Complete
+	u.C.landGuestTopUp()
+	switch {
+	case accept != nil && u.C.State == PaymentProposed:
+		return true, u.handlePaymentAcceptMsg(&Message{PaymentAcceptMsg: accept})
+	case accept != nil && u.C.State == AwaitingRatchet:
+		if err := u.acceptPayment(accept); err != nil {
+			return true, err
+		}
+		return true, u.transitionTo(AwaitingRatchet)
+	case complete != nil && u.C.State == PaymentAccepted:
+		return true, u.handlePaymentCompleteMsg(&Message{PaymentCompleteMsg: complete})
+	}
+	return true, nil
+}
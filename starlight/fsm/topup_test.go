@@ -0,0 +1,211 @@
+package fsm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stellar/go/xdr"
+
+	"github.com/interstellar/starlight/errors"
+	"github.com/interstellar/starlight/worizon"
+	"github.com/interstellar/starlight/worizon/xlm"
+)
+
+// startGuestTopUp tops up the guest's side of p's channel by amount
+// and delivers messages until the guest publishes the top-up tx,
+// which it returns.
+func startGuestTopUp(t *testing.T, p *htlcTestPair, amount xlm.Amount) xdr.TransactionEnvelope {
+	t.Helper()
+	err := p.guest.Cmd(&Command{Name: TopUp, Amount: amount})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.deliver(t)
+	if p.guest.C.State != PaymentProposed {
+		t.Fatalf("got guest state %s, want %s", p.guest.C.State, PaymentProposed)
+	}
+	if p.host.C.State != PaymentAccepted {
+		t.Fatalf("got host state %s, want %s", p.host.C.State, PaymentAccepted)
+	}
+	if len(p.guestOut.txs) != 1 {
+		t.Fatalf("got %d guest txs, want 1 top-up tx", len(p.guestOut.txs))
+	}
+	tx := p.guestOut.txs[0]
+	p.guestOut.txs = nil
+	return tx
+}
+
+func TestGuestTopUp(t *testing.T) {
+	now := time.Date(2018, 9, 24, 11, 03, 00, 0, time.UTC)
+	p := newHTLCTestPair(t, now)
+	walletBal := p.guest.H.NativeBalance
+	hostRatchetSeqNum := p.guest.C.HostRatchetAcctSeqNum
+
+	// Round 2 is a zero payment; round 3 makes the top-up.
+	topUpTx := startGuestTopUp(t, p, xlm.Lumen)
+	if p.guest.C.RoundNumber != 3 {
+		t.Errorf("got round %d, want 3", p.guest.C.RoundNumber)
+	}
+	if want := walletBal - xlm.Lumen - p.guest.C.guestTopUpFee(); p.guest.H.NativeBalance != want {
+		t.Errorf("got wallet balance %s, want %s", p.guest.H.NativeBalance, want)
+	}
+	if got := topUpTx.Tx.SourceAccount; !got.Equals(xdr.AccountId(p.guest.C.EscrowAcct)) {
+		t.Errorf("got top-up tx source %s, want escrow account", got.Address())
+	}
+	if want := p.guest.C.BaseSequenceNumber + 1; topUpTx.Tx.SeqNum != want {
+		t.Errorf("got top-up tx seqnum %d, want %d", topUpTx.Tx.SeqNum, want)
+	}
+	if len(topUpTx.Signatures) != 2 {
+		t.Errorf("got %d top-up tx signatures, want 2", len(topUpTx.Signatures))
+	}
+	// Until the top-up tx is on the ledger, neither party
+	// has a settlement tx paying out the top-up.
+	p.checkBalances(t, 2*xlm.Lumen, 2*xlm.Lumen)
+
+	ptx := &worizon.Tx{Env: &topUpTx, Result: new(xdr.TransactionResult)}
+	if err := p.guest.Tx(ptx); err != nil {
+		t.Fatal(err)
+	}
+	// The guest's PaymentCompleteMsg reaches the host before the tx.
+	p.deliver(t)
+	if p.host.C.State != PaymentAccepted {
+		t.Fatalf("got host state %s, want %s", p.host.C.State, PaymentAccepted)
+	}
+	if err := p.host.Tx(ptx); err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range []*Updater{p.host, p.guest} {
+		if u.C.State != Open {
+			t.Errorf("%s got state %s, want %s", u.C.Role, u.C.State, Open)
+		}
+		if u.C.GuestTopUp != nil {
+			t.Errorf("%s has guest top-up after its round", u.C.Role)
+		}
+		if want := hostRatchetSeqNum + 2; u.C.HostRatchetAcctSeqNum != want {
+			t.Errorf("%s got host ratchet seqnum %d, want %d", u.C.Role, u.C.HostRatchetAcctSeqNum, want)
+		}
+	}
+	p.checkBalances(t, 2*xlm.Lumen, 3*xlm.Lumen)
+	if got, want := p.guest.C.CurrentRatchetTx.Tx.SeqNum, hostRatchetSeqNum+3; got != want {
+		t.Errorf("got guest ratchet tx seqnum %d, want %d", got, want)
+	}
+
+	// The cooperative close tx follows the top-up tx.
+	closeTx, err := buildCooperativeCloseTx(p.host.C)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := closeTx.TX.SeqNum, p.host.C.BaseSequenceNumber+2; got != want {
+		t.Errorf("got coop close tx seqnum %d, want %d", got, want)
+	}
+}
+
+func TestGuestTopUpFailed(t *testing.T) {
+	now := time.Date(2018, 9, 24, 11, 03, 00, 0, time.UTC)
+	p := newHTLCTestPair(t, now)
+	walletBal := p.guest.H.NativeBalance
+	topUpTx := startGuestTopUp(t, p, xlm.Lumen)
+
+	err := p.guest.Tx(&worizon.Tx{
+		Env: &topUpTx,
+		Result: &xdr.TransactionResult{
+			Result: xdr.TransactionResultResult{Code: xdr.TransactionResultCodeTxTooLate},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.guest.C.GuestTopUp != nil {
+		t.Error("guest top-up still pending after its tx failed")
+	}
+	if p.guest.H.NativeBalance != walletBal {
+		t.Errorf("got wallet balance %s, want %s", p.guest.H.NativeBalance, walletBal)
+	}
+	p.checkBalances(t, 2*xlm.Lumen, 2*xlm.Lumen)
+}
+
+func TestGuestTopUpForceClose(t *testing.T) {
+	now := time.Date(2018, 9, 24, 11, 03, 00, 0, time.UTC)
+	p := newHTLCTestPair(t, now)
+	hostRatchetSeqNum := p.guest.C.HostRatchetAcctSeqNum
+	topUpTx := startGuestTopUp(t, p, xlm.Lumen)
+
+	// The guest force closes with the top-up tx in flight.
+	err := p.guest.Cmd(&Command{Name: ForceClose})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.guestOut.txs) != 1 {
+		t.Fatalf("got %d guest txs, want 1 ratchet tx", len(p.guestOut.txs))
+	}
+	ratchetTx := p.guestOut.txs[0]
+	p.guestOut.txs = nil
+
+	// The top-up tx lands first, so the ratchet tx for round 2 fails.
+	err = p.guest.Tx(&worizon.Tx{Env: &topUpTx, Result: new(xdr.TransactionResult)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.guest.Tx(&worizon.Tx{
+		Env: &ratchetTx,
+		Result: &xdr.TransactionResult{
+			Result: xdr.TransactionResultResult{Code: xdr.TransactionResultCodeTxBadSeq},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.guest.C.State != AwaitingRatchet {
+		t.Fatalf("got guest state %s, want %s", p.guest.C.State, AwaitingRatchet)
+	}
+	if len(p.guestOut.txs) != 1 {
+		t.Fatalf("got %d guest txs, want 1 ratchet tx", len(p.guestOut.txs))
+	}
+	if got, want := p.guestOut.txs[0].Tx.SeqNum, hostRatchetSeqNum+3; got != want {
+		t.Errorf("got ratchet tx seqnum %d, want %d", got, want)
+	}
+	if p.guest.C.GuestAmount != 3*xlm.Lumen {
+		t.Errorf("got guest balance %s, want %s", p.guest.C.GuestAmount, 3*xlm.Lumen)
+	}
+}
+
+func TestGuestFunding(t *testing.T) {
+	now := time.Date(2018, 9, 24, 11, 03, 00, 0, time.UTC)
+	p := newHTLCTestPair(t, now)
+	p.guest.C.State = AwaitingFunding
+	p.guest.C.GuestAmount = 0
+	p.host.C.GuestAmount = 0
+
+	err := p.guest.Cmd(&Command{Name: TopUp, Amount: 100 * xlm.Lumen})
+	if errors.Root(err) != ErrInsufficientFunds {
+		t.Errorf("got error %v, want %v", err, ErrInsufficientFunds)
+	}
+	err = p.guest.Cmd(&Command{Name: TopUp, Amount: 3 * xlm.Lumen})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.guestOut.msgs) != 0 {
+		t.Fatalf("got %d messages before the channel is open, want none", len(p.guestOut.msgs))
+	}
+
+	// Once the channel is open, the guest makes the top-up.
+	if err = p.guest.transitionTo(Open); err != nil {
+		t.Fatal(err)
+	}
+	topUpTx := p.guestOut.txs
+	p.deliver(t)
+	if len(topUpTx) != 0 || len(p.guestOut.txs) != 1 {
+		t.Fatalf("got %d guest txs, want 1 top-up tx", len(p.guestOut.txs))
+	}
+	ptx := &worizon.Tx{Env: &p.guestOut.txs[0], Result: new(xdr.TransactionResult)}
+	for _, u := range []*Updater{p.host, p.guest} {
+		if err = u.Tx(ptx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.deliver(t)
+	p.checkBalances(t, 2*xlm.Lumen, 3*xlm.Lumen)
+	if p.host.C.CurrentSettleWithGuestTx == nil {
+		t.Error("host has no settle with guest tx")
+	}
+}
@@ -2,6 +2,7 @@ package fsm
 
 import (
 	"bytes"
+	"math"
 
 	b "github.com/stellar/go/build"
 	"github.com/stellar/go/keypair"
@@ -22,7 +23,10 @@ var txHandlerFuncs = []func(*Updater, *worizon.Tx, bool) (bool, error){
 	handleRatchetTx,
 	handleSettleWithGuestTx,
 	handleSettleWithHostTx,
+	handleHTLCTx,
 	handleSetupAccountTx,
+	handleWithdrawalTx,
+	handleGuestTopUpTx,
 	handleTopUpTx,
 }
 
@@ -70,8 +74,8 @@ var (
 
 // MatchesFundingTx reports whether a transaction is the funding transaction for the channel.
 func MatchesFundingTx(c *Channel, tx *worizon.Tx) bool {
-	return txMatches(tx, c.HostAcct,
-		paymentOp(c.HostAcct, c.EscrowAcct, c.HostAmount+500*xlm.Millilumen+8*c.ChannelFeerate),
+	ops := []xdr.Operation{
+		paymentOp(c.HostAcct, c.EscrowAcct, c.escrowNativeFundingAmount()),
 		xdr.Operation{
 			SourceAccount: c.EscrowAcct.XDR(),
 			Body: xdr.OperationBody{
@@ -142,7 +146,14 @@ func MatchesFundingTx(c *Channel, tx *worizon.Tx) bool {
 				},
 			},
 		},
-	)
+	}
+	if !c.IsNative() {
+		ops = append(ops,
+			changeTrustOp(c.EscrowAcct, c.Asset, math.MaxInt64),
+			assetPaymentOp(c.HostAcct, c.EscrowAcct, c.Asset, c.HostAmount),
+		)
+	}
+	return txMatches(tx, c.HostAcct, ops...)
 }
 
 func handleFundingTx(u *Updater, tx *worizon.Tx, success bool) (bool, error) {
@@ -156,6 +167,7 @@ func handleFundingTx(u *Updater, tx *worizon.Tx, success bool) (bool, error) {
 		if u.C.Role == Host {
 			// Host gets back total funding tx-related amount.
 			u.H.NativeBalance += u.C.totalFundingTxAmount()
+			u.unreserveAssetAmount()
 			u.H.Seqnum++
 			err := u.transitionTo(AwaitingCleanup)
 			return true, err
@@ -170,12 +182,10 @@ func handleFundingTx(u *Updater, tx *worizon.Tx, success bool) (bool, error) {
 func handleCoopCloseTx(u *Updater, tx *worizon.Tx, success bool) (bool, error) {
 	// if guest has 0 balance,
 	// the coop close is matched by handleSettleWithHostTx
-	if !txMatches(tx, u.C.EscrowAcct,
-		paymentOp(u.C.EscrowAcct, u.C.GuestAcct, u.C.GuestAmount),
-		mergeOp(u.C.EscrowAcct, u.C.HostAcct),
-		mergeOp(u.C.GuestRatchetAcct, u.C.HostAcct),
-		mergeOp(u.C.HostRatchetAcct, u.C.HostAcct),
-	) {
+	ops := []xdr.Operation{assetPaymentOp(u.C.EscrowAcct, u.C.GuestAcct, u.C.Asset, u.C.GuestAmount)}
+	ops = append(ops, u.C.releaseAssetOps()...)
+	ops = append(ops, u.C.escrowMergeOps()...)
+	if !txMatches(tx, u.C.EscrowAcct, ops...) {
 		return false, nil
 	}
 	if u.C.State != AwaitingClose {
@@ -218,6 +228,19 @@ func handleRatchetTx(u *Updater, ptx *worizon.Tx, success bool) (bool, error) {
 		// It's a ratchet tx.
 
 		if !success {
+			if t := u.C.GuestTopUp; t != nil && t.Tx != nil {
+				// The guest's top-up tx, if it landed first,
+				// bumped the host ratchet account past this ratchet tx.
+				// The ratchet tx for the top-up's round is published once it is seen.
+				u.logf("ratchet tx failed with a top-up tx in flight, waiting for the top-up tx")
+				return true, nil
+			}
+			if cur := u.C.CurrentRatchetTx.Tx.SeqNum; cur != 0 && cur != tx.SeqNum {
+				// A newer ratchet tx, published after a top-up tx landed,
+				// replaces this one.
+				u.logf("outdated ratchet tx failed, ignoring")
+				return true, nil
+			}
 			// It's my ratchet tx, since we can only detect tx failures for transactions that we submit.
 			// TODO(vniu): add more detailed failure handling for different error cases, such as bump sequence target too low.
 			u.transitionTo(Closed)
@@ -249,12 +272,19 @@ func handleRatchetTx(u *Updater, ptx *worizon.Tx, success bool) (bool, error) {
 				u.C.GuestAmount = u.C.GuestAmount - u.C.PendingAmountReceived + u.C.PendingAmountSent
 				u.C.HostAmount = u.C.HostAmount + u.C.PendingAmountReceived - u.C.PendingAmountSent
 			}
+			// The round's settlement txs pay out less by its withdrawal,
+			// whose tx was never signed.
+			u.C.applyWithdrawal()
+			u.C.PendingWithdrawal = nil
 			u.C.RoundNumber++
+			if err := u.completeHTLCRound(u.C.PendingHTLCRefundSig); err != nil {
+				u.logf("no HTLC refund tx for round %d: %s", u.C.RoundNumber, err)
+			}
 			err := u.transitionTo(AwaitingSettlementMintime)
 			return true, err
 
 		default:
-			if u.C.Role == Guest && u.C.GuestAmount == 0 {
+			if u.C.Role == Guest && u.C.GuestAmount == 0 && u.C.HTLC == nil {
 				err := u.setForceCloseState()
 				return true, err
 			}
@@ -285,7 +315,7 @@ func handleSettleWithGuestTx(u *Updater, ptx *worizon.Tx, _ bool) (bool, error)
 	if !xdrEqual(op.Body.PaymentOp.Destination, xdr.AccountId(u.C.GuestAcct)) {
 		return false, nil
 	}
-	if op.Body.PaymentOp.Asset.Type != xdr.AssetTypeAssetTypeNative {
+	if !op.Body.PaymentOp.Asset.Equals(u.C.Asset) {
 		return false, nil
 	}
 	// skip checking the amount
@@ -298,11 +328,20 @@ func handleSettleWithGuestTx(u *Updater, ptx *worizon.Tx, _ bool) (bool, error)
 
 // also handles SettleRound1Tx
 func handleSettleWithHostTx(u *Updater, tx *worizon.Tx, _ bool) (bool, error) {
-	if !txMatches(tx, u.C.EscrowAcct,
-		mergeOp(u.C.EscrowAcct, u.C.HostAcct),
-		mergeOp(u.C.GuestRatchetAcct, u.C.HostAcct),
-		mergeOp(u.C.HostRatchetAcct, u.C.HostAcct),
-	) {
+	if u.C.HTLC != nil {
+		want, err := u.C.buildEscrowTx(0, u.C.settleWithHostMutators()...)
+		if err != nil {
+			return false, err
+		}
+		if txMatches(tx, u.C.EscrowAcct, want.TX.Operations...) {
+			// The HTLC stays in the escrow account until claimed or refunded.
+			u.C.HTLC.SettleSeqNum = tx.Env.Tx.SeqNum
+			err = u.transitionTo(AwaitingHTLC)
+			return true, err
+		}
+	}
+	ops := append(u.C.releaseAssetOps(), u.C.escrowMergeOps()...)
+	if !txMatches(tx, u.C.EscrowAcct, ops...) {
 		return false, nil
 	}
 	err := u.transitionTo(Closed)
@@ -332,18 +371,22 @@ func handleTopUpTx(u *Updater, ptx *worizon.Tx, success bool) (bool, error) {
 			if !xdrEqual(payOp.Destination, xdr.AccountId(u.C.EscrowAcct)) {
 				continue
 			}
+			if !payOp.Asset.Equals(u.C.Asset) {
+				continue
+			}
 			var ok bool
 			amt, ok = checked.AddInt64(amt, int64(payOp.Amount))
 			if !ok {
 				return false, checked.ErrOverflow
 			}
-			if payOp.Asset.Type != xdr.AssetTypeAssetTypeNative {
-				continue
-			}
 		case xdr.OperationTypeAccountMerge:
 			if !xdrEqual(op.Body.Destination, xdr.AccountId(u.C.EscrowAcct)) {
 				continue
 			}
+			if !u.C.IsNative() {
+				// merged lumens don't add to a non-native channel's balance
+				continue
+			}
 			var ok bool
 			mergeAmount := *(*ptx.Result.Result.Results)[index].Tr.AccountMergeResult.SourceAccountBalance
 			amt, ok = checked.AddInt64(amt, int64(mergeAmount))
@@ -428,21 +471,47 @@ func createAccountOp(src, dest AccountID, bal xlm.Amount) xdr.Operation {
 }
 
 func paymentOp(src, dest AccountID, amt xlm.Amount) xdr.Operation {
+	return assetPaymentOp(src, dest, xdr.Asset{Type: xdr.AssetTypeAssetTypeNative}, amt)
+}
+
+func assetPaymentOp(src, dest AccountID, asset xdr.Asset, amt xlm.Amount) xdr.Operation {
 	return xdr.Operation{
 		SourceAccount: src.XDR(),
 		Body: xdr.OperationBody{
 			Type: xdr.OperationTypePayment,
 			PaymentOp: &xdr.PaymentOp{
 				Destination: *dest.XDR(),
-				Asset: xdr.Asset{
-					Type: xdr.AssetTypeAssetTypeNative,
-				},
-				Amount: xdr.Int64(amt),
+				Asset:       asset,
+				Amount:      xdr.Int64(amt),
 			},
 		},
 	}
 }
 
+func changeTrustOp(src AccountID, asset xdr.Asset, limit int64) xdr.Operation {
+	return xdr.Operation{
+		SourceAccount: src.XDR(),
+		Body: xdr.OperationBody{
+			Type: xdr.OperationTypeChangeTrust,
+			ChangeTrustOp: &xdr.ChangeTrustOp{
+				Line:  asset,
+				Limit: xdr.Int64(limit),
+			},
+		},
+	}
+}
+
+func (ch *Channel) escrowMergeOps() []xdr.Operation {
+	var ops []xdr.Operation
+	if ch.IsNative() {
+		ops = append(ops, mergeOp(ch.EscrowAcct, ch.HostAcct))
+	}
+	return append(ops,
+		mergeOp(ch.GuestRatchetAcct, ch.HostAcct),
+		mergeOp(ch.HostRatchetAcct, ch.HostAcct),
+	)
+}
+
 func mergeOp(src, dest AccountID) xdr.Operation {
 	return xdr.Operation{
 		SourceAccount: src.XDR(),
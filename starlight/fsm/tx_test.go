@@ -12,6 +12,7 @@ import (
 	"github.com/stellar/go/network"
 	"github.com/stellar/go/xdr"
 
+	"github.com/interstellar/starlight/errors"
 	"github.com/interstellar/starlight/starlight/key"
 	"github.com/interstellar/starlight/worizon"
 	"github.com/interstellar/starlight/worizon/xlm"
@@ -565,3 +566,228 @@ func TestVerifyTxSig(t *testing.T) {
 		t.Errorf("expected %s, got %s", keypair.ErrInvalidSignature, err)
 	}
 }
+
+func createTestAssetChannel() (*Channel, error) {
+	ch, err := createTestChannel()
+	if err != nil {
+		return nil, err
+	}
+	var issuer xdr.AccountId
+	err = issuer.SetAddress(key.DeriveAccountPrimary([]byte(seed)).Address())
+	if err != nil {
+		return nil, err
+	}
+	err = ch.Asset.SetCredit("USD", issuer)
+	return ch, err
+}
+
+func TestAssetChannelTxs(t *testing.T) {
+	ch, err := createTestAssetChannel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := createTestHost()
+
+	builder, err := buildFundingTx(ch, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txenv, err := builder.Sign(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(txenv.E.Tx.Operations); got != 9 {
+		t.Errorf("got %d funding tx ops, want 9", got)
+	}
+	if !MatchesFundingTx(ch, &worizon.Tx{Env: txenv.E}) {
+		t.Error("asset funding tx not recognized")
+	}
+	native := *ch
+	native.Asset = xdr.Asset{}
+	if MatchesFundingTx(&native, &worizon.Tx{Env: txenv.E}) {
+		t.Error("asset funding tx recognized as native funding tx")
+	}
+
+	builder, err = buildSettleWithHostTx(ch, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	txenv, err = builder.Sign(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops := txenv.E.Tx.Operations
+	if len(ops) != 4 {
+		t.Fatalf("got %d settle with host tx ops, want 4", len(ops))
+	}
+	if ops[0].Body.Type != xdr.OperationTypePayment || !ops[0].Body.PaymentOp.Asset.Equals(ch.Asset) {
+		t.Errorf("settle with host tx does not pay host its asset balance")
+	}
+	if ops[1].Body.Type != xdr.OperationTypeSetOptions || ops[1].Body.SetOptionsOp.Signer == nil || ops[1].Body.SetOptionsOp.Signer.Weight != 0 {
+		t.Errorf("settle with host tx does not remove guest signer from escrow account")
+	}
+	for _, op := range ops {
+		if op.Body.Type == xdr.OperationTypeChangeTrust {
+			t.Errorf("settle with host tx removes escrow trustline")
+		}
+		if op.Body.Type == xdr.OperationTypeAccountMerge && xdrEqual(*op.SourceAccount, xdr.AccountId(ch.EscrowAcct)) {
+			t.Errorf("settle with host tx merges escrow account")
+		}
+	}
+
+	// Whatever else was sent to the escrow account
+	// is paid to the host when it releases the escrow account.
+	dust := xlm.Amount(1)
+	builder, err = BuildEscrowReleaseTx(ch, ch.BaseSequenceNumber+10, ch.HostAmount+dust)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := builder.TX
+	if release.SeqNum != ch.BaseSequenceNumber+11 {
+		t.Errorf("got escrow release tx seqnum %d, want %d", release.SeqNum, ch.BaseSequenceNumber+11)
+	}
+	if len(release.Operations) != 3 {
+		t.Fatalf("got %d escrow release tx ops, want 3", len(release.Operations))
+	}
+	if got := xlm.Amount(release.Operations[0].Body.PaymentOp.Amount); got != ch.HostAmount+dust {
+		t.Errorf("got escrow release payment %s, want %s", got, ch.HostAmount+dust)
+	}
+	if op := release.Operations[1]; op.Body.Type != xdr.OperationTypeChangeTrust || op.Body.ChangeTrustOp.Limit != 0 {
+		t.Errorf("escrow release tx does not remove escrow trustline")
+	}
+	if op := release.Operations[2]; op.Body.Type != xdr.OperationTypeAccountMerge {
+		t.Errorf("escrow release tx does not merge escrow account")
+	}
+	u := &Updater{
+		C:    ch,
+		O:    ono{},
+		H:    h,
+		Seed: []byte(seed),
+	}
+	ok, err := handleSettleWithHostTx(u, &worizon.Tx{Env: txenv.E}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("handleSettleWithHostTx returned not-ok status")
+	}
+
+	ch, err = createTestAssetChannel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.C = ch
+	err = u.transitionTo(AwaitingSettlement)
+	if err != nil {
+		t.Fatal(err)
+	}
+	builder, err = buildSettleWithGuestTx(ch, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	txenv, err = builder.Sign(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err = handleSettleWithGuestTx(u, &worizon.Tx{Env: txenv.E}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("handleSettleWithGuestTx returned not-ok status")
+	}
+
+	err = u.transitionTo(AwaitingClose)
+	if err != nil {
+		t.Fatal(err)
+	}
+	builder, err = buildCooperativeCloseTx(ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txenv, err = builder.Sign(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err = handleCoopCloseTx(u, &worizon.Tx{Env: txenv.E}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("handleCoopCloseTx returned not-ok status")
+	}
+	if ch.State != Closed {
+		t.Errorf("unexpected state: got %s, want %s", ch.State, Closed)
+	}
+}
+
+func TestAssetChannelTopUp(t *testing.T) {
+	ch, err := createTestAssetChannel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch.Role = Host
+	ch.State = Open
+	h := createTestHost()
+	h.Balances = map[string]Balance{
+		ch.Asset.String(): {Asset: ch.Asset, Amount: uint64(5 * xlm.Lumen), Authorized: true},
+	}
+	u := &Updater{
+		C:    ch,
+		O:    ono{},
+		H:    h,
+		Seed: []byte(seed),
+	}
+	err = u.Cmd(&Command{Name: TopUp, Amount: 10 * xlm.Lumen})
+	if errors.Root(err) != ErrInsufficientFunds {
+		t.Fatalf("got error %v, want %s", err, ErrInsufficientFunds)
+	}
+	err = u.Cmd(&Command{Name: TopUp, Amount: 3 * xlm.Lumen})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := h.Balances[ch.Asset.String()].Amount; got != uint64(2*xlm.Lumen) {
+		t.Errorf("got asset balance %d, want %d", got, 2*xlm.Lumen)
+	}
+	if h.NativeBalance != 10*xlm.Lumen-ch.HostFeerate {
+		t.Errorf("got native balance %s, want %s", h.NativeBalance, 10*xlm.Lumen-ch.HostFeerate)
+	}
+
+	builder, err := buildTopUpTx(ch, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txenv, err := builder.Sign(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err := handleTopUpTx(u, &worizon.Tx{Env: txenv.E}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("handleTopUpTx returned not-ok status")
+	}
+	if ch.HostAmount != 5*xlm.Lumen {
+		t.Errorf("got host amount %s, want %s", ch.HostAmount, 5*xlm.Lumen)
+	}
+
+	// A lumen payment to the escrow account is not a top-up of an asset channel.
+	native := *ch
+	native.Asset = xdr.Asset{}
+	builder, err = buildTopUpTx(&native, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txenv, err = builder.Sign(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err = handleTopUpTx(u, &worizon.Tx{Env: txenv.E}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("handleTopUpTx matched lumen payment to asset channel")
+	}
+}
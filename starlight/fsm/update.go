@@ -77,6 +77,15 @@ func (u *Updater) Msg(m *Message) error {
 
 	case m.CloseMsg != nil:
 		return u.handleCloseMsg(m)
+
+	case m.HTLCFulfillMsg != nil:
+		return u.handleHTLCFulfillMsg(m)
+
+	case m.ChannelCounterMsg != nil:
+		return u.handleChannelCounterMsg(m)
+
+	case m.WithdrawalMsg != nil:
+		return u.handleWithdrawalMsg(m)
 	}
 	return errors.New("no message specified")
 }
@@ -112,6 +121,7 @@ func (u *Updater) Time() error {
 		// since both the setup and funding txes have been published.
 		// TODO(debnil): test for expected balances.
 		u.H.NativeBalance += u.C.fundingBalanceAmount()
+		u.unreserveAssetAmount()
 
 		u.C.FundingTimedOut = true
 		return u.transitionTo(AwaitingCleanup)
@@ -121,15 +131,24 @@ func (u *Updater) Time() error {
 		u.debugf("ChannelProposedTimeout...")
 		if u.C.Role == Host {
 			u.H.NativeBalance += u.C.fundingBalanceAmount() + u.C.fundingFeeAmount() + u.C.fundedAcctsTxFeeAmount()
+			u.unreserveAssetAmount()
 			u.H.Seqnum++
 			return u.transitionTo(AwaitingCleanup)
 		}
 		return nil
 
 	case Open, PaymentProposed, PaymentAccepted, AwaitingClose:
-		// RoundTimeout
-		u.debugf("RoundTimeout...")
-		return u.setForceCloseState()
+		if !u.LedgerTime.Before(u.C.PaymentTime.Add(u.C.MaxRoundDuration)) {
+			// RoundTimeout
+			u.debugf("RoundTimeout...")
+			return u.setForceCloseState()
+		}
+		return u.htlcTimeout()
+
+	case AwaitingHTLC:
+		// HTLCRefundTimeout
+		u.debugf("HTLCRefundTimeout...")
+		return u.publishHTLCRefundTx()
 
 	case AwaitingSettlementMintime:
 		// SettlementMintimeTimeout
@@ -182,6 +201,15 @@ func (u *Updater) verifyMsg(m *Message) error {
 	if m.CloseMsg != nil {
 		counter++
 	}
+	if m.HTLCFulfillMsg != nil {
+		counter++
+	}
+	if m.ChannelCounterMsg != nil {
+		counter++
+	}
+	if m.WithdrawalMsg != nil {
+		counter++
+	}
 
 	if counter == 0 {
 		return errors.New("no message field set")
@@ -0,0 +1,270 @@
+package fsm
+
+import (
+	"math"
+	"time"
+
+	b "github.com/stellar/go/build"
+	"github.com/stellar/go/keypair"
+	"github.com/stellar/go/xdr"
+
+	"github.com/interstellar/starlight/errors"
+	"github.com/interstellar/starlight/math/checked"
+	"github.com/interstellar/starlight/starlight/key"
+	"github.com/interstellar/starlight/worizon"
+	"github.com/interstellar/starlight/worizon/xlm"
+)
+
+// Withdrawal is a payment of part of one party's balance
+// from the escrow account to that party's wallet account.
+// It is made in a payment round proposed by the withdrawing party:
+// the round's settlement txs pay that party Amount less.
+// Once that round completes, the withdrawing party reserves
+// the sequence number SeqNum of its wallet account for the withdrawal tx,
+// and the counterparty signs the tx only after it has
+// the round's ratchet tx, so the withdrawn amount cannot also
+// be paid out by an older round's settlement txs.
+type Withdrawal struct {
+	Role   Role
+	Amount xlm.Amount
+
+	// Round and Time are the number and payment time
+	// of the round making the withdrawal,
+	// and SeqNum is the withdrawal tx's sequence number.
+	// They are set once that round completes.
+	Round  uint64             `json:",omitempty"`
+	Time   time.Time          `json:",omitempty"`
+	SeqNum xdr.SequenceNumber `json:",omitempty"`
+
+	// Tx is the withdrawal tx, signed by both parties.
+	// It is set once the counterparty's signature arrives.
+	Tx *xdr.TransactionEnvelope `json:",omitempty"`
+}
+
+// WithdrawalTerms are the terms of a withdrawal
+// proposed by the withdrawing party.
+type WithdrawalTerms struct {
+	Amount xlm.Amount
+}
+
+// WithdrawalMsg is the protocol message carrying the recipient's
+// signature on the withdrawal tx of a completed round.
+type WithdrawalMsg struct {
+	RoundNumber   uint64
+	WithdrawalSig xdr.DecoratedSignature
+}
+
+func (ch *Channel) walletAcct(role Role) AccountID {
+	if role == Guest {
+		return ch.GuestAcct
+	}
+	return ch.HostAcct
+}
+
+// applyWithdrawal deducts the current round's withdrawal, if any,
+// from the withdrawing party's balance.
+func (ch *Channel) applyWithdrawal() {
+	w := ch.PendingWithdrawal
+	if w == nil {
+		return
+	}
+	if w.Role == Guest {
+		ch.GuestAmount -= w.Amount
+	} else {
+		ch.HostAmount -= w.Amount
+	}
+}
+
+// buildWithdrawalTx builds the tx paying w.Amount
+// from the escrow account to the wallet account of w.Role.
+// The channel feerate is used, since both parties must agree on the tx.
+// Like a ratchet tx, it is valid only until the round that
+// made the withdrawal could have timed out and been finalized.
+func buildWithdrawalTx(ch *Channel, w *Withdrawal) (*b.TransactionBuilder, error) {
+	maxTime := uint64(w.Time.Add(ch.FinalityDelay).Add(ch.MaxRoundDuration).Unix())
+	if maxTime > math.MaxInt64 {
+		return nil, checked.ErrOverflow
+	}
+	acct := ch.walletAcct(w.Role)
+	return ch.buildTx(
+		acct,
+		w.SeqNum,
+		ch.ChannelFeerate,
+		b.Timebounds{MaxTime: maxTime},
+		b.Payment(
+			b.SourceAccount{AddressOrSeed: ch.EscrowAcct.Address()},
+			b.Destination{AddressOrSeed: acct.Address()},
+			ch.assetAmount(w.Amount),
+		),
+	)
+}
+
+// reserveWithdrawal records that the round making the channel's
+// own withdrawal has completed, and reserves the wallet sequence number
+// of the withdrawal tx, which is sent in the PaymentCompleteMsg.
+// Reserving it only now means a withdrawal deferred
+// to a later round holds up no other wallet txs.
+func (u *Updater) reserveWithdrawal() {
+	w := u.C.PendingWithdrawal
+	u.C.PendingWithdrawal = nil
+	if w == nil {
+		return
+	}
+	u.H.Seqnum++
+	w.Round = u.C.RoundNumber
+	w.Time = u.C.PendingPaymentTime
+	w.SeqNum = u.H.Seqnum
+	u.C.Withdrawal = w
+}
+
+// sendWithdrawalMsg signs the counterparty's withdrawal tx,
+// made in the round that just completed with seqnum
+// from its PaymentCompleteMsg, and sends the signature.
+func (u *Updater) sendWithdrawalMsg(seqnum xdr.SequenceNumber) error {
+	w := u.C.PendingWithdrawal
+	u.C.PendingWithdrawal = nil
+	if w == nil {
+		return nil
+	}
+	if seqnum == 0 {
+		return errors.Wrap(ErrInvalidWithdrawal, "missing withdrawal tx sequence number")
+	}
+	w.Time = u.C.PendingPaymentTime
+	w.SeqNum = seqnum
+	tx, err := buildWithdrawalTx(u.C, w)
+	if err != nil {
+		return err
+	}
+	sig, err := detachedSig(tx.TX, u.Seed, u.C.Passphrase, u.C.KeyIndex)
+	if err != nil {
+		return err
+	}
+	m := &Message{
+		ChannelID: u.C.ID,
+		WithdrawalMsg: &WithdrawalMsg{
+			RoundNumber:   u.C.RoundNumber,
+			WithdrawalSig: sig,
+		},
+		Version: version,
+		MsgNum:  u.C.LastMsgIndex + 1,
+	}
+	m, err = m.signMsg(u.Seed)
+	if err != nil {
+		return err
+	}
+	u.O.OutputMsg(m)
+	return nil
+}
+
+// handleWithdrawalMsg finishes the channel's own withdrawal.
+// It checks the counterparty's signature on the withdrawal tx,
+// adds its own, and publishes the tx.
+func (u *Updater) handleWithdrawalMsg(m *Message) error {
+	msg := m.WithdrawalMsg
+	w := u.C.Withdrawal
+	if w == nil || w.Tx != nil || w.Round == 0 || w.Round != msg.RoundNumber {
+		u.debugf("dropped message: no withdrawal awaiting a signature for round %d", msg.RoundNumber)
+		return nil
+	}
+	counterparty := u.C.GuestAcct
+	if u.C.Role == Guest {
+		counterparty = u.C.EscrowAcct
+	}
+	verifyKey, err := keypair.Parse(counterparty.Address())
+	if err != nil {
+		return err
+	}
+	tx, err := buildWithdrawalTx(u.C, w)
+	if err != nil {
+		return err
+	}
+	if err = verifySig(tx, verifyKey, msg.WithdrawalSig); err != nil {
+		return errors.Wrap(err, "withdrawal tx")
+	}
+	// The guest's account key is also an escrow signer.
+	// The host signs for its account and for the escrow account.
+	indices := []uint32{key.PrimaryAccountIndex}
+	if u.C.Role == Host {
+		indices = append(indices, u.C.KeyIndex)
+	}
+	env := &xdr.TransactionEnvelope{
+		Tx:         *tx.TX,
+		Signatures: []xdr.DecoratedSignature{msg.WithdrawalSig},
+	}
+	for _, i := range indices {
+		mySig, err := detachedSig(tx.TX, u.Seed, u.C.Passphrase, i)
+		if err != nil {
+			return err
+		}
+		env.Signatures = append(env.Signatures, mySig)
+	}
+	w.Tx = env
+	u.O.OutputTx(*env)
+	return nil
+}
+
+// withdrawalTerms validates the withdrawal in a payment
+// proposed by the counterparty.
+func (u *Updater) withdrawalTerms(p *PaymentProposeMsg) (*Withdrawal, error) {
+	if p.Withdrawal == nil {
+		return nil, nil
+	}
+	if p.Withdrawal.Amount <= 0 {
+		return nil, errors.Wrapf(ErrInvalidWithdrawal, "amount %s", p.Withdrawal.Amount)
+	}
+	role := Host
+	if u.C.Role == Host {
+		role = Guest
+	}
+	return &Withdrawal{
+		Role:   role,
+		Amount: p.Withdrawal.Amount,
+	}, nil
+}
+
+// handleWithdrawalTx recognizes the withdrawal tx of either party.
+// Its amount has already left that party's channel balance,
+// so a failed withdrawal returns it there.
+func handleWithdrawalTx(u *Updater, ptx *worizon.Tx, success bool) (bool, error) {
+	tx := ptx.Env.Tx
+	if len(tx.Operations) != 1 {
+		return false, nil
+	}
+	op := tx.Operations[0]
+	payOp, ok := op.Body.GetPaymentOp()
+	if !ok || !txOpHasSrc(tx, op, xdr.AccountId(u.C.EscrowAcct)) {
+		return false, nil
+	}
+	for _, role := range []Role{Host, Guest} {
+		acct := u.C.walletAcct(role)
+		if !tx.SourceAccount.Equals(xdr.AccountId(acct)) || !payOp.Destination.Equals(xdr.AccountId(acct)) {
+			continue
+		}
+		if !payOp.Asset.Equals(u.C.Asset) {
+			return false, nil
+		}
+		if role == u.C.Role {
+			u.C.Withdrawal = nil
+		}
+		if success {
+			return true, nil
+		}
+		u.logf("withdrawal of %s by %s failed, returning it to the channel", xlm.Amount(payOp.Amount), role)
+		bal := &u.C.HostAmount
+		if role == Guest {
+			bal = &u.C.GuestAmount
+		}
+		sum, ok := checked.AddInt64(int64(*bal), int64(payOp.Amount))
+		if !ok {
+			return false, checked.ErrOverflow
+		}
+		*bal = xlm.Amount(sum)
+		if u.C.Role == Host && u.C.State == Open {
+			// The settlement txs must be re-signed
+			// to pay out the returned amount.
+			return true, u.proposePayment(0, u.LedgerTime, "", nil)
+		}
+		return true, nil
+	}
+	return false, nil
+}
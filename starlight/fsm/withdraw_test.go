@@ -0,0 +1,229 @@
+package fsm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stellar/go/xdr"
+
+	"github.com/interstellar/starlight/errors"
+	"github.com/interstellar/starlight/worizon"
+	"github.com/interstellar/starlight/worizon/xlm"
+)
+
+func TestWithdraw(t *testing.T) {
+	cases := []struct {
+		role                Role
+		wantHost, wantGuest xlm.Amount
+		wantSigs            int
+	}{
+		{Host, 1500 * xlm.Millilumen, 2 * xlm.Lumen, 3},
+		{Guest, 2 * xlm.Lumen, 1500 * xlm.Millilumen, 2},
+	}
+	for _, c := range cases {
+		t.Run(string(c.role), func(t *testing.T) {
+			now := time.Date(2018, 9, 24, 11, 03, 00, 0, time.UTC)
+			p := newHTLCTestPair(t, now)
+			u, out := p.host, p.hostOut
+			if c.role == Guest {
+				u, out = p.guest, p.guestOut
+			}
+			seqnum := u.H.Seqnum
+			walletBal := u.H.NativeBalance
+
+			err := u.Cmd(&Command{Name: Withdraw, Amount: 3 * xlm.Lumen})
+			if errors.Root(err) != ErrInsufficientFunds {
+				t.Errorf("got error %v, want %v", err, ErrInsufficientFunds)
+			}
+			err = u.Cmd(&Command{Name: Withdraw, Amount: 500 * xlm.Millilumen})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if u.H.Seqnum != seqnum {
+				t.Errorf("got wallet seqnum %d before the round, want %d", u.H.Seqnum, seqnum)
+			}
+			if want := walletBal - u.C.ChannelFeerate; u.H.NativeBalance != want {
+				t.Errorf("got wallet balance %s, want %s", u.H.NativeBalance, want)
+			}
+			p.deliver(t)
+			if u.H.Seqnum != seqnum+1 {
+				t.Errorf("got wallet seqnum %d, want %d", u.H.Seqnum, seqnum+1)
+			}
+			for _, v := range []*Updater{p.host, p.guest} {
+				if v.C.State != Open {
+					t.Errorf("%s got state %s, want %s", v.C.Role, v.C.State, Open)
+				}
+				if v.C.PendingWithdrawal != nil {
+					t.Errorf("%s has pending withdrawal after round", v.C.Role)
+				}
+			}
+			p.checkBalances(t, c.wantHost, c.wantGuest)
+
+			if len(out.txs) != 1 {
+				t.Fatalf("got %d txs, want 1 withdrawal tx", len(out.txs))
+			}
+			tx := out.txs[0]
+			if got := len(tx.Signatures); got != c.wantSigs {
+				t.Errorf("got %d withdrawal tx signatures, want %d", got, c.wantSigs)
+			}
+			if tx.Tx.SeqNum != seqnum+1 {
+				t.Errorf("got withdrawal tx seqnum %d, want %d", tx.Tx.SeqNum, seqnum+1)
+			}
+			wantMax := xdr.Uint64(now.Add(u.C.FinalityDelay + u.C.MaxRoundDuration).Unix())
+			if tb := tx.Tx.TimeBounds; tb == nil || tb.MaxTime != wantMax {
+				t.Errorf("got withdrawal tx timebounds %+v, want max time %d", tb, wantMax)
+			}
+			if u.C.Withdrawal == nil || u.C.Withdrawal.Tx == nil {
+				t.Fatal("withdrawal tx not recorded")
+			}
+
+			// No cooperative close, or second withdrawal,
+			// until the withdrawal tx is on the ledger.
+			err = u.Cmd(&Command{Name: CloseChannel})
+			if errors.Root(err) != errWithdrawalPending {
+				t.Errorf("got error %v, want %v", err, errWithdrawalPending)
+			}
+			err = u.Cmd(&Command{Name: Withdraw, Amount: xlm.Lumen})
+			if errors.Root(err) != errWithdrawalPending {
+				t.Errorf("got error %v, want %v", err, errWithdrawalPending)
+			}
+
+			for _, v := range []*Updater{p.host, p.guest} {
+				ok, err := handleWithdrawalTx(v, &worizon.Tx{Env: &tx}, true)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !ok {
+					t.Fatalf("%s: handleWithdrawalTx returned not-ok status", v.C.Role)
+				}
+			}
+			if u.C.Withdrawal != nil {
+				t.Error("withdrawal still pending after its tx succeeded")
+			}
+			p.checkBalances(t, c.wantHost, c.wantGuest)
+		})
+	}
+}
+
+func TestWithdrawFailed(t *testing.T) {
+	now := time.Date(2018, 9, 24, 11, 03, 00, 0, time.UTC)
+	p := newHTLCTestPair(t, now)
+	err := p.guest.Cmd(&Command{Name: Withdraw, Amount: xlm.Lumen})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.deliver(t)
+	p.checkBalances(t, 2*xlm.Lumen, xlm.Lumen)
+	tx := p.guestOut.txs[0]
+
+	for _, u := range []*Updater{p.host, p.guest} {
+		ok, err := handleWithdrawalTx(u, &worizon.Tx{Env: &tx}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Fatalf("%s: handleWithdrawalTx returned not-ok status", u.C.Role)
+		}
+	}
+	p.checkBalances(t, 2*xlm.Lumen, 2*xlm.Lumen)
+	if p.guest.C.Withdrawal != nil {
+		t.Error("withdrawal still pending after its tx failed")
+	}
+
+	// The host re-signs the settlement txs with the returned amount.
+	if p.host.C.State != PaymentProposed {
+		t.Fatalf("got host state %s, want %s", p.host.C.State, PaymentProposed)
+	}
+	p.deliver(t)
+	if p.guest.C.State != Open {
+		t.Errorf("got guest state %s, want %s", p.guest.C.State, Open)
+	}
+	want := xdr.Int64(2 * xlm.Lumen)
+	if got := p.host.C.CurrentSettleWithGuestTx.Tx.Operations[0].Body.PaymentOp.Amount; got != want {
+		t.Errorf("got settle with guest amount %d, want %d", got, want)
+	}
+}
+
+// TestWithdrawSigAfterRatchet checks that the counterparty signs
+// the withdrawal tx only once it has the round's ratchet tx,
+// so the withdrawing party cannot publish the withdrawal tx
+// and then force close with the previous round's settlement txs.
+func TestWithdrawSigAfterRatchet(t *testing.T) {
+	now := time.Date(2018, 9, 24, 11, 03, 00, 0, time.UTC)
+	p := newHTLCTestPair(t, now)
+	err := p.guest.Cmd(&Command{Name: Withdraw, Amount: xlm.Lumen})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Deliver the guest's proposal only.
+	propose := p.guestOut.msgs[0]
+	p.guestOut.msgs = nil
+	if err = p.host.Msg(propose); err != nil {
+		t.Fatal(err)
+	}
+	accept := p.hostOut.msgs[0]
+	p.hostOut.msgs = nil
+	if err = p.guest.Msg(accept); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.guestOut.txs) != 0 {
+		t.Fatal("guest published withdrawal tx before completing the round")
+	}
+	// The guest withholds its PaymentCompleteMsg.
+	complete := p.guestOut.msgs[0]
+	p.guestOut.msgs = nil
+	if complete.PaymentCompleteMsg == nil || complete.PaymentCompleteMsg.WithdrawalSeqNum != p.guest.H.Seqnum {
+		t.Fatalf("got %+v, want PaymentCompleteMsg with withdrawal seqnum %d", complete, p.guest.H.Seqnum)
+	}
+	if len(p.hostOut.msgs) != 0 {
+		t.Fatal("host signed withdrawal tx without the round's ratchet tx")
+	}
+
+	if err = p.host.Msg(complete); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.hostOut.msgs) != 1 || p.hostOut.msgs[0].WithdrawalMsg == nil {
+		t.Fatalf("got host messages %+v, want one WithdrawalMsg", p.hostOut.msgs)
+	}
+	p.deliver(t)
+	if len(p.guestOut.txs) != 1 {
+		t.Fatalf("got %d guest txs, want 1 withdrawal tx", len(p.guestOut.txs))
+	}
+	p.checkBalances(t, 2*xlm.Lumen, xlm.Lumen)
+}
+
+func TestWithdrawConflict(t *testing.T) {
+	now := time.Date(2018, 9, 24, 11, 03, 00, 0, time.UTC)
+	p := newHTLCTestPair(t, now)
+	err := p.guest.Cmd(&Command{Name: Withdraw, Amount: xlm.Lumen})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.host.Cmd(&Command{Name: ChannelPay, Amount: xlm.Lumen})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The host's payment wins, and the guest's withdrawal waits,
+	// holding no wallet sequence number.
+	seqnum := p.guest.H.Seqnum
+	p.deliver(t)
+	p.checkBalances(t, xlm.Lumen, 3*xlm.Lumen)
+	if w := p.guest.C.Withdrawal; w == nil || w.Round != 0 {
+		t.Fatalf("got guest withdrawal %+v, want one waiting for a round", w)
+	}
+	if p.guest.H.Seqnum != seqnum {
+		t.Errorf("got guest wallet seqnum %d, want %d", p.guest.H.Seqnum, seqnum)
+	}
+
+	// The guest's next round makes it.
+	err = p.guest.Cmd(&Command{Name: ChannelPay, Amount: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.deliver(t)
+	p.checkBalances(t, xlm.Lumen, 2*xlm.Lumen)
+	if w := p.guest.C.Withdrawal; w == nil || w.Tx == nil {
+		t.Fatal("guest withdrawal tx not recorded")
+	}
+}
@@ -17,6 +17,7 @@ import (
 // wallet RPC handler.
 var (
 	ErrAuthFailed   = errors.New("authentication failed")
+	ErrForbidden    = errors.New("forbidden")
 	ErrUnauthorized = errors.New("unauthorized")
 	ErrUnmarshaling = errors.New("error unmarshaling input")
 )
@@ -26,6 +27,10 @@ type response struct {
 	HTTPStatus int    `json:"-"`
 	Message    string `json:"message"`
 	Retriable  bool   `json:"retriable"`
+
+	// Counter is a guest's counter-proposal,
+	// in response to a channel proposal it does not accept.
+	Counter *fsm.Message `json:"counter,omitempty"`
 }
 
 type formatter struct {
@@ -48,6 +53,7 @@ func init() {
 	// Handler errors
 	errorFormatter.add(ErrUnauthorized, 401, "invalid session cookie", true)
 	errorFormatter.add(ErrAuthFailed, 401, "invalid login", false)
+	errorFormatter.add(ErrForbidden, 403, "insufficient token scope", false)
 	errorFormatter.add(ErrUnmarshaling, 400, "invalid input", false)
 
 	// General agent errors
@@ -68,34 +74,51 @@ func init() {
 	errorFormatter.add(errEmptyAsset, 400, "no asset specified", false)
 	errorFormatter.add(errInsufficientBalance, 400, "insufficient balance", true)
 	errorFormatter.add(errEmptyIssuer, 400, "no issuer specified", false)
+	errorFormatter.add(errAssetAuthRequired, 400, "asset issuer requires authorization", false)
 	errorFormatter.add(errAcctsSame, 400, "same host and guest accounts", false)
 	errorFormatter.add(errNotFunded, 500, "agent not yet funded", true)
 	errorFormatter.add(errInvalidAddress, 400, "invalid address", false)
+	errorFormatter.add(errNoRoute, 400, "no route to destination", true)
+	errorFormatter.add(errNoInvoice, 404, "invoice not found", false)
+	errorFormatter.add(errNoChannel, 404, "channel not found", false)
+	errorFormatter.add(errInvalidInvoice, 400, "invalid invoice", false)
+	errorFormatter.add(errInvoiceExpired, 400, "invoice expired", false)
+	errorFormatter.add(errNoInvoiceChannel, 400, "no native channel with the invoice's account", false)
 
 	// Message errors
 	errorFormatter.add(errExists, 400, "channel already exists", false)
-	errorFormatter.add(errChannelExistsRetriable, 400, "channel already exists, in setting up state", true)
 	errorFormatter.add(errInvalidChannelID, 400, "invalid channel ID", false)
 	errorFormatter.add(errFetchingAccounts, 400, "error fetching sequence numbers for accounts", false)
 	errorFormatter.add(errRemoteGuestMessage, 400, "received RPC message from guest", false)
+	errorFormatter.add(errChannelTerms, 400, "channel terms not accepted", false)
 
 	// Configuration
 	errorFormatter.add(errAlreadyConfigured, 400, "already configured", false)
 	errorFormatter.add(errInvalidAsset, 400, "invalid asset", false)
 	errorFormatter.add(errInvalidInput, 400, "invalid input", false)
 	errorFormatter.add(errInvalidPassword, 400, "invalid password", false)
+	errorFormatter.add(errInvalidMnemonic, 400, "invalid recovery phrase", false)
 	errorFormatter.add(errInvalidUsername, 400, "invalid username", false)
 	errorFormatter.add(errInvalidEdit, 400, "invalid edit field", false)
 	errorFormatter.add(errEmptyConfigEdit, 400, "empty configuration edit", false)
 	errorFormatter.add(errNotConfigured, 500, "not configured", true)
 	errorFormatter.add(errPasswordsDontMatch, 400, "passwords don't match", false)
 
+	// API tokens
+	errorFormatter.add(errInvalidScope, 400, "invalid token scope", false)
+	errorFormatter.add(errNoAPIToken, 404, "API token not found", false)
+
 	// FSM errors
 	errorFormatter.add(fsm.ErrInvalidVersion, 400, "invalid message version", false)
 	errorFormatter.add(fsm.ErrChannelExists, 400, "channel proposed already exists", false)
 	errorFormatter.add(fsm.ErrUnusedSettleWithGuestSig, 400, "unused settle with guest sig", false)
 	errorFormatter.add(fsm.ErrUnexpectedState, 400, "unexpected state", true)
 	errorFormatter.add(fsm.ErrInsufficientFunds, 400, "insufficient funds", true)
+	errorFormatter.add(fsm.ErrUntrustedAsset, 400, "no authorized trustline for channel asset", false)
+	errorFormatter.add(fsm.ErrInvalidHTLC, 400, "invalid conditional payment", false)
+	errorFormatter.add(fsm.ErrInvalidPreimage, 400, "preimage does not match hash", false)
+	errorFormatter.add(fsm.ErrInvalidWithdrawal, 400, "invalid withdrawal", false)
+	errorFormatter.add(fsm.ErrInvalidPaymentInfo, 400, "invalid payment memo or ID", false)
 }
 
 func (f *formatter) write(req *http.Request, w http.ResponseWriter, err error) {
@@ -103,6 +126,14 @@ func (f *formatter) write(req *http.Request, w http.ResponseWriter, err error) {
 	httpjson.Write(req.Context(), w, resp.HTTPStatus, resp)
 }
 
+// writeCounterProposal answers a channel proposal
+// with the counter-proposal m.
+func writeCounterProposal(req *http.Request, w http.ResponseWriter, m *fsm.Message) {
+	resp := errorFormatter.format(errChannelTerms)
+	resp.Counter = m
+	httpjson.Write(req.Context(), w, resp.HTTPStatus, resp)
+}
+
 func (f *formatter) format(err error) response {
 	root := errors.Root(err)
 
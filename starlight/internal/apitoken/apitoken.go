@@ -0,0 +1,59 @@
+package apitoken
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Scope is the type of a token-scope constant.
+type Scope string
+
+// Token scopes, from least to most privileged.
+// Each scope permits everything the scopes before it permit.
+const (
+	// Read permits reading the agent's state and updates.
+	Read Scope = "read"
+
+	// Pay also permits making payments and creating invoices.
+	Pay Scope = "pay"
+
+	// Admin permits everything a logged-in user can do.
+	Admin Scope = "admin"
+)
+
+var scopeLevels = map[Scope]int{Read: 1, Pay: 2, Admin: 3}
+
+// Valid reports whether s is a known scope.
+func (s Scope) Valid() bool {
+	return scopeLevels[s] > 0
+}
+
+// Permits reports whether s permits everything scope t permits.
+func (s Scope) Permits(t Scope) bool {
+	return s.Valid() && scopeLevels[s] >= scopeLevels[t]
+}
+
+// Token is an agent's record of an API token.
+// Records are keyed by ID.
+// The token's secret is not stored, only its hash.
+type Token struct {
+	ID      string
+	Name    string
+	Scope   Scope
+	Created time.Time
+
+	// Hash is the SHA-256 hash of the token's secret.
+	Hash []byte `json:",omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler. Required for genbolt.
+func (tok *Token) MarshalJSON() ([]byte, error) {
+	type t Token
+	return json.Marshal((*t)(tok))
+}
+
+// UnmarshalJSON implements json.Unmarshaler. Required for genbolt.
+func (tok *Token) UnmarshalJSON(b []byte) error {
+	type t Token
+	return json.Unmarshal(b, (*t)(tok))
+}
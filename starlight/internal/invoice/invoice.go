@@ -0,0 +1,55 @@
+package invoice
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/interstellar/starlight/worizon/xlm"
+)
+
+// Status is the type of an invoice status constant.
+type Status string
+
+// Invoice statuses.
+// Expired is never stored: it is reported for
+// unpaid invoices whose expiry has passed.
+const (
+	Unpaid  Status = "unpaid"
+	Paid    Status = "paid"
+	Expired Status = "expired"
+)
+
+// Invoice is an agent's record of a payment it has requested.
+// Records are keyed by ID.
+type Invoice struct {
+	ID          string
+	Amount      xlm.Amount
+	Description string `json:",omitempty"`
+	Created     time.Time
+	Expiry      time.Time
+
+	// Encoded is the signed invoice string
+	// the agent gives to the payer.
+	Encoded string
+
+	Status Status
+
+	// ChannelID and PaymentID identify the channel payment
+	// that paid the invoice, made at PaidTime.
+	// They are set once Status is Paid.
+	ChannelID string    `json:",omitempty"`
+	PaymentID string    `json:",omitempty"`
+	PaidTime  time.Time `json:",omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler. Required for genbolt.
+func (inv *Invoice) MarshalJSON() ([]byte, error) {
+	type t Invoice
+	return json.Marshal((*t)(inv))
+}
+
+// UnmarshalJSON implements json.Unmarshaler. Required for genbolt.
+func (inv *Invoice) UnmarshalJSON(b []byte) error {
+	type t Invoice
+	return json.Unmarshal(b, (*t)(inv))
+}
@@ -2,6 +2,7 @@ package message
 
 import (
 	"encoding/json"
+	"sort"
 
 	"github.com/interstellar/starlight/starlight/fsm"
 )
@@ -25,14 +26,32 @@ func (m *Message) Add(msg *fsm.Message, num *uint64) {
 // up until sequence number b, exclusive.
 func (m *Message) From(a, b uint64) []*fsm.Message {
 	msgs := make([]*fsm.Message, 0)
-	for _, msg := range m.Messages {
-		if a <= msg.MsgNum && msg.MsgNum < b {
-			msgs = append(msgs, msg)
+	i := sort.Search(len(m.Messages), func(i int) bool {
+		return m.Messages[i].MsgNum >= a
+	})
+	for _, msg := range m.Messages[i:] {
+		if msg.MsgNum >= b {
+			break
 		}
+		msgs = append(msgs, msg)
 	}
 	return msgs
 }
 
+// Ack discards the messages numbered below n,
+// which the counterparty has received.
+// It reports whether there were any.
+func (m *Message) Ack(n uint64) bool {
+	i := sort.Search(len(m.Messages), func(i int) bool {
+		return m.Messages[i].MsgNum >= n
+	})
+	if i == 0 {
+		return false
+	}
+	m.Messages = append([]*fsm.Message(nil), m.Messages[i:]...)
+	return true
+}
+
 // MarshalJSON implements json.Marshaler. Required for genbolt.
 func (m *Message) MarshalJSON() ([]byte, error) {
 	type t Message
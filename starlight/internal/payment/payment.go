@@ -0,0 +1,74 @@
+package payment
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Kind is the type of a payment-kind constant.
+type Kind string
+
+// Payment kinds.
+const (
+	// Channel payments are made in a round of a channel.
+	Channel Kind = "channel"
+
+	// Wallet payments are payment operations on the ledger
+	// to or from the agent's primary account.
+	Wallet Kind = "wallet"
+)
+
+// Direction is the type of a payment-direction constant.
+type Direction string
+
+// Payment directions.
+const (
+	Sent     Direction = "sent"
+	Received Direction = "received"
+)
+
+// Payment is an agent's record of a completed payment,
+// sent or received.
+// Records are numbered in the order the payments completed.
+type Payment struct {
+	PaymentNum uint64
+	Kind       Kind
+	Direction  Direction
+
+	// Counterparty is the account ID of the other party.
+	Counterparty string
+
+	// Amount is in stroops, or in units of Asset
+	// if Asset is set.
+	Amount uint64
+
+	// Asset is the asset paid, in the form produced by
+	// xdr.Asset.String. It is empty for lumens.
+	Asset string `json:",omitempty"`
+
+	// ChannelID, ID, Memo, and InvoiceID describe
+	// a channel payment. ID, Memo, and InvoiceID
+	// are set only if the payer set them.
+	ChannelID string `json:",omitempty"`
+	ID        string `json:",omitempty"`
+	Memo      string `json:",omitempty"`
+	InvoiceID string `json:",omitempty"`
+
+	// TxHash is the hash of a wallet payment's transaction.
+	TxHash string `json:",omitempty"`
+
+	// Time is the ledger time at which the payment completed.
+	Time time.Time
+}
+
+// MarshalJSON implements json.Marshaler. Required for genbolt.
+func (p *Payment) MarshalJSON() ([]byte, error) {
+	type t Payment
+	return json.Marshal((*t)(p))
+}
+
+// UnmarshalJSON implements json.Unmarshaler. Required for genbolt.
+func (p *Payment) UnmarshalJSON(b []byte) error {
+	type t Payment
+	return json.Unmarshal(b, (*t)(p))
+}
@@ -0,0 +1,57 @@
+package route
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/stellar/go/xdr"
+
+	"github.com/interstellar/starlight/worizon/xlm"
+)
+
+// Status is the type of a routed-payment status constant.
+type Status string
+
+// Routed-payment statuses.
+const (
+	Pending   Status = "pending"
+	Fulfilled Status = "fulfilled"
+	Failed    Status = "failed"
+)
+
+// Payment is an agent's record of a routed payment
+// that it sends, forwards, or receives.
+// Records are keyed by the payment's hash.
+type Payment struct {
+	Hash xdr.Hash
+
+	// Preimage is known to the destination from the start,
+	// and to the other agents on the route once it is fulfilled.
+	Preimage []byte `json:",omitempty"`
+
+	// Amount is the amount of the HTLC the agent sends on OutChannel,
+	// or, at the destination, the amount it expects to receive.
+	Amount xlm.Amount
+
+	// InChannel is the channel on which the agent receives the
+	// payment's HTLC. It is empty at the source.
+	// OutChannel is the channel on which the agent sends it.
+	// It is empty at the destination.
+	InChannel  string `json:",omitempty"`
+	OutChannel string `json:",omitempty"`
+
+	Status  Status
+	Created time.Time
+}
+
+// MarshalJSON implements json.Marshaler. Required for genbolt.
+func (p *Payment) MarshalJSON() ([]byte, error) {
+	type t Payment
+	return json.Marshal((*t)(p))
+}
+
+// UnmarshalJSON implements json.Unmarshaler. Required for genbolt.
+func (p *Payment) UnmarshalJSON(b []byte) error {
+	type t Payment
+	return json.Unmarshal(b, (*t)(p))
+}
@@ -5,6 +5,8 @@ import (
 	"time"
 
 	"github.com/interstellar/starlight/starlight/fsm"
+	"github.com/interstellar/starlight/starlight/internal/invoice"
+	"github.com/interstellar/starlight/starlight/internal/route"
 	"github.com/interstellar/starlight/worizon"
 	"github.com/interstellar/starlight/worizon/xlm"
 )
@@ -21,6 +23,9 @@ const (
 	WarningType   Type = "warning"
 	TxSuccessType Type = "tx_success"
 	TxFailureType Type = "tx_failed"
+
+	RoutedPaymentType Type = "routed_payment"
+	InvoiceType       Type = "invoice"
 )
 
 // Update is a record of some state change in a Starlight agent that should be reflected to the user.
@@ -31,6 +36,8 @@ type Update struct {
 	// If Type is Channel, field Channel will be set,
 	// along with one of the InputX fields.
 	// If Type is Warning, field Warning will be set.
+	// If Type is RoutedPayment, field RoutedPayment will be set.
+	// If Type is Invoice, field Invoice will be set.
 	Type Type
 
 	// UpdateNum is the number of this update.
@@ -71,6 +78,13 @@ type Update struct {
 
 	Warning string
 
+	// RoutedPayment describes a routed payment
+	// whose status has changed.
+	RoutedPayment *route.Payment `json:",omitempty"`
+
+	// Invoice describes an invoice that has been created or paid.
+	Invoice *invoice.Invoice `json:",omitempty"`
+
 	// if this update included an outgoing transaction from the wallet account,
 	// this is its sequence number (as a string, so JS can read it)
 	PendingSequence string
@@ -97,6 +111,14 @@ type Config struct {
 	ChannelFeerate    xlm.Amount `json:",omitempty"`
 	HostFeerate       xlm.Amount `json:",omitempty"`
 
+	MinMaxRoundDurMins   int64 `json:",omitempty"`
+	MaxMaxRoundDurMins   int64 `json:",omitempty"`
+	MinFinalityDelayMins int64 `json:",omitempty"`
+	MaxFinalityDelayMins int64 `json:",omitempty"`
+
+	ForwardFeeBase xlm.Amount `json:",omitempty"`
+	ForwardFeeRate int64      `json:",omitempty"`
+
 	KeepAlive bool `json:",omitempty"`
 }
 
@@ -0,0 +1,334 @@
+package starlight
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/stellar/go/keypair"
+
+	"github.com/interstellar/starlight/errors"
+	"github.com/interstellar/starlight/starlight/db"
+	"github.com/interstellar/starlight/starlight/fsm"
+	"github.com/interstellar/starlight/starlight/internal/invoice"
+	"github.com/interstellar/starlight/starlight/internal/update"
+	"github.com/interstellar/starlight/starlight/key"
+	"github.com/interstellar/starlight/worizon/xlm"
+)
+
+// invoicePrefix begins every encoded invoice.
+const invoicePrefix = "starlight-invoice:"
+
+// maxInvoiceDescLen is the maximum length of an invoice description, in bytes.
+const maxInvoiceDescLen = 512
+
+// Invoice is an agent's record of a payment it has requested.
+type Invoice = invoice.Invoice
+
+// InvoiceRequest is the content of an encoded invoice:
+// the payment requested of the payer.
+// It is signed with the key of Account, the requesting agent's
+// primary account, which is also the account of federation address Address.
+//
+// To pay it, the payer sends a ChannelPay of Amount,
+// with InvoiceID set to ID, on a channel with Account
+// before Expiry; see PayInvoice.
+// Only native (lumen) channels can pay invoices:
+// Amount is in lumens,
+// and a payment on an asset channel pays nothing.
+type InvoiceRequest struct {
+	Address     string
+	Account     string
+	ID          string
+	Amount      xlm.Amount
+	Description string `json:",omitempty"`
+	Expiry      time.Time
+}
+
+// CreateInvoice creates an invoice requesting amount,
+// to be paid before expiry.
+// The returned record's Encoded field holds the signed
+// invoice string to give to the payer.
+// Its status changes are reported in updates of type Invoice.
+func (g *Agent) CreateInvoice(amount xlm.Amount, expiry time.Time, description string) (*Invoice, error) {
+	if amount <= 0 {
+		return nil, errEmptyAmount
+	}
+	if len(description) > maxInvoiceDescLen {
+		return nil, errors.Wrapf(errInvalidInput, "description longer than %d bytes", maxInvoiceDescLen)
+	}
+	now := g.wclient.Now()
+	if !expiry.After(now) {
+		return nil, errors.Wrapf(errInvalidInput, "expiry %s is in the past", expiry)
+	}
+	id := make([]byte, 16)
+	randRead(id)
+	inv := &Invoice{
+		ID:          hex.EncodeToString(id),
+		Amount:      amount,
+		Description: description,
+		Created:     now,
+		Expiry:      expiry,
+		Status:      invoice.Unpaid,
+	}
+	err := db.Update(g.db, func(root *db.Root) error {
+		if !g.isReadyConfigured(root) {
+			return errNotConfigured
+		}
+		encoded, err := encodeInvoice(g.seed, &InvoiceRequest{
+			Address:     root.Agent().Wallet().Address,
+			Account:     root.Agent().PrimaryAcct().Address(),
+			ID:          inv.ID,
+			Amount:      inv.Amount,
+			Description: inv.Description,
+			Expiry:      inv.Expiry,
+		})
+		if err != nil {
+			return err
+		}
+		inv.Encoded = encoded
+		putInvoice(root, inv)
+		g.putUpdate(root, &Update{
+			Type:    update.InvoiceType,
+			Invoice: inv,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+// Invoices returns the agent's invoices, oldest first.
+func (g *Agent) Invoices() []*Invoice {
+	invoices := make([]*Invoice, 0) // we want json "[]" not "null"
+	now := g.wclient.Now()
+	db.View(g.db, func(root *db.Root) error {
+		bucket := root.Agent().Invoices().Bucket()
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(id, _ []byte) error {
+			invoices = append(invoices, withExpiry(root.Agent().Invoices().Get(id), now))
+			return nil
+		})
+	})
+	sort.Slice(invoices, func(i, j int) bool {
+		return invoices[i].Created.Before(invoices[j].Created)
+	})
+	return invoices
+}
+
+// Invoice returns the invoice with the given ID.
+func (g *Agent) Invoice(id string) (*Invoice, error) {
+	var inv *Invoice
+	db.View(g.db, func(root *db.Root) error {
+		inv = getInvoice(root, id)
+		return nil
+	})
+	if inv == nil {
+		return nil, errors.Wrap(errNoInvoice, id)
+	}
+	return withExpiry(inv, g.wclient.Now()), nil
+}
+
+// withExpiry reports inv as expired if it is unpaid at its expiry.
+func withExpiry(inv *Invoice, now time.Time) *Invoice {
+	if inv.Status == invoice.Unpaid && now.After(inv.Expiry) {
+		inv.Status = invoice.Expired
+	}
+	return inv
+}
+
+// updateInvoices marks as paid the invoices named by the payments
+// received in the round completed by the latest update of channel c.
+// A payment pays an invoice if it is made on a native channel,
+// for at least the invoice's amount, in a round whose payment time
+// is no later than the invoice's expiry.
+// Must be called from within an update transaction.
+func (g *Agent) updateInvoices(root *db.Root, c *fsm.Channel) {
+	for _, p := range c.ReceivedPayments {
+		if p.InvoiceID == "" {
+			continue
+		}
+		inv := getInvoice(root, p.InvoiceID)
+		if inv == nil || inv.Status != invoice.Unpaid {
+			continue
+		}
+		if !c.IsNative() || p.Amount < inv.Amount || c.PaymentTime.After(inv.Expiry) {
+			g.logf("payment %s of %s on channel %s does not pay invoice %s", p.ID, p.Amount, c.ID, inv.ID)
+			continue
+		}
+		inv.Status = invoice.Paid
+		inv.ChannelID = c.ID
+		inv.PaymentID = p.ID
+		inv.PaidTime = c.PaymentTime
+		putInvoice(root, inv)
+		g.putUpdate(root, &Update{
+			Type:    update.InvoiceType,
+			Invoice: inv,
+		})
+	}
+}
+
+// InvoicePayment is a payment made by PayInvoice.
+type InvoicePayment struct {
+	Invoice   *InvoiceRequest
+	ChannelID string
+	PaymentID string
+}
+
+// PayInvoice decodes the invoice string encoded
+// and pays it on a native channel with the invoice's account.
+// If amount is set, the invoice must be for that amount.
+// PayInvoice checks that the invoice has not expired,
+// and that its Account is the account of its Address,
+// so the payment goes to whoever owns that address.
+func (g *Agent) PayInvoice(encoded string, amount xlm.Amount) (*InvoicePayment, error) {
+	r, err := DecodeInvoice(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if amount > 0 && r.Amount != amount {
+		return nil, errors.Wrapf(errInvalidInput, "invoice is for %s, not %s", r.Amount, amount)
+	}
+	if now := g.wclient.Now(); !now.Before(r.Expiry) {
+		return nil, errors.Wrapf(errInvoiceExpired, "expired at %s", r.Expiry)
+	}
+	acct, _, err := g.FindAccount(r.Address)
+	if err != nil {
+		return nil, errors.Wrapf(err, "finding account %s", r.Address)
+	}
+	if acct != r.Account {
+		return nil, errors.Wrapf(errInvalidInvoice, "%s is account %s, not %s", r.Address, acct, r.Account)
+	}
+
+	var chanIDs []string
+	err = db.View(g.db, func(root *db.Root) error {
+		if root.Agent().PrimaryAcct().Address() == r.Account {
+			return errAcctsSame
+		}
+		chanIDs = invoiceChannels(root, r.Account)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(chanIDs) == 0 {
+		return nil, errors.Wrap(errNoInvoiceChannel, r.Account)
+	}
+	cmd := &fsm.Command{
+		Name:      fsm.ChannelPay,
+		Amount:    r.Amount,
+		InvoiceID: r.ID,
+	}
+	for _, id := range chanIDs {
+		err = g.DoCommand(id, cmd)
+		if errors.Root(err) == fsm.ErrInsufficientFunds {
+			continue // try the next channel
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &InvoicePayment{Invoice: r, ChannelID: id, PaymentID: cmd.PaymentID}, nil
+	}
+	return nil, err
+}
+
+// invoiceChannels returns the IDs of the native channels
+// with account acct that can make payments,
+// or will once their current round ends.
+func invoiceChannels(root *db.Root, acct string) []string {
+	var ids []string
+	bucket := root.Agent().Channels().Bucket()
+	if bucket == nil {
+		return nil
+	}
+	bucket.ForEach(func(id, _ []byte) error {
+		c := root.Agent().Channels().Get(id)
+		other := c.HostAcct
+		if c.Role == fsm.Host {
+			other = c.GuestAcct
+		}
+		if !c.IsNative() || other.Address() != acct {
+			return nil
+		}
+		switch c.State {
+		case fsm.Open, fsm.PaymentProposed, fsm.PaymentAccepted, fsm.AwaitingPaymentMerge:
+			ids = append(ids, c.ID)
+		}
+		return nil
+	})
+	return ids
+}
+
+// getInvoice returns the invoice with the given ID,
+// or nil if there is none.
+func getInvoice(root *db.Root, id string) *Invoice {
+	invoices := root.Agent().Invoices()
+	if bucket := invoices.Bucket(); bucket == nil || bucket.Get([]byte(id)) == nil {
+		return nil
+	}
+	return invoices.GetByString(id)
+}
+
+func putInvoice(root *db.Root, inv *Invoice) {
+	root.Agent().Invoices().PutByString(inv.ID, inv)
+}
+
+// encodeInvoice signs r with the primary account key
+// and encodes it, with its signature, as an invoice string.
+func encodeInvoice(seed []byte, r *InvoiceRequest) (string, error) {
+	payload, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	sig, err := key.DeriveAccountPrimary(seed).Sign(payload)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	return invoicePrefix + enc.EncodeToString(payload) + "." + enc.EncodeToString(sig), nil
+}
+
+// DecodeInvoice decodes an invoice string made by CreateInvoice
+// and checks its signature against its Account.
+// It does not check that Account is the account of Address;
+// the payer can do so with FindAccount.
+func DecodeInvoice(s string) (*InvoiceRequest, error) {
+	if !strings.HasPrefix(s, invoicePrefix) {
+		return nil, errors.Wrap(errInvalidInvoice, "missing prefix")
+	}
+	parts := strings.Split(strings.TrimPrefix(s, invoicePrefix), ".")
+	if len(parts) != 2 {
+		return nil, errors.Wrap(errInvalidInvoice, "malformed")
+	}
+	enc := base64.RawURLEncoding
+	payload, err := enc.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.Sub(errInvalidInvoice, err)
+	}
+	sig, err := enc.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.Sub(errInvalidInvoice, err)
+	}
+	r := new(InvoiceRequest)
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(r); err != nil {
+		return nil, errors.Sub(errInvalidInvoice, err)
+	}
+	kp, err := keypair.Parse(r.Account)
+	if err != nil {
+		return nil, errors.Sub(errInvalidInvoice, err)
+	}
+	if err = kp.Verify(payload, sig); err != nil {
+		return nil, errors.Wrap(errInvalidInvoice, "bad signature")
+	}
+	return r, nil
+}
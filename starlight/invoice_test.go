@@ -0,0 +1,181 @@
+package starlight
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stellar/go/xdr"
+
+	"github.com/interstellar/starlight/errors"
+	"github.com/interstellar/starlight/starlight/db"
+	"github.com/interstellar/starlight/starlight/fsm"
+	"github.com/interstellar/starlight/starlight/internal/invoice"
+	"github.com/interstellar/starlight/starlight/key"
+	"github.com/interstellar/starlight/worizon/xlm"
+)
+
+func TestInvoice(t *testing.T) {
+	g, closer := startTestAgent(t)
+	defer closer()
+	config := Config{
+		Username:   "alice",
+		Password:   "password",
+		HorizonURL: testHorizonURL,
+	}
+	err := g.ConfigInit(&config, "starlight.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := g.wclient.Now()
+
+	_, err = g.CreateInvoice(xlm.Lumen, now.Add(-time.Minute), "late")
+	if errors.Root(err) != errInvalidInput {
+		t.Errorf("got error %v, want %v", err, errInvalidInput)
+	}
+	inv, err := g.CreateInvoice(5*xlm.Lumen, now.Add(time.Hour), "order 17")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := DecodeInvoice(inv.Encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var acct string
+	db.View(g.db, func(root *db.Root) error {
+		acct = root.Agent().PrimaryAcct().Address()
+		return nil
+	})
+	if r.Address != "alice*starlight.com" || r.Account != acct {
+		t.Errorf("got invoice from %s (%s), want alice*starlight.com (%s)", r.Address, r.Account, acct)
+	}
+	if r.ID != inv.ID || r.Amount != inv.Amount || r.Description != "order 17" {
+		t.Errorf("got invoice request %+v for invoice %+v", r, inv)
+	}
+	tampered := inv.Encoded[:len(invoicePrefix)] + "x" + inv.Encoded[len(invoicePrefix)+1:]
+	if _, err = DecodeInvoice(tampered); errors.Root(err) != errInvalidInvoice {
+		t.Errorf("got error %v decoding tampered invoice, want %v", err, errInvalidInvoice)
+	}
+
+	// An underpayment does not pay the invoice.
+	ch := &fsm.Channel{ID: "chan", PaymentTime: now}
+	ch.ReceivedPayments = []fsm.PaymentIntent{{ID: "p1", Amount: xlm.Lumen, InvoiceID: inv.ID}}
+	db.Update(g.db, func(root *db.Root) error {
+		g.updateInvoices(root, ch)
+		return nil
+	})
+	got, err := g.Invoice(inv.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != invoice.Unpaid {
+		t.Errorf("got status %s after underpayment, want %s", got.Status, invoice.Unpaid)
+	}
+
+	ch.ReceivedPayments = []fsm.PaymentIntent{{ID: "p2", Amount: 5 * xlm.Lumen, InvoiceID: inv.ID}}
+	db.Update(g.db, func(root *db.Root) error {
+		g.updateInvoices(root, ch)
+		return nil
+	})
+	got, err = g.Invoice(inv.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != invoice.Paid || got.ChannelID != "chan" || got.PaymentID != "p2" {
+		t.Errorf("got invoice %+v, want paid by p2 on chan", got)
+	}
+
+	_, err = g.Invoice("nonexistent")
+	if errors.Root(err) != errNoInvoice {
+		t.Errorf("got error %v, want %v", err, errNoInvoice)
+	}
+	if n := len(g.Invoices()); n != 1 {
+		t.Errorf("got %d invoices, want 1", n)
+	}
+}
+
+func TestPayInvoice(t *testing.T) {
+	g, closer := startTestAgent(t)
+	defer closer()
+	config := Config{
+		Username:   "bob",
+		Password:   "password",
+		HorizonURL: testHorizonURL,
+	}
+	err := g.ConfigInit(&config, "starlight.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := g.wclient.Now()
+	seed := make([]byte, 32)
+	seed[0] = 1
+	acct := key.DeriveAccountPrimary(seed).Address()
+	encode := func(r *InvoiceRequest) string {
+		s, err := encodeInvoice(seed, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	valid := &InvoiceRequest{
+		Address: "carol*starlight.com",
+		Account: acct,
+		ID:      "inv",
+		Amount:  xlm.Lumen,
+		Expiry:  now.Add(time.Hour),
+	}
+
+	cases := []struct {
+		name   string
+		r      InvoiceRequest
+		amount xlm.Amount
+		want   error
+	}{
+		{"wrong amount", *valid, 2 * xlm.Lumen, errInvalidInput},
+		{"expired", InvoiceRequest{Address: valid.Address, Account: acct, ID: "inv", Amount: xlm.Lumen, Expiry: now}, 0, errInvoiceExpired},
+		// alice*starlight.com is another account.
+		{"wrong destination", InvoiceRequest{Address: "alice*starlight.com", Account: acct, ID: "inv", Amount: xlm.Lumen, Expiry: valid.Expiry}, 0, errInvalidInvoice},
+	}
+	for _, tc := range cases {
+		_, err := g.PayInvoice(encode(&tc.r), tc.amount)
+		if errors.Root(err) != tc.want {
+			t.Errorf("%s: got error %v, want %v", tc.name, err, tc.want)
+		}
+	}
+	if _, err = g.PayInvoice("starlight-invoice:bogus", 0); errors.Root(err) != errInvalidInvoice {
+		t.Errorf("got error %v paying malformed invoice, want %v", err, errInvalidInvoice)
+	}
+
+	// Only native channels with the invoice's account,
+	// open or in a round, can pay it.
+	newChannel := func(id string, state fsm.State, account string) *fsm.Channel {
+		c := &fsm.Channel{ID: id, Role: fsm.Host, State: state}
+		if err := c.GuestAcct.SetAddress(account); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	asset := newChannel("asset", fsm.Open, acct)
+	asset.Asset.Type = xdr.AssetTypeAssetTypeCreditAlphanum4
+	chans := []*fsm.Channel{
+		newChannel("open", fsm.Open, acct),
+		newChannel("round", fsm.PaymentProposed, acct),
+		newChannel("closed", fsm.Closed, acct),
+		newChannel("other", fsm.Open, "GDSRO6H2YM6MC6ZO7KORPJXSTUMBMT3E7MZ66CFVNMUAULFG6G2OP32I"),
+		asset,
+	}
+	var got []string
+	db.Update(g.db, func(root *db.Root) error {
+		for _, c := range chans {
+			g.putChannel(root, c.ID, c)
+		}
+		got = invoiceChannels(root, acct)
+		return nil
+	})
+	sort.Strings(got)
+	if want := []string{"open", "round"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got invoice channels %v, want %v", got, want)
+	}
+}
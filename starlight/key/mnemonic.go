@@ -0,0 +1,83 @@
+package key
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+var wordIndex = func() map[string]int {
+	m := make(map[string]int, len(wordlist))
+	for i, w := range wordlist {
+		m[w] = i
+	}
+	return m
+}()
+
+// Mnemonic returns the BIP-39 recovery phrase for seed,
+// whose length must be a multiple of 4 bytes from 16 to 32.
+// A 32-byte seed, like the agent's, takes 24 words.
+//
+// The phrase encodes the seed itself, as BIP-39 "entropy".
+// Unlike other BIP-39 wallets,
+// Starlight derives keys from the seed directly,
+// not from the PBKDF2 stretching of the phrase,
+// so other wallets given the same phrase
+// derive different accounts.
+func Mnemonic(seed []byte) string {
+	n := len(seed)
+	if n < 16 || n > 32 || n%4 != 0 {
+		panic(fmt.Sprintf("key: bad seed length %d for mnemonic", n))
+	}
+	// The phrase encodes the seed followed by a checksum
+	// of one bit per 4 bytes of seed,
+	// taken from its SHA-256 hash,
+	// in groups of 11 bits, each selecting a word.
+	csBits := uint(n / 4)
+	sum := sha256.Sum256(seed)
+	v := new(big.Int).SetBytes(seed)
+	v.Lsh(v, csBits)
+	v.Or(v, big.NewInt(int64(sum[0]>>(8-csBits))))
+
+	words := make([]string, (n*8+int(csBits))/11)
+	mask := big.NewInt(2047)
+	for i := len(words) - 1; i >= 0; i-- {
+		words[i] = wordlist[new(big.Int).And(v, mask).Int64()]
+		v.Rsh(v, 11)
+	}
+	return strings.Join(words, " ")
+}
+
+// SeedFromMnemonic returns the seed encoded by phrase,
+// as produced by Mnemonic.
+// Words may be separated by any white space,
+// and are case-insensitive.
+func SeedFromMnemonic(phrase string) ([]byte, error) {
+	words := strings.Fields(strings.ToLower(phrase))
+	switch len(words) {
+	case 12, 15, 18, 21, 24:
+	default:
+		return nil, fmt.Errorf("got %d words, want 12, 15, 18, 21, or 24", len(words))
+	}
+	v := new(big.Int)
+	for _, w := range words {
+		i, ok := wordIndex[w]
+		if !ok {
+			return nil, fmt.Errorf("unknown word %q", w)
+		}
+		v.Lsh(v, 11)
+		v.Or(v, big.NewInt(int64(i)))
+	}
+	n := len(words) * 11 * 32 / 33 / 8 // seed length in bytes
+	csBits := uint(n / 4)
+	cs := new(big.Int).And(v, big.NewInt(1<<csBits-1)).Int64()
+	v.Rsh(v, csBits)
+	seed := make([]byte, n)
+	v.FillBytes(seed)
+	sum := sha256.Sum256(seed)
+	if int64(sum[0]>>(8-csBits)) != cs {
+		return nil, fmt.Errorf("bad checksum")
+	}
+	return seed, nil
+}
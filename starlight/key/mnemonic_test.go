@@ -0,0 +1,84 @@
+package key
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// Test vectors from BIP-39.
+var mnemonicTests = []struct {
+	seed, phrase string
+}{
+	{
+		"00000000000000000000000000000000",
+		"abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about",
+	},
+	{
+		"7f7f7f7f7f7f7f7f7f7f7f7f7f7f7f7f",
+		"legal winner thank year wave sausage worth useful legal winner thank yellow",
+	},
+	{
+		"9e885d952ad362caeb4efe34a8e91bd2",
+		"ozone drill grab fiber curtain grace pudding thank cruise elder eight picnic",
+	},
+	{
+		"6610b25967cdcca9d59875f5cb50b0ea75433311869e930b",
+		"gravity machine north sort system female filter attitude volume fold club stay feature office ecology stable narrow fog",
+	},
+	{
+		"0000000000000000000000000000000000000000000000000000000000000000",
+		"abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon art",
+	},
+	{
+		"8080808080808080808080808080808080808080808080808080808080808080",
+		"letter advice cage absurd amount doctor acoustic avoid letter advice cage absurd amount doctor acoustic avoid letter advice cage absurd amount doctor acoustic bless",
+	},
+	{
+		"ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff",
+		"zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo vote",
+	},
+	{
+		"68a79eaca2324873eacc50cb9c6eca8cc68ea5d936f98787c60c7ebc74e6ce7c",
+		"hamster diagram private dutch cause delay private meat slide toddler razor book happy fancy gospel tennis maple dilemma loan word shrug inflict delay length",
+	},
+	{
+		"f585c11aec520db57dd353c69554b21a89b20fb0650966fa0a9d6f74fd989d8f",
+		"void come effort suffer camp survey warrior heavy shoot primary clutch crush open amazing screen patrol group space point ten exist slush involve unfold",
+	},
+}
+
+func TestMnemonic(t *testing.T) {
+	if len(wordlist) != 2048 {
+		t.Fatalf("wordlist has %d words, want 2048", len(wordlist))
+	}
+	for _, tt := range mnemonicTests {
+		seed, err := hex.DecodeString(tt.seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := Mnemonic(seed); got != tt.phrase {
+			t.Errorf("Mnemonic(%s) = %q, want %q", tt.seed, got, tt.phrase)
+		}
+		got, err := SeedFromMnemonic(strings.ToUpper(tt.phrase) + "\n")
+		if err != nil {
+			t.Errorf("SeedFromMnemonic(%q): %s", tt.phrase, err)
+		} else if !bytes.Equal(got, seed) {
+			t.Errorf("SeedFromMnemonic(%q) = %x, want %s", tt.phrase, got, tt.seed)
+		}
+	}
+}
+
+func TestSeedFromMnemonicErrors(t *testing.T) {
+	for _, phrase := range []string{
+		"",
+		"abandon abandon abandon",
+		"abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon", // bad checksum
+		"abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon bitcoin",
+	} {
+		if _, err := SeedFromMnemonic(phrase); err == nil {
+			t.Errorf("SeedFromMnemonic(%q) succeeded, want error", phrase)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package starlight
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stellar/go/xdr"
+
+	"github.com/interstellar/starlight/metrics"
+	"github.com/interstellar/starlight/starlight/db"
+	"github.com/interstellar/starlight/starlight/fsm"
+)
+
+// agentMetrics instruments an agent.
+// Values derived from the database, such as channel counts,
+// are computed when the metrics are read.
+type agentMetrics struct {
+	reg *metrics.Registry
+
+	roundDuration *metrics.Histogram
+	submitTx      *metrics.Counter
+	sendFailures  *metrics.Counter
+
+	mu         sync.Mutex
+	roundStart map[string]time.Time // by channel ID
+}
+
+func (g *Agent) newMetrics() *agentMetrics {
+	m := &agentMetrics{
+		reg:        new(metrics.Registry),
+		roundStart: make(map[string]time.Time),
+	}
+	m.reg.NewGaugeFunc("starlight_channels", "Number of channels in each state.", []string{"state"},
+		func(emit func(float64, ...string)) {
+			for _, c := range g.Channels() {
+				emit(1, string(c.State))
+			}
+		})
+	m.reg.NewGaugeFunc("starlight_channel_locked_balance",
+		"Total balance held in channel escrow accounts, in units of each asset.", []string{"asset"},
+		func(emit func(float64, ...string)) {
+			for _, c := range g.Channels() {
+				emit(float64(c.HostAmount+c.GuestAmount)/1e7, c.Asset.String())
+			}
+		})
+	m.roundDuration = m.reg.NewHistogram("starlight_round_duration_seconds",
+		"Time from a channel's proposing or accepting a payment to its return to the open state.",
+		[]float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300})
+	m.reg.NewGaugeFunc("starlight_taskbasket_tasks", "Number of pending tasks.", nil,
+		func(emit func(float64, ...string)) {
+			db.View(g.db, func(root *db.Root) error {
+				if g.tb == nil {
+					return nil
+				}
+				n, err := g.tb.LenTx(root.Tx())
+				if err == nil {
+					emit(float64(n))
+				}
+				return err
+			})
+		})
+	m.reg.NewCounterFunc("starlight_taskbasket_retries_total", "Number of failed task runs, each retried later.", nil,
+		func(emit func(float64, ...string)) {
+			db.View(g.db, func(root *db.Root) error {
+				if g.tb != nil {
+					emit(float64(g.tb.Retries()))
+				}
+				return nil
+			})
+		})
+	m.reg.NewCounterFunc("starlight_horizon_reconnects_total", "Number of Horizon streams restarted after an error.", nil,
+		func(emit func(float64, ...string)) {
+			emit(float64(g.wclient.Reconnects()))
+		})
+	m.submitTx = m.reg.NewCounter("starlight_submit_tx_total",
+		"Number of transactions submitted to Horizon, by result code.", "result")
+	m.sendFailures = m.reg.NewCounter("starlight_peer_send_failures_total",
+		"Number of failed attempts to send a message to a peer.")
+	return m
+}
+
+// MetricsHandler returns a handler that serves g's metrics
+// in the Prometheus text exposition format.
+func (g *Agent) MetricsHandler() http.Handler {
+	return g.metrics.reg
+}
+
+// observeTransition records the timing of payment rounds
+// when channel chanID moves from state prev to state next.
+// It must be called from within an update transaction,
+// and takes effect only if the transaction commits.
+func (m *agentMetrics) observeTransition(root *db.Root, chanID string, prev, next fsm.State) {
+	if prev == next {
+		return
+	}
+	now := time.Now()
+	root.Tx().OnCommit(func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		switch {
+		case prev == fsm.Open && (next == fsm.PaymentProposed || next == fsm.PaymentAccepted):
+			m.roundStart[chanID] = now
+		case inRound(prev):
+			if start, ok := m.roundStart[chanID]; ok && !inRound(next) {
+				delete(m.roundStart, chanID)
+				if next == fsm.Open {
+					m.roundDuration.Observe(now.Sub(start).Seconds())
+				}
+			}
+		}
+	})
+}
+
+// inRound reports whether a channel in state s
+// has a payment round in flight.
+func inRound(s fsm.State) bool {
+	switch s {
+	case fsm.PaymentProposed, fsm.PaymentAccepted, fsm.AwaitingPaymentMerge:
+		return true
+	}
+	return false
+}
+
+// submitResult returns the label for the outcome
+// of submitting a transaction,
+// given its result, if any, and the error from SubmitTx.
+func submitResult(tr *xdr.TransactionResult, err error) string {
+	if err == nil {
+		return "TxSuccess"
+	}
+	if tr == nil {
+		return "error"
+	}
+	return strings.TrimPrefix(tr.Result.Code.String(), "TransactionResultCode")
+}
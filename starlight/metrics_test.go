@@ -0,0 +1,65 @@
+package starlight
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/interstellar/starlight/starlight/db"
+	"github.com/interstellar/starlight/starlight/fsm"
+	"github.com/interstellar/starlight/worizon/xlm"
+)
+
+func TestMetrics(t *testing.T) {
+	g, closer := startTestAgent(t)
+	defer closer()
+	err := g.ConfigInit(&Config{
+		Username:   "alice",
+		Password:   "password",
+		HorizonURL: testHorizonURL,
+	}, "starlight.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transition := func(c *fsm.Channel, state fsm.State) {
+		err := db.Update(g.db, func(root *db.Root) error {
+			g.metrics.observeTransition(root, c.ID, c.State, state)
+			c.State = state
+			g.putChannel(root, c.ID, c)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	a := &fsm.Channel{ID: "a", State: fsm.Open, HostAmount: 2 * xlm.Lumen, GuestAmount: xlm.Lumen}
+	b := &fsm.Channel{ID: "b", State: fsm.Open, HostAmount: xlm.Lumen}
+	transition(a, fsm.Open)
+	transition(b, fsm.Open)
+	transition(a, fsm.PaymentProposed)
+	transition(b, fsm.PaymentAccepted)
+	transition(b, fsm.Open)
+	g.metrics.submitTx.Inc(submitResult(nil, nil))
+
+	var buf bytes.Buffer
+	_, err = g.metrics.reg.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := buf.String()
+	for _, want := range []string{
+		`starlight_channels{state="Open"} 1`,
+		`starlight_channels{state="PaymentProposed"} 1`,
+		`starlight_channel_locked_balance{asset="native"} 4`,
+		`starlight_round_duration_seconds_count 1`,
+		`starlight_submit_tx_total{result="TxSuccess"} 1`,
+		`starlight_peer_send_failures_total 0`,
+		`starlight_horizon_reconnects_total 0`,
+		`starlight_taskbasket_tasks 0`,
+	} {
+		if !strings.Contains(got, want+"\n") {
+			t.Errorf("metrics missing %q; got:\n%s", want, got)
+		}
+	}
+}
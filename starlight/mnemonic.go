@@ -0,0 +1,164 @@
+package starlight
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/stellar/go/xdr"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/interstellar/starlight/errors"
+	"github.com/interstellar/starlight/starlight/db"
+	"github.com/interstellar/starlight/starlight/fsm"
+	"github.com/interstellar/starlight/starlight/internal/update"
+	"github.com/interstellar/starlight/starlight/key"
+	"github.com/interstellar/starlight/worizon"
+	"github.com/interstellar/starlight/worizon/xlm"
+)
+
+// ExportMnemonic returns the recovery phrase for g's seed,
+// 24 words from which ConfigInit can restore the agent's keys.
+// It requires the agent's password,
+// even if the user is already logged in.
+func (g *Agent) ExportMnemonic(password string) (string, error) {
+	var seed []byte
+	err := db.View(g.db, func(root *db.Root) error {
+		if !g.isReadyConfigured(root) {
+			return errNotConfigured
+		}
+		digest := root.Agent().Config().PwHash()
+		if bcrypt.CompareHashAndPassword(digest, []byte(password)) != nil {
+			return errors.Wrap(ErrAuthFailed, "export password")
+		}
+		seed = openBox(root.Agent().EncryptedSeed(), []byte(password))
+		if seed == nil {
+			return errors.Wrap(ErrAuthFailed, "decrypting seed")
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return key.Mnemonic(seed), nil
+}
+
+// scanGap is how many unused channel key indexes in a row
+// scanKeys checks before concluding that no more are in use.
+const scanGap = 20
+
+// keyScan is what scanKeys finds on the ledger
+// among the accounts derived from a seed.
+type keyScan struct {
+	primary *worizon.Account // nil if the account doesn't exist
+
+	// escrows holds the key indexes of the escrow accounts found.
+	escrows []uint32
+
+	// nextIndex is the first key index after those in use.
+	nextIndex uint32
+}
+
+// scanKeys looks for the accounts derived from seed on the ledger:
+// the primary account, and the escrow accounts of channels
+// that the agent created as host.
+// Each channel takes three consecutive key indexes, starting at 1,
+// for its escrow account and two ratchet accounts;
+// see DoCreateChannel.
+// The scan stops after scanGap channels' worth of unused indexes.
+//
+// Channels that have closed leave no accounts behind,
+// so their key indexes may be reused.
+// That's safe: a new escrow account with the same key
+// has a higher sequence number than any transaction
+// built for the old one.
+func (g *Agent) scanKeys(seed []byte) (*keyScan, error) {
+	s := &keyScan{nextIndex: 1}
+	acct, err := g.wclient.LoadAccount(key.DeriveAccountPrimary(seed).Address())
+	if err == nil {
+		s.primary = &acct
+	} else if !worizon.IsNotFound(err) {
+		return nil, errors.Wrap(err, "loading primary account")
+	}
+	for i, unused := uint32(1), 0; unused < scanGap; i += 3 {
+		addr := key.DeriveAccount(seed, i).Address()
+		_, err := g.wclient.SequenceForAccount(addr)
+		if worizon.IsNotFound(err) {
+			unused++
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "loading account %s", addr)
+		}
+		s.escrows = append(s.escrows, i)
+		s.nextIndex = i + 3
+		unused = 0
+	}
+	return s, nil
+}
+
+// putRestoredKeys records in root the accounts s found
+// for an agent restored from its recovery phrase.
+// Must be called from within an update transaction,
+// after the agent's wallet has been put.
+func (g *Agent) putRestoredKeys(root *db.Root, s *keyScan) error {
+	root.Agent().PutNextKeypathIndex(s.nextIndex)
+	if s.primary != nil {
+		w, err := walletFromLedger(s.primary, root.Agent().Wallet().Address)
+		if err != nil {
+			return err
+		}
+		root.Agent().PutWallet(w)
+	}
+	for _, i := range s.escrows {
+		g.putUpdate(root, &Update{
+			Type: update.WarningType,
+			Warning: fmt.Sprintf("found escrow account %s of a channel (key index %d); "+
+				"its state can't be recovered from the recovery phrase, but only from a backup",
+				key.DeriveAccount(g.seed, i).Address(), i),
+		})
+	}
+	return nil
+}
+
+// walletFromLedger returns the state of the wallet account acct,
+// as it is on the ledger now,
+// with federation address addr.
+func walletFromLedger(acct *worizon.Account, addr string) (*fsm.WalletAcct, error) {
+	seqnum, err := strconv.ParseInt(acct.Sequence, 10, 64)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing sequence number", acct.Sequence)
+	}
+	w := &fsm.WalletAcct{
+		Reserve:  xlm.Amount(2+acct.SubentryCount) * baseReserve,
+		Seqnum:   xdr.SequenceNumber(seqnum),
+		Address:  addr,
+		Cursor:   "now",
+		Balances: map[string]fsm.Balance{},
+	}
+	for _, b := range acct.Balances {
+		amount, err := xlm.Parse(b.Balance)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing balance", b.Balance)
+		}
+		if b.Asset.Type == "native" {
+			w.NativeBalance = amount - w.Reserve
+			continue
+		}
+		var issuer xdr.AccountId
+		err = issuer.SetAddress(b.Asset.Issuer)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing issuer", b.Asset.Issuer)
+		}
+		var asset xdr.Asset
+		err = asset.SetCredit(b.Asset.Code, issuer)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing asset", b.Asset.Code)
+		}
+		w.Balances[asset.String()] = fsm.Balance{
+			Asset:      asset,
+			Amount:     uint64(amount),
+			Authorized: true,
+		}
+	}
+	return w, nil
+}
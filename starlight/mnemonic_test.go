@@ -0,0 +1,147 @@
+package starlight
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stellar/go/clients/horizon"
+	"github.com/stellar/go/protocols/horizon/base"
+	"github.com/stellar/go/xdr"
+
+	"github.com/interstellar/starlight/errors"
+	"github.com/interstellar/starlight/starlight/db"
+	"github.com/interstellar/starlight/starlight/internal/update"
+	"github.com/interstellar/starlight/starlight/key"
+	"github.com/interstellar/starlight/worizon"
+	"github.com/interstellar/starlight/worizon/worizontest"
+	"github.com/interstellar/starlight/worizon/xlm"
+)
+
+// ledgerHorizon knows only the accounts in its map,
+// and reports any other account as not found.
+type ledgerHorizon struct {
+	worizontest.FakeHorizonClient
+	accounts map[string]horizon.Account
+}
+
+func (h *ledgerHorizon) LoadAccount(id string) (horizon.Account, error) {
+	acct, ok := h.accounts[id]
+	if !ok {
+		return horizon.Account{}, &horizon.Error{Problem: horizon.Problem{Status: 404}}
+	}
+	return acct, nil
+}
+
+func (h *ledgerHorizon) SequenceForAccount(id string) (xdr.SequenceNumber, error) {
+	acct, err := h.LoadAccount(id)
+	if err != nil {
+		return 0, err
+	}
+	seqnum, err := strconv.ParseInt(acct.Sequence, 10, 64)
+	return xdr.SequenceNumber(seqnum), err
+}
+
+func TestExportMnemonic(t *testing.T) {
+	g, closer := startTestAgent(t)
+	defer closer()
+
+	_, err := g.ExportMnemonic("password")
+	if errors.Root(err) != errNotConfigured {
+		t.Fatalf("got error %v exporting before config, want %v", err, errNotConfigured)
+	}
+	err = g.ConfigInit(&Config{
+		Username:   "alice",
+		Password:   "password",
+		HorizonURL: testHorizonURL,
+	}, "starlight.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = g.ExportMnemonic("wrong")
+	if errors.Root(err) != ErrAuthFailed {
+		t.Fatalf("got error %v exporting with wrong password, want %v", err, ErrAuthFailed)
+	}
+	phrase, err := g.ExportMnemonic("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(strings.Fields(phrase)); n != 24 {
+		t.Errorf("got %d words, want 24", n)
+	}
+	seed, err := key.SeedFromMnemonic(phrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.View(g.db, func(root *db.Root) error {
+		want := root.Agent().PrimaryAcct().Address()
+		if got := key.DeriveAccountPrimary(seed).Address(); got != want {
+			t.Errorf("phrase derives primary account %s, want %s", got, want)
+		}
+		return nil
+	})
+}
+
+func TestConfigInitMnemonic(t *testing.T) {
+	seed := make([]byte, 32)
+	seed[0] = 1
+	primary := key.DeriveAccountPrimary(seed).Address()
+	escrow := key.DeriveAccount(seed, 4).Address()
+	h := &ledgerHorizon{accounts: map[string]horizon.Account{
+		primary: {
+			Sequence: "12345",
+			Balances: []horizon.Balance{{
+				Balance: "100.0000000",
+				Asset:   base.Asset{Type: "native"},
+			}},
+		},
+		escrow: {Sequence: "67890"},
+	}}
+
+	g, closer := startTestAgent(t)
+	defer closer()
+	g.wclient = worizon.NewClient(horizonHTTP{}, h)
+
+	config := &Config{
+		Username:   "alice",
+		Password:   "password",
+		HorizonURL: testHorizonURL,
+		Mnemonic:   "abandon abandon abandon",
+	}
+	err := g.ConfigInit(config, "starlight.com")
+	if errors.Root(err) != errInvalidMnemonic {
+		t.Fatalf("got error %v, want %v", err, errInvalidMnemonic)
+	}
+	config.Mnemonic = key.Mnemonic(seed)
+	err = g.ConfigInit(config, "starlight.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.View(g.db, func(root *db.Root) error {
+		if got := root.Agent().PrimaryAcct().Address(); got != primary {
+			t.Errorf("primary account %s, want %s", got, primary)
+		}
+		if got := root.Agent().NextKeypathIndex(); got != 7 {
+			t.Errorf("next keypath index %d, want 7", got)
+		}
+		w := root.Agent().Wallet()
+		if w.Seqnum != 12345 {
+			t.Errorf("wallet seqnum %d, want 12345", w.Seqnum)
+		}
+		if want := 100*xlm.Lumen - 2*baseReserve; w.NativeBalance != want {
+			t.Errorf("wallet balance %s, want %s", w.NativeBalance, want)
+		}
+		return nil
+	})
+
+	var warned bool
+	for _, u := range g.Updates(1, 100) {
+		if u.Type == update.WarningType && strings.Contains(u.Warning, escrow) {
+			warned = true
+		}
+	}
+	if !warned {
+		t.Errorf("no warning about escrow account %s", escrow)
+	}
+}
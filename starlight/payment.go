@@ -0,0 +1,112 @@
+package starlight
+
+import (
+	"encoding/binary"
+
+	"github.com/stellar/go/xdr"
+
+	"github.com/interstellar/starlight/starlight/db"
+	"github.com/interstellar/starlight/starlight/fsm"
+	"github.com/interstellar/starlight/starlight/internal/payment"
+	"github.com/interstellar/starlight/worizon"
+)
+
+// maxPaymentsPage is the most payments Payments returns at once.
+const maxPaymentsPage = 200
+
+// Payment is an agent's record of a completed payment.
+type Payment = payment.Payment
+
+// Payments returns at most limit of the agent's payments,
+// in the order they completed, beginning with payment number from.
+// Payments are numbered 1, 2, 3, etc.
+// A limit outside (0, maxPaymentsPage] means maxPaymentsPage.
+func (g *Agent) Payments(from uint64, limit int) []*Payment {
+	if limit <= 0 || limit > maxPaymentsPage {
+		limit = maxPaymentsPage
+	}
+	payments := make([]*Payment, 0) // we want json "[]" not "null"
+	db.View(g.db, func(root *db.Root) error {
+		seq := root.Agent().Payments()
+		bucket := seq.Bucket()
+		if bucket == nil {
+			return nil
+		}
+		c := bucket.Cursor()
+		k := make([]byte, 8)
+		binary.BigEndian.PutUint64(k, from)
+		for k, _ = c.Seek(k); k != nil && len(payments) < limit; k, _ = c.Next() {
+			payments = append(payments, seq.Get(binary.BigEndian.Uint64(k)))
+		}
+		return nil
+	})
+	return payments
+}
+
+// putChannelPayments records the payments sent and received
+// in the round completed by the latest update of channel c.
+// Must be called from within an update transaction.
+func putChannelPayments(root *db.Root, c *fsm.Channel) {
+	counterparty := c.GuestAcct.Address()
+	if c.Role == fsm.Guest {
+		counterparty = c.HostAcct.Address()
+	}
+	var asset string
+	if !c.IsNative() {
+		asset = c.Asset.String()
+	}
+	put := func(payments []fsm.PaymentIntent, dir payment.Direction) {
+		for _, p := range payments {
+			if p.Amount == 0 {
+				continue // keep-alive
+			}
+			putPayment(root, &Payment{
+				Kind:         payment.Channel,
+				Direction:    dir,
+				Counterparty: counterparty,
+				Amount:       uint64(p.Amount),
+				Asset:        asset,
+				ChannelID:    c.ID,
+				ID:           p.ID,
+				Memo:         p.Memo,
+				InvoiceID:    p.InvoiceID,
+				Time:         c.PaymentTime,
+			})
+		}
+	}
+	put(c.SettledPayments, payment.Sent)
+	put(c.ReceivedPayments, payment.Received)
+}
+
+// putWalletPayment records the payment made by payment operation op
+// of transaction tx, with hash txHash,
+// sent or received by account acctID.
+// Must be called from within an update transaction.
+func putWalletPayment(root *db.Root, acctID string, tx *worizon.Tx, txHash string, op *xdr.Operation) {
+	src := tx.Env.Tx.SourceAccount.Address()
+	if op.SourceAccount != nil {
+		src = op.SourceAccount.Address()
+	}
+	paymentOp := op.Body.PaymentOp
+	p := &Payment{
+		Kind:      payment.Wallet,
+		Direction: payment.Sent,
+		Amount:    uint64(paymentOp.Amount),
+		TxHash:    txHash,
+		Time:      tx.LedgerTime,
+	}
+	if paymentOp.Asset.Type != xdr.AssetTypeAssetTypeNative {
+		p.Asset = paymentOp.Asset.String()
+	}
+	if src == acctID {
+		p.Counterparty = paymentOp.Destination.Address()
+	} else {
+		p.Direction = payment.Received
+		p.Counterparty = src
+	}
+	putPayment(root, p)
+}
+
+func putPayment(root *db.Root, p *Payment) {
+	root.Agent().Payments().Add(p, &p.PaymentNum)
+}
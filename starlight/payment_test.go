@@ -0,0 +1,66 @@
+package starlight
+
+import (
+	"testing"
+
+	"github.com/interstellar/starlight/errors"
+	"github.com/interstellar/starlight/starlight/db"
+	"github.com/interstellar/starlight/starlight/fsm"
+	"github.com/interstellar/starlight/starlight/internal/payment"
+	"github.com/interstellar/starlight/worizon/xlm"
+)
+
+func TestPayments(t *testing.T) {
+	g, closer := startTestAgent(t)
+	defer closer()
+
+	ch := &fsm.Channel{ID: "chan", Role: fsm.Host, PaymentTime: g.wclient.Now()}
+	ch.SettledPayments = []fsm.PaymentIntent{
+		{ID: "p1", Amount: xlm.Lumen, Memo: "coffee"},
+		{Amount: 0},
+		{ID: "p2", Amount: 2 * xlm.Lumen},
+	}
+	ch.ReceivedPayments = []fsm.PaymentIntent{{ID: "p3", Amount: 3 * xlm.Lumen, InvoiceID: "inv"}}
+	db.Update(g.db, func(root *db.Root) error {
+		putChannelPayments(root, ch)
+		return nil
+	})
+
+	all := g.Payments(1, 0)
+	if len(all) != 3 {
+		t.Fatalf("got %d payments, want 3 (keep-alive excluded)", len(all))
+	}
+	for i, want := range []struct {
+		id  string
+		dir payment.Direction
+	}{{"p1", payment.Sent}, {"p2", payment.Sent}, {"p3", payment.Received}} {
+		p := all[i]
+		if p.PaymentNum != uint64(i+1) || p.ID != want.id || p.Direction != want.dir || p.ChannelID != "chan" {
+			t.Errorf("payment %d: got %+v, want %s %s", i, p, want.id, want.dir)
+		}
+	}
+	if all[0].Memo != "coffee" || all[2].InvoiceID != "inv" {
+		t.Errorf("got memo %q, invoice ID %q", all[0].Memo, all[2].InvoiceID)
+	}
+
+	page := g.Payments(2, 1)
+	if len(page) != 1 || page[0].ID != "p2" {
+		t.Errorf("got page %+v, want p2 only", page)
+	}
+	if page = g.Payments(4, 10); len(page) != 0 {
+		t.Errorf("got %d payments past the end, want 0", len(page))
+	}
+}
+
+func TestChannelNotFound(t *testing.T) {
+	g, closer := startTestAgent(t)
+	defer closer()
+
+	_, err := g.Channel("nonexistent")
+	if errors.Root(err) != errNoChannel {
+		t.Errorf("got error %v, want %v", err, errNoChannel)
+	}
+	if n := len(g.Channels()); n != 0 {
+		t.Errorf("got %d channels, want 0", n)
+	}
+}
@@ -0,0 +1,164 @@
+package starlight
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/interstellar/starlight/errors"
+	"github.com/interstellar/starlight/starlight/db"
+	"github.com/interstellar/starlight/starlight/internal/update"
+)
+
+// RetentionPolicy says which updates PruneUpdates keeps.
+// An update is kept if it is one of the last KeepUpdates updates,
+// or if it is no older than MaxAge, by ledger time.
+// If both are zero, every update is kept.
+type RetentionPolicy struct {
+	KeepUpdates uint64
+	MaxAge      time.Duration
+
+	// Archive, if set, receives each pruned update
+	// as a line of JSON before it is deleted.
+	Archive io.Writer
+
+	// Flush, if set, is called once the pruned updates
+	// are written to Archive, before their deletion commits,
+	// to make the archive durable.
+	// If it returns an error, nothing is deleted.
+	Flush func() error
+}
+
+// PruneUpdates deletes the updates that policy p does not keep,
+// and returns how many it deleted.
+//
+// Whatever their age, it keeps the latest init and config updates
+// and the latest update of each channel that is not closed,
+// so that a client reading all the updates
+// from the start still learns the agent's current state.
+// Update numbers are never reused,
+// so clients that have seen an update
+// can keep reading where they left off.
+func (g *Agent) PruneUpdates(p *RetentionPolicy) (int, error) {
+	if p.KeepUpdates == 0 && p.MaxAge == 0 {
+		return 0, nil
+	}
+	var n int
+	err := db.Update(g.db, func(root *db.Root) error {
+		bu := root.Agent().Updates().Bucket()
+		if bu == nil {
+			return nil
+		}
+
+		// Updates numbered below end are old enough to prune.
+		end := bu.Sequence() + 1
+		if p.KeepUpdates > 0 {
+			if bu.Sequence() <= p.KeepUpdates {
+				return nil
+			}
+			end = bu.Sequence() - p.KeepUpdates + 1
+		}
+		var cutoff time.Time
+		if p.MaxAge > 0 {
+			cutoff = g.wclient.Now().Add(-p.MaxAge)
+		}
+
+		var doomed []*Update
+		c := bu.Cursor()
+		for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k) < end; k, _ = c.Next() {
+			u := root.Agent().Updates().Get(binary.BigEndian.Uint64(k))
+			if !cutoff.IsZero() && !u.UpdateLedgerTime.Before(cutoff) {
+				break // updates are in ledger-time order
+			}
+			doomed = append(doomed, u)
+		}
+		if len(doomed) == 0 {
+			return nil
+		}
+
+		pinned := pinnedUpdates(root, doomed[len(doomed)-1].UpdateNum)
+		var enc *json.Encoder
+		if p.Archive != nil {
+			enc = json.NewEncoder(p.Archive)
+		}
+		key := make([]byte, 8)
+		for _, u := range doomed {
+			if pinned[u.UpdateNum] {
+				continue
+			}
+			if enc != nil {
+				err := enc.Encode(u)
+				if err != nil {
+					return errors.Wrapf(err, "archiving update %d", u.UpdateNum)
+				}
+			}
+			binary.BigEndian.PutUint64(key, u.UpdateNum)
+			err := bu.Delete(key)
+			if err != nil {
+				return err
+			}
+			n++
+		}
+		if n > 0 && p.Flush != nil {
+			err := p.Flush()
+			if err != nil {
+				return errors.Wrap(err, "flushing archive")
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Compact returns the space freed by PruneUpdates
+// to the operating system, if the agent's storage
+// can do so while in use; see kv.DB.Compact.
+func (g *Agent) Compact() error {
+	return g.db.Compact()
+}
+
+// pinnedUpdates returns the numbers of the updates
+// that PruneUpdates must keep, among those numbered max and below:
+// the latest init and config updates,
+// and the latest update of each channel in root.
+func pinnedUpdates(root *db.Root, max uint64) map[uint64]bool {
+	pinned := make(map[uint64]bool)
+	seen := map[update.Type]bool{}
+	chans := make(map[string]bool)
+	if bu := root.Agent().Channels().Bucket(); bu != nil {
+		bu.ForEach(func(k, _ []byte) error {
+			chans[string(k)] = true
+			return nil
+		})
+	}
+
+	// Walk backward from the newest update,
+	// until every pin is accounted for.
+	c := root.Agent().Updates().Bucket().Cursor()
+	for k, _ := c.Last(); k != nil; k, _ = c.Prev() {
+		if seen[update.InitType] && seen[update.ConfigType] && len(chans) == 0 {
+			break
+		}
+		num := binary.BigEndian.Uint64(k)
+		u := root.Agent().Updates().Get(num)
+		pin := false
+		switch u.Type {
+		case update.InitType, update.ConfigType:
+			pin = !seen[u.Type]
+			seen[u.Type] = true
+		case update.ChannelType:
+			if u.Channel != nil && chans[u.Channel.ID] {
+				pin = true
+				delete(chans, u.Channel.ID)
+			}
+		}
+		if pin && num <= max {
+			pinned[num] = true
+		}
+	}
+	return pinned
+}
@@ -0,0 +1,184 @@
+package starlight
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/interstellar/starlight/errors"
+	"github.com/interstellar/starlight/starlight/db"
+	"github.com/interstellar/starlight/starlight/fsm"
+	"github.com/interstellar/starlight/starlight/internal/update"
+)
+
+func TestPruneUpdates(t *testing.T) {
+	cases := []struct {
+		name   string
+		policy RetentionPolicy
+		want   []uint64
+	}{
+		{"keep all", RetentionPolicy{}, []uint64{1, 2, 3, 4, 5, 6, 7, 8}},
+		{"keep 3", RetentionPolicy{KeepUpdates: 3}, []uint64{1, 3, 6, 7, 8}},
+		{"keep 10", RetentionPolicy{KeepUpdates: 10}, []uint64{1, 2, 3, 4, 5, 6, 7, 8}},
+		{"max age", RetentionPolicy{MaxAge: 90 * time.Minute}, []uint64{1, 3, 7, 8}},
+		{"either", RetentionPolicy{KeepUpdates: 3, MaxAge: 90 * time.Minute}, []uint64{1, 3, 6, 7, 8}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			g, closer := startTestAgent(t)
+			defer closer()
+
+			// Update 1 is init, 3 is the latest for channel "open",
+			// and 5 is for a channel that has since closed.
+			// Update n is 8-n hours old.
+			now := g.wclient.Now()
+			types := []update.Type{
+				update.InitType,
+				update.ChannelType,
+				update.ChannelType,
+				update.WarningType,
+				update.ChannelType,
+				update.WarningType,
+				update.WarningType,
+				update.WarningType,
+			}
+			chanIDs := []string{"", "open", "open", "", "closed", "", "", ""}
+			db.Update(g.db, func(root *db.Root) error {
+				g.putChannel(root, "open", &fsm.Channel{ID: "open", State: fsm.Open})
+				for i, typ := range types {
+					u := &Update{
+						Type:             typ,
+						UpdateLedgerTime: now.Add(-time.Duration(len(types)-1-i) * time.Hour),
+					}
+					if chanIDs[i] != "" {
+						u.Channel = &fsm.Channel{ID: chanIDs[i]}
+					}
+					root.Agent().Updates().Add(u, &u.UpdateNum)
+				}
+				return nil
+			})
+
+			var archive bytes.Buffer
+			flushed := -1
+			tc.policy.Archive = &archive
+			tc.policy.Flush = func() error {
+				flushed = archive.Len()
+				return nil
+			}
+			n, err := g.PruneUpdates(&tc.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n > 0 && flushed != archive.Len() {
+				t.Errorf("flushed archive at %d bytes, want %d", flushed, archive.Len())
+			}
+			if n != len(types)-len(tc.want) {
+				t.Errorf("pruned %d updates, want %d", n, len(types)-len(tc.want))
+			}
+
+			var got []uint64
+			for _, u := range g.Updates(1, 100) {
+				got = append(got, u.UpdateNum)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("kept updates %v, want %v", got, tc.want)
+			}
+
+			var archived int
+			sc := bufio.NewScanner(&archive)
+			for sc.Scan() {
+				var u Update
+				err := json.Unmarshal(sc.Bytes(), &u)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, k := range tc.want {
+					if u.UpdateNum == k {
+						t.Errorf("archived kept update %d", k)
+					}
+				}
+				archived++
+			}
+			if archived != n {
+				t.Errorf("archived %d updates, want %d", archived, n)
+			}
+
+			if lastUpdateNum(g.db) != uint64(len(types)) {
+				t.Errorf("last update number %d, want %d", lastUpdateNum(g.db), len(types))
+			}
+		})
+	}
+}
+
+func TestPruneUpdatesFlushFails(t *testing.T) {
+	g, closer := startTestAgent(t)
+	defer closer()
+	db.Update(g.db, func(root *db.Root) error {
+		for _, typ := range []update.Type{update.InitType, update.WarningType, update.WarningType} {
+			u := &Update{Type: typ, UpdateLedgerTime: g.wclient.Now()}
+			root.Agent().Updates().Add(u, &u.UpdateNum)
+		}
+		return nil
+	})
+
+	p := &RetentionPolicy{
+		KeepUpdates: 1,
+		Archive:     new(bytes.Buffer),
+		Flush:       func() error { return errors.New("disk full") },
+	}
+	n, err := g.PruneUpdates(p)
+	if err == nil {
+		t.Error("got no error")
+	}
+	if n != 0 {
+		t.Errorf("pruned %d updates, want 0", n)
+	}
+	if got := len(g.Updates(1, 100)); got != 3 {
+		t.Errorf("kept %d updates, want 3", got)
+	}
+}
+
+func TestAckMessages(t *testing.T) {
+	g, closer := startTestAgent(t)
+	defer closer()
+
+	c := &fsm.Channel{ID: "chan", Role: fsm.Guest, State: fsm.Open}
+	db.Update(g.db, func(root *db.Root) error {
+		for i := 0; i < 5; i++ {
+			g.putMessage(root, c, new(fsm.Message))
+		}
+		return nil
+	})
+
+	err := g.AckMessages("chan", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs := g.Messages("chan", 1, 10)
+	if len(msgs) != 3 || msgs[0].MsgNum != 3 {
+		t.Errorf("got %d messages starting with %d, want 3 starting with 3", len(msgs), msgs[0].MsgNum)
+	}
+	if n := lastMsgNum(g.db, "chan"); n != 5 {
+		t.Errorf("last message number %d, want 5", n)
+	}
+
+	// Acknowledging again, or acknowledging nothing, changes nothing.
+	for _, n := range []uint64{3, 1} {
+		err = g.AckMessages("chan", n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := len(g.Messages("chan", 1, 10)); got != 3 {
+			t.Errorf("after AckMessages(%d), got %d messages, want 3", n, got)
+		}
+	}
+
+	// Unknown channels have no messages to acknowledge.
+	err = g.AckMessages("nonexistent", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
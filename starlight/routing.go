@@ -0,0 +1,660 @@
+package starlight
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/stellar/go/keypair"
+	"github.com/stellar/go/xdr"
+
+	"github.com/interstellar/starlight/errors"
+	"github.com/interstellar/starlight/starlight/db"
+	"github.com/interstellar/starlight/starlight/fsm"
+	"github.com/interstellar/starlight/starlight/internal/route"
+	"github.com/interstellar/starlight/starlight/internal/update"
+	"github.com/interstellar/starlight/worizon/xlm"
+)
+
+// maxRouteHops is the maximum number of channels
+// a routed payment can cross.
+const maxRouteHops = 4
+
+// RoutedPayment is an agent's record of a routed payment.
+type RoutedPayment = route.Payment
+
+// RouteAdvert describes the channels over which an agent
+// can forward routed payments, and the fee it charges to do so.
+// Agents serve their advert to peers at /starlight/routes.
+type RouteAdvert struct {
+	Account  string
+	FeeBase  xlm.Amount
+	FeeRate  int64 // parts per million of the forwarded amount
+	Channels []RouteChannel
+}
+
+// RouteChannel is a channel in a RouteAdvert.
+// Capacity is the amount the advertising agent can send on it.
+type RouteChannel struct {
+	ChannelID           string
+	Counterparty        string // account ID
+	CounterpartyAddress string // federation address or account ID
+	Capacity            xlm.Amount
+	MaxRoundDuration    time.Duration
+	FinalityDelay       time.Duration
+}
+
+// routeEdge is a channel in the routing graph,
+// with the fee its sending side, From, charges to forward on it.
+type routeEdge struct {
+	From    string
+	FeeBase xlm.Amount
+	FeeRate int64
+	RouteChannel
+}
+
+// forwardFee is the fee for forwarding amt under a fee policy.
+func forwardFee(base xlm.Amount, rate int64, amt xlm.Amount) xlm.Amount {
+	// Split amt to avoid overflowing amt*rate.
+	const ppm = 1000000
+	return base + xlm.Amount(int64(amt)/ppm*rate+int64(amt)%ppm*rate/ppm)
+}
+
+// routeExpiryDelta is the minimum time between the expiry of an HTLC
+// an agent receives on a channel and the expiry of the HTLC it forwards.
+// Once the forwarded HTLC is fulfilled, this leaves the agent time
+// to get paid on the incoming channel, force closing it if necessary.
+func routeExpiryDelta(maxRoundDuration, finalityDelay time.Duration) time.Duration {
+	return 2*finalityDelay + 4*maxRoundDuration
+}
+
+// routeChannels returns the channels the agent can currently
+// send a routed payment on: open, native channels with no HTLC.
+func routeChannels(root *db.Root) []RouteChannel {
+	var result []RouteChannel
+	chans := root.Agent().Channels()
+	bucket := chans.Bucket()
+	if bucket == nil {
+		return nil
+	}
+	bucket.ForEach(func(chanID, _ []byte) error {
+		c := chans.Get(chanID)
+		if c.State != fsm.Open || !c.IsNative() || c.HTLC != nil || c.PendingHTLC != nil {
+			return nil
+		}
+		counterparty := c.GuestAcct
+		if c.Role == fsm.Guest {
+			counterparty = c.HostAcct
+		}
+		result = append(result, RouteChannel{
+			ChannelID:           c.ID,
+			Counterparty:        counterparty.Address(),
+			CounterpartyAddress: c.CounterpartyAddress,
+			Capacity:            c.SpendableAmount(),
+			MaxRoundDuration:    c.MaxRoundDuration,
+			FinalityDelay:       c.FinalityDelay,
+		})
+		return nil
+	})
+	return result
+}
+
+func (g *Agent) handleRoutes(w http.ResponseWriter, req *http.Request) {
+	var advert RouteAdvert
+	err := db.View(g.db, func(root *db.Root) error {
+		if !g.isReadyFunded(root) {
+			return errNotFunded
+		}
+		advert.Account = root.Agent().PrimaryAcct().Address()
+		advert.FeeBase = xlm.Amount(root.Agent().Config().ForwardFeeBase())
+		advert.FeeRate = root.Agent().Config().ForwardFeeRate()
+		advert.Channels = routeChannels(root)
+		return nil
+	})
+	if err != nil {
+		WriteError(req, w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(advert)
+}
+
+// routeHashExpiry is how long the agent keeps the preimage
+// of a routed payment to it before the payment's HTLC arrives.
+const routeHashExpiry = time.Hour
+
+// routeHashRequest is the body of a request for the hash
+// of a routed payment to the agent.
+type routeHashRequest struct {
+	From   string // account ID of the requesting agent
+	Amount xlm.Amount
+	Time   time.Time
+}
+
+// handleRouteHash starts a routed payment to the agent.
+// It generates a preimage, records the payment,
+// and responds with the hex-encoded hash the sender locks it with.
+// The request must come from a counterparty of one of the agent's channels;
+// see checkRouteHashRequest.
+func (g *Agent) handleRouteHash(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, 1<<16))
+	if err != nil {
+		WriteError(req, w, errors.Sub(ErrUnmarshaling, err))
+		return
+	}
+	r, err := g.checkRouteHashRequest(body, req.Header.Get(MessagesSigHeader))
+	if err != nil {
+		WriteError(req, w, err)
+		return
+	}
+	if r.Amount <= 0 {
+		WriteError(req, w, errEmptyAmount)
+		return
+	}
+	preimage := make([]byte, 32)
+	randRead(preimage)
+	now := g.wclient.Now()
+	p := &RoutedPayment{
+		Hash:     sha256.Sum256(preimage),
+		Preimage: preimage,
+		Amount:   r.Amount,
+		Status:   route.Pending,
+		Created:  now,
+	}
+	err = db.Update(g.db, func(root *db.Root) error {
+		if !g.isReadyFunded(root) {
+			return errNotFunded
+		}
+		expireRouteHashes(root, now)
+		putRoutedPayment(root, p)
+		return nil
+	})
+	if err != nil {
+		WriteError(req, w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"Hash": hex.EncodeToString(p.Hash[:])})
+}
+
+// checkRouteHashRequest checks a request for the hash of a routed payment,
+// with the given body and signature header.
+// The request must be signed by its From account,
+// which must be the counterparty of one of the agent's channels,
+// and made recently.
+func (g *Agent) checkRouteHashRequest(body []byte, sig string) (*routeHashRequest, error) {
+	r := new(routeHashRequest)
+	err := json.Unmarshal(body, r)
+	if err != nil {
+		return nil, errors.Sub(ErrUnmarshaling, err)
+	}
+	sigBytes, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		return nil, errors.Sub(ErrUnauthorized, err)
+	}
+	kp, err := keypair.Parse(r.From)
+	if err != nil {
+		return nil, errors.Sub(ErrUnauthorized, err)
+	}
+	if kp.Verify(body, sigBytes) != nil {
+		return nil, errors.Wrap(ErrUnauthorized, "bad signature")
+	}
+	if d := g.wclient.Now().Sub(r.Time); d > maxMessagesRequestAge || d < -maxMessagesRequestAge {
+		return nil, errors.Wrapf(ErrUnauthorized, "request time %s too far from now", r.Time)
+	}
+	var counterparty bool
+	db.View(g.db, func(root *db.Root) error {
+		chans := root.Agent().Channels()
+		bucket := chans.Bucket()
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(chanID, _ []byte) error {
+			c := chans.Get(chanID)
+			if c.HostAcct.Address() == r.From || c.GuestAcct.Address() == r.From {
+				counterparty = true
+			}
+			return nil
+		})
+	})
+	if !counterparty {
+		return nil, errors.Wrapf(ErrUnauthorized, "no channel with %s", r.From)
+	}
+	return r, nil
+}
+
+// expireRouteHashes deletes the records of routed payments to the agent
+// whose HTLC has not arrived within routeHashExpiry.
+// Must be called from within an update transaction.
+func expireRouteHashes(root *db.Root, now time.Time) {
+	payments := root.Agent().RoutedPayments()
+	bucket := payments.Bucket()
+	if bucket == nil {
+		return
+	}
+	var expired [][]byte
+	bucket.ForEach(func(k, _ []byte) error {
+		p := payments.Get(k)
+		if p.InChannel == "" && p.OutChannel == "" && p.Status == route.Pending && now.Sub(p.Created) > routeHashExpiry {
+			expired = append(expired, k)
+		}
+		return nil
+	})
+	for _, k := range expired {
+		bucket.Delete(k)
+	}
+}
+
+// DoRoutedPay pays amount to dest, a federation address or account ID,
+// over a route of up to maxRouteHops channels: the agent's own channels
+// and those advertised by its peers and their peers.
+// Each hop is secured by an HTLC locked with a hash
+// generated by dest, and each intermediate agent takes its fee.
+// The returned record tracks the payment; its status changes
+// are reported in updates of type RoutedPayment.
+func (g *Agent) DoRoutedPay(dest string, amount xlm.Amount) (*RoutedPayment, error) {
+	if dest == "" {
+		return nil, errEmptyAddress
+	}
+	if amount <= 0 {
+		return nil, errEmptyAmount
+	}
+	destAcct, destURL, err := g.FindAccount(dest)
+	if err != nil {
+		return nil, errors.Wrapf(err, "finding account %s", dest)
+	}
+	var (
+		self  string
+		local []RouteChannel
+	)
+	db.View(g.db, func(root *db.Root) error {
+		self = root.Agent().PrimaryAcct().Address()
+		local = routeChannels(root)
+		return nil
+	})
+	if destAcct == self {
+		return nil, errAcctsSame
+	}
+	hops, err := findRoute(self, destAcct, g.routeGraph(self, local), amount, g.wclient.Now())
+	if err != nil {
+		return nil, err
+	}
+	hash, err := g.requestRouteHash(destURL, amount)
+	if err != nil {
+		return nil, err
+	}
+	p := &RoutedPayment{
+		Hash:       hash,
+		Amount:     hops[0].Amount,
+		OutChannel: hops[0].ChannelID,
+		Status:     route.Pending,
+		Created:    g.wclient.Now(),
+	}
+	err = db.Update(g.db, func(root *db.Root) error {
+		if !root.Agent().Ready() || g.draining {
+			return errAgentClosing
+		}
+		if getRoutedPayment(root, hash) != nil {
+			return errors.Wrap(errBadRequest, "duplicate payment hash")
+		}
+		putRoutedPayment(root, p)
+		return g.doUpdateChannel(root, hops[0].ChannelID, commandCaller(&fsm.Command{
+			Name:       fsm.ConditionalPay,
+			Amount:     hops[0].Amount,
+			HTLCHash:   hash,
+			HTLCExpiry: hops[0].Expiry,
+			Route:      hops[1:],
+		}))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// routeGraph returns the channels reachable from self in fewer than
+// maxRouteHops hops, keyed by their sending side's account ID,
+// fetching the route adverts of the agents along the way.
+// Agents whose advert cannot be fetched are skipped.
+func (g *Agent) routeGraph(self string, local []RouteChannel) map[string][]routeEdge {
+	graph := make(map[string][]routeEdge)
+	for _, c := range local {
+		graph[self] = append(graph[self], routeEdge{From: self, RouteChannel: c})
+	}
+	visited := map[string]bool{self: true}
+	frontier := local
+	for depth := 1; depth < maxRouteHops; depth++ {
+		var next []RouteChannel
+		for _, c := range frontier {
+			if visited[c.Counterparty] {
+				continue
+			}
+			visited[c.Counterparty] = true
+			advert, err := g.fetchRouteAdvert(c.CounterpartyAddress)
+			if err != nil {
+				g.debugf("fetching route advert of %s: %s", c.CounterpartyAddress, err)
+				continue
+			}
+			if advert.Account != c.Counterparty {
+				g.debugf("route advert of %s is for account %s", c.Counterparty, advert.Account)
+				continue
+			}
+			for _, ac := range advert.Channels {
+				graph[advert.Account] = append(graph[advert.Account], routeEdge{
+					From:         advert.Account,
+					FeeBase:      advert.FeeBase,
+					FeeRate:      advert.FeeRate,
+					RouteChannel: ac,
+				})
+			}
+			next = append(next, advert.Channels...)
+		}
+		frontier = next
+	}
+	return graph
+}
+
+func (g *Agent) fetchRouteAdvert(addr string) (*RouteAdvert, error) {
+	_, starlightURL, err := g.FindAccount(addr)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := g.httpclient.Get(strings.TrimRight(starlightURL, "/") + "/starlight/routes")
+	if err != nil {
+		return nil, errors.Sub(errBadHTTPRequest, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return nil, errors.Wrapf(errBadHTTPStatus, "got http status %d fetching routes", resp.StatusCode)
+	}
+	advert := new(RouteAdvert)
+	err = json.NewDecoder(resp.Body).Decode(advert)
+	if err != nil {
+		return nil, errors.Sub(errDecoding, err)
+	}
+	return advert, nil
+}
+
+// requestRouteHash asks the destination agent at starlightURL
+// for the hash of a routed payment of amount.
+func (g *Agent) requestRouteHash(starlightURL string, amount xlm.Amount) (xdr.Hash, error) {
+	var hash xdr.Hash
+	var self string
+	db.View(g.db, func(root *db.Root) error {
+		self = root.Agent().PrimaryAcct().Address()
+		return nil
+	})
+	body, err := json.Marshal(&routeHashRequest{
+		From:   self,
+		Amount: amount,
+		Time:   g.wclient.Now(),
+	})
+	if err != nil {
+		return hash, err
+	}
+	sig, err := g.signPrimary(body)
+	if err != nil {
+		return hash, err
+	}
+	url := strings.TrimRight(starlightURL, "/") + "/starlight/route-hash"
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return hash, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(MessagesSigHeader, sig)
+	resp, err := g.httpclient.Do(req)
+	if err != nil {
+		return hash, errors.Sub(errBadHTTPRequest, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return hash, errors.Wrapf(errBadHTTPStatus, "got http status %d requesting payment hash", resp.StatusCode)
+	}
+	var v struct {
+		Hash string
+	}
+	err = json.NewDecoder(resp.Body).Decode(&v)
+	if err != nil {
+		return hash, errors.Sub(errDecoding, err)
+	}
+	b, err := hex.DecodeString(v.Hash)
+	if err != nil || len(b) != len(hash) {
+		return hash, errors.Wrap(errDecoding, "payment hash")
+	}
+	copy(hash[:], b)
+	return hash, nil
+}
+
+// findRoute finds the route from self to dest in graph
+// that costs the least in fees, breaking ties by length.
+// It returns the route's hops, the first of which
+// is the agent's own channel.
+func findRoute(self, dest string, graph map[string][]routeEdge, amount xlm.Amount, now time.Time) ([]fsm.Hop, error) {
+	var (
+		best  []fsm.Hop
+		path  []routeEdge
+		visit func(node string)
+	)
+	onPath := map[string]bool{self: true}
+	visit = func(node string) {
+		if node == dest {
+			hops := routeHops(path, amount, now)
+			if hops == nil {
+				return
+			}
+			if best == nil || hops[0].Amount < best[0].Amount || (hops[0].Amount == best[0].Amount && len(hops) < len(best)) {
+				best = hops
+			}
+			return
+		}
+		if len(path) == maxRouteHops {
+			return
+		}
+		for _, e := range graph[node] {
+			if onPath[e.Counterparty] {
+				continue
+			}
+			onPath[e.Counterparty] = true
+			path = append(path, e)
+			visit(e.Counterparty)
+			path = path[:len(path)-1]
+			onPath[e.Counterparty] = false
+		}
+	}
+	visit(self)
+	if best == nil {
+		return nil, errors.Wrap(errNoRoute, dest)
+	}
+	return best, nil
+}
+
+// routeHops computes the amount and expiry of each hop
+// of a payment of amount along path.
+// Working back from the destination, each hop adds the fee
+// of the agent forwarding it and its channel's expiry delta.
+// The final HTLC's expiry also leaves a round per hop
+// for the payment to reach the destination.
+// It returns nil if a hop exceeds its channel's capacity.
+func routeHops(path []routeEdge, amount xlm.Amount, now time.Time) []fsm.Hop {
+	hops := make([]fsm.Hop, len(path))
+	expiry := now
+	for _, e := range path {
+		expiry = expiry.Add(e.MaxRoundDuration)
+	}
+	for i := len(path) - 1; i >= 0; i-- {
+		e := path[i]
+		if amount > e.Capacity {
+			return nil
+		}
+		expiry = expiry.Add(routeExpiryDelta(e.MaxRoundDuration, e.FinalityDelay))
+		hops[i] = fsm.Hop{ChannelID: e.ChannelID, Amount: amount, Expiry: expiry}
+		amount += forwardFee(e.FeeBase, e.FeeRate, amount)
+	}
+	return hops
+}
+
+// updateRoutedPayment advances the routed payment, if any,
+// whose HTLC was changed by the latest update of channel c.
+// The agent forwards an HTLC it receives with a route,
+// fulfills one it is the destination of, and passes
+// the outcome of an HTLC it forwarded back to the incoming channel.
+// Arguments prev and prevPending are c's HTLC and pending HTLC
+// before the update.
+// Must be called from within an update transaction,
+// after the update of c is complete.
+func (g *Agent) updateRoutedPayment(root *db.Root, c *fsm.Channel, prev, prevPending *fsm.HTLC) error {
+	var h *fsm.HTLC
+	for _, h = range []*fsm.HTLC{c.HTLC, c.PendingHTLC, prev, prevPending} {
+		if h != nil {
+			break
+		}
+	}
+	if h == nil {
+		return nil
+	}
+	incoming := c.HTLC != nil && c.HTLC.Sender != c.Role && c.State == fsm.Open
+	resolved := (c.HTLC == nil && c.PendingHTLC == nil) || c.State == fsm.Closed
+
+	p := getRoutedPayment(root, h.Hash)
+	switch {
+	case p == nil:
+		if incoming && len(c.HTLC.Route) > 0 {
+			return g.forwardHTLC(root, c)
+		}
+
+	case p.Status != route.Pending:
+		// nothing to do
+
+	case p.OutChannel == c.ID:
+		if h.Preimage != nil {
+			p.Preimage = h.Preimage
+			g.setRoutedPaymentStatus(root, p, route.Fulfilled)
+			if p.InChannel != "" {
+				return g.routedPaymentCmd(root, p.InChannel, &fsm.Command{Name: fsm.FulfillHTLC, Preimage: p.Preimage})
+			}
+		} else if resolved {
+			g.setRoutedPaymentStatus(root, p, route.Failed)
+			if p.InChannel != "" {
+				return g.routedPaymentCmd(root, p.InChannel, &fsm.Command{Name: fsm.CancelHTLC})
+			}
+		}
+
+	case p.OutChannel == "" && p.InChannel == "":
+		// The agent is the payment's destination.
+		if !incoming {
+			return nil
+		}
+		p.InChannel = c.ID
+		if c.HTLC.Amount < p.Amount {
+			g.setRoutedPaymentStatus(root, p, route.Failed)
+			return g.routedPaymentCmd(root, c.ID, &fsm.Command{Name: fsm.CancelHTLC})
+		}
+		g.setRoutedPaymentStatus(root, p, route.Fulfilled)
+		return g.routedPaymentCmd(root, c.ID, &fsm.Command{Name: fsm.FulfillHTLC, Preimage: p.Preimage})
+
+	case p.InChannel == c.ID:
+		if resolved {
+			// The incoming HTLC expired before the forwarded one resolved.
+			g.setRoutedPaymentStatus(root, p, route.Failed)
+		}
+	}
+	return nil
+}
+
+// forwardHTLC forwards the HTLC received on channel c
+// to the first hop of its route, if the hop is valid and pays
+// the agent's fee, and cancels the received HTLC otherwise.
+func (g *Agent) forwardHTLC(root *db.Root, c *fsm.Channel) error {
+	h := c.HTLC
+	hop := h.Route[0]
+	p := &RoutedPayment{
+		Hash:       h.Hash,
+		Amount:     hop.Amount,
+		InChannel:  c.ID,
+		OutChannel: hop.ChannelID,
+		Status:     route.Pending,
+		Created:    g.wclient.Now(),
+	}
+	putRoutedPayment(root, p)
+
+	fee := forwardFee(xlm.Amount(root.Agent().Config().ForwardFeeBase()), root.Agent().Config().ForwardFeeRate(), hop.Amount)
+	err := errors.Wrapf(errNoRoute, "no channel %s", hop.ChannelID)
+	if out := g.getChannel(root, hop.ChannelID); out.State != fsm.Start && out.ID != c.ID {
+		switch {
+		case h.Amount-hop.Amount < fee:
+			err = errors.Wrapf(errNoRoute, "fee %s, want %s", h.Amount-hop.Amount, fee)
+		case h.Expiry.Before(hop.Expiry.Add(routeExpiryDelta(c.MaxRoundDuration, c.FinalityDelay))):
+			err = errors.Wrapf(errNoRoute, "expiry %s too close to incoming expiry %s", hop.Expiry, h.Expiry)
+		default:
+			err = g.doUpdateChannel(root, hop.ChannelID, commandCaller(&fsm.Command{
+				Name:       fsm.ConditionalPay,
+				Amount:     hop.Amount,
+				HTLCHash:   h.Hash,
+				HTLCExpiry: hop.Expiry,
+				Route:      h.Route[1:],
+			}))
+		}
+	}
+	if err == nil {
+		return nil
+	}
+	g.logf("cannot forward routed payment on channel %s: %s", hop.ChannelID, err)
+	g.setRoutedPaymentStatus(root, p, route.Failed)
+	return g.routedPaymentCmd(root, c.ID, &fsm.Command{Name: fsm.CancelHTLC})
+}
+
+// routedPaymentCmd executes cmd on channel chanID to pass on the
+// outcome of a routed payment. If the channel cannot execute it,
+// the error is logged rather than returned:
+// the HTLC is then resolved by its timers.
+func (g *Agent) routedPaymentCmd(root *db.Root, chanID string, cmd *fsm.Command) error {
+	err := g.doUpdateChannel(root, chanID, commandCaller(cmd))
+	if err != nil {
+		g.logf("routed payment %s on channel %s: %s", cmd.Name, chanID, err)
+	}
+	return nil
+}
+
+// commandCaller returns an update function executing cmd,
+// for use with doUpdateChannel.
+func commandCaller(cmd *fsm.Command) func(*db.Root, *fsm.Updater, *Update) error {
+	return func(_ *db.Root, updater *fsm.Updater, update *Update) error {
+		update.InputCommand = cmd
+		return updater.Cmd(cmd)
+	}
+}
+
+func (g *Agent) setRoutedPaymentStatus(root *db.Root, p *RoutedPayment, status route.Status) {
+	p.Status = status
+	putRoutedPayment(root, p)
+	g.putUpdate(root, &Update{
+		Type:          update.RoutedPaymentType,
+		RoutedPayment: p,
+	})
+}
+
+// getRoutedPayment returns the routed payment with the given hash,
+// or nil if there is none.
+func getRoutedPayment(root *db.Root, hash xdr.Hash) *RoutedPayment {
+	key := hex.EncodeToString(hash[:])
+	payments := root.Agent().RoutedPayments()
+	if bucket := payments.Bucket(); bucket == nil || bucket.Get([]byte(key)) == nil {
+		return nil
+	}
+	return payments.GetByString(key)
+}
+
+func putRoutedPayment(root *db.Root, p *RoutedPayment) {
+	root.Agent().RoutedPayments().PutByString(hex.EncodeToString(p.Hash[:]), p)
+}
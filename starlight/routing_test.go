@@ -0,0 +1,210 @@
+package starlight
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stellar/go/xdr"
+
+	"github.com/interstellar/starlight/errors"
+	"github.com/interstellar/starlight/starlight/db"
+	"github.com/interstellar/starlight/starlight/fsm"
+	"github.com/interstellar/starlight/starlight/internal/route"
+	"github.com/interstellar/starlight/starlight/key"
+	"github.com/interstellar/starlight/worizon/xlm"
+)
+
+func TestForwardFee(t *testing.T) {
+	cases := []struct {
+		base xlm.Amount
+		rate int64
+		amt  xlm.Amount
+		want xlm.Amount
+	}{
+		{0, 0, xlm.Lumen, 0},
+		{100, 0, xlm.Lumen, 100},
+		{0, 1000, xlm.Lumen, xlm.Lumen / 1000},
+		{10, 1000, 1500, 11},
+		{0, 1, 999999, 0},
+	}
+	for _, c := range cases {
+		if got := forwardFee(c.base, c.rate, c.amt); got != c.want {
+			t.Errorf("forwardFee(%d, %d, %d) = %d, want %d", c.base, c.rate, c.amt, got, c.want)
+		}
+	}
+}
+
+func TestFindRoute(t *testing.T) {
+	now := time.Date(2018, 9, 24, 11, 03, 00, 0, time.UTC)
+	edge := func(from, to, chanID string, capacity xlm.Amount, feeBase xlm.Amount) routeEdge {
+		return routeEdge{
+			From:    from,
+			FeeBase: feeBase,
+			RouteChannel: RouteChannel{
+				ChannelID:        chanID,
+				Counterparty:     to,
+				Capacity:         capacity,
+				MaxRoundDuration: time.Minute,
+				FinalityDelay:    time.Minute,
+			},
+		}
+	}
+	graph := map[string][]routeEdge{
+		"a": {
+			edge("a", "b", "ab", 10*xlm.Lumen, 0),
+			edge("a", "c", "ac", 10*xlm.Lumen, 0),
+		},
+		"b": {
+			edge("b", "d", "bd", 10*xlm.Lumen, 200),
+			edge("b", "a", "ba", 10*xlm.Lumen, 0),
+		},
+		"c": {
+			edge("c", "d", "cd", 10*xlm.Lumen, 100),
+			edge("c", "e", "ce", xlm.Lumen, 0),
+		},
+		"d": {
+			edge("d", "e", "de", 10*xlm.Lumen, 50),
+		},
+	}
+
+	// The cheapest route to d is through c.
+	hops, err := findRoute("a", "d", graph, xlm.Lumen, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hops) != 2 || hops[0].ChannelID != "ac" || hops[1].ChannelID != "cd" {
+		t.Fatalf("got route %+v, want ac, cd", hops)
+	}
+	if hops[0].Amount != xlm.Lumen+100 || hops[1].Amount != xlm.Lumen {
+		t.Errorf("got amounts %s, %s, want %s, %s", hops[0].Amount, hops[1].Amount, xlm.Lumen+100, xlm.Lumen)
+	}
+	delta := routeExpiryDelta(time.Minute, time.Minute)
+	if want := now.Add(2*time.Minute + delta); !hops[1].Expiry.Equal(want) {
+		t.Errorf("got final expiry %s, want %s", hops[1].Expiry, want)
+	}
+	if want := hops[1].Expiry.Add(delta); !hops[0].Expiry.Equal(want) {
+		t.Errorf("got first expiry %s, want %s", hops[0].Expiry, want)
+	}
+
+	// The direct route through c to e lacks capacity.
+	hops, err = findRoute("a", "e", graph, 2*xlm.Lumen, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hops) != 3 || hops[2].ChannelID != "de" {
+		t.Errorf("got route %+v, want one ending in de", hops)
+	}
+
+	_, err = findRoute("a", "f", graph, xlm.Lumen, now)
+	if errors.Root(err) != errNoRoute {
+		t.Errorf("got error %v, want %v", err, errNoRoute)
+	}
+	_, err = findRoute("a", "d", graph, 20*xlm.Lumen, now)
+	if errors.Root(err) != errNoRoute {
+		t.Errorf("got error %v, want %v", err, errNoRoute)
+	}
+}
+
+func TestCheckRouteHashRequest(t *testing.T) {
+	dest, closeDest := startTestAgent(t)
+	defer closeDest()
+	peer, closePeer := startTestAgent(t)
+	defer closePeer()
+	other, closeOther := startTestAgent(t)
+	defer closeOther()
+
+	peer.seed = make([]byte, 32)
+	other.seed = make([]byte, 32)
+	other.seed[0] = 1
+	peerAcct := key.DeriveAccountPrimary(peer.seed).Address()
+	otherAcct := key.DeriveAccountPrimary(other.seed).Address()
+
+	c := &fsm.Channel{ID: "chan", Role: fsm.Host, State: fsm.Open}
+	err := c.GuestAcct.SetAddress(peerAcct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Update(dest.db, func(root *db.Root) error {
+		dest.putChannel(root, c.ID, c)
+		return nil
+	})
+
+	sign := func(g *Agent, from string, tm time.Time) ([]byte, string) {
+		body, err := json.Marshal(&routeHashRequest{From: from, Amount: xlm.Lumen, Time: tm})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig, err := g.signPrimary(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return body, sig
+	}
+
+	now := dest.wclient.Now()
+	r, err := dest.checkRouteHashRequest(sign(peer, peerAcct, now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Amount != xlm.Lumen {
+		t.Errorf("got amount %s, want %s", r.Amount, xlm.Lumen)
+	}
+
+	cases := []struct {
+		name string
+		f    func() ([]byte, string)
+	}{{
+		name: "not a counterparty",
+		f:    func() ([]byte, string) { return sign(other, otherAcct, now) },
+	}, {
+		name: "wrong key",
+		f:    func() ([]byte, string) { return sign(other, peerAcct, now) },
+	}, {
+		name: "stale",
+		f:    func() ([]byte, string) { return sign(peer, peerAcct, now.Add(-time.Hour)) },
+	}, {
+		name: "no signature",
+		f: func() ([]byte, string) {
+			body, _ := sign(peer, peerAcct, now)
+			return body, ""
+		},
+	}}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := dest.checkRouteHashRequest(tc.f())
+			if errors.Root(err) != ErrUnauthorized {
+				t.Errorf("got error %v, want %v", err, ErrUnauthorized)
+			}
+		})
+	}
+}
+
+func TestExpireRouteHashes(t *testing.T) {
+	g, cleanup := startTestAgent(t)
+	defer cleanup()
+
+	now := time.Date(2018, 9, 24, 11, 03, 00, 0, time.UTC)
+	payments := []*RoutedPayment{
+		{Hash: xdr.Hash{1}, Status: route.Pending, Created: now.Add(-2 * routeHashExpiry)},
+		{Hash: xdr.Hash{2}, Status: route.Pending, Created: now.Add(-routeHashExpiry / 2)},
+		{Hash: xdr.Hash{3}, Status: route.Pending, Created: now.Add(-2 * routeHashExpiry), InChannel: "chan"},
+		{Hash: xdr.Hash{4}, Status: route.Pending, Created: now.Add(-2 * routeHashExpiry), OutChannel: "chan"},
+	}
+	db.Update(g.db, func(root *db.Root) error {
+		for _, p := range payments {
+			putRoutedPayment(root, p)
+		}
+		expireRouteHashes(root, now)
+		return nil
+	})
+	db.View(g.db, func(root *db.Root) error {
+		for i, p := range payments {
+			got := getRoutedPayment(root, p.Hash) != nil
+			if want := i != 0; got != want {
+				t.Errorf("payment %d: got kept %t, want %t", i, got, want)
+			}
+		}
+		return nil
+	})
+}
@@ -14,6 +14,7 @@ import (
 	"github.com/stellar/go/network"
 	"github.com/stellar/go/xdr"
 
+	"github.com/interstellar/starlight/starlight/db/kv"
 	"github.com/interstellar/starlight/worizon"
 	"github.com/interstellar/starlight/worizon/worizontest"
 )
@@ -29,7 +30,7 @@ func startTestAgent(t *testing.T) (*Agent, func()) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	g, err := StartAgent(context.Background(), db)
+	g, err := StartAgent(context.Background(), kv.Bolt(db))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -8,6 +8,7 @@ import (
 	bolt "github.com/coreos/bbolt"
 
 	"github.com/interstellar/starlight/starlight"
+	"github.com/interstellar/starlight/starlight/db/kv"
 )
 
 // StartTestnetAgent starts an agent for testing
@@ -18,7 +19,7 @@ func StartTestnetAgent(ctx context.Context, t *testing.T, dbpath string) *starli
 	if err != nil {
 		t.Fatal(err)
 	}
-	g, err := starlight.StartAgent(ctx, db)
+	g, err := starlight.StartAgent(ctx, kv.Bolt(db))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -14,6 +14,7 @@ import (
 
 	"github.com/interstellar/starlight/starlight"
 	"github.com/interstellar/starlight/starlight/fsm"
+	"github.com/interstellar/starlight/starlight/wallet"
 	"github.com/interstellar/starlight/starlight/walletrpc"
 	"github.com/interstellar/starlight/worizon/xlm"
 )
@@ -56,7 +57,7 @@ func start(ctx context.Context, t *testing.T, testdir, name string) *Starlightd
 		g:             g,
 		nextUpdateNum: 1,
 	}
-	s.handler = logWrapper(walletrpc.Handler(s.g), name)
+	s.handler = logWrapper(walletrpc.Handler(s.g, wallet.Assets()), name)
 	s.server = httptest.NewServer(s.handler)
 	s.address = strings.TrimPrefix(s.server.URL, "http://")
 	return s
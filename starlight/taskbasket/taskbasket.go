@@ -5,11 +5,11 @@ import (
 	"context"
 	"crypto/rand"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	bolt "github.com/coreos/bbolt"
-
 	"github.com/interstellar/starlight/net"
+	"github.com/interstellar/starlight/starlight/db/kv"
 )
 
 // Task is an item in a TB.
@@ -42,18 +42,20 @@ type pair struct {
 // it launches each task in a goroutine that retries until the task succeeds,
 // at which point it is removed from the database.
 type TB struct {
-	db     *bolt.DB
+	db     *kv.DB
 	bucket []byte
 	codec  Codec
 	ch     chan pair
 	wg     *sync.WaitGroup
+
+	retries uint64 // accessed atomically
 }
 
 // New creates a new taskbasket.
 // It launches goroutines for any tasks already existing in the db.
-func New(ctx context.Context, db *bolt.DB, bucket []byte, codec Codec) (*TB, error) {
+func New(ctx context.Context, db *kv.DB, bucket []byte, codec Codec) (*TB, error) {
 	var tb *TB
-	err := db.Update(func(tx *bolt.Tx) error {
+	err := db.Update(func(tx *kv.Tx) error {
 		var err error
 		tb, err = NewTx(ctx, tx, db, bucket, codec)
 		return err
@@ -61,9 +63,9 @@ func New(ctx context.Context, db *bolt.DB, bucket []byte, codec Codec) (*TB, err
 	return tb, err
 }
 
-// NewTx creates a new taskbasket in the context of an existing bolt Update transaction.
+// NewTx creates a new taskbasket in the context of an existing Update transaction.
 // It launches goroutines for any tasks already exiting in the db.
-func NewTx(ctx context.Context, tx *bolt.Tx, db *bolt.DB, bucket []byte, codec Codec) (*TB, error) {
+func NewTx(ctx context.Context, tx *kv.Tx, db *kv.DB, bucket []byte, codec Codec) (*TB, error) {
 	tb := &TB{
 		db:     db,
 		bucket: bucket,
@@ -111,16 +113,16 @@ func NewTx(ctx context.Context, tx *bolt.Tx, db *bolt.DB, bucket []byte, codec C
 // Note that if TB.Run has not been called,
 // this function can block.
 func (tb *TB) Add(t Task) error {
-	return tb.db.Update(func(tx *bolt.Tx) error {
+	return tb.db.Update(func(tx *kv.Tx) error {
 		return tb.AddTx(tx, t)
 	})
 }
 
-// AddTx adds a task to the taskbasket in the context of an existing bolt Update transaction.
+// AddTx adds a task to the taskbasket in the context of an existing Update transaction.
 // It is persisted to the database and processed when the transaction commits.
 // Note that if TB.Run has not been called,
 // this function can block.
-func (tb *TB) AddTx(tx *bolt.Tx, t Task) error {
+func (tb *TB) AddTx(tx *kv.Tx, t Task) error {
 	bits, err := tb.codec.Encode(t)
 	if err != nil {
 		return err
@@ -144,6 +146,28 @@ func (tb *TB) AddTx(tx *bolt.Tx, t Task) error {
 	return nil
 }
 
+// LenTx returns the number of tasks in the taskbasket,
+// in the context of an existing transaction.
+// Tasks remain in the taskbasket until they succeed.
+func (tb *TB) LenTx(tx *kv.Tx) (int, error) {
+	bu := tx.Bucket(tb.bucket)
+	if bu == nil {
+		return 0, nil
+	}
+	var n int
+	c := bu.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		n++
+	}
+	return n, nil
+}
+
+// Retries returns the number of times a task in tb
+// has failed and been scheduled to run again.
+func (tb *TB) Retries() uint64 {
+	return atomic.LoadUint64(&tb.retries)
+}
+
 // Run runs forever, processing the tasks in a taskbasket.
 // When it starts,
 // it reads all existing tasks from persistent storage and launches a goroutine for each.
@@ -174,6 +198,8 @@ func (tb *TB) runTask(ctx context.Context, key []byte, t Task) {
 	for {
 		err := t.Run(ctx)
 		if err != nil {
+			atomic.AddUint64(&tb.retries, 1)
+
 			// Start this timer first,
 			// so timing is as right as possible even if the db update takes long.
 			timer := time.NewTimer(backoff.Next())
@@ -184,7 +210,7 @@ func (tb *TB) runTask(ctx context.Context, key []byte, t Task) {
 				panic(err)
 			}
 			// TODO(bobg): Test whether bits actually have changed and skip db write if so.
-			err = tb.db.Update(func(tx *bolt.Tx) error {
+			err = tb.db.Update(func(tx *kv.Tx) error {
 				bu := tx.Bucket(tb.bucket)
 				return bu.Put(key, bits)
 			})
@@ -201,7 +227,7 @@ func (tb *TB) runTask(ctx context.Context, key []byte, t Task) {
 				continue
 			}
 		}
-		err = tb.db.Update(func(tx *bolt.Tx) error {
+		err = tb.db.Update(func(tx *kv.Tx) error {
 			bu := tx.Bucket(tb.bucket)
 			return bu.Delete(key)
 		})
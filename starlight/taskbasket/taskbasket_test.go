@@ -11,6 +11,8 @@ import (
 	"time"
 
 	bolt "github.com/coreos/bbolt"
+
+	"github.com/interstellar/starlight/starlight/db/kv"
 )
 
 const testBucket = "testbucket"
@@ -60,10 +62,11 @@ func TestTaskbasket(t *testing.T) {
 	f.Close()
 	defer os.Remove(f.Name())
 
-	db, err := bolt.Open(filename, 0600, nil)
+	boltDB, err := bolt.Open(filename, 0600, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
+	db := kv.Bolt(boltDB)
 
 	forceFailures := true
 	ch := make(chan *testTask)
@@ -108,7 +111,7 @@ func TestTaskbasket(t *testing.T) {
 		t.Fatal("got 0 failures, want 1")
 	}
 
-	err = db.View(func(tx *bolt.Tx) error {
+	err = db.View(func(tx *kv.Tx) error {
 		bu := tx.Bucket([]byte(testBucket))
 		if bu == nil {
 			t.Fatalf("bucket %s does not exist", testBucket)
@@ -171,7 +174,7 @@ func TestTaskbasket(t *testing.T) {
 	tb.wg.Wait()
 	timer.Stop()
 
-	err = db.View(func(tx *bolt.Tx) error {
+	err = db.View(func(tx *kv.Tx) error {
 		bu := tx.Bucket([]byte(testBucket))
 		if bu == nil {
 			t.Fatalf("bucket %s does not exist", testBucket)
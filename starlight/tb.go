@@ -11,13 +11,14 @@ import (
 	"strconv"
 	"strings"
 
-	bolt "github.com/coreos/bbolt"
 	"github.com/stellar/go/clients/horizon"
 	"github.com/stellar/go/xdr"
 
 	"github.com/interstellar/starlight/starlight/db"
+	"github.com/interstellar/starlight/starlight/db/kv"
 	"github.com/interstellar/starlight/starlight/fsm"
 	"github.com/interstellar/starlight/starlight/internal/update"
+	"github.com/interstellar/starlight/starlight/key"
 	"github.com/interstellar/starlight/starlight/taskbasket"
 	"github.com/interstellar/starlight/worizon"
 	"github.com/interstellar/starlight/worizon/xlm"
@@ -28,8 +29,9 @@ type tbCodec struct {
 }
 
 type encodedTask struct {
-	*TbTx  `json:",omitempty"`
-	*TbMsg `json:",omitempty"`
+	*TbTx            `json:",omitempty"`
+	*TbMsg           `json:",omitempty"`
+	*TbEscrowRelease `json:",omitempty"`
 }
 
 // Encode implements taskbasket.Codec.Encode.
@@ -41,6 +43,8 @@ func (c tbCodec) Encode(t taskbasket.Task) ([]byte, error) {
 		et.TbTx = t
 	case *TbMsg:
 		et.TbMsg = t
+	case *TbEscrowRelease:
+		et.TbEscrowRelease = t
 	default:
 		return nil, fmt.Errorf("unknown task type %T", t)
 	}
@@ -62,6 +66,9 @@ func (c tbCodec) Decode(b []byte) (taskbasket.Task, error) {
 	case et.TbMsg != nil:
 		et.TbMsg.g = c.g
 		return et.TbMsg, nil
+	case et.TbEscrowRelease != nil:
+		et.TbEscrowRelease.g = c.g
+		return et.TbEscrowRelease, nil
 	}
 
 	return nil, errors.New("empty task")
@@ -96,7 +103,9 @@ func (t *TbTx) Run(ctx context.Context) error {
 	}
 
 	succ, submitErr := t.g.wclient.SubmitTx(txstr)
-	if submitErr != nil {
+	if submitErr == nil {
+		t.g.metrics.submitTx.Inc(submitResult(nil, nil))
+	} else {
 		t.g.debugf("SubmitTx error (channel %s): %s\ntx: %s", string(t.ChanID), submitErr, txstr)
 
 		var (
@@ -116,6 +125,7 @@ func (t *TbTx) Run(ctx context.Context) error {
 			resultStr = succ.Result
 			if resultStr == "" {
 				t.g.debugf("cannot locate result string from failed SubmitTx call")
+				t.g.metrics.submitTx.Inc(submitResult(nil, submitErr))
 				return err // will retry
 			}
 		}
@@ -125,8 +135,10 @@ func (t *TbTx) Run(ctx context.Context) error {
 		err = xdr.SafeUnmarshalBase64(resultStr, &tr)
 		if err != nil {
 			t.g.debugf("unmarshaling TransactionResult: %s", err)
+			t.g.metrics.submitTx.Inc(submitResult(nil, submitErr))
 			return err // will retry
 		}
+		t.g.metrics.submitTx.Inc(submitResult(&tr, submitErr))
 
 		if !isRetriableSubmitErr(t.g, &t.E.Tx, &tr, submitErr) {
 			if isWalletTx {
@@ -250,36 +262,121 @@ func (m *TbMsg) Run(ctx context.Context) error {
 		return nil
 	}
 	url := strings.TrimRight(m.RemoteURL, "/") + "/starlight/message"
-	err = post(&m.g.httpclient, url, bytes.NewReader(j))
+	r, err := post(&m.g.httpclient, url, bytes.NewReader(j))
 	if err != nil {
 		m.g.debugf("error %s sending message to %s", err, url)
+		m.g.metrics.sendFailures.Inc()
+		return err
+	}
+	if r != nil && r.Counter != nil && m.Msg.ChannelProposeMsg != nil {
+		m.g.handleCounterProposal(r.Counter)
 	}
-	return err
+	return nil
 }
 
-func post(client *http.Client, url string, body io.Reader) error {
-	resp, err := client.Post(url, "application/json", body)
+// TbEscrowRelease is a taskbasket task that merges the escrow account
+// of a closed non-native channel hosted by the agent
+// into the host's account. See releaseEscrow.
+// The task is the only record of the release once the channel is deleted,
+// so it retries until the escrow account is gone.
+type TbEscrowRelease struct {
+	g       *Agent
+	Channel fsm.Channel
+}
+
+// Run implements taskbasket.Task.Run.
+// It waits for the agent to be unlocked,
+// then looks up the escrow account and,
+// if the host alone can sign for it,
+// submits an EscrowReleaseTx built from its current
+// sequence number and balance.
+func (r *TbEscrowRelease) Run(ctx context.Context) error {
+	c := &r.Channel
+
+	var seed []byte
+	db.View(r.g.db, func(root *db.Root) error {
+		seed = r.g.seed
+		return nil
+	})
+	if seed == nil {
+		return errors.New("agent not authenticated") // will retry
+	}
+
+	acct, err := r.g.wclient.LoadAccount(c.EscrowAcct.Address())
+	if worizon.IsNotFound(err) {
+		return nil // already merged
+	}
+	if err != nil {
+		r.g.debugf("loading escrow account of closed channel %s: %s", c.ID, err)
+		return err
+	}
+	if len(acct.Signers) != 1 {
+		// The channel closed without leaving the escrow account
+		// to the host alone, so the host cannot merge it.
+		r.g.logf("escrow account of closed channel %s needs the guest's signature; not releasing it", c.ID)
+		return nil
+	}
+	seqnum, err := strconv.ParseInt(acct.Sequence, 10, 64)
+	if err != nil {
+		return fmt.Errorf("parsing escrow account sequence number %s: %s", acct.Sequence, err)
+	}
+	var typ, code, issuer string
+	c.Asset.MustExtract(&typ, &code, &issuer)
+	bal, err := xlm.Parse(acct.GetCreditBalance(code, issuer))
+	if err != nil {
+		return fmt.Errorf("parsing escrow account balance: %s", err)
+	}
+	tx, err := fsm.BuildEscrowReleaseTx(c, xdr.SequenceNumber(seqnum), bal)
+	if err != nil {
+		return err
+	}
+	env, err := tx.Sign(key.DeriveAccount(seed, c.KeyIndex).Seed())
+	if err != nil {
+		return err
+	}
+	txstr, err := xdr.MarshalBase64(env.E)
+	if err != nil {
+		return err
+	}
+
+	// Any failure is retried with a freshly built tx,
+	// since the escrow account's sequence number and balance
+	// may have changed in the meantime.
+	_, err = r.g.wclient.SubmitTx(txstr)
+	r.g.metrics.submitTx.Inc(submitResult(nil, err))
 	if err != nil {
+		r.g.debugf("SubmitTx error (escrow release for channel %s): %s\ntx: %s", c.ID, err, txstr)
 		return err
 	}
+	return nil
+}
+
+// post posts body to url.
+// It returns the error response, if any, unless it is retriable,
+// in which case it returns an error.
+func post(client *http.Client, url string, body io.Reader) (*response, error) {
+	resp, err := client.Post(url, "application/json", body)
+	if err != nil {
+		return nil, err
+	}
 	defer resp.Body.Close()
 
 	r, ok := parse(resp.Body)
 	if ok && !r.Retriable {
-		return nil
+		return r, nil
 	}
 
 	if resp.StatusCode/100 != 2 {
-		return errors.New("bad status " + resp.Status)
+		return nil, errors.New("bad status " + resp.Status)
 	}
 
-	return nil
+	return nil, nil
 }
 
-func channelExists(boltDB *bolt.DB, chanID string) (bool, error) {
+func channelExists(store *kv.DB, chanID string) (bool, error) {
 	var exists bool
 
-	err := db.View(boltDB, func(root *db.Root) error {
+	err := db.View(store, func(root *db.Root) error {
 		chans := root.Agent().Channels()
 		c := chans.Get([]byte(chanID))
 		exists = len(c.ID) > 0
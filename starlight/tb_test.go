@@ -5,10 +5,15 @@ import (
 	"reflect"
 	"testing"
 
+	"github.com/stellar/go/clients/horizon"
 	"github.com/stellar/go/keypair"
+	"github.com/stellar/go/protocols/horizon/base"
+	"github.com/stellar/go/xdr"
 
 	"github.com/interstellar/starlight/starlight/db"
 	"github.com/interstellar/starlight/starlight/fsm"
+	"github.com/interstellar/starlight/starlight/key"
+	"github.com/interstellar/starlight/worizon"
 )
 
 func testMsg() (*fsm.Message, error) {
@@ -115,3 +120,109 @@ func TestAddMsgs(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// submitHorizon is a ledgerHorizon that records the txs submitted to it.
+type submitHorizon struct {
+	ledgerHorizon
+	submitted []string
+}
+
+func (h *submitHorizon) SubmitTransaction(txeBase64 string) (horizon.TransactionSuccess, error) {
+	h.submitted = append(h.submitted, txeBase64)
+	return horizon.TransactionSuccess{}, nil
+}
+
+func TestRunEscrowRelease(t *testing.T) {
+	g, closer := startTestAgent(t)
+	defer closer()
+
+	seed := make([]byte, 32)
+	var c fsm.Channel
+	c.ID = "channel"
+	c.Role = fsm.Host
+	c.KeyIndex = 1
+	c.Passphrase = "Test SDF Network ; September 2015"
+	c.ChannelFeerate = 100
+	err := c.HostAcct.SetAddress(key.DeriveAccountPrimary(seed).Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	escrow := key.DeriveAccount(seed, c.KeyIndex).Address()
+	err = c.EscrowAcct.SetAddress(escrow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Asset.SetCredit("USD", xdr.AccountId(c.HostAcct))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &submitHorizon{ledgerHorizon: ledgerHorizon{accounts: map[string]horizon.Account{
+		escrow: {
+			Sequence: "100",
+			Signers:  []horizon.Signer{{Key: escrow, Weight: 1}},
+			Balances: []horizon.Balance{{
+				Balance: "5.0000000",
+				Asset: base.Asset{
+					Type:   "credit_alphanum4",
+					Code:   "USD",
+					Issuer: c.HostAcct.Address(),
+				},
+			}},
+		},
+	}}}
+	g.wclient = worizon.NewClient(horizonHTTP{}, h)
+
+	codec := tbCodec{g: g}
+	b, err := codec.Encode(&TbEscrowRelease{g: g, Channel: c})
+	if err != nil {
+		t.Fatal(err)
+	}
+	task, err := codec.Decode(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, ok := task.(*TbEscrowRelease)
+	if !ok {
+		t.Fatalf("decoded task is %T, want *TbEscrowRelease", task)
+	}
+
+	// The task waits for the agent to be unlocked.
+	err = r.Run(context.Background())
+	if err == nil {
+		t.Fatal("escrow release ran while locked")
+	}
+	if len(h.submitted) != 0 {
+		t.Fatalf("submitted %d txs while locked, want 0", len(h.submitted))
+	}
+
+	g.seed = seed
+	err = r.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.submitted) != 1 {
+		t.Fatalf("submitted %d txs, want 1", len(h.submitted))
+	}
+	var env xdr.TransactionEnvelope
+	err = xdr.SafeUnmarshalBase64(h.submitted[0], &env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Tx.SeqNum != 101 {
+		t.Errorf("got escrow release tx seqnum %d, want 101", env.Tx.SeqNum)
+	}
+	if len(env.Tx.Operations) != 3 {
+		t.Errorf("got %d escrow release tx ops, want 3", len(env.Tx.Operations))
+	}
+
+	// Once the escrow account is merged, the task is done.
+	delete(h.accounts, escrow)
+	err = r.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.submitted) != 1 {
+		t.Errorf("submitted %d txs after the escrow account was merged, want 1", len(h.submitted))
+	}
+}
@@ -0,0 +1,118 @@
+package starlight
+
+import (
+	"time"
+
+	"github.com/interstellar/starlight/errors"
+	"github.com/interstellar/starlight/starlight/db"
+	"github.com/interstellar/starlight/starlight/fsm"
+)
+
+// termBounds are the ranges of max round duration and finality delay
+// the agent accepts for a channel.
+type termBounds struct {
+	minRoundDur, maxRoundDur           time.Duration
+	minFinalityDelay, maxFinalityDelay time.Duration
+}
+
+// getTermBounds returns the agent's configured term bounds.
+// Unset bounds are the agent's own max round duration
+// and finality delay.
+func getTermBounds(root *db.Root) termBounds {
+	config := root.Agent().Config()
+	mins := func(v, dflt int64) time.Duration {
+		if v == 0 {
+			v = dflt
+		}
+		return time.Duration(v) * time.Minute
+	}
+	roundDur, finalityDelay := config.MaxRoundDurMins(), config.FinalityDelayMins()
+	return termBounds{
+		minRoundDur:      mins(config.MinMaxRoundDurMins(), roundDur),
+		maxRoundDur:      mins(config.MaxMaxRoundDurMins(), roundDur),
+		minFinalityDelay: mins(config.MinFinalityDelayMins(), finalityDelay),
+		maxFinalityDelay: mins(config.MaxFinalityDelayMins(), finalityDelay),
+	}
+}
+
+func (b termBounds) accepts(maxRoundDur, finalityDelay time.Duration) bool {
+	return maxRoundDur >= b.minRoundDur && maxRoundDur <= b.maxRoundDur &&
+		finalityDelay >= b.minFinalityDelay && finalityDelay <= b.maxFinalityDelay
+}
+
+// counter returns the terms within b closest to those proposed.
+func (b termBounds) counter(maxRoundDur, finalityDelay time.Duration) (time.Duration, time.Duration) {
+	clamp := func(v, min, max time.Duration) time.Duration {
+		if v < min {
+			return min
+		}
+		if v > max {
+			return max
+		}
+		return v
+	}
+	return clamp(maxRoundDur, b.minRoundDur, b.maxRoundDur), clamp(finalityDelay, b.minFinalityDelay, b.maxFinalityDelay)
+}
+
+// checkTermBounds checks that the term bounds set in c are valid.
+// A bound that is set must be positive, and no greater than
+// the other bound of its pair, if that is set.
+func (c *Config) checkTermBounds() error {
+	pairs := []struct {
+		name     string
+		min, max int64
+	}{
+		{"max round duration", c.MinMaxRoundDurMins, c.MaxMaxRoundDurMins},
+		{"finality delay", c.MinFinalityDelayMins, c.MaxFinalityDelayMins},
+	}
+	for _, p := range pairs {
+		if p.min < 0 || p.max < 0 {
+			return errors.Wrapf(errInvalidInput, "negative %s bound", p.name)
+		}
+		if p.min != 0 && p.max != 0 && p.min > p.max {
+			return errors.Wrapf(errInvalidInput, "%s bounds %d > %d", p.name, p.min, p.max)
+		}
+	}
+	return nil
+}
+
+// channelCounterProposal returns the agent's counter-proposal
+// to the proposal of channel chanID,
+// or nil if the agent accepts the proposed terms.
+func (g *Agent) channelCounterProposal(chanID string, propose *fsm.ChannelProposeMsg) (*fsm.Message, error) {
+	var b termBounds
+	db.View(g.db, func(root *db.Root) error {
+		b = getTermBounds(root)
+		return nil
+	})
+	if b.accepts(propose.MaxRoundDuration, propose.FinalityDelay) {
+		return nil, nil
+	}
+	maxRoundDur, finalityDelay := b.counter(propose.MaxRoundDuration, propose.FinalityDelay)
+	g.logf("channel %s proposed with max round duration %s, finality delay %s: countering with %s, %s",
+		chanID, propose.MaxRoundDuration, propose.FinalityDelay, maxRoundDur, finalityDelay)
+	return fsm.NewChannelCounterMsg(g.seed, chanID, maxRoundDur, finalityDelay)
+}
+
+// handleCounterProposal handles a guest's counter-proposal
+// to a channel the agent proposed.
+// If the counter-proposed terms are within the agent's bounds,
+// it proposes the channel again with them.
+// Otherwise it cleans up the channel.
+func (g *Agent) handleCounterProposal(m *fsm.Message) {
+	counter := m.ChannelCounterMsg
+	err := g.updateChannel(m.ChannelID, func(root *db.Root, updater *fsm.Updater, update *Update) error {
+		if getTermBounds(root).accepts(counter.MaxRoundDuration, counter.FinalityDelay) {
+			update.InputMessage = m
+			return updater.Msg(m)
+		}
+		g.logf("rejecting counter-proposal for channel %s: max round duration %s, finality delay %s",
+			m.ChannelID, counter.MaxRoundDuration, counter.FinalityDelay)
+		cmd := &fsm.Command{Name: fsm.CleanUp}
+		update.InputCommand = cmd
+		return updater.Cmd(cmd)
+	})
+	if err != nil {
+		g.logf("handling counter-proposal for channel %s: %s", m.ChannelID, err)
+	}
+}
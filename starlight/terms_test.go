@@ -0,0 +1,52 @@
+package starlight
+
+import (
+	"testing"
+	"time"
+
+	"github.com/interstellar/starlight/errors"
+)
+
+func TestTermBounds(t *testing.T) {
+	b := termBounds{
+		minRoundDur:      30 * time.Minute,
+		maxRoundDur:      2 * time.Hour,
+		minFinalityDelay: time.Hour,
+		maxFinalityDelay: time.Hour,
+	}
+	cases := []struct {
+		roundDur, finalityDelay    time.Duration
+		wantAccept                 bool
+		wantRoundDur, wantFinality time.Duration
+	}{
+		{time.Hour, time.Hour, true, time.Hour, time.Hour},
+		{10 * time.Minute, time.Hour, false, 30 * time.Minute, time.Hour},
+		{time.Hour, 3 * time.Hour, false, time.Hour, time.Hour},
+		{5 * time.Hour, time.Minute, false, 2 * time.Hour, time.Hour},
+	}
+	for _, c := range cases {
+		if got := b.accepts(c.roundDur, c.finalityDelay); got != c.wantAccept {
+			t.Errorf("accepts(%s, %s) = %t, want %t", c.roundDur, c.finalityDelay, got, c.wantAccept)
+		}
+		roundDur, finality := b.counter(c.roundDur, c.finalityDelay)
+		if roundDur != c.wantRoundDur || finality != c.wantFinality {
+			t.Errorf("counter(%s, %s) = %s, %s, want %s, %s", c.roundDur, c.finalityDelay, roundDur, finality, c.wantRoundDur, c.wantFinality)
+		}
+	}
+}
+
+func TestConfigInitTermBounds(t *testing.T) {
+	g, closer := startTestAgent(t)
+	defer closer()
+	config := Config{
+		Username:           "alice",
+		Password:           "password",
+		HorizonURL:         testHorizonURL,
+		MinMaxRoundDurMins: 90,
+		MaxMaxRoundDurMins: 60,
+	}
+	err := g.ConfigInit(&config, "")
+	if errors.Root(err) != errInvalidInput {
+		t.Errorf("got error %v, want %v", err, errInvalidInput)
+	}
+}
@@ -0,0 +1,109 @@
+package starlight
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/interstellar/starlight/errors"
+	"github.com/interstellar/starlight/starlight/db"
+)
+
+// A SeedUnlocker supplies the password that decrypts
+// the agent's secret seed.
+// It lets an agent that restarts resume private-key operations,
+// such as executing rounds of the protocol,
+// without waiting in watchtower mode for the user to log in.
+// See doc/opsec.txt.
+type SeedUnlocker interface {
+	Password(ctx context.Context) ([]byte, error)
+}
+
+type unlockerFunc func(ctx context.Context) ([]byte, error)
+
+func (f unlockerFunc) Password(ctx context.Context) ([]byte, error) {
+	return f(ctx)
+}
+
+// PassphraseFile returns a SeedUnlocker that reads the password
+// from the named file, less any trailing newline.
+// The file must not be accessible to other users.
+func PassphraseFile(name string) SeedUnlocker {
+	return unlockerFunc(func(context.Context) ([]byte, error) {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		if fi.Mode()&077 != 0 {
+			return nil, fmt.Errorf("%s must be accessible only to current user", name)
+		}
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.TrimRight(b, "\r\n"), nil
+	})
+}
+
+// EnvPassphrase returns a SeedUnlocker that takes the password
+// from the named environment variable.
+func EnvPassphrase(name string) SeedUnlocker {
+	return unlockerFunc(func(context.Context) ([]byte, error) {
+		s, ok := os.LookupEnv(name)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s not set", name)
+		}
+		return []byte(s), nil
+	})
+}
+
+// CommandPassphrase returns a SeedUnlocker that runs the named
+// program with the given arguments and takes the password
+// from its standard output, less any trailing newline.
+// The program can fetch the password from a key management service,
+// or decrypt it with a key that the service holds.
+func CommandPassphrase(name string, arg ...string) SeedUnlocker {
+	return unlockerFunc(func(ctx context.Context) ([]byte, error) {
+		cmd := exec.CommandContext(ctx, name, arg...)
+		cmd.Stderr = os.Stderr
+		b, err := cmd.Output()
+		if err != nil {
+			return nil, errors.Wrap(err, "running ", name)
+		}
+		return bytes.TrimRight(b, "\r\n"), nil
+	})
+}
+
+// Unlock decrypts g's secret seed with the password from u,
+// if the seed is not already decrypted.
+// It returns ErrAuthFailed if the password is wrong.
+// Otherwise g keeps u, and unlocks itself with it again
+// whenever an error puts it in watchtower mode.
+func (g *Agent) Unlock(ctx context.Context, u SeedUnlocker) error {
+	password, err := u.Password(ctx)
+	if err != nil {
+		return errors.Wrap(err, "getting unlock password")
+	}
+	return db.Update(g.db, func(root *db.Root) error {
+		if !g.isReadyConfigured(root) {
+			return errNotConfigured
+		}
+		digest := root.Agent().Config().PwHash()
+		if bcrypt.CompareHashAndPassword(digest, password) != nil {
+			return errors.Wrap(ErrAuthFailed, "unlock password")
+		}
+		if g.seed == nil {
+			g.seed = openBox(root.Agent().EncryptedSeed(), password)
+			if g.seed == nil {
+				return errors.Wrap(ErrAuthFailed, "decrypting seed")
+			}
+		}
+		g.unlocker = u
+		return nil
+	})
+}
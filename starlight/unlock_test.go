@@ -0,0 +1,95 @@
+package starlight
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/interstellar/starlight/errors"
+)
+
+func TestUnlock(t *testing.T) {
+	g, closer := startTestAgent(t)
+	defer closer()
+	ctx := context.Background()
+
+	err := g.Unlock(ctx, EnvPassphrase("PATH"))
+	if errors.Root(err) != errNotConfigured {
+		t.Errorf("got error %v unlocking unconfigured agent, want %v", err, errNotConfigured)
+	}
+
+	err = g.ConfigInit(&Config{
+		Username:   "alice",
+		Password:   "password",
+		HorizonURL: testHorizonURL,
+	}, "starlight.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	seed := g.seed
+
+	dir, err := ioutil.TempDir("", "unlock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "passphrase")
+	err = ioutil.WriteFile(file, []byte("password\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("STARLIGHT_TEST_PASSPHRASE", "password")
+	defer os.Unsetenv("STARLIGHT_TEST_PASSPHRASE")
+
+	cases := []struct {
+		name string
+		u    SeedUnlocker
+	}{
+		{"file", PassphraseFile(file)},
+		{"env", EnvPassphrase("STARLIGHT_TEST_PASSPHRASE")},
+		{"command", CommandPassphrase("echo", "password")},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			g.unlocker = nil
+			g.mustDeauthenticate()
+			err := g.Unlock(ctx, tc.u)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(g.seed, seed) {
+				t.Error("unlocked seed differs from original")
+			}
+
+			// Put in watchtower mode, g unlocks itself again.
+			g.mustDeauthenticate()
+			if !bytes.Equal(g.seed, seed) {
+				t.Error("seed not decrypted again after deauthenticating")
+			}
+		})
+	}
+
+	g.unlocker = nil
+	g.mustDeauthenticate()
+	err = g.Unlock(ctx, CommandPassphrase("echo", "wrong"))
+	if errors.Root(err) != ErrAuthFailed {
+		t.Errorf("got error %v with wrong password, want %v", err, ErrAuthFailed)
+	}
+	if g.seed != nil {
+		t.Error("seed decrypted with wrong password")
+	}
+
+	err = os.Chmod(file, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = g.Unlock(ctx, PassphraseFile(file)); err == nil {
+		t.Error("unlocked with world-readable passphrase file")
+	}
+	if err = g.Unlock(ctx, EnvPassphrase("STARLIGHT_TEST_UNSET")); err == nil {
+		t.Error("unlocked with unset environment variable")
+	}
+}
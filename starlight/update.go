@@ -8,9 +8,8 @@ import (
 	"io"
 	"os"
 
-	bolt "github.com/coreos/bbolt"
-
 	"github.com/interstellar/starlight/starlight/db"
+	"github.com/interstellar/starlight/starlight/db/kv"
 	"github.com/interstellar/starlight/starlight/internal/update"
 )
 
@@ -79,8 +78,8 @@ func (g *Agent) putUpdate(root *db.Root, ev *Update) {
 	g.debugf("putUpdate: %s", string(b.Bytes()))
 }
 
-func lastUpdateNum(boltDB *bolt.DB) (n uint64) {
-	err := db.View(boltDB, func(root *db.Root) error {
+func lastUpdateNum(store *kv.DB) (n uint64) {
+	err := db.View(store, func(root *db.Root) error {
 		if bu := root.Agent().Updates().Bucket(); bu != nil {
 			n = bu.Sequence()
 		}
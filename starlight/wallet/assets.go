@@ -0,0 +1,26 @@
+// Package wallet provides the wallet frontend,
+// compiled into the binary, for starlightd to serve.
+//
+// The frontend is built from the TypeScript sources
+// in this directory with npm run build,
+// which must be done before building starlightd.
+package wallet
+
+import (
+	"embed"
+	"io/fs"
+)
+
+//go:embed public
+var files embed.FS
+
+// Assets returns the files of the built wallet frontend.
+// If the frontend was not built when this package was compiled,
+// it contains no index.html.
+func Assets() fs.FS {
+	sub, err := fs.Sub(files, "public")
+	if err != nil {
+		panic(err) // can't happen: "public" is a valid path
+	}
+	return sub
+}
@@ -6,13 +6,9 @@ var getConfig = require('hjs-webpack')
 var path = require('path')
 var fs = require('fs')
 
-// If you want to make changes to the client and deploy them,
-// change this URL to point to where you've deployed your changes.
-// See ./sync-frontend.sh for how we're hosting the client.
-let publicPath = 'https://starlight-client.s3.amazonaws.com/v1/'
-if (process.env.NODE_ENV !== 'production') {
-  publicPath = '/'
-}
+// starlightd serves the production build from its own root,
+// and the dev server serves from its root too.
+let publicPath = '/'
 
 // Set base path to JS and CSS files when
 // required by other files
@@ -43,7 +39,11 @@ var config = getConfig({
   // get a fresh folder. Usually you want this
   // but since it's destructive we make it
   // false by default
-  clearBeforeBuild: true,
+  //
+  // Keep the README, which git tracks so that
+  // starlightd can embed the folder before the
+  // wallet is first built.
+  clearBeforeBuild: '!(README.md)',
 
   html: function(context) {
     return {
@@ -0,0 +1,140 @@
+package walletrpc
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// contentSecurityPolicy restricts the wallet page to resources
+// served by starlightd itself.
+// Inline styles are allowed because styled-components
+// injects its CSS in style elements.
+const contentSecurityPolicy = "default-src 'self'; " +
+	"script-src 'self'; " +
+	"style-src 'self' 'unsafe-inline'; " +
+	"img-src 'self' data:; " +
+	"font-src 'self' data:; " +
+	"connect-src 'self'; " +
+	"object-src 'none'; " +
+	"base-uri 'self'; " +
+	"form-action 'self'; " +
+	"frame-ancestors 'none'"
+
+// hashedName matches the names webpack gives to build outputs,
+// which include a hash of their contents.
+// Files with such names never change and can be cached indefinitely.
+var hashedName = regexp.MustCompile(`\.[0-9a-f]{8,}\.[a-z0-9]+$`)
+
+// frontend serves the files of the wallet frontend.
+// Paths that don't name a file get index.html,
+// so that the app's client-side routes survive a reload.
+type frontend struct {
+	files fs.FS
+
+	// etags holds ETags for files without a modification time,
+	// such as those embedded in the binary,
+	// which would otherwise have no cache validator.
+	etags map[string]string
+}
+
+func newFrontend(files fs.FS) *frontend {
+	fe := &frontend{files: files, etags: make(map[string]string)}
+	fs.WalkDir(files, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil || !info.ModTime().IsZero() {
+			return err
+		}
+		f, err := files.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return err
+		}
+		fe.etags[name] = `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+		return nil
+	})
+	return fe
+}
+
+func (fe *frontend) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(path.Clean("/"+req.URL.Path), "/")
+	if name == "" {
+		name = "index.html"
+	}
+	if !fe.serveFile(w, req, name) {
+		if path.Ext(name) != "" {
+			http.NotFound(w, req)
+			return
+		}
+		if !fe.serveFile(w, req, "index.html") {
+			w.Header().Set("Cache-Control", "no-cache")
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, notBuiltPage)
+		}
+	}
+}
+
+// serveFile serves the named file, if it exists,
+// and reports whether it did.
+func (fe *frontend) serveFile(w http.ResponseWriter, req *http.Request, name string) bool {
+	f, err := fe.files.Open(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		return false
+	}
+	content, ok := f.(io.ReadSeeker)
+	if !ok {
+		return false
+	}
+
+	h := w.Header()
+	if etag, ok := fe.etags[name]; ok {
+		h.Set("ETag", etag)
+	}
+	if hashedName.MatchString(name) {
+		h.Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		// Always revalidate, so a new starlightd
+		// serves its own version of the app.
+		h.Set("Cache-Control", "no-cache")
+	}
+	h.Set("Content-Security-Policy", contentSecurityPolicy)
+	h.Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, req, name, info.ModTime(), content)
+	return true
+}
+
+const notBuiltPage = `<!DOCTYPE html>
+<html>
+	<head><title>Starlight</title></head>
+	<body>
+		<p>
+			This starlightd was built without the wallet frontend.
+			Run <code>npm run build</code> in starlight/wallet
+			and rebuild starlightd,
+			or start starlightd with <code>-wallet-dir</code>.
+		</p>
+	</body>
+</html>
+`
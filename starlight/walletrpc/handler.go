@@ -1,11 +1,14 @@
 package walletrpc
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
 	"encoding/json"
-	"io"
+	"io/fs"
+	"io/ioutil"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/kr/session"
@@ -22,11 +25,12 @@ type wallet struct {
 	sess  session.Config
 }
 
-// Handler returns a handler that serves a React/JavaScript app
+// Handler returns a handler that serves a React/JavaScript app,
+// whose built files are in assets,
 // for user interaction with g.
 // The returned handler also forwards requests as appropriate
 // to g's peer handler.
-func Handler(g *starlight.Agent) http.Handler {
+func Handler(g *starlight.Agent, assets fs.FS) http.Handler {
 	wt := &wallet{agent: g}
 	wt.sess.HTTPOnly = true
 	wt.sess.MaxAge = 14 * 24 * time.Hour
@@ -40,22 +44,47 @@ func Handler(g *starlight.Agent) http.Handler {
 	wt.sess.Keys = append(wt.sess.Keys, genKey())
 
 	mux := new(http.ServeMux)
-	mux.HandleFunc("/", index)
+	mux.Handle("/", newFrontend(assets))
 	mux.Handle("/starlight/", g.PeerHandler())
 	mux.Handle("/federation", g.PeerHandler())
 	mux.Handle("/.well-known/stellar.toml", g.PeerHandler())
 
 	// Wallet RPCs. Add more here as necessary.
-	mux.Handle("/api/updates", wt.auth(wt.updates))
-	mux.Handle("/api/config-edit", wt.auth(wt.configEdit))
-	mux.Handle("/api/logout", wt.auth(wt.logout))
-	mux.Handle("/api/do-create-channel", wt.auth(wt.doCreateChannel))
-	mux.Handle("/api/do-wallet-pay", wt.auth(wt.doWalletPay))
-	mux.Handle("/api/do-close-account", wt.auth(wt.doCloseAccount))
-	mux.Handle("/api/do-command", wt.auth(wt.doCommand))
-	mux.Handle("/api/do-add-asset", wt.auth(wt.doAddAsset))
-	mux.Handle("/api/find-account", wt.auth(wt.findAccount))
-	// TODO(vniu): authenticate requests to the messages endpoint
+	mux.Handle("/api/updates", wt.auth(starlight.ScopeRead, wt.updates))
+	mux.Handle("/api/updates/stream", wt.auth(starlight.ScopeRead, wt.updateStream))
+	mux.Handle("/api/config-edit", wt.auth(starlight.ScopeAdmin, wt.configEdit))
+	mux.Handle("/api/logout", wt.auth(starlight.ScopeRead, wt.logout))
+	mux.Handle("/api/do-create-channel", wt.auth(starlight.ScopeAdmin, wt.doCreateChannel))
+	mux.Handle("/api/do-wallet-pay", wt.auth(starlight.ScopePay, wt.doWalletPay))
+	mux.Handle("/api/do-routed-pay", wt.auth(starlight.ScopePay, wt.doRoutedPay))
+	mux.Handle("/api/do-close-account", wt.auth(starlight.ScopeAdmin, wt.doCloseAccount))
+	mux.Handle("/api/do-command", wt.auth(starlight.ScopePay, wt.doCommand))
+	mux.Handle("/api/do-add-asset", wt.auth(starlight.ScopeAdmin, wt.doAddAsset))
+	mux.Handle("/api/do-remove-asset", wt.auth(starlight.ScopeAdmin, wt.doRemoveAsset))
+	mux.Handle("/api/find-account", wt.auth(starlight.ScopeRead, wt.findAccount))
+	mux.Handle("/api/do-create-invoice", wt.auth(starlight.ScopePay, wt.doCreateInvoice))
+	mux.Handle("/api/do-pay-invoice", wt.auth(starlight.ScopePay, wt.doPayInvoice))
+	mux.Handle("/api/invoices", wt.auth(starlight.ScopeRead, wt.invoices))
+	mux.Handle("/api/invoice", wt.auth(starlight.ScopeRead, wt.invoice))
+
+	// Read-only resource API.
+	mux.Handle("/api/v1/channels", wt.auth(starlight.ScopeRead, wt.v1Channels))
+	mux.Handle("/api/v1/channels/", wt.auth(starlight.ScopeRead, wt.v1Channel))
+	mux.Handle("/api/v1/wallet", wt.auth(starlight.ScopeRead, wt.v1Wallet))
+	mux.Handle("/api/v1/assets", wt.auth(starlight.ScopeRead, wt.v1Assets))
+	mux.Handle("/api/v1/payments", wt.auth(starlight.ScopeRead, wt.v1Payments))
+
+	// API tokens.
+	mux.Handle("/api/tokens", wt.auth(starlight.ScopeAdmin, wt.tokens))
+	mux.Handle("/api/do-create-token", wt.auth(starlight.ScopeAdmin, wt.doCreateToken))
+	mux.Handle("/api/do-revoke-token", wt.auth(starlight.ScopeAdmin, wt.doRevokeToken))
+
+	mux.Handle("/api/do-backup", wt.auth(starlight.ScopeAdmin, wt.doBackup))
+	mux.Handle("/api/do-export-mnemonic", wt.auth(starlight.ScopeAdmin, wt.doExportMnemonic))
+
+	// Prometheus metrics, for scraping with a read-scoped API token.
+	mux.Handle("/metrics", wt.auth(starlight.ScopeRead, g.MetricsHandler().ServeHTTP))
+
 	mux.HandleFunc("/api/messages", wt.messages)
 	mux.HandleFunc("/api/login", wt.login)
 	mux.HandleFunc("/api/config-init", wt.configInit)
@@ -64,28 +93,6 @@ func Handler(g *starlight.Agent) http.Handler {
 	return mux
 }
 
-func index(w http.ResponseWriter, req *http.Request) {
-	io.WriteString(w, `
-		<html>
-			<script>
-				let xmlhttp = new XMLHttpRequest();
-				xmlhttp.onreadystatechange = function(){
-					if (xmlhttp.readyState == 4 && xmlhttp.status == 200){
-						document.open();
-						document.write(xmlhttp.responseText);
-						document.close();
-					}
-				}
-				// If you want to make changes to the client and deploy them,
-				// change this URL to point to where you've deployed your changes.
-				// See ./sync-frontend.sh for how we're hosting the client.
-				xmlhttp.open('GET', 'https://starlight-client.s3.amazonaws.com/v1/index.html', true);
-				xmlhttp.send();
-			</script>
-		</html>
-	`)
-}
-
 func (wt *wallet) updates(w http.ResponseWriter, req *http.Request) {
 	// This is a handler for a standard long-polling event loop in
 	// the client. The frontend will call GET /updates repeatedly, each
@@ -147,13 +154,15 @@ func (wt *wallet) doCreateChannel(w http.ResponseWriter, req *http.Request) {
 	var v struct {
 		GuestAddr  string
 		HostAmount xlm.Amount
+		AssetCode  string // optional, for non-native channels
+		Issuer     string // optional, for non-native channels
 	}
 	err := json.NewDecoder(req.Body).Decode(&v)
 	if err != nil {
 		starlight.WriteError(req, w, errors.Sub(starlight.ErrUnmarshaling, err))
 		return
 	}
-	ch, err := wt.agent.DoCreateChannel(v.GuestAddr, v.HostAmount)
+	ch, err := wt.agent.DoCreateChannel(v.GuestAddr, v.HostAmount, v.AssetCode, v.Issuer)
 	switch errors.Root(err) {
 	case nil:
 		w.Header().Set("Content-Type", "application/json")
@@ -181,6 +190,178 @@ func (wt *wallet) doWalletPay(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+func (wt *wallet) doRoutedPay(w http.ResponseWriter, req *http.Request) {
+	var v struct {
+		Dest   string
+		Amount xlm.Amount
+	}
+	err := json.NewDecoder(req.Body).Decode(&v)
+	if err != nil {
+		starlight.WriteError(req, w, errors.Sub(starlight.ErrUnmarshaling, err))
+		return
+	}
+	p, err := wt.agent.DoRoutedPay(v.Dest, v.Amount)
+	if err != nil {
+		starlight.WriteError(req, w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
+
+func (wt *wallet) doCreateInvoice(w http.ResponseWriter, req *http.Request) {
+	var v struct {
+		Amount      xlm.Amount
+		Expiry      time.Time
+		Description string
+	}
+	err := json.NewDecoder(req.Body).Decode(&v)
+	if err != nil {
+		starlight.WriteError(req, w, errors.Sub(starlight.ErrUnmarshaling, err))
+		return
+	}
+	inv, err := wt.agent.CreateInvoice(v.Amount, v.Expiry, v.Description)
+	if err != nil {
+		starlight.WriteError(req, w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(inv)
+}
+
+func (wt *wallet) doPayInvoice(w http.ResponseWriter, req *http.Request) {
+	var v struct {
+		Invoice string
+		Amount  xlm.Amount
+	}
+	err := json.NewDecoder(req.Body).Decode(&v)
+	if err != nil {
+		starlight.WriteError(req, w, errors.Sub(starlight.ErrUnmarshaling, err))
+		return
+	}
+	p, err := wt.agent.PayInvoice(v.Invoice, v.Amount)
+	if err != nil {
+		starlight.WriteError(req, w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
+
+func (wt *wallet) invoices(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(wt.agent.Invoices())
+}
+
+func (wt *wallet) invoice(w http.ResponseWriter, req *http.Request) {
+	var v struct {
+		ID string
+	}
+	err := json.NewDecoder(req.Body).Decode(&v)
+	if err != nil {
+		starlight.WriteError(req, w, errors.Sub(starlight.ErrUnmarshaling, err))
+		return
+	}
+	inv, err := wt.agent.Invoice(v.ID)
+	if err != nil {
+		starlight.WriteError(req, w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(inv)
+}
+
+func (wt *wallet) tokens(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(wt.agent.APITokens())
+}
+
+func (wt *wallet) doCreateToken(w http.ResponseWriter, req *http.Request) {
+	var v struct {
+		Name  string
+		Scope starlight.Scope
+	}
+	err := json.NewDecoder(req.Body).Decode(&v)
+	if err != nil {
+		starlight.WriteError(req, w, errors.Sub(starlight.ErrUnmarshaling, err))
+		return
+	}
+	tok, secret, err := wt.agent.CreateAPIToken(v.Name, v.Scope)
+	if err != nil {
+		starlight.WriteError(req, w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	// The token is shown only once, here.
+	json.NewEncoder(w).Encode(struct {
+		ID      string
+		Name    string
+		Scope   starlight.Scope
+		Created time.Time
+		Token   string
+	}{tok.ID, tok.Name, tok.Scope, tok.Created, secret})
+}
+
+// doBackup responds with an encrypted backup of the agent,
+// as written by Agent.Backup.
+// The request must include the agent's password,
+// which is the key to the backup.
+func (wt *wallet) doBackup(w http.ResponseWriter, req *http.Request) {
+	var v struct {
+		Password string
+	}
+	err := json.NewDecoder(req.Body).Decode(&v)
+	if err != nil {
+		starlight.WriteError(req, w, errors.Sub(starlight.ErrUnmarshaling, err))
+		return
+	}
+	var buf bytes.Buffer
+	err = wt.agent.Backup(&buf, []byte(v.Password))
+	if err != nil {
+		starlight.WriteError(req, w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="starlight.backup"`)
+	w.Write(buf.Bytes())
+}
+
+// doExportMnemonic responds with the agent's recovery phrase.
+// Like doBackup, it requires the agent's password
+// even from a logged-in session.
+func (wt *wallet) doExportMnemonic(w http.ResponseWriter, req *http.Request) {
+	var v struct {
+		Password string
+	}
+	err := json.NewDecoder(req.Body).Decode(&v)
+	if err != nil {
+		starlight.WriteError(req, w, errors.Sub(starlight.ErrUnmarshaling, err))
+		return
+	}
+	phrase, err := wt.agent.ExportMnemonic(v.Password)
+	if err != nil {
+		starlight.WriteError(req, w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct{ Mnemonic string }{phrase})
+}
+
+func (wt *wallet) doRevokeToken(w http.ResponseWriter, req *http.Request) {
+	var v struct {
+		ID string
+	}
+	err := json.NewDecoder(req.Body).Decode(&v)
+	if err != nil {
+		starlight.WriteError(req, w, errors.Sub(starlight.ErrUnmarshaling, err))
+		return
+	}
+	err = wt.agent.RevokeAPIToken(v.ID)
+	if err != nil {
+		starlight.WriteError(req, w, err)
+	}
+}
+
 func (wt *wallet) doCloseAccount(w http.ResponseWriter, req *http.Request) {
 	var v struct {
 		Dest string
@@ -208,6 +389,14 @@ func (wt *wallet) doCommand(w http.ResponseWriter, req *http.Request) {
 		starlight.WriteError(req, w, errors.Sub(starlight.ErrUnmarshaling, err))
 		return
 	}
+	switch v.Command.Name {
+	case fsm.ChannelPay, fsm.ConditionalPay, fsm.FulfillHTLC, fsm.CancelHTLC:
+	default:
+		if !grantedScope(req).Permits(starlight.ScopeAdmin) {
+			starlight.WriteError(req, w, errors.Wrapf(starlight.ErrForbidden, "need scope %s for %s", starlight.ScopeAdmin, v.Command.Name))
+			return
+		}
+	}
 	err = wt.agent.DoCommand(v.ChannelID, &v.Command)
 	if err != nil {
 		starlight.WriteError(req, w, err)
@@ -268,25 +457,34 @@ func (wt *wallet) doRemoveAsset(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// messages is polled by the host of each channel
+// on which the agent is guest.
+// The host signs each request with its channel key.
 func (wt *wallet) messages(w http.ResponseWriter, req *http.Request) {
-	var v struct {
-		ChannelID string `json:"channel_id"`
-		From      uint64
-	}
-	err := json.NewDecoder(req.Body).Decode(&v)
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, 1<<16))
 	if err != nil {
 		starlight.WriteError(req, w, errors.Sub(starlight.ErrUnmarshaling, err))
 		return
 	}
+	chanID, from, err := wt.agent.CheckMessagesRequest(body, req.Header.Get(starlight.MessagesSigHeader))
+	if err != nil {
+		starlight.WriteError(req, w, err)
+		return
+	}
+	err = wt.agent.AckMessages(chanID, from)
+	if err != nil {
+		starlight.WriteError(req, w, err)
+		return
+	}
 	ctx := req.Context()
 
 	// must be lower than the global write timeout (15s)
 	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
 
-	wt.agent.WaitMsg(ctx, v.ChannelID, v.From)
+	wt.agent.WaitMsg(ctx, chanID, from)
 	// return max 100 messages at a time
-	msgs := wt.agent.Messages(v.ChannelID, v.From, v.From+100)
+	msgs := wt.agent.Messages(chanID, from, from+100)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(msgs)
 	return
@@ -331,17 +529,51 @@ func (wt *wallet) logout(w http.ResponseWriter, req *http.Request) {
 	session.Set(w, &struct{}{}, &wt.sess)
 }
 
-func (wt *wallet) auth(f http.HandlerFunc) http.Handler {
+type scopeKey struct{}
+
+// auth returns a handler that calls f for requests
+// authenticated with at least the given scope.
+// The scope granted to the request is stored in its context.
+func (wt *wallet) auth(scope starlight.Scope, f http.HandlerFunc) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		err := session.Get(req, &struct{}{}, &wt.sess)
+		granted, err := wt.authenticate(req)
 		if err != nil {
 			starlight.WriteError(req, w, errors.Sub(starlight.ErrUnauthorized, err))
 			return
 		}
-		f(w, req)
+		if !granted.Permits(scope) {
+			starlight.WriteError(req, w, errors.Wrapf(starlight.ErrForbidden, "need scope %s", scope))
+			return
+		}
+		f(w, req.WithContext(context.WithValue(req.Context(), scopeKey{}, granted)))
 	})
 }
 
+// authenticate returns the scope granted to req.
+// A request bearing an API token in its Authorization header
+// is granted the token's scope; one with a session cookie,
+// made by a logged-in user, is granted every scope.
+func (wt *wallet) authenticate(req *http.Request) (starlight.Scope, error) {
+	if h := req.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		scope, ok := wt.agent.AuthenticateAPIToken(strings.TrimPrefix(h, "Bearer "))
+		if !ok {
+			return "", errors.New("invalid API token")
+		}
+		return scope, nil
+	}
+	err := session.Get(req, &struct{}{}, &wt.sess)
+	if err != nil {
+		return "", err
+	}
+	return starlight.ScopeAdmin, nil
+}
+
+// grantedScope returns the scope granted to req by auth.
+func grantedScope(req *http.Request) starlight.Scope {
+	scope, _ := req.Context().Value(scopeKey{}).(starlight.Scope)
+	return scope
+}
+
 func genKey() *[32]byte {
 	b := new([32]byte)
 	_, err := rand.Read(b[:])
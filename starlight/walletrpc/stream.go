@@ -0,0 +1,124 @@
+package walletrpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/interstellar/starlight/errors"
+	"github.com/interstellar/starlight/starlight"
+	"github.com/interstellar/starlight/starlight/internal/update"
+)
+
+// streamKeepAlive is how long the update stream waits
+// for a new update before sending a comment to keep
+// the connection open.
+// It must be lower than the global write timeout (15s).
+const streamKeepAlive = 10 * time.Second
+
+// updateFilter selects the updates sent on an update stream.
+// An empty field matches every update.
+type updateFilter struct {
+	types    map[update.Type]bool
+	channels map[string]bool
+}
+
+func (f *updateFilter) match(u *starlight.Update) bool {
+	if len(f.types) > 0 && !f.types[u.Type] {
+		return false
+	}
+	if len(f.channels) > 0 && (u.Channel == nil || !f.channels[u.Channel.ID]) {
+		return false
+	}
+	return true
+}
+
+// updateStream is a handler for a stream of updates
+// in the Server-Sent Events format.
+// Each event's data is one update, as JSON,
+// and its ID is the update's UpdateNum.
+//
+// The stream begins at the update numbered by query parameter from
+// (default 1), or the one after the Last-Event-ID header,
+// if the client is reconnecting.
+// It is limited to updates of the types given by
+// query parameter type, and to channel updates
+// of the channels given by query parameter channel,
+// each of which may be repeated.
+//
+// Updates that do not match the filter are skipped,
+// but still advance the stream.
+func (wt *wallet) updateStream(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	from := uint64(1)
+	if s := query.Get("from"); s != "" {
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			starlight.WriteError(req, w, errors.Sub(starlight.ErrUnmarshaling, err))
+			return
+		}
+		from = n
+	}
+	if s := req.Header.Get("Last-Event-ID"); s != "" {
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			starlight.WriteError(req, w, errors.Sub(starlight.ErrUnmarshaling, err))
+			return
+		}
+		from = n + 1
+	}
+	filter := &updateFilter{
+		types:    make(map[update.Type]bool),
+		channels: make(map[string]bool),
+	}
+	for _, t := range query["type"] {
+		filter.types[update.Type(t)] = true
+	}
+	for _, id := range query["channel"] {
+		filter.channels[id] = true
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	// The stream outlives the global write timeout,
+	// so extend the deadline before each write,
+	// where the server allows it (Go 1.20 and later).
+	// Elsewhere the server ends the stream at its write timeout,
+	// and the client reconnects with Last-Event-ID.
+	deadliner, _ := w.(interface{ SetWriteDeadline(time.Time) error })
+	ctx := req.Context()
+	for ctx.Err() == nil {
+		if deadliner != nil {
+			deadliner.SetWriteDeadline(time.Now().Add(2 * streamKeepAlive))
+		}
+
+		waitCtx, cancel := context.WithTimeout(ctx, streamKeepAlive)
+		wt.agent.WaitUpdate(waitCtx, from)
+		cancel()
+
+		updates := wt.agent.Updates(from, from+100)
+		if len(updates) == 0 {
+			fmt.Fprint(w, ": keep-alive\n\n")
+		}
+		for _, u := range updates {
+			from = u.UpdateNum + 1
+			if !filter.match(u) {
+				continue
+			}
+			data, err := json.Marshal(u)
+			if err != nil {
+				panic(err) // only errors here are bugs
+			}
+			fmt.Fprintf(w, "id: %d\ndata: %s\n\n", u.UpdateNum, data)
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
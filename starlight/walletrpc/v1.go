@@ -0,0 +1,220 @@
+package walletrpc
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stellar/go/xdr"
+
+	"github.com/interstellar/starlight/errors"
+	"github.com/interstellar/starlight/starlight"
+	"github.com/interstellar/starlight/starlight/fsm"
+)
+
+// The /api/v1 resources are read-only views of the agent's state.
+// Their JSON schemas are defined here, independently of the
+// agent's internal types, so that they stay stable as those change.
+// Amounts are in stroops, or in units of the named asset.
+
+type v1Channel struct {
+	ID                  string    `json:"id"`
+	State               fsm.State `json:"state"`
+	Role                fsm.Role  `json:"role"`
+	Counterparty        string    `json:"counterparty"`
+	HostAccount         string    `json:"host_account"`
+	GuestAccount        string    `json:"guest_account"`
+	EscrowAccount       string    `json:"escrow_account"`
+	Asset               string    `json:"asset,omitempty"`
+	HostBalance         int64     `json:"host_balance"`
+	GuestBalance        int64     `json:"guest_balance"`
+	RoundNumber         uint64    `json:"round_number"`
+	MaxRoundDurationSec int64     `json:"max_round_duration_sec"`
+	FinalityDelaySec    int64     `json:"finality_delay_sec"`
+	FundingTime         time.Time `json:"funding_time"`
+	PaymentTime         time.Time `json:"payment_time"`
+	QueuedPayments      int       `json:"queued_payments"`
+}
+
+type v1Asset struct {
+	Asset      string `json:"asset"`
+	Code       string `json:"code"`
+	Issuer     string `json:"issuer"`
+	Balance    uint64 `json:"balance"`
+	Pending    bool   `json:"pending"`
+	Authorized bool   `json:"authorized"`
+}
+
+type v1Wallet struct {
+	Address       string    `json:"address"`
+	NativeBalance int64     `json:"native_balance"`
+	Reserve       int64     `json:"reserve"`
+	Assets        []v1Asset `json:"assets"`
+}
+
+type v1Payment struct {
+	Num          uint64    `json:"num"`
+	Kind         string    `json:"kind"`
+	Direction    string    `json:"direction"`
+	Counterparty string    `json:"counterparty"`
+	Amount       uint64    `json:"amount"`
+	Asset        string    `json:"asset,omitempty"`
+	ChannelID    string    `json:"channel_id,omitempty"`
+	ID           string    `json:"id,omitempty"`
+	Memo         string    `json:"memo,omitempty"`
+	InvoiceID    string    `json:"invoice_id,omitempty"`
+	TxHash       string    `json:"tx_hash,omitempty"`
+	Time         time.Time `json:"time"`
+}
+
+type v1PaymentPage struct {
+	Payments []v1Payment `json:"payments"`
+
+	// Next is the value of query parameter from
+	// that gets the following page.
+	Next uint64 `json:"next"`
+}
+
+func newV1Channel(c *fsm.Channel) v1Channel {
+	v := v1Channel{
+		ID:                  c.ID,
+		State:               c.State,
+		Role:                c.Role,
+		Counterparty:        c.CounterpartyAddress,
+		HostAccount:         c.HostAcct.Address(),
+		GuestAccount:        c.GuestAcct.Address(),
+		EscrowAccount:       c.EscrowAcct.Address(),
+		HostBalance:         int64(c.HostAmount),
+		GuestBalance:        int64(c.GuestAmount),
+		RoundNumber:         c.RoundNumber,
+		MaxRoundDurationSec: int64(c.MaxRoundDuration / time.Second),
+		FinalityDelaySec:    int64(c.FinalityDelay / time.Second),
+		FundingTime:         c.FundingTime,
+		PaymentTime:         c.PaymentTime,
+		QueuedPayments:      len(c.QueuedPayments),
+	}
+	if !c.IsNative() {
+		v.Asset = c.Asset.String()
+	}
+	return v
+}
+
+func newV1Assets(w *fsm.WalletAcct) []v1Asset {
+	assets := make([]v1Asset, 0, len(w.Balances)) // we want json "[]" not "null"
+	for s, bal := range w.Balances {
+		var code, issuer string
+		bal.Asset.Extract(new(xdr.AssetType), &code, &issuer)
+		assets = append(assets, v1Asset{
+			Asset:      s,
+			Code:       code,
+			Issuer:     issuer,
+			Balance:    bal.Amount,
+			Pending:    bal.Pending,
+			Authorized: bal.Authorized,
+		})
+	}
+	sort.Slice(assets, func(i, j int) bool {
+		return assets[i].Asset < assets[j].Asset
+	})
+	return assets
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// v1Channels serves GET /api/v1/channels,
+// listing the agent's channels that have not yet closed,
+// whatever their state.
+func (wt *wallet) v1Channels(w http.ResponseWriter, req *http.Request) {
+	channels := wt.agent.Channels()
+	views := make([]v1Channel, 0, len(channels))
+	for _, c := range channels {
+		views = append(views, newV1Channel(c))
+	}
+	writeJSON(w, views)
+}
+
+// v1Channel serves GET /api/v1/channels/{id}.
+func (wt *wallet) v1Channel(w http.ResponseWriter, req *http.Request) {
+	id := strings.TrimPrefix(req.URL.Path, "/api/v1/channels/")
+	c, err := wt.agent.Channel(id)
+	if err != nil {
+		starlight.WriteError(req, w, err)
+		return
+	}
+	writeJSON(w, newV1Channel(c))
+}
+
+// v1Wallet serves GET /api/v1/wallet.
+func (wt *wallet) v1Wallet(w http.ResponseWriter, req *http.Request) {
+	acct := wt.agent.Wallet()
+	writeJSON(w, v1Wallet{
+		Address:       acct.Address,
+		NativeBalance: int64(acct.NativeBalance),
+		Reserve:       int64(acct.Reserve),
+		Assets:        newV1Assets(acct),
+	})
+}
+
+// v1Assets serves GET /api/v1/assets,
+// listing the wallet's non-native balances and trustlines.
+func (wt *wallet) v1Assets(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, newV1Assets(wt.agent.Wallet()))
+}
+
+// v1Payments serves GET /api/v1/payments,
+// a page of completed payments, oldest first.
+// Query parameter from is the number of the first payment
+// in the page (default 1), and limit the page size.
+func (wt *wallet) v1Payments(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	from, limit := uint64(1), 0
+	if s := query.Get("from"); s != "" {
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			starlight.WriteError(req, w, errors.Sub(starlight.ErrUnmarshaling, err))
+			return
+		}
+		from = n
+	}
+	if s := query.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			starlight.WriteError(req, w, errors.Sub(starlight.ErrUnmarshaling, err))
+			return
+		}
+		if n < 0 {
+			starlight.WriteError(req, w, errors.Wrapf(starlight.ErrUnmarshaling, "negative limit %d", n))
+			return
+		}
+		limit = n
+	}
+	payments := wt.agent.Payments(from, limit)
+	page := v1PaymentPage{
+		Payments: make([]v1Payment, 0, len(payments)),
+		Next:     from,
+	}
+	for _, p := range payments {
+		page.Payments = append(page.Payments, v1Payment{
+			Num:          p.PaymentNum,
+			Kind:         string(p.Kind),
+			Direction:    string(p.Direction),
+			Counterparty: p.Counterparty,
+			Amount:       p.Amount,
+			Asset:        p.Asset,
+			ChannelID:    p.ChannelID,
+			ID:           p.ID,
+			Memo:         p.Memo,
+			InvoiceID:    p.InvoiceID,
+			TxHash:       p.TxHash,
+			Time:         p.Time,
+		})
+		page.Next = p.PaymentNum + 1
+	}
+	writeJSON(w, page)
+}
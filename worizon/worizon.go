@@ -10,6 +10,7 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/stellar/go/clients/horizon"
@@ -65,6 +66,8 @@ type Client struct {
 	initHorizon bool
 
 	startClockOnce sync.Once
+
+	reconnects uint64 // accessed atomically
 }
 
 type timer struct {
@@ -308,6 +311,7 @@ func (c *Client) streamHorizon(ctx context.Context, cur *Cursor, s func(context.
 
 		if origCtx.Err() == nil {
 			if ctx.Err() != nil || streamErr != nil {
+				atomic.AddUint64(&c.reconnects, 1)
 				dur := backoff.Next()
 				log.Printf("received error %s streaming from horizon, retrying in %s", streamErr, dur)
 				time.Sleep(dur)
@@ -322,6 +326,12 @@ func (c *Client) streamHorizon(ctx context.Context, cur *Cursor, s func(context.
 	}
 }
 
+// Reconnects returns the number of times c has restarted
+// a Horizon stream after an error.
+func (c *Client) Reconnects() uint64 {
+	return atomic.LoadUint64(&c.reconnects)
+}
+
 // SequenceForAccount implements SequenceProvider
 // from package github.com/stellar/go/build.
 func (c *Client) SequenceForAccount(accountID string) (xdr.SequenceNumber, error) {
@@ -347,6 +357,14 @@ func (c *Client) SubmitTx(envXdr string) (response TxSuccess, err error) {
 	return hclient.SubmitTransaction(envXdr)
 }
 
+// IsNotFound reports whether err is an error from Horizon
+// saying that the requested resource, such as an account,
+// does not exist.
+func IsNotFound(err error) bool {
+	herr, ok := errors.Root(err).(*horizon.Error)
+	return ok && herr.Problem.Status == http.StatusNotFound
+}
+
 func (c *Client) LoadAccount(id string) (Account, error) {
 	c.mu.Lock()
 	hclient := c.hclient